@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type AdminConfig struct {
+	Token string `json:"token" yaml:"token" toml:"token"`
+}
+
+func RegisterAdminHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("POST /admin/captures", requireAdmin(httpHandleCaptureStart))
+	mux.HandleFunc("GET /admin/captures", requireAdmin(httpHandleCapturesList))
+	mux.HandleFunc("GET /admin/captures/{id}", requireAdmin(httpHandleCaptureGet))
+	mux.HandleFunc("GET /admin/captures/{id}/pcap", requireAdmin(httpHandleCaptureDownload))
+	mux.HandleFunc("DELETE /admin/captures/{id}", requireAdmin(httpHandleCaptureStop))
+
+	mux.HandleFunc("POST /admin/rooms/{id}/file-publishers", requireAdmin(httpHandleFilePublisherStart))
+	mux.HandleFunc("GET /admin/file-publishers", requireAdmin(httpHandleFilePublishersList))
+	mux.HandleFunc("POST /admin/file-publishers/{id}/seek", requireAdmin(httpHandleFilePublisherSeek))
+	mux.HandleFunc("DELETE /admin/file-publishers/{id}", requireAdmin(httpHandleFilePublisherStop))
+
+	mux.HandleFunc("GET /admin/whip-sessions", requireAdmin(httpHandleWhipSessionsList))
+
+	mux.HandleFunc("POST /admin/rooms/{id}/rtp-ingests", requireAdmin(httpHandleRTPIngestStart))
+	mux.HandleFunc("GET /admin/rtp-ingests", requireAdmin(httpHandleRTPIngestsList))
+	mux.HandleFunc("DELETE /admin/rtp-ingests/{id}", requireAdmin(httpHandleRTPIngestStop))
+
+	mux.HandleFunc("POST /admin/rooms/{id}/forwards", requireAdmin(httpHandleForwardStart))
+	mux.HandleFunc("GET /admin/forwards", requireAdmin(httpHandleForwardsList))
+	mux.HandleFunc("GET /admin/forwards/{id}/sdp", requireAdmin(httpHandleForwardSdp))
+	mux.HandleFunc("DELETE /admin/forwards/{id}", requireAdmin(httpHandleForwardStop))
+
+	mux.HandleFunc("POST /admin/rooms/{id}/rtmp-keys", requireAdmin(httpHandleRTMPKeyCreate))
+	mux.HandleFunc("GET /admin/rtmp-keys", requireAdmin(httpHandleRTMPKeysList))
+	mux.HandleFunc("DELETE /admin/rtmp-keys/{key}", requireAdmin(httpHandleRTMPKeyRevoke))
+	mux.HandleFunc("GET /admin/rtmp-sessions", requireAdmin(httpHandleRTMPSessionsList))
+	mux.HandleFunc("DELETE /admin/rtmp-sessions/{id}", requireAdmin(httpHandleRTMPSessionStop))
+
+	mux.HandleFunc("POST /admin/rooms/{id}/hls", requireAdmin(httpHandleHLSStart))
+	mux.HandleFunc("GET /admin/hls", requireAdmin(httpHandleHLSList))
+	mux.HandleFunc("DELETE /admin/hls/{id}", requireAdmin(httpHandleHLSStop))
+}
+
+// requireAdmin only lets through requests carrying the configured admin
+// token, the api answers 404 when no token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if GetConfig().Admin.Token == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		token, ok := bearerToken(r)
+		if !ok || !isAdminToken(token) {
+			writeUnauthorized(w, "unauthorized", "invalid admin token")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func isAdminToken(token string) bool {
+	expected := GetConfig().Admin.Token
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Debug(fmt.Sprintf("failed writing http response, %s", err.Error()))
+	}
+}
+
+func writeJsonError(w http.ResponseWriter, status int, action string, reason string) {
+	writeJson(w, status, ErrorMessage{
+		Error:  action,
+		Reason: reason,
+	})
+}
+
+func writeUnauthorized(w http.ResponseWriter, action string, reason string) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeJsonError(w, http.StatusUnauthorized, action, reason)
+}
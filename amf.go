@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfEcmaArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0a
+	amfDate        = 0x0b
+	amfLongString  = 0x0c
+)
+
+// amfMaxDepth bounds the nesting of objects and arrays, the decoder recurses
+// on them and clients send commands before they are authorized.
+const amfMaxDepth = 32
+
+// amfObjectMap keeps the order of the keys of an encoded object, rtmp clients
+// don't need it but it makes the replies deterministic.
+type amfObjectMap []amfProperty
+
+type amfProperty struct {
+	Key   string
+	Value any
+}
+
+// decodeAmf reads every AMF0 value of a command message, objects and ecma
+// arrays are returned as maps.
+func decodeAmf(data []byte) ([]any, error) {
+	reader := bytes.NewReader(data)
+	values := make([]any, 0)
+	for reader.Len() > 0 {
+		value, err := decodeAmfValue(reader, 0)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func decodeAmfValue(reader *bytes.Reader, depth int) (any, error) {
+	if depth > amfMaxDepth {
+		return nil, errors.New("amf0 values nested too deeply")
+	}
+
+	marker, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch marker {
+	case amfNumber:
+		var bits uint64
+		if err := binary.Read(reader, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(bits), nil
+	case amfBoolean:
+		value, err := reader.ReadByte()
+		return value != 0, err
+	case amfString:
+		return decodeAmfString(reader)
+	case amfLongString:
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		return readAmfBytes(reader, int(length))
+	case amfObject:
+		return decodeAmfProperties(reader, depth)
+	case amfEcmaArray:
+		if _, err := reader.Seek(4, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		return decodeAmfProperties(reader, depth)
+	case amfStrictArray:
+		var count uint32
+		if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		values := make([]any, 0)
+		for range count {
+			value, err := decodeAmfValue(reader, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case amfDate:
+		var bits uint64
+		if err := binary.Read(reader, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+		if _, err := reader.Seek(2, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(bits), nil
+	case amfNull, amfUndefined:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported amf0 marker 0x%02x", marker)
+	}
+}
+
+func decodeAmfString(reader *bytes.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	return readAmfBytes(reader, int(length))
+}
+
+func readAmfBytes(reader *bytes.Reader, length int) (string, error) {
+	if length > reader.Len() {
+		return "", io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func decodeAmfProperties(reader *bytes.Reader, depth int) (map[string]any, error) {
+	properties := make(map[string]any)
+	for {
+		key, err := decodeAmfString(reader)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			marker, err := reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if marker != amfObjectEnd {
+				return nil, errors.New("amf0 object has an empty key")
+			}
+			return properties, nil
+		}
+
+		value, err := decodeAmfValue(reader, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		properties[key] = value
+	}
+}
+
+func encodeAmf(values ...any) []byte {
+	buffer := new(bytes.Buffer)
+	for _, value := range values {
+		encodeAmfValue(buffer, value)
+	}
+	return buffer.Bytes()
+}
+
+func encodeAmfValue(buffer *bytes.Buffer, value any) {
+	switch value := value.(type) {
+	case nil:
+		buffer.WriteByte(amfNull)
+	case bool:
+		buffer.WriteByte(amfBoolean)
+		if value {
+			buffer.WriteByte(1)
+		} else {
+			buffer.WriteByte(0)
+		}
+	case int:
+		encodeAmfValue(buffer, float64(value))
+	case float64:
+		buffer.WriteByte(amfNumber)
+		buffer.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(value)))
+	case string:
+		if len(value) > math.MaxUint16 {
+			buffer.WriteByte(amfLongString)
+			buffer.Write(binary.BigEndian.AppendUint32(nil, uint32(len(value))))
+		} else {
+			buffer.WriteByte(amfString)
+			buffer.Write(binary.BigEndian.AppendUint16(nil, uint16(len(value))))
+		}
+		buffer.WriteString(value)
+	case amfObjectMap:
+		buffer.WriteByte(amfObject)
+		for _, property := range value {
+			buffer.Write(binary.BigEndian.AppendUint16(nil, uint16(len(property.Key))))
+			buffer.WriteString(property.Key)
+			encodeAmfValue(buffer, property.Value)
+		}
+		buffer.Write([]byte{0, 0, amfObjectEnd})
+	default:
+		buffer.WriteByte(amfUndefined)
+	}
+}
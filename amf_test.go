@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAmfRoundTrip(t *testing.T) {
+	long := strings.Repeat("a", 70000)
+	encoded := encodeAmf(
+		"connect",
+		1,
+		2.5,
+		true,
+		nil,
+		long,
+		amfObjectMap{{Key: "app", Value: "live"}, {Key: "level", Value: amfObjectMap{{Key: "n", Value: 3}}}},
+	)
+
+	values, err := decodeAmf(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []any{
+		"connect",
+		float64(1),
+		2.5,
+		true,
+		nil,
+		long,
+		map[string]any{"app": "live", "level": map[string]any{"n": float64(3)}},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("decoded %v, want %v", values, expected)
+	}
+}
+
+func TestAmfDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		values []any
+		fails  bool
+	}{
+		{name: "empty", data: []byte{}, values: []any{}},
+		{name: "number", data: []byte{amfNumber, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0}, values: []any{float64(1)}},
+		{name: "truncated number", data: []byte{amfNumber, 0x3f, 0xf0}, fails: true},
+		{name: "truncated boolean", data: []byte{amfBoolean}, fails: true},
+		{name: "string", data: []byte{amfString, 0, 2, 'o', 'k'}, values: []any{"ok"}},
+		{name: "truncated string length", data: []byte{amfString, 0}, fails: true},
+		{name: "string longer than the data", data: []byte{amfString, 0xff, 0xff, 'o', 'k'}, fails: true},
+		{name: "long string longer than the data", data: []byte{amfLongString, 0xff, 0xff, 0xff, 0xff, 'o'}, fails: true},
+		{name: "undefined and null", data: []byte{amfUndefined, amfNull}, values: []any{nil, nil}},
+		{
+			name:   "ecma array",
+			data:   []byte{amfEcmaArray, 0, 0, 0, 1, 0, 1, 'k', amfBoolean, 1, 0, 0, amfObjectEnd},
+			values: []any{map[string]any{"k": true}},
+		},
+		{name: "truncated ecma array count", data: []byte{amfEcmaArray, 0, 0}, fails: true},
+		{
+			name:   "strict array",
+			data:   []byte{amfStrictArray, 0, 0, 0, 2, amfNull, amfBoolean, 0},
+			values: []any{[]any{nil, false}},
+		},
+		{name: "strict array with missing items", data: []byte{amfStrictArray, 0xff, 0xff, 0xff, 0xff, amfNull}, fails: true},
+		{name: "date", data: []byte{amfDate, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0, 0, 0}, values: []any{float64(1)}},
+		{name: "object without end", data: []byte{amfObject, 0, 1, 'k', amfNull}, fails: true},
+		{name: "object with an empty key", data: []byte{amfObject, 0, 0, amfNull}, fails: true},
+		{name: "unsupported marker", data: []byte{0x11}, fails: true},
+		{name: "values nested too deeply", data: bytes.Repeat([]byte{amfStrictArray, 0, 0, 0, 1}, amfMaxDepth+2), fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := decodeAmf(test.data)
+			if test.fails {
+				if err == nil {
+					t.Errorf("decoded %v, want an error", values)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, test.values) {
+				t.Errorf("decoded %v, want %v", values, test.values)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+const maxBreakouts = 50
+
+var ErrNoBreakouts = errors.New("the room has no open breakout rooms")
+
+type BreakoutSummary struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name"`
+	Participants []string `json:"participants"`
+}
+
+// OpenBreakouts creates count child rooms from the room options and moves
+// every participant which isn't a moderator into one of them, following
+// assignments when provided and round robin otherwise.
+func (room *Room) OpenBreakouts(actor *User, count int, assignments map[string]int, duration time.Duration) error {
+	if !room.RoleOf(actor).CanModerate() {
+		return ErrNotAllowed
+	}
+	if room.parent != nil {
+		return errors.New("breakout rooms can't have their own breakout rooms")
+	}
+	if count < 1 || count > maxBreakouts {
+		return fmt.Errorf("breakout count must be between 1 and %d", maxBreakouts)
+	}
+	if duration < 0 {
+		return errors.New("breakout duration must not be negative")
+	}
+	for userId, index := range assignments {
+		if index < 0 || index >= count {
+			return fmt.Errorf("user %s is assigned to an unknown breakout %d", userId, index)
+		}
+	}
+
+	room.breakoutsMutex.Lock()
+	if len(room.breakouts) > 0 {
+		room.breakoutsMutex.Unlock()
+		return errors.New("breakout rooms are already open")
+	}
+
+	breakouts := make([]*Room, 0, count)
+	for i := range count {
+		breakout, err := room.newBreakout(i)
+		if err != nil {
+			room.breakoutsMutex.Unlock()
+			for _, breakout := range breakouts {
+				breakout.DestroyWithCause("breakout rooms creation failed")
+			}
+			return err
+		}
+		breakouts = append(breakouts, breakout)
+	}
+	room.breakouts = breakouts
+	if duration > 0 {
+		room.breakoutsTimer = time.AfterFunc(duration, func() {
+			room.closeBreakouts("breakout time is over")
+		})
+	}
+	room.breakoutsMutex.Unlock()
+
+	logger.Info(fmt.Sprintf("user %s open %d breakout rooms in room %s", actor.Id, count, room.Id))
+
+	next := 0
+	for _, user := range room.GetUsers() {
+		if room.RoleOf(user).CanModerate() {
+			continue
+		}
+
+		index, ok := assignments[user.Id]
+		if !ok {
+			index = next % count
+			next++
+		}
+
+		if err := user.JoinRoom(breakouts[index]); err != nil {
+			logger.Warn(fmt.Sprintf("failed moving user %s to breakout %s, %s", user.Id, breakouts[index].Id, err.Error()))
+		}
+	}
+
+	room.BroadcastToModeratorsJson(NewMessageBreakoutsState(room))
+
+	return nil
+}
+
+func (room *Room) CloseBreakouts(actor *User) error {
+	if !room.RoleOf(actor).CanModerate() {
+		return ErrNotAllowed
+	}
+
+	if !room.closeBreakouts(fmt.Sprintf("breakout rooms closed by %s", actor.Id)) {
+		return ErrNoBreakouts
+	}
+	return nil
+}
+
+func (room *Room) BroadcastToBreakouts(actor *User, payload json.RawMessage) error {
+	if !room.RoleOf(actor).CanModerate() {
+		return ErrNotAllowed
+	}
+
+	breakouts := room.GetBreakouts()
+	if len(breakouts) == 0 {
+		return ErrNoBreakouts
+	}
+
+	message := NewMessageBreakoutBroadcast(room, actor, payload)
+	for _, breakout := range breakouts {
+		breakout.BroadcastJson(message)
+	}
+	return nil
+}
+
+func (room *Room) GetBreakouts() []*Room {
+	room.breakoutsMutex.Lock()
+	defer room.breakoutsMutex.Unlock()
+
+	return slices.Clone(room.breakouts)
+}
+
+func (room *Room) HasBreakouts() bool {
+	room.breakoutsMutex.Lock()
+	defer room.breakoutsMutex.Unlock()
+
+	return len(room.breakouts) > 0
+}
+
+func (room *Room) BreakoutsSummary() []BreakoutSummary {
+	summaries := make([]BreakoutSummary, 0)
+	for _, breakout := range room.GetBreakouts() {
+		participants := make([]string, 0)
+		for _, user := range breakout.GetUsers() {
+			participants = append(participants, user.Id)
+		}
+		summaries = append(summaries, BreakoutSummary{
+			Id:           breakout.Id,
+			Name:         breakout.Name,
+			Participants: participants,
+		})
+	}
+	return summaries
+}
+
+func (room *Room) newBreakout(index int) (*Room, error) {
+	opts := room.options
+	opts.Id = ""
+	opts.Name = fmt.Sprintf("%s breakout %d", room.Name, index+1)
+	if room.Name == "" {
+		opts.Name = fmt.Sprintf("breakout %d", index+1)
+	}
+	opts.Unlisted = true
+	opts.OwnerId = room.Owner()
+	opts.Passcode = ""
+	opts.InviteOnly = false
+	opts.Lobby = false
+	opts.Persistent = false
+
+	breakout, err := NewRoom(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	room.rolesMutex.Lock()
+	roles, banned, bannedIPs := maps.Clone(room.roles), maps.Clone(room.banned), maps.Clone(room.bannedIPs)
+	room.rolesMutex.Unlock()
+
+	breakout.rolesMutex.Lock()
+	breakout.roles, breakout.banned, breakout.bannedIPs = roles, banned, bannedIPs
+	breakout.rolesMutex.Unlock()
+
+	breakout.ParentId = room.Id
+	breakout.parent = room
+
+	return breakout, nil
+}
+
+// closeBreakouts moves everyone back to the room and destroys the breakout
+// rooms, it reports whether there was anything to close.
+func (room *Room) closeBreakouts(cause string) bool {
+	breakouts := room.takeBreakouts()
+	if len(breakouts) == 0 {
+		return false
+	}
+
+	for _, breakout := range breakouts {
+		for _, user := range breakout.GetUsers() {
+			if err := user.JoinRoom(room); err != nil {
+				logger.Warn(fmt.Sprintf("failed moving user %s back to room %s, %s", user.Id, room.Id, err.Error()))
+			}
+		}
+		breakout.DestroyWithCause(cause)
+	}
+
+	logger.Info(fmt.Sprintf("breakout rooms of room %s closed, %s", room.Id, cause))
+	room.BroadcastToModeratorsJson(NewMessageBreakoutsState(room))
+
+	return true
+}
+
+func (room *Room) destroyBreakouts(cause string) {
+	breakouts := room.takeBreakouts()
+
+	for _, breakout := range breakouts {
+		breakout.DestroyWithCause(cause)
+	}
+}
+
+func (room *Room) takeBreakouts() []*Room {
+	room.breakoutsMutex.Lock()
+	defer room.breakoutsMutex.Unlock()
+
+	breakouts := room.breakouts
+	room.breakouts = nil
+	if room.breakoutsTimer != nil {
+		room.breakoutsTimer.Stop()
+		room.breakoutsTimer = nil
+	}
+	return breakouts
+}
+
+// removeBreakout drops a destroyed breakout, the room is destroyed in turn
+// once everyone left it from the breakouts.
+func (room *Room) removeBreakout(breakout *Room) {
+	room.breakoutsMutex.Lock()
+	idx := slices.Index(room.breakouts, breakout)
+	if idx != -1 {
+		room.breakouts = slices.Delete(room.breakouts, idx, idx+1)
+	}
+	last := idx != -1 && len(room.breakouts) == 0
+	room.breakoutsMutex.Unlock()
+
+	if last {
+		room.startEmptyDestroy()
+	}
+}
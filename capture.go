@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+type CaptureConfig struct {
+	Directory   string   `json:"directory" yaml:"directory" toml:"directory"`
+	MaxSize     int64    `json:"max_size" yaml:"max_size" toml:"max_size"`
+	MaxDuration Duration `json:"max_duration" yaml:"max_duration" toml:"max_duration"`
+}
+
+func (cfg CaptureConfig) Validate() error {
+	if cfg.Directory == "" {
+		return errors.New("directory must not be empty")
+	}
+	if cfg.MaxSize <= 0 || cfg.MaxDuration.Duration <= 0 {
+		return errors.New("max_size and max_duration must be positive")
+	}
+	return nil
+}
+
+type CaptureOptions struct {
+	RoomId      string   `json:"room_id,omitempty"`
+	UserId      string   `json:"user_id,omitempty"`
+	StreamId    string   `json:"stream_id,omitempty"`
+	MaxSize     int64    `json:"max_size,omitempty"`
+	MaxDuration Duration `json:"max_duration,omitempty"`
+}
+
+// Capture writes the decrypted rtp and rtcp of a room, a user or a stream to
+// a pcap file. Packets get synthetic ip and udp headers built from the
+// selected ice candidate pair of their peer connection. Both legs crossing the
+// server boundary are written: rtp and rtcp exchanged with the publishers,
+// the subscribers and the whep viewers.
+type Capture struct {
+	Id          string     `json:"id"`
+	RoomId      string     `json:"room_id,omitempty"`
+	UserId      string     `json:"user_id,omitempty"`
+	StreamId    string     `json:"stream_id,omitempty"`
+	Path        string     `json:"path"`
+	MaxSize     int64      `json:"max_size"`
+	MaxDuration Duration   `json:"max_duration"`
+	StartedAt   time.Time  `json:"started_at"`
+	StoppedAt   *time.Time `json:"stopped_at,omitempty"`
+	Cause       string     `json:"cause,omitempty"`
+	Packets     int64      `json:"packets"`
+	Size        int64      `json:"size"`
+
+	file      *os.File
+	writer    *bufio.Writer
+	timer     *time.Timer
+	endpoints map[*webrtc.PeerConnection][2]*net.UDPAddr
+	stopped   bool
+	mutex     *sync.Mutex
+}
+
+const (
+	pcapMagicNanoseconds = 0xa1b23c4d
+	pcapLinkTypeRaw      = 101
+	pcapSnapLength       = 65535
+	pcapHeaderSize       = 24
+	pcapRecordHeaderSize = 16
+)
+
+var (
+	captures       map[string]*Capture = make(map[string]*Capture)
+	capturesMutex  *sync.Mutex         = new(sync.Mutex)
+	capturesActive atomic.Int32
+
+	ErrCaptureNotFound = errors.New("the capture does not exist")
+)
+
+func StartCapture(opts CaptureOptions) (*Capture, error) {
+	scopes := 0
+	for _, id := range []string{opts.RoomId, opts.UserId, opts.StreamId} {
+		if id != "" {
+			scopes++
+		}
+	}
+	if scopes != 1 {
+		return nil, errors.New("exactly one of room_id, user_id or stream_id is required")
+	}
+
+	cfg := GetConfig().Capture
+	if opts.MaxSize < 0 || opts.MaxDuration.Duration < 0 {
+		return nil, errors.New("max_size and max_duration must not be negative")
+	}
+	maxSize := cfg.MaxSize
+	if opts.MaxSize > 0 {
+		maxSize = min(opts.MaxSize, cfg.MaxSize)
+	}
+	maxDuration := cfg.MaxDuration.Duration
+	if opts.MaxDuration.Duration > 0 {
+		maxDuration = min(opts.MaxDuration.Duration, cfg.MaxDuration.Duration)
+	}
+
+	capture := &Capture{
+		Id:          uuid.NewString(),
+		RoomId:      opts.RoomId,
+		UserId:      opts.UserId,
+		StreamId:    opts.StreamId,
+		MaxSize:     maxSize,
+		MaxDuration: Duration{maxDuration},
+		StartedAt:   time.Now(),
+
+		endpoints: make(map[*webrtc.PeerConnection][2]*net.UDPAddr),
+		mutex:     new(sync.Mutex),
+	}
+
+	if err := os.MkdirAll(cfg.Directory, 0o755); err != nil {
+		return nil, err
+	}
+	capture.Path = filepath.Join(cfg.Directory, capture.Id+".pcap")
+
+	file, err := os.Create(capture.Path)
+	if err != nil {
+		return nil, err
+	}
+	capture.file = file
+	capture.writer = bufio.NewWriter(file)
+
+	header := make([]byte, 0, pcapHeaderSize)
+	header = binary.LittleEndian.AppendUint32(header, pcapMagicNanoseconds)
+	header = binary.LittleEndian.AppendUint16(header, 2)
+	header = binary.LittleEndian.AppendUint16(header, 4)
+	header = binary.LittleEndian.AppendUint32(header, 0)
+	header = binary.LittleEndian.AppendUint32(header, 0)
+	header = binary.LittleEndian.AppendUint32(header, pcapSnapLength)
+	header = binary.LittleEndian.AppendUint32(header, pcapLinkTypeRaw)
+	if _, err := capture.writer.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	capture.Size = pcapHeaderSize
+
+	// The timer is armed under the lock so Stop can't run before it is set.
+	capturesActive.Add(1)
+	capture.mutex.Lock()
+	capture.timer = time.AfterFunc(maxDuration, func() {
+		capture.Stop("duration limit reached")
+	})
+	capture.mutex.Unlock()
+
+	capturesMutex.Lock()
+	captures[capture.Id] = capture
+	capturesMutex.Unlock()
+
+	logger.Info(fmt.Sprintf("capture %s started, writing to %s", capture.Id, capture.Path))
+
+	return capture, nil
+}
+
+func GetCapture(id string) *Capture {
+	capturesMutex.Lock()
+	defer capturesMutex.Unlock()
+
+	return captures[id]
+}
+
+func GetCaptures() []*Capture {
+	capturesMutex.Lock()
+	defer capturesMutex.Unlock()
+
+	return slices.Collect(maps.Values(captures))
+}
+
+// Stop closes the file, the capture stays listed so it can be downloaded.
+func (c *Capture) Stop(cause string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stopped {
+		return
+	}
+	c.stopped = true
+	now := time.Now()
+	c.StoppedAt = &now
+	c.Cause = cause
+	c.timer.Stop()
+	capturesActive.Add(-1)
+
+	if err := c.writer.Flush(); err != nil {
+		logger.Warn(fmt.Sprintf("failed flushing capture %s, %s", c.Id, err.Error()))
+	}
+	if err := c.file.Close(); err != nil {
+		logger.Warn(fmt.Sprintf("failed closing capture %s, %s", c.Id, err.Error()))
+	}
+
+	logger.Info(fmt.Sprintf("capture %s stopped after %d packets, %s", c.Id, c.Packets, cause))
+}
+
+func (c *Capture) IsStopped() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.stopped
+}
+
+func (c *Capture) MarshalJSON() ([]byte, error) {
+	type capture Capture
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return json.Marshal((*capture)(c))
+}
+
+func (c *Capture) matchesStream(stream *IncomingStream) bool {
+	switch {
+	case c.StreamId != "":
+		return c.StreamId == stream.Id
+	case c.UserId != "":
+		return c.UserId == stream.Publisher.Id
+	default:
+		return c.RoomId == stream.room.Id
+	}
+}
+
+func (c *Capture) matchesSubscription(sub *OutgoingStream) bool {
+	switch {
+	case c.StreamId != "":
+		return c.StreamId == sub.StreamId
+	case c.UserId != "":
+		return c.UserId == sub.Subscriber.Id
+	default:
+		return c.RoomId == sub.Stream.room.Id
+	}
+}
+
+// matchesViewer accepts the viewers of a room, and the viewers of a single
+// stream for stream captures, whep viewers aren't users.
+func (c *Capture) matchesViewer(viewer *WhepViewer) bool {
+	switch {
+	case c.StreamId != "":
+		return c.StreamId == viewer.StreamId
+	case c.UserId != "":
+		return false
+	default:
+		return c.RoomId == viewer.RoomId
+	}
+}
+
+// captureStreamPacket is called with every packet exchanged with the
+// publisher of a stream, inbound tells whether the server received it.
+func captureStreamPacket(stream *IncomingStream, packet []byte, inbound bool) {
+	if capturesActive.Load() == 0 {
+		return
+	}
+
+	for _, capture := range GetCaptures() {
+		if capture.matchesStream(stream) {
+			capture.write(stream.PeerConnection, packet, inbound)
+		}
+	}
+}
+
+func captureStreamRTP(stream *IncomingStream, packet *rtp.Packet) {
+	if capturesActive.Load() == 0 {
+		return
+	}
+
+	raw, err := packet.Marshal()
+	if err != nil {
+		return
+	}
+	captureStreamPacket(stream, raw, true)
+}
+
+func captureSubscriptionPacket(sub *OutgoingStream, packet []byte, inbound bool) {
+	if capturesActive.Load() == 0 {
+		return
+	}
+
+	for _, capture := range GetCaptures() {
+		if capture.matchesSubscription(sub) {
+			capture.write(sub.PeerConnection, packet, inbound)
+		}
+	}
+}
+
+func captureViewerPacket(viewer *WhepViewer, packet []byte, inbound bool) {
+	if capturesActive.Load() == 0 {
+		return
+	}
+
+	for _, capture := range GetCaptures() {
+		if capture.matchesViewer(viewer) {
+			capture.write(viewer.PeerConnection, packet, inbound)
+		}
+	}
+}
+
+// captureTap is the interceptor writing the rtp and rtcp the server sends on
+// a peer connection, it sits under the other interceptors so retransmissions
+// and generated reports are written too.
+type captureTap struct {
+	interceptor.NoOp
+	target atomic.Pointer[captureTarget]
+}
+
+type captureTarget struct {
+	pc      *webrtc.PeerConnection
+	matches func(capture *Capture) bool
+}
+
+// captureTapFactory hands its tap to the single peer connection built from
+// its registry.
+type captureTapFactory struct {
+	tap *captureTap
+}
+
+func (f *captureTapFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return f.tap, nil
+}
+
+// registryFactory builds the interceptors of a shared registry, so they can
+// be added to the registry of a single peer connection.
+type registryFactory struct {
+	registry *interceptor.Registry
+}
+
+func (f *registryFactory) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return f.registry.Build(id)
+}
+
+// newCapturedPeerConnection creates a peer connection of the room whose sent
+// packets are written to the captures matches accepts.
+func newCapturedPeerConnection(room *Room, configuration webrtc.Configuration, matches func(capture *Capture) bool) (*webrtc.PeerConnection, error) {
+	tap := &captureTap{}
+	registry := new(interceptor.Registry)
+	registry.Add(&captureTapFactory{tap: tap})
+	registry.Add(&registryFactory{registry: room.interceptors})
+
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(room.mediaEngine),
+		webrtc.WithSettingEngine(settingEngine),
+		webrtc.WithInterceptorRegistry(registry),
+	)
+	pc, err := api.NewPeerConnection(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	tap.target.Store(&captureTarget{pc: pc, matches: matches})
+	return pc, nil
+}
+
+func (tap *captureTap) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		if capturesActive.Load() != 0 {
+			packet := &rtp.Packet{Header: *header, Payload: payload}
+			if raw, err := packet.Marshal(); err == nil {
+				tap.write(raw)
+			}
+		}
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+func (tap *captureTap) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(packets []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		if capturesActive.Load() != 0 {
+			if raw, err := rtcp.Marshal(packets); err == nil {
+				tap.write(raw)
+			}
+		}
+		return writer.Write(packets, attributes)
+	})
+}
+
+func (tap *captureTap) write(packet []byte) {
+	target := tap.target.Load()
+	if target == nil {
+		return
+	}
+
+	for _, capture := range GetCaptures() {
+		if target.matches(capture) {
+			capture.write(target.pc, packet, false)
+		}
+	}
+}
+
+func (c *Capture) write(pc *webrtc.PeerConnection, packet []byte, inbound bool) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	if c.stopped {
+		c.mutex.Unlock()
+		return
+	}
+
+	local, remote := c.peerEndpoints(pc)
+	src, dst := local, remote
+	if inbound {
+		src, dst = remote, local
+	}
+	datagram := udpDatagram(src, dst, packet)
+
+	if c.Size+pcapRecordHeaderSize+int64(len(datagram)) > c.MaxSize {
+		c.mutex.Unlock()
+		c.Stop("size limit reached")
+		return
+	}
+
+	record := make([]byte, 0, pcapRecordHeaderSize)
+	record = binary.LittleEndian.AppendUint32(record, uint32(now.Unix()))
+	record = binary.LittleEndian.AppendUint32(record, uint32(now.Nanosecond()))
+	record = binary.LittleEndian.AppendUint32(record, uint32(min(len(datagram), pcapSnapLength)))
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(datagram)))
+
+	_, err := c.writer.Write(record)
+	if err == nil {
+		_, err = c.writer.Write(datagram[:min(len(datagram), pcapSnapLength)])
+	}
+	c.Packets++
+	c.Size += int64(pcapRecordHeaderSize + len(datagram))
+	c.mutex.Unlock()
+
+	if err != nil {
+		logger.Warn(fmt.Sprintf("failed writing capture %s, %s", c.Id, err.Error()))
+		c.Stop("write failed")
+	}
+}
+
+// peerEndpoints returns the addresses of the selected candidate pair, or
+// placeholder addresses until one is selected.
+func (c *Capture) peerEndpoints(pc *webrtc.PeerConnection) (*net.UDPAddr, *net.UDPAddr) {
+	if endpoints, ok := c.endpoints[pc]; ok {
+		return endpoints[0], endpoints[1]
+	}
+
+	fallback := [2]*net.UDPAddr{
+		{IP: net.IPv4(127, 0, 0, 1), Port: 5004},
+		{IP: net.IPv4(127, 0, 0, 2), Port: 5004},
+	}
+	// The ice transport can only be read safely once it is connected.
+	if pc == nil || pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+		return fallback[0], fallback[1]
+	}
+
+	pair, err := pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return fallback[0], fallback[1]
+	}
+	local := &net.UDPAddr{IP: net.ParseIP(pair.Local.Address), Port: int(pair.Local.Port)}
+	remote := &net.UDPAddr{IP: net.ParseIP(pair.Remote.Address), Port: int(pair.Remote.Port)}
+	if local.IP == nil || remote.IP == nil || (local.IP.To4() == nil) != (remote.IP.To4() == nil) {
+		return fallback[0], fallback[1]
+	}
+
+	c.endpoints[pc] = [2]*net.UDPAddr{local, remote}
+	return local, remote
+}
+
+func udpDatagram(src, dst *net.UDPAddr, payload []byte) []byte {
+	udpLength := 8 + len(payload)
+
+	udp := make([]byte, 8, udpLength)
+	binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLength))
+	udp = append(udp, payload...)
+
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, 20, 20+udpLength)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+udpLength))
+		binary.BigEndian.PutUint16(ip[6:8], 0x4000)
+		ip[8] = 64
+		ip[9] = 17
+		copy(ip[12:16], src4)
+		copy(ip[16:20], dst4)
+		binary.BigEndian.PutUint16(ip[10:12], internetChecksum(0, ip))
+		// The udp checksum is optional over ipv4.
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40, 40+udpLength)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], uint16(udpLength))
+	ip[6] = 17
+	ip[7] = 64
+	copy(ip[8:24], src.IP.To16())
+	copy(ip[24:40], dst.IP.To16())
+
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, ip[8:40]...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(udpLength))
+	pseudo = append(pseudo, 0, 0, 0, 17)
+	checksum := internetChecksum(internetChecksumSum(0, pseudo), udp)
+	if checksum == 0 {
+		checksum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(udp[6:8], checksum)
+
+	return append(ip, udp...)
+}
+
+func internetChecksumSum(sum uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+func internetChecksum(sum uint32, data []byte) uint16 {
+	sum = internetChecksumSum(sum, data)
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func httpHandleCaptureStart(w http.ResponseWriter, r *http.Request) {
+	opts := CaptureOptions{}
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "capture_failure", err.Error())
+		return
+	}
+
+	capture, err := StartCapture(opts)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "capture_failure", err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusCreated, capture)
+}
+
+func httpHandleCapturesList(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, GetCaptures())
+}
+
+func httpHandleCaptureGet(w http.ResponseWriter, r *http.Request) {
+	capture := GetCapture(r.PathValue("id"))
+	if capture == nil {
+		writeJsonError(w, http.StatusNotFound, "capture_failure", ErrCaptureNotFound.Error())
+		return
+	}
+
+	writeJson(w, http.StatusOK, capture)
+}
+
+func httpHandleCaptureDownload(w http.ResponseWriter, r *http.Request) {
+	capture := GetCapture(r.PathValue("id"))
+	if capture == nil {
+		writeJsonError(w, http.StatusNotFound, "capture_failure", ErrCaptureNotFound.Error())
+		return
+	}
+	if !capture.IsStopped() {
+		writeJsonError(w, http.StatusConflict, "capture_failure", "the capture is still running")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", capture.Id+".pcap"))
+	http.ServeFile(w, r, capture.Path)
+}
+
+func httpHandleCaptureStop(w http.ResponseWriter, r *http.Request) {
+	capture := GetCapture(r.PathValue("id"))
+	if capture == nil {
+		writeJsonError(w, http.StatusNotFound, "capture_failure", ErrCaptureNotFound.Error())
+		return
+	}
+
+	capture.Stop("stopped by an admin")
+	writeJson(w, http.StatusOK, capture)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestInternetChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		checksum uint16
+	}{
+		// The example of RFC 1071.
+		{name: "rfc 1071", data: []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, checksum: 0x220d},
+		{name: "odd length", data: []byte{0x00, 0x01, 0xf2}, checksum: 0x0dfe},
+		{name: "carries folded twice", data: []byte{0xff, 0xff, 0xff, 0xff, 0x00, 0x01}, checksum: 0xfffe},
+		{name: "empty", data: []byte{}, checksum: 0xffff},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if checksum := internetChecksum(0, test.data); checksum != test.checksum {
+				t.Errorf("checksum %04x, want %04x", checksum, test.checksum)
+			}
+		})
+	}
+}
+
+func TestUdpDatagram(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     *net.UDPAddr
+		dst     *net.UDPAddr
+		payload []byte
+		header  int
+	}{
+		{
+			name:    "ipv4",
+			src:     &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5004},
+			dst:     &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 40000},
+			payload: []byte{0x80, 0x60, 0x00, 0x01},
+			header:  20,
+		},
+		{
+			name:    "ipv4 odd payload",
+			src:     &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5004},
+			dst:     &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 40000},
+			payload: []byte{0x80, 0x60, 0x00},
+			header:  20,
+		},
+		{
+			name:    "ipv6",
+			src:     &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5004},
+			dst:     &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 40000},
+			payload: []byte{0x80, 0x60, 0x00, 0x01, 0x02},
+			header:  40,
+		},
+		{
+			name:   "ipv6 empty payload",
+			src:    &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1},
+			dst:    &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2},
+			header: 40,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			datagram := udpDatagram(test.src, test.dst, test.payload)
+			if len(datagram) != test.header+8+len(test.payload) {
+				t.Fatalf("%d bytes", len(datagram))
+			}
+			ip, udp := datagram[:test.header], datagram[test.header:]
+
+			if test.header == 20 {
+				if ip[0] != 0x45 || ip[9] != 17 || int(binary.BigEndian.Uint16(ip[2:4])) != len(datagram) {
+					t.Errorf("ipv4 header %x", ip)
+				}
+				if !net.IP(ip[12:16]).Equal(test.src.IP) || !net.IP(ip[16:20]).Equal(test.dst.IP) {
+					t.Errorf("addresses %s to %s", net.IP(ip[12:16]), net.IP(ip[16:20]))
+				}
+				if internetChecksum(0, ip) != 0 {
+					t.Error("invalid ipv4 header checksum")
+				}
+			} else {
+				if ip[0]>>4 != 6 || ip[6] != 17 || int(binary.BigEndian.Uint16(ip[4:6])) != len(udp) {
+					t.Errorf("ipv6 header %x", ip)
+				}
+				if !net.IP(ip[8:24]).Equal(test.src.IP) || !net.IP(ip[24:40]).Equal(test.dst.IP) {
+					t.Errorf("addresses %s to %s", net.IP(ip[8:24]), net.IP(ip[24:40]))
+				}
+				pseudo := append(append([]byte{}, ip[8:40]...), 0, 0, byte(len(udp)>>8), byte(len(udp)), 0, 0, 0, 17)
+				if internetChecksum(internetChecksumSum(0, pseudo), udp) != 0 {
+					t.Error("invalid udp checksum")
+				}
+			}
+
+			if int(binary.BigEndian.Uint16(udp[0:2])) != test.src.Port || int(binary.BigEndian.Uint16(udp[2:4])) != test.dst.Port {
+				t.Errorf("ports %x", udp[0:4])
+			}
+			if int(binary.BigEndian.Uint16(udp[4:6])) != len(udp) {
+				t.Errorf("udp length %d", binary.BigEndian.Uint16(udp[4:6]))
+			}
+			if !bytes.Equal(udp[8:], test.payload) {
+				t.Errorf("payload %x", udp[8:])
+			}
+		})
+	}
+}
+
+type captureTestRecord struct {
+	datagram []byte
+	length   uint32
+}
+
+// captureTestRecords checks the global header of a pcap file and splits its
+// records.
+func captureTestRecords(data []byte) ([]captureTestRecord, error) {
+	if len(data) < pcapHeaderSize {
+		return nil, fmt.Errorf("truncated header")
+	}
+	if binary.LittleEndian.Uint32(data[0:4]) != pcapMagicNanoseconds || binary.LittleEndian.Uint32(data[20:24]) != pcapLinkTypeRaw {
+		return nil, fmt.Errorf("invalid header %x", data[:pcapHeaderSize])
+	}
+
+	records := make([]captureTestRecord, 0)
+	for data = data[pcapHeaderSize:]; len(data) > 0; {
+		if len(data) < pcapRecordHeaderSize {
+			return nil, fmt.Errorf("truncated record header")
+		}
+		included := binary.LittleEndian.Uint32(data[8:12])
+		length := binary.LittleEndian.Uint32(data[12:16])
+		if included > length || binary.LittleEndian.Uint32(data[4:8]) >= uint32(time.Second) {
+			return nil, fmt.Errorf("invalid record header %x", data[:pcapRecordHeaderSize])
+		}
+		if uint32(len(data)-pcapRecordHeaderSize) < included {
+			return nil, fmt.Errorf("truncated record")
+		}
+		records = append(records, captureTestRecord{
+			datagram: data[pcapRecordHeaderSize : pcapRecordHeaderSize+included],
+			length:   length,
+		})
+		data = data[pcapRecordHeaderSize+included:]
+	}
+	return records, nil
+}
+
+func startTestCapture(t *testing.T, opts CaptureOptions) *Capture {
+	t.Helper()
+
+	previous := GetConfig()
+	t.Cleanup(func() { SetConfig(previous) })
+	cfg := DefaultConfig()
+	cfg.Capture.Directory = t.TempDir()
+	SetConfig(cfg)
+
+	capture, err := StartCapture(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		capture.Stop("test done")
+		capturesMutex.Lock()
+		delete(captures, capture.Id)
+		capturesMutex.Unlock()
+	})
+	return capture
+}
+
+func TestCaptureFile(t *testing.T) {
+	capture := startTestCapture(t, CaptureOptions{RoomId: "room"})
+	packets := [][]byte{{0x80, 0x60, 0x00, 0x01}, {0x81, 0xc9, 0x00, 0x01, 0x00}}
+	capture.write(nil, packets[0], false)
+	capture.write(nil, packets[1], true)
+	capture.Stop("stopped")
+
+	data, err := os.ReadFile(capture.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != capture.Size {
+		t.Errorf("file of %d bytes, counted %d", len(data), capture.Size)
+	}
+	records, err := captureTestRecords(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(packets) || capture.Packets != int64(len(packets)) {
+		t.Fatalf("%d records, want %d", len(records), len(packets))
+	}
+
+	for i, record := range records {
+		if int(record.length) != len(record.datagram) || !bytes.Equal(record.datagram[28:], packets[i]) {
+			t.Errorf("record %d is %x", i, record.datagram)
+		}
+	}
+	// The inbound packet goes from the remote peer to the server.
+	if !bytes.Equal(records[0].datagram[12:16], records[1].datagram[16:20]) || !bytes.Equal(records[0].datagram[16:20], records[1].datagram[12:16]) {
+		t.Error("inbound addresses aren't swapped")
+	}
+}
+
+func TestCaptureSizeLimit(t *testing.T) {
+	packet := make([]byte, 100)
+	record := int64(pcapRecordHeaderSize + 28 + len(packet))
+	capture := startTestCapture(t, CaptureOptions{StreamId: "stream", MaxSize: pcapHeaderSize + 2*record + 10})
+
+	for range 5 {
+		capture.write(nil, packet, false)
+	}
+	if !capture.IsStopped() || capture.Cause != "size limit reached" {
+		t.Fatalf("capture running after %d packets", capture.Packets)
+	}
+
+	data, err := os.ReadFile(capture.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := captureTestRecords(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || int64(len(data)) > capture.MaxSize {
+		t.Errorf("%d records in %d bytes", len(records), len(data))
+	}
+}
+
+func TestStartCaptureOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts CaptureOptions
+	}{
+		{name: "no scope", opts: CaptureOptions{}},
+		{name: "two scopes", opts: CaptureOptions{RoomId: "room", UserId: "user"}},
+		{name: "negative size", opts: CaptureOptions{RoomId: "room", MaxSize: -1}},
+		{name: "negative duration", opts: CaptureOptions{RoomId: "room", MaxDuration: Duration{-time.Second}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if capture, err := StartCapture(test.opts); err == nil {
+				capture.Stop("test done")
+				t.Error("started the capture, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+type RoomMessage struct {
+	ServerToUserMessage
+	RoomId    string          `json:"room_id"`
+	SenderId  string          `json:"sender_id"`
+	To        string          `json:"to,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+func NewRoomMessage(room *Room, sender *User, to string, payload json.RawMessage) RoomMessage {
+	return RoomMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "room_message",
+		},
+		RoomId:    room.Id,
+		SenderId:  sender.Id,
+		To:        to,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}
+}
+
+// SendRoomMessage delivers the payload to the whole room when to is empty,
+// only room wide messages are kept in the history.
+func (room *Room) SendRoomMessage(sender *User, to string, payload json.RawMessage) error {
+	if len(payload) == 0 {
+		return errors.New("the message payload is empty")
+	}
+	if maxSize := GetConfig().Room.MaxMessageSize; maxSize > 0 && len(payload) > maxSize {
+		return fmt.Errorf("the message payload exceeds %d bytes", maxSize)
+	}
+
+	message := NewRoomMessage(room, sender, to, payload)
+
+	if to != "" {
+		recipient := room.getMember(to)
+		if recipient == nil {
+			return ErrUserNotInRoom
+		}
+		recipient.SendMessageJson(message)
+		if recipient != sender {
+			sender.SendMessageJson(message)
+		}
+		return nil
+	}
+
+	room.appendHistory(message)
+	room.BroadcastJson(message)
+
+	return nil
+}
+
+func (room *Room) GetHistory() []RoomMessage {
+	room.historyMutex.Lock()
+	defer room.historyMutex.Unlock()
+
+	return slices.Clone(room.history)
+}
+
+func (room *Room) appendHistory(message RoomMessage) {
+	if room.HistorySize == 0 {
+		return
+	}
+
+	room.historyMutex.Lock()
+	defer room.historyMutex.Unlock()
+
+	room.history = append(room.history, message)
+	if overflow := len(room.history) - room.HistorySize; overflow > 0 {
+		room.history = slices.Delete(room.history, 0, overflow)
+	}
+}
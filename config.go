@@ -0,0 +1,559 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const configEnvPrefix = "SPLASH_"
+
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+type Config struct {
+	Listen   string     `json:"listen" yaml:"listen" toml:"listen"`
+	LogLevel string     `json:"log_level" yaml:"log_level" toml:"log_level"`
+	ICE      ICEConfig  `json:"ice" yaml:"ice" toml:"ice"`
+	Room     RoomConfig `json:"room" yaml:"room" toml:"room"`
+	Turn     TurnConfig `json:"turn" yaml:"turn" toml:"turn"`
+
+	Recording RecordingConfig `json:"recording" yaml:"recording" toml:"recording"`
+	Capture   CaptureConfig   `json:"capture" yaml:"capture" toml:"capture"`
+	Admin     AdminConfig     `json:"admin" yaml:"admin" toml:"admin"`
+
+	FilePublisher FilePublisherConfig `json:"file_publisher" yaml:"file_publisher" toml:"file_publisher"`
+	RTPIngest     RTPIngestConfig     `json:"rtp_ingest" yaml:"rtp_ingest" toml:"rtp_ingest"`
+	Forward       ForwardConfig       `json:"forward" yaml:"forward" toml:"forward"`
+	RTMP          RTMPConfig          `json:"rtmp" yaml:"rtmp" toml:"rtmp"`
+	HLS           HLSConfig           `json:"hls" yaml:"hls" toml:"hls"`
+	RTSP          RTSPConfig          `json:"rtsp" yaml:"rtsp" toml:"rtsp"`
+
+	Metrics MetricsConfig `json:"metrics" yaml:"metrics" toml:"metrics"`
+}
+
+type ICEConfig struct {
+	Servers []ICEServerConfig `json:"servers" yaml:"servers" toml:"servers"`
+
+	Lite         bool     `json:"lite" yaml:"lite" toml:"lite"`
+	NetworkTypes []string `json:"network_types" yaml:"network_types" toml:"network_types"`
+
+	UDPPort    int      `json:"udp_port" yaml:"udp_port" toml:"udp_port"`
+	TCPPort    int      `json:"tcp_port" yaml:"tcp_port" toml:"tcp_port"`
+	NAT1To1IPs []string `json:"nat_1to1_ips" yaml:"nat_1to1_ips" toml:"nat_1to1_ips"`
+	Interfaces []string `json:"interfaces" yaml:"interfaces" toml:"interfaces"`
+	IPFilter   []string `json:"ip_filter" yaml:"ip_filter" toml:"ip_filter"`
+}
+
+type RoomConfig struct {
+	DestroyTimeout Duration `json:"destroy_timeout" yaml:"destroy_timeout" toml:"destroy_timeout"`
+	MaxLifetime    Duration `json:"max_lifetime" yaml:"max_lifetime" toml:"max_lifetime"`
+	IdleTimeout    Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`
+	ExpiryWarning  Duration `json:"expiry_warning" yaml:"expiry_warning" toml:"expiry_warning"`
+
+	MaxParticipants   int `json:"max_participants" yaml:"max_participants" toml:"max_participants"`
+	MaxPublishers     int `json:"max_publishers" yaml:"max_publishers" toml:"max_publishers"`
+	MaxStreamsPerUser int `json:"max_streams_per_user" yaml:"max_streams_per_user" toml:"max_streams_per_user"`
+
+	MaxMessageSize int `json:"max_message_size" yaml:"max_message_size" toml:"max_message_size"`
+	HistorySize    int `json:"history_size" yaml:"history_size" toml:"history_size"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:   "0.0.0.0:8888",
+		LogLevel: "debug",
+		ICE: ICEConfig{
+			Servers: []ICEServerConfig{
+				{URLs: []string{"stun:stun2.l.google.com:19302"}},
+			},
+		},
+		Room: RoomConfig{
+			DestroyTimeout: Duration{30 * time.Second},
+			ExpiryWarning:  Duration{time.Minute},
+			MaxMessageSize: 16 * 1024,
+			HistorySize:    50,
+		},
+		Turn: DefaultTurnConfig(),
+		Recording: RecordingConfig{
+			Directory: "recordings",
+		},
+		Capture: CaptureConfig{
+			Directory:   "captures",
+			MaxSize:     100 * 1024 * 1024,
+			MaxDuration: Duration{5 * time.Minute},
+		},
+		FilePublisher: FilePublisherConfig{
+			Directory: "media",
+		},
+		RTPIngest: RTPIngestConfig{
+			Host: "127.0.0.1",
+		},
+		Forward: ForwardConfig{
+			AllowedNetworks: []string{"127.0.0.0/8", "::1/128"},
+		},
+		HLS: HLSConfig{
+			SegmentDuration: Duration{2 * time.Second},
+			PlaylistSize:    6,
+		},
+	}
+}
+
+func (cfg *Config) Validate() error {
+	errs := make([]error, 0)
+
+	if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %w", err))
+	}
+	if _, err := ParseLogLevel(cfg.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log_level: %w", err))
+	}
+	if err := cfg.ICE.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("ice.%w", err))
+	}
+	if cfg.Room.DestroyTimeout.Duration < 0 || cfg.Room.MaxLifetime.Duration < 0 || cfg.Room.IdleTimeout.Duration < 0 || cfg.Room.ExpiryWarning.Duration < 0 {
+		errs = append(errs, errors.New("room: timeouts must not be negative"))
+	}
+	if cfg.Room.MaxParticipants < 0 || cfg.Room.MaxPublishers < 0 || cfg.Room.MaxStreamsPerUser < 0 {
+		errs = append(errs, errors.New("room: limits must not be negative"))
+	}
+	if cfg.Room.MaxMessageSize < 0 || cfg.Room.HistorySize < 0 {
+		errs = append(errs, errors.New("room: message size and history size must not be negative"))
+	}
+	if err := cfg.Turn.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("turn: %w", err))
+	}
+	if cfg.Recording.Directory == "" {
+		errs = append(errs, errors.New("recording: directory must not be empty"))
+	}
+	if err := cfg.Capture.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("capture: %w", err))
+	}
+	if cfg.FilePublisher.Directory == "" {
+		errs = append(errs, errors.New("file_publisher: directory must not be empty"))
+	}
+	if net.ParseIP(cfg.RTPIngest.Host) == nil {
+		errs = append(errs, fmt.Errorf("rtp_ingest: host %q is not an ip address", cfg.RTPIngest.Host))
+	}
+	if err := cfg.Forward.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("forward: %w", err))
+	}
+	if cfg.RTMP.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.RTMP.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("rtmp: listen: %w", err))
+		}
+	}
+	if cfg.RTSP.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.RTSP.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("rtsp: listen: %w", err))
+		}
+	}
+	if err := cfg.HLS.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("hls: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+const redactedSecret = "<redacted>"
+
+// Print writes the config as yaml, its secrets and credentials redacted.
+func (cfg *Config) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	defer encoder.Close()
+
+	return encoder.Encode(cfg.redacted())
+}
+
+func (cfg *Config) redacted() *Config {
+	redact := func(value *string) {
+		if *value != "" {
+			*value = redactedSecret
+		}
+	}
+
+	redacted := *cfg
+	redacted.ICE.Servers = slices.Clone(cfg.ICE.Servers)
+	for i := range redacted.ICE.Servers {
+		redact(&redacted.ICE.Servers[i].Credential)
+		redact(&redacted.ICE.Servers[i].Secret)
+	}
+	redact(&redacted.Turn.Secret)
+	redact(&redacted.Admin.Token)
+	redact(&redacted.Metrics.Token)
+
+	return &redacted
+}
+
+// applyReloadable copies onto a copy of cfg the settings of next that can
+// safely change while the server is running.
+func (cfg *Config) applyReloadable(next *Config) *Config {
+	reloaded := *cfg
+	reloaded.LogLevel = next.LogLevel
+	reloaded.ICE.Servers = next.ICE.Servers
+	reloaded.Room = next.Room
+	reloaded.Recording = next.Recording
+	reloaded.Capture = next.Capture
+	reloaded.Admin = next.Admin
+	reloaded.FilePublisher = next.FilePublisher
+	reloaded.RTPIngest = next.RTPIngest
+	reloaded.Forward = next.Forward
+	reloaded.HLS = next.HLS
+	reloaded.Metrics = next.Metrics
+
+	if next.Listen != cfg.Listen {
+		logger.Warn(fmt.Sprintf("config listen changed to %s, a restart is required to apply it", next.Listen))
+	}
+	if !cfg.ICE.sameTransport(next.ICE) {
+		logger.Warn("config ice transport changed, a restart is required to apply it")
+	}
+	if !reflect.DeepEqual(next.Turn, cfg.Turn) {
+		logger.Warn("config turn changed, a restart is required to apply it")
+	}
+	if next.RTMP != cfg.RTMP {
+		logger.Warn("config rtmp changed, a restart is required to apply it")
+	}
+	if next.RTSP != cfg.RTSP {
+		logger.Warn("config rtsp changed, a restart is required to apply it")
+	}
+
+	return &reloaded
+}
+
+type configSetting struct {
+	name  string
+	usage string
+	set   func(cfg *Config, value string) error
+}
+
+var configSettings = []configSetting{
+	{
+		name:  "listen",
+		usage: "address the http server listens on",
+		set: func(cfg *Config, value string) error {
+			cfg.Listen = value
+			return nil
+		},
+	},
+	{
+		name:  "log-level",
+		usage: "log level (trace, debug, info, warn, error)",
+		set: func(cfg *Config, value string) error {
+			cfg.LogLevel = value
+			return nil
+		},
+	},
+	{
+		name:  "ice-servers",
+		usage: "comma separated list of credential-less ice server urls, replaces the configured servers",
+		set: func(cfg *Config, value string) error {
+			cfg.ICE.Servers = make([]ICEServerConfig, 0)
+			for _, url := range splitList(value) {
+				cfg.ICE.Servers = append(cfg.ICE.Servers, ICEServerConfig{URLs: []string{url}})
+			}
+			return nil
+		},
+	},
+	{
+		name:  "ice-lite",
+		usage: "run as an ice-lite agent, only for servers reachable on a public ip",
+		set: func(cfg *Config, value string) (err error) {
+			cfg.ICE.Lite, err = strconv.ParseBool(value)
+			return err
+		},
+	},
+	{
+		name:  "ice-network-types",
+		usage: "comma separated list of candidate network types (udp4, udp6, tcp4, tcp6)",
+		set: func(cfg *Config, value string) error {
+			cfg.ICE.NetworkTypes = splitList(value)
+			return nil
+		},
+	},
+	{
+		name:  "ice-udp-port",
+		usage: "single udp port shared by every peer connection, 0 for ephemeral ports",
+		set: func(cfg *Config, value string) (err error) {
+			cfg.ICE.UDPPort, err = strconv.Atoi(value)
+			return err
+		},
+	},
+	{
+		name:  "ice-tcp-port",
+		usage: "single tcp port shared by every peer connection, 0 to disable",
+		set: func(cfg *Config, value string) (err error) {
+			cfg.ICE.TCPPort, err = strconv.Atoi(value)
+			return err
+		},
+	},
+	{
+		name:  "ice-nat-1to1-ips",
+		usage: "comma separated list of public ips advertised instead of the host candidates",
+		set: func(cfg *Config, value string) error {
+			cfg.ICE.NAT1To1IPs = splitList(value)
+			return nil
+		},
+	},
+	{
+		name:  "room-destroy-timeout",
+		usage: "delay before an empty room is destroyed",
+		set: func(cfg *Config, value string) error {
+			return cfg.Room.DestroyTimeout.UnmarshalText([]byte(value))
+		},
+	},
+	{
+		name:  "turn-enabled",
+		usage: "run the embedded turn server",
+		set: func(cfg *Config, value string) (err error) {
+			cfg.Turn.Enabled, err = strconv.ParseBool(value)
+			return err
+		},
+	},
+	{
+		name:  "turn-public-ip",
+		usage: "public ip address advertised by the embedded turn server",
+		set: func(cfg *Config, value string) error {
+			cfg.Turn.PublicIP = value
+			return nil
+		},
+	},
+	{
+		name:  "turn-secret",
+		usage: "shared secret used to sign the embedded turn server credentials",
+		set: func(cfg *Config, value string) error {
+			cfg.Turn.Secret = value
+			return nil
+		},
+	},
+	{
+		name:  "recording-directory",
+		usage: "directory where room recordings are written",
+		set: func(cfg *Config, value string) error {
+			cfg.Recording.Directory = value
+			return nil
+		},
+	},
+	{
+		name:  "capture-directory",
+		usage: "directory where packet captures are written",
+		set: func(cfg *Config, value string) error {
+			cfg.Capture.Directory = value
+			return nil
+		},
+	},
+	{
+		name:  "file-publisher-directory",
+		usage: "directory of the files the file publishers can replay",
+		set: func(cfg *Config, value string) error {
+			cfg.FilePublisher.Directory = value
+			return nil
+		},
+	},
+	{
+		name:  "rtp-ingest-host",
+		usage: "address the rtp ingest sockets bind to",
+		set: func(cfg *Config, value string) error {
+			cfg.RTPIngest.Host = value
+			return nil
+		},
+	},
+	{
+		name:  "rtmp-listen",
+		usage: "address of the rtmp ingest listener, disabled when empty",
+		set: func(cfg *Config, value string) error {
+			cfg.RTMP.Listen = value
+			return nil
+		},
+	},
+	{
+		name:  "rtsp-listen",
+		usage: "address of the rtsp server, disabled when empty",
+		set: func(cfg *Config, value string) error {
+			cfg.RTSP.Listen = value
+			return nil
+		},
+	},
+	{
+		name:  "admin-token",
+		usage: "bearer token of the admin http api, the api is disabled when empty",
+		set: func(cfg *Config, value string) error {
+			cfg.Admin.Token = value
+			return nil
+		},
+	},
+	{
+		name:  "metrics-token",
+		usage: "bearer token required by the /metrics endpoint, open when empty",
+		set: func(cfg *Config, value string) error {
+			cfg.Metrics.Token = value
+			return nil
+		},
+	},
+}
+
+func (setting configSetting) envName() string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(setting.name, "-", "_"))
+}
+
+type configFlag struct {
+	setting configSetting
+	value   string
+}
+
+type ConfigSource struct {
+	Path        string
+	PrintConfig bool
+
+	flags []configFlag
+}
+
+func ParseConfigSource(args []string) (*ConfigSource, error) {
+	source := &ConfigSource{
+		Path:  os.Getenv(configEnvPrefix + "CONFIG"),
+		flags: make([]configFlag, 0),
+	}
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.StringVar(&source.Path, "config", source.Path, "path to a yaml, json or toml config file")
+	fs.BoolVar(&source.PrintConfig, "print-config", false, "print the resolved config and exit")
+	for _, setting := range configSettings {
+		fs.Func(setting.name, fmt.Sprintf("%s (env %s)", setting.usage, setting.envName()), func(value string) error {
+			source.flags = append(source.flags, configFlag{setting: setting, value: value})
+			return nil
+		})
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	return source, nil
+}
+
+func (source *ConfigSource) Load() (*Config, error) {
+	cfg := DefaultConfig()
+
+	if source.Path != "" {
+		if err := loadConfigFile(cfg, source.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, setting := range configSettings {
+		value, ok := os.LookupEnv(setting.envName())
+		if !ok {
+			continue
+		}
+		if err := setting.set(cfg, value); err != nil {
+			return nil, fmt.Errorf("env %s: %w", setting.envName(), err)
+		}
+	}
+
+	for _, f := range source.flags {
+		if err := f.setting.set(cfg, f.value); err != nil {
+			return nil, fmt.Errorf("flag -%s: %w", f.setting.name, err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config, %w", err)
+	}
+
+	return cfg, nil
+}
+
+func loadConfigFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed reading config file, %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	case ".json":
+		err = json.Unmarshal(data, cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("unsupported config file extension %q", filepath.Ext(path))
+	}
+	if err != nil {
+		return fmt.Errorf("failed parsing config file %s, %w", path, err)
+	}
+
+	return nil
+}
+
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var (
+	config      *Config       = DefaultConfig()
+	configMutex *sync.RWMutex = new(sync.RWMutex)
+)
+
+func GetConfig() *Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	return config
+}
+
+func SetConfig(cfg *Config) {
+	configMutex.Lock()
+	config = cfg
+	configMutex.Unlock()
+
+	if level, err := ParseLogLevel(cfg.LogLevel); err == nil {
+		logger.SetLevel(level)
+	}
+}
+
+func ReloadConfig(source *ConfigSource) error {
+	next, err := source.Load()
+	if err != nil {
+		return err
+	}
+
+	SetConfig(GetConfig().applyReloadable(next))
+	logger.Info("config reloaded")
+
+	return nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		valid  bool
+	}{
+		{name: "default", modify: func(cfg *Config) {}, valid: true},
+		{name: "listeners", modify: func(cfg *Config) { cfg.RTMP.Listen, cfg.RTSP.Listen = ":1935", ":8554" }, valid: true},
+		{name: "ice tcp", modify: func(cfg *Config) { cfg.ICE.NetworkTypes, cfg.ICE.TCPPort = []string{"udp4", "tcp4"}, 8443 }, valid: true},
+		{name: "invalid listen", modify: func(cfg *Config) { cfg.Listen = "8888" }},
+		{name: "invalid log level", modify: func(cfg *Config) { cfg.LogLevel = "verbose" }},
+		{name: "invalid ice server", modify: func(cfg *Config) { cfg.ICE.Servers = []ICEServerConfig{{URLs: []string{"turn:turn.example.com"}}} }},
+		{name: "unknown network type", modify: func(cfg *Config) { cfg.ICE.NetworkTypes = []string{"sctp"} }},
+		{name: "ice tcp without port", modify: func(cfg *Config) { cfg.ICE.NetworkTypes = []string{"tcp4"} }},
+		{name: "ice port out of range", modify: func(cfg *Config) { cfg.ICE.UDPPort = 70000 }},
+		{name: "invalid nat ip", modify: func(cfg *Config) { cfg.ICE.NAT1To1IPs = []string{"public"} }},
+		{name: "invalid ip filter", modify: func(cfg *Config) { cfg.ICE.IPFilter = []string{"10.0.0.1"} }},
+		{name: "negative room timeout", modify: func(cfg *Config) { cfg.Room.IdleTimeout = Duration{-time.Second} }},
+		{name: "negative room limit", modify: func(cfg *Config) { cfg.Room.MaxPublishers = -1 }},
+		{name: "negative history size", modify: func(cfg *Config) { cfg.Room.HistorySize = -1 }},
+		{name: "invalid turn", modify: func(cfg *Config) { cfg.Turn.Enabled = true }},
+		{name: "empty recording directory", modify: func(cfg *Config) { cfg.Recording.Directory = "" }},
+		{name: "invalid capture", modify: func(cfg *Config) { cfg.Capture.MaxSize = 0 }},
+		{name: "empty file publisher directory", modify: func(cfg *Config) { cfg.FilePublisher.Directory = "" }},
+		{name: "invalid rtp ingest host", modify: func(cfg *Config) { cfg.RTPIngest.Host = "localhost" }},
+		{name: "invalid rtmp listen", modify: func(cfg *Config) { cfg.RTMP.Listen = "1935" }},
+		{name: "invalid rtsp listen", modify: func(cfg *Config) { cfg.RTSP.Listen = "8554" }},
+		{name: "invalid hls", modify: func(cfg *Config) { cfg.HLS.PlaylistSize = 0 }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			test.modify(cfg)
+			if err := cfg.Validate(); (err == nil) != test.valid {
+				t.Errorf("validated with %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestConfigValidateJoinsErrors(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Listen = "8888"
+	cfg.Recording.Directory = ""
+
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "listen:") || !strings.Contains(err.Error(), "recording:") {
+		t.Errorf("validated with %v, want both errors", err)
+	}
+}
+
+func writeTestConfig(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	files := []struct {
+		name    string
+		content string
+	}{
+		{
+			name:    "config.yaml",
+			content: "listen: 127.0.0.1:9000\nroom:\n  destroy_timeout: 45s\n  max_participants: 8\nice:\n  servers:\n    - urls: [\"stun:stun.example.com\"]\n",
+		},
+		{
+			name:    "config.YML",
+			content: "listen: 127.0.0.1:9000\nroom:\n  destroy_timeout: 45s\n  max_participants: 8\nice:\n  servers:\n    - urls: [\"stun:stun.example.com\"]\n",
+		},
+		{
+			name:    "config.json",
+			content: `{"listen": "127.0.0.1:9000", "room": {"destroy_timeout": "45s", "max_participants": 8}, "ice": {"servers": [{"urls": ["stun:stun.example.com"]}]}}`,
+		},
+		{
+			name:    "config.toml",
+			content: "listen = \"127.0.0.1:9000\"\n[room]\ndestroy_timeout = \"45s\"\nmax_participants = 8\n[[ice.servers]]\nurls = [\"stun:stun.example.com\"]\n",
+		},
+	}
+
+	for _, file := range files {
+		t.Run(file.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			if err := loadConfigFile(cfg, writeTestConfig(t, file.name, file.content)); err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.Listen != "127.0.0.1:9000" || cfg.Room.DestroyTimeout.Duration != 45*time.Second || cfg.Room.MaxParticipants != 8 {
+				t.Errorf("loaded %s, %s, %d", cfg.Listen, cfg.Room.DestroyTimeout, cfg.Room.MaxParticipants)
+			}
+			if len(cfg.ICE.Servers) != 1 || !slices.Equal(cfg.ICE.Servers[0].URLs, []string{"stun:stun.example.com"}) {
+				t.Errorf("loaded ice servers %+v", cfg.ICE.Servers)
+			}
+			// The settings missing from the file keep their defaults.
+			if cfg.Room.HistorySize != DefaultConfig().Room.HistorySize || cfg.Recording.Directory != "recordings" {
+				t.Error("defaults overwritten")
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{name: "unsupported extension", file: "config.ini", content: "listen=:9000"},
+		{name: "no extension", file: "config", content: "listen: :9000"},
+		{name: "invalid yaml", file: "config.yaml", content: "listen: [\n"},
+		{name: "invalid json", file: "config.json", content: `{"listen": `},
+		{name: "invalid toml", file: "config.toml", content: "listen = \n"},
+		{name: "invalid duration", file: "config.yaml", content: "room:\n  destroy_timeout: soon\n"},
+		{name: "duration without unit", file: "config.json", content: `{"room": {"destroy_timeout": "30"}}`},
+		{name: "wrong type", file: "config.json", content: `{"room": {"max_participants": "eight"}}`},
+		{name: "list instead of object", file: "config.yaml", content: "room: [1, 2]\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := loadConfigFile(DefaultConfig(), writeTestConfig(t, test.file, test.content)); err == nil {
+				t.Error("loaded the file, want an error")
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		if err := loadConfigFile(DefaultConfig(), filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+			t.Error("loaded the file, want an error")
+		}
+	})
+}
+
+func TestConfigSourceLoad(t *testing.T) {
+	path := writeTestConfig(t, "config.yaml", "listen: 127.0.0.1:9000\nlog_level: info\nrecording:\n  directory: from-file\n")
+
+	tests := []struct {
+		name      string
+		args      []string
+		env       map[string]string
+		listen    string
+		logLevel  string
+		directory string
+	}{
+		{name: "defaults", listen: "0.0.0.0:8888", logLevel: "debug", directory: "recordings"},
+		{name: "file", args: []string{"-config", path}, listen: "127.0.0.1:9000", logLevel: "info", directory: "from-file"},
+		{name: "config path from env", env: map[string]string{"SPLASH_CONFIG": path}, listen: "127.0.0.1:9000", logLevel: "info", directory: "from-file"},
+		{
+			name:   "env over file",
+			args:   []string{"-config", path},
+			env:    map[string]string{"SPLASH_LISTEN": "127.0.0.1:9001", "SPLASH_RECORDING_DIRECTORY": "from-env"},
+			listen: "127.0.0.1:9001", logLevel: "info", directory: "from-env",
+		},
+		{
+			name:   "flags over env",
+			args:   []string{"-config", path, "-listen", "127.0.0.1:9002", "-log-level", "warn"},
+			env:    map[string]string{"SPLASH_LISTEN": "127.0.0.1:9001"},
+			listen: "127.0.0.1:9002", logLevel: "warn", directory: "from-file",
+		},
+		{
+			name:   "last flag wins",
+			args:   []string{"-listen", "127.0.0.1:9003", "-listen", "127.0.0.1:9004"},
+			listen: "127.0.0.1:9004", logLevel: "debug", directory: "recordings",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			source, err := ParseConfigSource(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := source.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Listen != test.listen || cfg.LogLevel != test.logLevel || cfg.Recording.Directory != test.directory {
+				t.Errorf("loaded %s %s %s, want %s %s %s", cfg.Listen, cfg.LogLevel, cfg.Recording.Directory, test.listen, test.logLevel, test.directory)
+			}
+		})
+	}
+}
+
+func TestConfigSourceSettings(t *testing.T) {
+	source, err := ParseConfigSource([]string{
+		"-ice-servers", "stun:a.example.com, ,stun:b.example.com",
+		"-ice-lite", "true",
+		"-ice-network-types", "udp4,tcp4",
+		"-ice-tcp-port", "8443",
+		"-room-destroy-timeout", "1m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := source.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers := []ICEServerConfig{{URLs: []string{"stun:a.example.com"}}, {URLs: []string{"stun:b.example.com"}}}
+	if !reflect.DeepEqual(cfg.ICE.Servers, servers) {
+		t.Errorf("ice servers %+v", cfg.ICE.Servers)
+	}
+	if !cfg.ICE.Lite || !slices.Equal(cfg.ICE.NetworkTypes, []string{"udp4", "tcp4"}) || cfg.ICE.TCPPort != 8443 {
+		t.Errorf("ice %+v", cfg.ICE)
+	}
+	if cfg.Room.DestroyTimeout.Duration != time.Minute {
+		t.Errorf("destroy timeout %s", cfg.Room.DestroyTimeout)
+	}
+}
+
+func TestConfigSourceErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{name: "invalid flag value", args: []string{"-ice-udp-port", "many"}},
+		{name: "invalid bool flag", args: []string{"-turn-enabled", "maybe"}},
+		{name: "invalid duration flag", args: []string{"-room-destroy-timeout", "30"}},
+		{name: "invalid env value", env: map[string]string{"SPLASH_ICE_LITE": "maybe"}},
+		{name: "missing config file", args: []string{"-config", "/nonexistent/config.yaml"}},
+		{name: "invalid resulting config", args: []string{"-listen", "nowhere"}},
+		{name: "incomplete turn", env: map[string]string{"SPLASH_TURN_ENABLED": "true"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			source, err := ParseConfigSource(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := source.Load(); err == nil {
+				t.Error("loaded the config, want an error")
+			}
+		})
+	}
+
+	t.Run("unknown flag", func(t *testing.T) {
+		if _, err := ParseConfigSource([]string{"-unknown", "value"}); err == nil {
+			t.Error("parsed the flags, want an error")
+		}
+	})
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		value string
+		items []string
+	}{
+		{value: "a,b,c", items: []string{"a", "b", "c"}},
+		{value: " a , b ", items: []string{"a", "b"}},
+		{value: "a,,b,", items: []string{"a", "b"}},
+		{value: "", items: []string{}},
+		{value: " , ", items: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			if items := splitList(test.value); !slices.Equal(items, test.items) {
+				t.Errorf("split %q, want %q", items, test.items)
+			}
+		})
+	}
+}
+
+func TestConfigPrintRedactsSecrets(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ICE.Servers = append(cfg.ICE.Servers,
+		ICEServerConfig{URLs: []string{"turn:a.example.com"}, Username: "user", Credential: "static-credential"},
+		ICEServerConfig{URLs: []string{"turn:b.example.com"}, Secret: "rest-secret", TTL: Duration{time.Hour}},
+	)
+	cfg.Turn.Secret = "turn-secret"
+	cfg.Admin.Token = "admin-token"
+	cfg.Metrics.Token = "metrics-token"
+
+	output := new(bytes.Buffer)
+	if err := cfg.Print(output); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"static-credential", "rest-secret", "turn-secret", "admin-token", "metrics-token"} {
+		if strings.Contains(output.String(), secret) {
+			t.Errorf("printed %s", secret)
+		}
+	}
+	if !strings.Contains(output.String(), "user") || strings.Count(output.String(), redactedSecret) != 5 {
+		t.Errorf("printed\n%s", output.String())
+	}
+
+	// The printed config is a copy, the running one keeps its secrets.
+	if cfg.ICE.Servers[1].Credential != "static-credential" || cfg.Turn.Secret != "turn-secret" {
+		t.Error("the config itself was redacted")
+	}
+}
+
+func TestConfigApplyReloadable(t *testing.T) {
+	current := DefaultConfig()
+	next := DefaultConfig()
+	next.Listen = "127.0.0.1:9000"
+	next.LogLevel = "warn"
+	next.ICE.UDPPort = 3478
+	next.ICE.Servers = []ICEServerConfig{{URLs: []string{"stun:stun.example.com"}}}
+	next.Room.MaxParticipants = 4
+	next.RTMP.Listen = ":1935"
+
+	reloaded := current.applyReloadable(next)
+	if reloaded.Listen != current.Listen || reloaded.ICE.UDPPort != 0 || reloaded.RTMP.Listen != "" {
+		t.Error("settings requiring a restart were applied")
+	}
+	if reloaded.LogLevel != "warn" || reloaded.Room.MaxParticipants != 4 || !reflect.DeepEqual(reloaded.ICE.Servers, next.ICE.Servers) {
+		t.Error("reloadable settings weren't applied")
+	}
+	if current.LogLevel != "debug" {
+		t.Error("the current config was modified")
+	}
+}
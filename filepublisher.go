@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+)
+
+type FilePublisherConfig struct {
+	Directory string `json:"directory" yaml:"directory" toml:"directory"`
+}
+
+type FilePublisherOptions struct {
+	Files []string `json:"files"`
+	Loop  bool     `json:"loop,omitempty"`
+	Start Duration `json:"start,omitempty"`
+}
+
+// FilePublisher joins a room as a synthetic user and publishes ivf and ogg
+// files as a single stream, paced in real time. Video can't restart on
+// keyframe requests, new subscribers wait for the next keyframe of the file.
+type FilePublisher struct {
+	Id       string    `json:"id"`
+	RoomId   string    `json:"room_id"`
+	UserId   string    `json:"user_id"`
+	StreamId string    `json:"stream_id"`
+	Files    []string  `json:"files"`
+	Loop     bool      `json:"loop"`
+	Started  time.Time `json:"started_at"`
+
+	room   *Room
+	user   *User
+	stream *IncomingStream
+	tracks []*fileTrack
+	seeks  chan time.Duration
+	stop   chan struct{}
+	once   *sync.Once
+}
+
+type fileTrack struct {
+	path       string
+	codec      webrtc.RTPCodecParameters
+	track      *StreamTrack
+	packetizer rtp.Packetizer
+	timestamp  uint32
+
+	file   *os.File
+	reader fileFrameReader
+	next   *fileFrame
+}
+
+type fileFrame struct {
+	data []byte
+	at   time.Duration
+}
+
+type fileFrameReader interface {
+	ReadFrame() ([]byte, time.Duration, error)
+}
+
+const (
+	filePublisherMTU = 1200
+
+	// maxIvfFrameSize bounds the frames read from a file, pion's reader
+	// allocates the size of the frame header as is.
+	maxIvfFrameSize    = 16 << 20
+	ivfFrameHeaderSize = 12
+)
+
+var (
+	ivfMimeTypes = map[string]string{
+		"VP80": webrtc.MimeTypeVP8,
+		"VP90": webrtc.MimeTypeVP9,
+		"AV01": webrtc.MimeTypeAV1,
+	}
+
+	filePublishers      map[string]*FilePublisher = make(map[string]*FilePublisher)
+	filePublishersMutex *sync.Mutex               = new(sync.Mutex)
+
+	ErrFilePublisherNotFound = errors.New("the file publisher does not exist")
+)
+
+func StartFilePublisher(room *Room, opts FilePublisherOptions) (*FilePublisher, error) {
+	if len(opts.Files) == 0 {
+		return nil, errors.New("at least one file is required")
+	}
+	if opts.Start.Duration < 0 {
+		return nil, errors.New("start must not be negative")
+	}
+
+	publisher := &FilePublisher{
+		Id:      uuid.NewString(),
+		RoomId:  room.Id,
+		Files:   opts.Files,
+		Loop:    opts.Loop,
+		Started: time.Now(),
+
+		room:  room,
+		seeks: make(chan time.Duration),
+		stop:  make(chan struct{}),
+		once:  new(sync.Once),
+	}
+
+	directory := GetConfig().FilePublisher.Directory
+	for _, name := range opts.Files {
+		// Cleaning a rooted path keeps the file inside the directory.
+		path := filepath.Join(directory, filepath.Clean("/"+name))
+		track, err := probeFileTrack(room, path)
+		if err != nil {
+			return nil, fmt.Errorf("file %s, %w", name, err)
+		}
+		publisher.tracks = append(publisher.tracks, track)
+	}
+
+	user, err := JoinSyntheticUser(room, RoleParticipant)
+	if err != nil {
+		return nil, err
+	}
+	publisher.user = user
+	publisher.UserId = user.Id
+
+	stream := newIncomingStream(user)
+	for i, track := range publisher.tracks {
+		id := fmt.Sprintf("%s-%d", sanitizeFileName(filepath.Base(track.path)), i)
+		streamTrack, err := stream.addTrack(id, track.codec, nil)
+		if err != nil {
+			publisher.leave("file publisher failed starting")
+			return nil, err
+		}
+		track.track = streamTrack
+	}
+	if err := room.AddInStream(stream); err != nil {
+		publisher.leave("file publisher failed starting")
+		return nil, err
+	}
+	publisher.stream = stream
+	publisher.StreamId = stream.Id
+
+	filePublishersMutex.Lock()
+	filePublishers[publisher.Id] = publisher
+	filePublishersMutex.Unlock()
+
+	logger.Info(fmt.Sprintf("file publisher %s started in room %s with %s", publisher.Id, room.Id, strings.Join(opts.Files, ", ")))
+	go publisher.run(opts.Start.Duration)
+
+	return publisher, nil
+}
+
+func GetFilePublisher(id string) *FilePublisher {
+	filePublishersMutex.Lock()
+	defer filePublishersMutex.Unlock()
+
+	return filePublishers[id]
+}
+
+func GetFilePublishers() []*FilePublisher {
+	filePublishersMutex.Lock()
+	defer filePublishersMutex.Unlock()
+
+	return slices.Collect(maps.Values(filePublishers))
+}
+
+// Seek restarts every file from position, video resumes at the first
+// keyframe after it.
+func (p *FilePublisher) Seek(position time.Duration) error {
+	if position < 0 {
+		return errors.New("position must not be negative")
+	}
+
+	select {
+	case p.seeks <- position:
+		return nil
+	case <-p.stop:
+		return ErrFilePublisherNotFound
+	}
+}
+
+func (p *FilePublisher) Stop() {
+	p.once.Do(func() {
+		close(p.stop)
+	})
+}
+
+func (p *FilePublisher) run(position time.Duration) {
+	defer p.finish()
+
+	for {
+		seek, ended := p.play(position)
+		switch {
+		case seek >= 0:
+			position = seek
+		case ended && p.Loop:
+			position = 0
+		default:
+			return
+		}
+	}
+}
+
+// play sends the files from position until they all end, it returns the
+// requested seek position or -1, and whether the files ended after sending
+// at least one frame.
+func (p *FilePublisher) play(position time.Duration) (time.Duration, bool) {
+	for _, track := range p.tracks {
+		if err := track.open(position); err != nil {
+			logger.Warn(fmt.Sprintf("file publisher %s failed opening %s, %s", p.Id, track.path, err.Error()))
+			return -1, false
+		}
+	}
+	defer func() {
+		for _, track := range p.tracks {
+			track.close()
+		}
+	}()
+
+	base := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	sent := false
+	for {
+		var next *fileTrack
+		for _, track := range p.tracks {
+			if track.next != nil && (next == nil || track.next.at < next.next.at) {
+				next = track
+			}
+		}
+		if next == nil {
+			return -1, sent
+		}
+
+		due := base.Add(next.next.at - position)
+		timer.Reset(time.Until(due))
+		select {
+		case <-timer.C:
+		case seek := <-p.seeks:
+			return seek, false
+		case <-p.stop:
+			return -1, false
+		case <-p.stream.Done():
+			return -1, false
+		}
+
+		next.send(p.stream, due.Sub(p.Started))
+		sent = true
+		if err := next.advance(); err != nil {
+			logger.Warn(fmt.Sprintf("file publisher %s failed reading %s, %s", p.Id, next.path, err.Error()))
+		}
+	}
+}
+
+func (p *FilePublisher) finish() {
+	p.Stop()
+
+	filePublishersMutex.Lock()
+	delete(filePublishers, p.Id)
+	filePublishersMutex.Unlock()
+
+	p.leave("file publisher stopped")
+	logger.Info(fmt.Sprintf("file publisher %s stopped", p.Id))
+}
+
+func (p *FilePublisher) leave(cause string) {
+	LeaveSyntheticUser(p.room, p.user, cause)
+}
+
+func probeFileTrack(room *Room, path string) (*fileTrack, error) {
+	track := &fileTrack{
+		path:      path,
+		timestamp: rand.Uint32(),
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var kind webrtc.RTPCodecType
+	var mimeType string
+	var payloader rtp.Payloader
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ivf":
+		reader, err := newIvfFileReader(file)
+		if err != nil {
+			return nil, err
+		}
+		kind, mimeType = webrtc.RTPCodecTypeVideo, reader.MimeType
+		switch mimeType {
+		case webrtc.MimeTypeVP8:
+			payloader = &codecs.VP8Payloader{EnablePictureID: true}
+		case webrtc.MimeTypeVP9:
+			payloader = &codecs.VP9Payloader{}
+		case webrtc.MimeTypeAV1:
+			payloader = &codecs.AV1Payloader{}
+		}
+	case ".ogg", ".opus":
+		if _, err := newOggOpusReader(file); err != nil {
+			return nil, err
+		}
+		kind, mimeType = webrtc.RTPCodecTypeAudio, webrtc.MimeTypeOpus
+		payloader = &codecs.OpusPayloader{}
+	default:
+		return nil, errors.New("only ivf and ogg files can be published")
+	}
+
+	track.codec, err = room.findCodec(kind, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	track.packetizer = rtp.NewPacketizer(filePublisherMTU, uint8(track.codec.PayloadType), rand.Uint32(), payloader, rtp.NewRandomSequencer(), track.codec.ClockRate)
+
+	return track, nil
+}
+
+// findCodec returns the first codec of the room media engine with the mime
+// type, with the payload type the subscribers of the room negotiate.
+func (room *Room) findCodec(kind webrtc.RTPCodecType, mimeType string) (webrtc.RTPCodecParameters, error) {
+	// An empty registry keeps the api from registering the default
+	// interceptors on the media engine of the room.
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(room.mediaEngine),
+		webrtc.WithSettingEngine(settingEngine),
+		webrtc.WithInterceptorRegistry(new(interceptor.Registry)),
+	)
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return webrtc.RTPCodecParameters{}, err
+	}
+	defer pc.Close()
+
+	// Adding the transceiver fails when the room has no codec of the kind.
+	transceiver, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	if err == nil {
+		for _, codec := range transceiver.Sender().GetParameters().Codecs {
+			if strings.EqualFold(codec.MimeType, mimeType) {
+				return codec, nil
+			}
+		}
+	}
+
+	return webrtc.RTPCodecParameters{}, fmt.Errorf("the room doesn't support the %s codec", mimeType)
+}
+
+// open reads the file from its start and skips the frames before position,
+// for video up to the next keyframe.
+func (t *fileTrack) open(position time.Duration) error {
+	file, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+
+	var reader fileFrameReader
+	if t.codec.MimeType == webrtc.MimeTypeOpus {
+		reader, err = newOggOpusReader(file)
+	} else {
+		reader, err = newIvfFileReader(file)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	t.file, t.reader, t.next = file, reader, nil
+
+	video := t.codec.MimeType != webrtc.MimeTypeOpus
+	for {
+		if err := t.advance(); err != nil || t.next == nil {
+			return err
+		}
+		if t.next.at < position {
+			continue
+		}
+		if video && !isVideoKeyframe(t.codec.MimeType, t.next.data) {
+			continue
+		}
+		return nil
+	}
+}
+
+func (t *fileTrack) advance() error {
+	data, at, err := t.reader.ReadFrame()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		t.next = nil
+		return nil
+	}
+	if err != nil {
+		t.next = nil
+		return err
+	}
+
+	t.next = &fileFrame{data: data, at: at}
+	return nil
+}
+
+// send packetizes the pending frame, elapsed is its schedule since the
+// publisher started and gives a continuous rtp timestamp across loops and
+// seeks.
+func (t *fileTrack) send(stream *IncomingStream, elapsed time.Duration) {
+	timestamp := t.timestamp + uint32(uint64(elapsed/time.Microsecond)*uint64(t.codec.ClockRate)/1000000)
+
+	for _, packet := range t.packetizer.Packetize(t.next.data, 0) {
+		packet.Timestamp = timestamp
+		stream.forwardRTP(t.track, packet)
+	}
+}
+
+func (t *fileTrack) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	t.next = nil
+}
+
+// ivfFileReader reads the frames of an ivf file with pion's reader, it peeks
+// the frame headers to bound the frame sizes and to time the frames with
+// the time base of the file.
+type ivfFileReader struct {
+	in       *bufio.Reader
+	reader   *ivfreader.IVFReader
+	MimeType string
+
+	// The time of a frame is pts * numerator / denominator seconds.
+	denominator uint32
+	numerator   uint32
+}
+
+func newIvfFileReader(file io.Reader) (*ivfFileReader, error) {
+	in := bufio.NewReader(file)
+	reader, header, err := ivfreader.NewWith(in)
+	if err != nil {
+		return nil, err
+	}
+	if header.TimebaseNumerator == 0 {
+		return nil, errors.New("invalid ivf time base")
+	}
+	mimeType, ok := ivfMimeTypes[header.FourCC]
+	if !ok {
+		return nil, fmt.Errorf("unsupported ivf codec %q", header.FourCC)
+	}
+
+	return &ivfFileReader{
+		in:          in,
+		reader:      reader,
+		MimeType:    mimeType,
+		denominator: header.TimebaseDenominator,
+		numerator:   header.TimebaseNumerator,
+	}, nil
+}
+
+// ReadFrame returns the next frame and its time from the start of the file.
+func (r *ivfFileReader) ReadFrame() ([]byte, time.Duration, error) {
+	header, err := r.in.Peek(ivfFrameHeaderSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	if size := binary.LittleEndian.Uint32(header[0:4]); size > maxIvfFrameSize {
+		return nil, 0, fmt.Errorf("ivf frame of %d bytes is too large", size)
+	}
+	pts := binary.LittleEndian.Uint64(header[4:12])
+
+	frame, _, err := r.reader.ParseNextFrame()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	at := time.Duration(pts) * time.Duration(r.numerator) * time.Second / time.Duration(r.denominator)
+	return frame, at, nil
+}
+
+func httpHandleFilePublisherStart(w http.ResponseWriter, r *http.Request) {
+	room := GetRoom(r.PathValue("id"))
+	if room == nil {
+		writeJsonError(w, http.StatusNotFound, "file_publisher_failure", "the room does not exist")
+		return
+	}
+
+	opts := FilePublisherOptions{}
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "file_publisher_failure", err.Error())
+		return
+	}
+
+	publisher, err := StartFilePublisher(room, opts)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "file_publisher_failure", err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusCreated, publisher)
+}
+
+func httpHandleFilePublishersList(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, GetFilePublishers())
+}
+
+func httpHandleFilePublisherSeek(w http.ResponseWriter, r *http.Request) {
+	publisher := GetFilePublisher(r.PathValue("id"))
+	if publisher == nil {
+		writeJsonError(w, http.StatusNotFound, "file_publisher_failure", ErrFilePublisherNotFound.Error())
+		return
+	}
+
+	request := struct {
+		Position Duration `json:"position"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "file_publisher_failure", err.Error())
+		return
+	}
+
+	if err := publisher.Seek(request.Position.Duration); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "file_publisher_failure", err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusOK, publisher)
+}
+
+func httpHandleFilePublisherStop(w http.ResponseWriter, r *http.Request) {
+	publisher := GetFilePublisher(r.PathValue("id"))
+	if publisher == nil {
+		writeJsonError(w, http.StatusNotFound, "file_publisher_failure", ErrFilePublisherNotFound.Error())
+		return
+	}
+
+	publisher.Stop()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+)
+
+func ivfTestHeader(fourCC string, denominator, numerator uint32) []byte {
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:8], 32)
+	copy(header[8:12], fourCC)
+	binary.LittleEndian.PutUint32(header[16:20], denominator)
+	binary.LittleEndian.PutUint32(header[20:24], numerator)
+	return header
+}
+
+func ivfTestFrame(pts uint64, size uint32, data []byte) []byte {
+	frame := binary.LittleEndian.AppendUint32(nil, size)
+	frame = binary.LittleEndian.AppendUint64(frame, pts)
+	return append(frame, data...)
+}
+
+func TestIvfFileReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		mimeType string
+		frames   [][]byte
+		times    []time.Duration
+		fails    bool
+	}{
+		{
+			name:     "millisecond time base",
+			data:     slices.Concat(ivfTestHeader("VP80", 1000, 1), ivfTestFrame(0, 2, []byte{1, 2}), ivfTestFrame(40, 1, []byte{3})),
+			mimeType: webrtc.MimeTypeVP8,
+			frames:   [][]byte{{1, 2}, {3}},
+			times:    []time.Duration{0, 40 * time.Millisecond},
+		},
+		{
+			name:     "frame rate time base",
+			data:     slices.Concat(ivfTestHeader("AV01", 30, 1), ivfTestFrame(0, 1, []byte{1}), ivfTestFrame(3, 1, []byte{2})),
+			mimeType: webrtc.MimeTypeAV1,
+			frames:   [][]byte{{1}, {2}},
+			times:    []time.Duration{0, 100 * time.Millisecond},
+		},
+		{
+			name:     "truncated frame header",
+			data:     slices.Concat(ivfTestHeader("VP90", 1000, 1), ivfTestFrame(0, 1, []byte{1}), []byte{1, 0, 0}),
+			mimeType: webrtc.MimeTypeVP9,
+			frames:   [][]byte{{1}},
+			times:    []time.Duration{0},
+		},
+		{
+			name:     "truncated frame",
+			data:     slices.Concat(ivfTestHeader("VP80", 1000, 1), ivfTestFrame(0, 10, []byte{1, 2})),
+			mimeType: webrtc.MimeTypeVP8,
+			fails:    true,
+		},
+		{
+			name:     "frame too large",
+			data:     slices.Concat(ivfTestHeader("VP80", 1000, 1), ivfTestFrame(0, maxIvfFrameSize+1, nil)),
+			mimeType: webrtc.MimeTypeVP8,
+			fails:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := newIvfFileReader(bytes.NewReader(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reader.MimeType != test.mimeType {
+				t.Errorf("mime type %s, want %s", reader.MimeType, test.mimeType)
+			}
+
+			frames := make([][]byte, 0)
+			times := make([]time.Duration, 0)
+			for {
+				frame, at, err := reader.ReadFrame()
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+				if err != nil {
+					if !test.fails {
+						t.Fatal(err)
+					}
+					return
+				}
+				frames = append(frames, frame)
+				times = append(times, at)
+			}
+			if test.fails {
+				t.Fatal("read every frame, want an error")
+			}
+			if len(frames) != len(test.frames) || !slices.Equal(times, test.times) {
+				t.Fatalf("read %x at %v, want %x at %v", frames, times, test.frames, test.times)
+			}
+			for i := range frames {
+				if !bytes.Equal(frames[i], test.frames[i]) {
+					t.Errorf("frame %d is %x, want %x", i, frames[i], test.frames[i])
+				}
+			}
+		})
+	}
+}
+
+func TestIvfFileReaderMalformedHeader(t *testing.T) {
+	badSignature := ivfTestHeader("VP80", 1000, 1)
+	copy(badSignature, "RIFF")
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "truncated header", data: ivfTestHeader("VP80", 1000, 1)[:20]},
+		{name: "invalid signature", data: badSignature},
+		{name: "unsupported codec", data: ivfTestHeader("H264", 1000, 1)},
+		{name: "zero denominator", data: ivfTestHeader("VP80", 0, 1)},
+		{name: "zero numerator", data: ivfTestHeader("VP80", 1000, 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newIvfFileReader(bytes.NewReader(test.data)); err == nil {
+				t.Error("read the header, want an error")
+			}
+		})
+	}
+}
+
+func TestIvfFileReaderReadsIvfWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.ivf")
+	writer, err := ivfwriter.New(path, ivfwriter.WithCodec(webrtc.MimeTypeVP8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keyframes with the start of partition bit set, a frame every 100 ms.
+	for i := range 3 {
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Marker: true, SequenceNumber: uint16(i), Timestamp: uint32(i * 9000)},
+			Payload: []byte{0x10, byte(i) << 1, 0x9d, 0x01, 0x2a},
+		}
+		if err := writer.WriteRTP(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	reader, err := newIvfFileReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		frame, at, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame) != 4 || at != time.Duration(i)*100*time.Millisecond {
+			t.Errorf("frame %d of %d bytes at %s", i, len(frame), at)
+		}
+	}
+}
+
+func TestRoomFindCodec(t *testing.T) {
+	tests := []struct {
+		name        string
+		videoCodec  string
+		kind        webrtc.RTPCodecType
+		mimeType    string
+		payloadType webrtc.PayloadType
+		fails       bool
+	}{
+		{name: "vp8", kind: webrtc.RTPCodecTypeVideo, mimeType: webrtc.MimeTypeVP8, payloadType: 96},
+		{name: "vp9 profile 0", kind: webrtc.RTPCodecTypeVideo, mimeType: webrtc.MimeTypeVP9, payloadType: 98},
+		{name: "opus", kind: webrtc.RTPCodecTypeAudio, mimeType: webrtc.MimeTypeOpus, payloadType: 111},
+		{name: "av1 in an av1 room", videoCodec: "av1", kind: webrtc.RTPCodecTypeVideo, mimeType: webrtc.MimeTypeAV1, payloadType: 45},
+		{name: "vp8 in an av1 room", videoCodec: "av1", kind: webrtc.RTPCodecTypeVideo, mimeType: webrtc.MimeTypeVP8, fails: true},
+		{name: "opus in an av1 room", videoCodec: "av1", kind: webrtc.RTPCodecTypeAudio, mimeType: webrtc.MimeTypeOpus, fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			room, err := NewRoom(&NewRoomOptions{VideoCodec: test.videoCodec})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer room.Destroy()
+
+			codec, err := room.findCodec(test.kind, test.mimeType)
+			if test.fails {
+				if err == nil {
+					t.Errorf("found %+v, want an error", codec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codec.PayloadType != test.payloadType {
+				t.Errorf("payload type %d, want %d", codec.PayloadType, test.payloadType)
+			}
+		})
+	}
+}
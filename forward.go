@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+type ForwardConfig struct {
+	// AllowedNetworks restricts the destinations moderators can forward to,
+	// the admin api isn't restricted.
+	AllowedNetworks []string `json:"allowed_networks" yaml:"allowed_networks" toml:"allowed_networks"`
+}
+
+func (cfg ForwardConfig) Validate() error {
+	for _, network := range cfg.AllowedNetworks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg ForwardConfig) Allows(ip net.IP) bool {
+	for _, network := range cfg.AllowedNetworks {
+		if _, ipNet, err := net.ParseCIDR(network); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type ForwardOptions struct {
+	StreamId string `json:"stream_id"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	RTCP     bool   `json:"rtcp,omitempty"`
+}
+
+// Forward sends the rtp of a stream to a udp destination, the tracks use
+// consecutive even ports from Port with their rtcp on the next odd port.
+type Forward struct {
+	Id        string          `json:"id"`
+	RoomId    string          `json:"room_id"`
+	StreamId  string          `json:"stream_id"`
+	Host      string          `json:"host"`
+	Port      int             `json:"port"`
+	RTCP      bool            `json:"rtcp"`
+	StartedBy string          `json:"started_by,omitempty"`
+	StartedAt time.Time       `json:"started_at"`
+	Tracks    []*ForwardTrack `json:"tracks"`
+
+	stream  *IncomingStream
+	ip      net.IP
+	stopped bool
+	done    chan struct{}
+	mutex   *sync.Mutex
+}
+
+type ForwardTrack struct {
+	Id       string `json:"id"`
+	MimeType string `json:"mime_type"`
+	Port     int    `json:"port"`
+	SSRC     uint32 `json:"ssrc"`
+
+	track   *StreamTrack
+	rtp     *net.UDPConn
+	rtcp    *net.UDPConn
+	packets uint32
+	octets  uint32
+
+	lastTimestamp uint32
+	lastPacketAt  time.Time
+}
+
+const (
+	forwardReportInterval = time.Second
+	forwardReadBackoff    = 500 * time.Millisecond
+)
+
+var (
+	forwards      map[string]*Forward = make(map[string]*Forward)
+	forwardsMutex *sync.Mutex         = new(sync.Mutex)
+
+	ErrForwardNotFound = errors.New("the forward does not exist")
+)
+
+// ForwardStream lets moderators forward a stream of their room to one of the
+// allowed networks.
+func (room *Room) ForwardStream(actor *User, opts ForwardOptions) (*Forward, error) {
+	if !room.RoleOf(actor).CanModerate() {
+		return nil, ErrNotAllowed
+	}
+	if ip := net.ParseIP(opts.Host); ip != nil && !GetConfig().Forward.Allows(ip) {
+		return nil, fmt.Errorf("forwarding to %s is not allowed", opts.Host)
+	}
+
+	return StartForward(room, opts, actor.Id)
+}
+
+func (room *Room) StopForward(actor *User, forwardId string) error {
+	if !room.RoleOf(actor).CanModerate() {
+		return ErrNotAllowed
+	}
+
+	forward := GetForward(forwardId)
+	if forward == nil || forward.RoomId != room.Id {
+		return ErrForwardNotFound
+	}
+
+	forward.Stop()
+	return nil
+}
+
+// StartForward is used by the admin api with an empty startedBy.
+func StartForward(room *Room, opts ForwardOptions, startedBy string) (*Forward, error) {
+	ip := net.ParseIP(opts.Host)
+	if ip == nil {
+		return nil, fmt.Errorf("host %q is not an ip address", opts.Host)
+	}
+	if opts.Port <= 0 || opts.Port > 65534 || opts.Port%2 != 0 {
+		return nil, errors.New("port must be an even port number")
+	}
+
+	stream := room.GetInStream(opts.StreamId)
+	if stream == nil {
+		return nil, ErrStreamNotInRoom
+	}
+
+	forward := &Forward{
+		Id:        uuid.NewString(),
+		RoomId:    room.Id,
+		StreamId:  stream.Id,
+		Host:      ip.String(),
+		Port:      opts.Port,
+		RTCP:      opts.RTCP,
+		StartedBy: startedBy,
+		StartedAt: time.Now(),
+		Tracks:    make([]*ForwardTrack, 0),
+
+		stream: stream,
+		ip:     ip,
+		done:   make(chan struct{}),
+		mutex:  new(sync.Mutex),
+	}
+
+	forward.mutex.Lock()
+	for _, track := range stream.GetTracks() {
+		forward.trackFor(track)
+	}
+	forward.mutex.Unlock()
+
+	forwardsMutex.Lock()
+	forwards[forward.Id] = forward
+	forwardsMutex.Unlock()
+
+	if !stream.AddSink(forward) {
+		forward.Close()
+		return nil, ErrStreamNotInRoom
+	}
+	if forward.RTCP {
+		go forward.sendReports()
+	}
+	stream.RequestKeyframe()
+
+	logger.Info(fmt.Sprintf("forward %s of stream %s started to %s", forward.Id, stream.Id, net.JoinHostPort(forward.Host, fmt.Sprint(forward.Port))))
+
+	return forward, nil
+}
+
+func GetForward(id string) *Forward {
+	forwardsMutex.Lock()
+	defer forwardsMutex.Unlock()
+
+	return forwards[id]
+}
+
+func GetForwards() []*Forward {
+	forwardsMutex.Lock()
+	defer forwardsMutex.Unlock()
+
+	return slices.Collect(maps.Values(forwards))
+}
+
+func (f *Forward) MarshalJSON() ([]byte, error) {
+	type forward Forward
+
+	sdp := f.SDP()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return json.Marshal(struct {
+		*forward
+		SDP string `json:"sdp"`
+	}{(*forward)(f), sdp})
+}
+
+func (f *Forward) GetTracks() []*ForwardTrack {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return slices.Clone(f.Tracks)
+}
+
+func (f *Forward) Stop() {
+	f.stream.RemoveSink(f)
+}
+
+// WriteRTP sends the packet with the ssrc announced in the sdp, tracks added
+// to the stream after the forward started get the next ports.
+func (f *Forward) WriteRTP(track *StreamTrack, packet *rtp.Packet) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.stopped {
+		return
+	}
+
+	forwardTrack := f.trackFor(track)
+	if forwardTrack == nil {
+		return
+	}
+
+	header := packet.Header
+	header.SSRC = forwardTrack.SSRC
+	payload, err := (&rtp.Packet{Header: header, Payload: packet.Payload}).Marshal()
+	if err != nil {
+		return
+	}
+	if _, err := forwardTrack.rtp.Write(payload); err != nil {
+		logger.Trace(fmt.Sprintf("forward %s failed sending rtp, %s", f.Id, err.Error()))
+		return
+	}
+
+	forwardTrack.packets++
+	forwardTrack.octets += uint32(len(packet.Payload))
+	forwardTrack.lastTimestamp = packet.Timestamp
+	forwardTrack.lastPacketAt = time.Now()
+}
+
+func (f *Forward) trackFor(track *StreamTrack) *ForwardTrack {
+	for _, forwardTrack := range f.Tracks {
+		if forwardTrack.track == track {
+			return forwardTrack
+		}
+	}
+
+	port := f.Port + 2*len(f.Tracks)
+	if port > 65534 {
+		return nil
+	}
+
+	forwardTrack := &ForwardTrack{
+		Id:       track.Id,
+		MimeType: track.MimeType,
+		Port:     port,
+		SSRC:     rand.Uint32(),
+		track:    track,
+	}
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: f.ip, Port: port})
+	if err != nil {
+		logger.Warn(fmt.Sprintf("forward %s failed opening port %d, %s", f.Id, port, err.Error()))
+		return nil
+	}
+	forwardTrack.rtp = conn
+
+	if f.RTCP {
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: f.ip, Port: port + 1})
+		if err != nil {
+			logger.Warn(fmt.Sprintf("forward %s failed opening port %d, %s", f.Id, port+1, err.Error()))
+		} else {
+			forwardTrack.rtcp = conn
+			go f.readReports(conn)
+		}
+	}
+
+	f.Tracks = append(f.Tracks, forwardTrack)
+	return forwardTrack
+}
+
+// Close is called once the stream is torn down or the forward removed.
+func (f *Forward) Close() {
+	f.mutex.Lock()
+	if f.stopped {
+		f.mutex.Unlock()
+		return
+	}
+	f.stopped = true
+	close(f.done)
+	for _, track := range f.Tracks {
+		track.rtp.Close()
+		if track.rtcp != nil {
+			track.rtcp.Close()
+		}
+	}
+	f.mutex.Unlock()
+
+	forwardsMutex.Lock()
+	delete(forwards, f.Id)
+	forwardsMutex.Unlock()
+
+	logger.Info(fmt.Sprintf("forward %s of stream %s stopped", f.Id, f.StreamId))
+}
+
+// SDP describes the forwarded tracks for the receiving side.
+func (f *Forward) SDP() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	addrType := "IP4"
+	if f.ip.To4() == nil {
+		addrType = "IP6"
+	}
+
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=- 0 0 IN %s %s", addrType, f.Host),
+		fmt.Sprintf("s=SplashRTC stream %s", f.StreamId),
+		fmt.Sprintf("c=IN %s %s", addrType, f.Host),
+		"t=0 0",
+	}
+	for _, track := range f.Tracks {
+		lines = append(lines, sdpMediaLines(track.track.Codec, track.Port)...)
+		if f.RTCP {
+			lines = append(lines, fmt.Sprintf("a=rtcp:%d", track.Port+1))
+		}
+		lines = append(lines, fmt.Sprintf("a=ssrc:%d cname:%s", track.SSRC, f.StreamId), "a=sendonly")
+	}
+
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// sdpMediaLines describes a codec sent over plain rtp, as the receiving side
+// of a forward or an rtsp client expects it.
+func sdpMediaLines(codec webrtc.RTPCodecParameters, port int) []string {
+	kind, encoding, _ := strings.Cut(codec.MimeType, "/")
+
+	rtpmap := fmt.Sprintf("%s/%d", encoding, codec.ClockRate)
+	if codec.Channels > 0 {
+		rtpmap += fmt.Sprintf("/%d", codec.Channels)
+	}
+
+	lines := []string{
+		fmt.Sprintf("m=%s %d RTP/AVP %d", kind, port, codec.PayloadType),
+		fmt.Sprintf("a=rtpmap:%d %s", codec.PayloadType, rtpmap),
+	}
+	if codec.SDPFmtpLine != "" {
+		lines = append(lines, fmt.Sprintf("a=fmtp:%d %s", codec.PayloadType, codec.SDPFmtpLine))
+	}
+	return lines
+}
+
+// sendReports sends sender reports so receivers can synchronize the tracks.
+func (f *Forward) sendReports() {
+	ticker := time.NewTicker(forwardReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case now := <-ticker.C:
+			f.mutex.Lock()
+			for _, track := range f.Tracks {
+				if track.rtcp == nil || track.packets == 0 {
+					continue
+				}
+				elapsed := now.Sub(track.lastPacketAt)
+				report := &rtcp.SenderReport{
+					SSRC:        track.SSRC,
+					NTPTime:     ntpTime(now),
+					RTPTime:     track.lastTimestamp + uint32(elapsed.Seconds()*float64(track.track.Codec.ClockRate)),
+					PacketCount: track.packets,
+					OctetCount:  track.octets,
+				}
+				if payload, err := report.Marshal(); err == nil {
+					if _, err := track.rtcp.Write(payload); err != nil {
+						logger.Trace(fmt.Sprintf("forward %s failed sending rtcp, %s", f.Id, err.Error()))
+					}
+				}
+			}
+			f.mutex.Unlock()
+		}
+	}
+}
+
+// readReports forwards the keyframe requests of the receiver to the stream.
+func (f *Forward) readReports(conn *net.UDPConn) {
+	buffer := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			// The destination not listening yet is reported as an error on
+			// every packet sent, so the reads back off until it listens.
+			select {
+			case <-f.done:
+				return
+			case <-time.After(forwardReadBackoff):
+				continue
+			}
+		}
+
+		packets, err := rtcp.Unmarshal(buffer[:n])
+		if err != nil {
+			continue
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				f.stream.RequestKeyframe()
+			}
+		}
+	}
+}
+
+// ntpTime converts a time to the 64 bits ntp format of sender reports.
+func ntpTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + 2208988800)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+func httpHandleForwardStart(w http.ResponseWriter, r *http.Request) {
+	room := GetRoom(r.PathValue("id"))
+	if room == nil {
+		writeJsonError(w, http.StatusNotFound, "forward_stream_failure", "the room does not exist")
+		return
+	}
+
+	opts := ForwardOptions{}
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "forward_stream_failure", err.Error())
+		return
+	}
+
+	forward, err := StartForward(room, opts, "")
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "forward_stream_failure", err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusCreated, forward)
+}
+
+func httpHandleForwardsList(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, GetForwards())
+}
+
+func httpHandleForwardSdp(w http.ResponseWriter, r *http.Request) {
+	forward := GetForward(r.PathValue("id"))
+	if forward == nil {
+		writeJsonError(w, http.StatusNotFound, "forward_stream_failure", ErrForwardNotFound.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", sdpContentType)
+	if _, err := io.WriteString(w, forward.SDP()); err != nil {
+		logger.Debug(fmt.Sprintf("failed writing forward sdp, %s", err.Error()))
+	}
+}
+
+func httpHandleForwardStop(w http.ResponseWriter, r *http.Request) {
+	forward := GetForward(r.PathValue("id"))
+	if forward == nil {
+		writeJsonError(w, http.StatusNotFound, "stop_forward_failure", ErrForwardNotFound.Error())
+		return
+	}
+
+	forward.Stop()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+)
+
+const (
+	h264NaluIDR = 5
+	h264NaluSPS = 7
+	h264NaluPPS = 8
+	h264NaluAUD = 9
+)
+
+// h264BitReader reads the exp-golomb coded fields of a parameter set with the
+// emulation prevention bytes removed.
+type h264BitReader struct {
+	data []byte
+	bit  int
+}
+
+func (r *h264BitReader) readBit() (uint32, error) {
+	if r.bit >= len(r.data)*8 {
+		return 0, errors.New("parameter set truncated")
+	}
+	value := uint32(r.data[r.bit/8]>>(7-r.bit%8)) & 0x01
+	r.bit++
+	return value, nil
+}
+
+func (r *h264BitReader) readBits(count int) (uint32, error) {
+	value := uint32(0)
+	for range count {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<1 | bit
+	}
+	return value, nil
+}
+
+func (r *h264BitReader) readUE() (uint32, error) {
+	zeros := 0
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("invalid exp-golomb code")
+		}
+	}
+	value, err := r.readBits(zeros)
+	return (1<<zeros - 1) + value, err
+}
+
+func (r *h264BitReader) readSE() (int32, error) {
+	value, err := r.readUE()
+	if value%2 == 0 {
+		return -int32(value / 2), err
+	}
+	return int32(value/2) + 1, err
+}
+
+// h264PictureSize reads the cropped picture size of a sequence parameter set.
+func h264PictureSize(sps []byte) (uint16, uint16, error) {
+	rbsp := make([]byte, 0, len(sps))
+	for i := 1; i < len(sps); i++ {
+		if i >= 3 && sps[i] == 3 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+	if len(rbsp) < 3 {
+		return 0, 0, errors.New("parameter set truncated")
+	}
+
+	r := &h264BitReader{data: rbsp, bit: 24}
+	profile := rbsp[0]
+	if _, err := r.readUE(); err != nil {
+		return 0, 0, err
+	}
+
+	chromaFormat := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		var err error
+		if chromaFormat, err = r.readUE(); err != nil {
+			return 0, 0, err
+		}
+		if chromaFormat == 3 {
+			r.readBit()
+		}
+		r.readUE()
+		r.readUE()
+		r.readBit()
+		scalingMatrix, err := r.readBit()
+		if err != nil {
+			return 0, 0, err
+		}
+		if scalingMatrix == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := range lists {
+				present, err := r.readBit()
+				if err != nil {
+					return 0, 0, err
+				}
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for range size {
+					if next != 0 {
+						delta, err := r.readSE()
+						if err != nil {
+							return 0, 0, err
+						}
+						next = (last + delta + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.readUE()
+	pocType, err := r.readUE()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch pocType {
+	case 0:
+		r.readUE()
+	case 1:
+		r.readBit()
+		r.readSE()
+		r.readSE()
+		cycle, err := r.readUE()
+		if err != nil {
+			return 0, 0, err
+		}
+		if cycle > 255 {
+			return 0, 0, errors.New("invalid pic order count cycle")
+		}
+		for range cycle {
+			if _, err := r.readSE(); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	r.readUE()
+	r.readBit()
+
+	widthInMbs, _ := r.readUE()
+	heightInMapUnits, _ := r.readUE()
+	frameMbsOnly, err := r.readBit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMbsOnly == 0 {
+		r.readBit()
+	}
+	r.readBit()
+
+	width := (widthInMbs + 1) * 16
+	height := (2 - frameMbsOnly) * (heightInMapUnits + 1) * 16
+
+	cropping, err := r.readBit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if cropping == 1 {
+		left, _ := r.readUE()
+		right, _ := r.readUE()
+		top, _ := r.readUE()
+		bottom, err := r.readUE()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		cropX, cropY := uint32(1), 2-frameMbsOnly
+		switch chromaFormat {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX, cropY = 2, 2-frameMbsOnly
+		}
+		width -= (left + right) * cropX
+		height -= (top + bottom) * cropY
+	}
+
+	return uint16(width), uint16(height), nil
+}
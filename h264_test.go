@@ -0,0 +1,232 @@
+package main
+
+import (
+	"testing"
+)
+
+// h264BitWriter writes the fields of a crafted parameter set.
+type h264BitWriter struct {
+	data []byte
+	bit  int
+}
+
+func (w *h264BitWriter) writeBits(value uint32, count int) {
+	for i := count - 1; i >= 0; i-- {
+		if w.bit%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte(value>>i&0x01) << (7 - w.bit%8)
+		w.bit++
+	}
+}
+
+func (w *h264BitWriter) writeUE(value uint32) {
+	value++
+	size := 0
+	for v := value; v > 1; v >>= 1 {
+		size++
+	}
+	w.writeBits(0, size)
+	w.writeBits(value, size+1)
+}
+
+func (w *h264BitWriter) writeSE(value int32) {
+	if value > 0 {
+		w.writeUE(uint32(2*value - 1))
+	} else {
+		w.writeUE(uint32(-2 * value))
+	}
+}
+
+type h264TestSPS struct {
+	profile        byte
+	chromaFormat   uint32
+	scalingMatrix  bool
+	pocType        uint32
+	pocCycle       uint32
+	widthInMbs     uint32
+	heightInMaps   uint32
+	frameMbsOnly   bool
+	crop           [4]uint32
+	cropping       bool
+	truncateToBits int
+}
+
+func (sps h264TestSPS) bytes() []byte {
+	w := &h264BitWriter{}
+	w.writeBits(uint32(sps.profile), 8)
+	w.writeBits(0, 8)
+	w.writeBits(31, 8)
+	w.writeUE(0)
+	if sps.profile == 100 {
+		w.writeUE(sps.chromaFormat)
+		if sps.chromaFormat == 3 {
+			w.writeBits(0, 1)
+		}
+		w.writeUE(0)
+		w.writeUE(0)
+		w.writeBits(0, 1)
+		if sps.scalingMatrix {
+			w.writeBits(1, 1)
+			// The first list is sent with a few deltas, the others are absent.
+			w.writeBits(1, 1)
+			w.writeSE(8)
+			w.writeSE(-16)
+			for range 7 {
+				w.writeBits(0, 1)
+			}
+		} else {
+			w.writeBits(0, 1)
+		}
+	}
+	w.writeUE(0)
+	w.writeUE(sps.pocType)
+	switch sps.pocType {
+	case 0:
+		w.writeUE(0)
+	case 1:
+		w.writeBits(0, 1)
+		w.writeSE(0)
+		w.writeSE(0)
+		w.writeUE(sps.pocCycle)
+		for range min(sps.pocCycle, 4) {
+			w.writeSE(1)
+		}
+	}
+	w.writeUE(1)
+	w.writeBits(0, 1)
+	w.writeUE(sps.widthInMbs)
+	w.writeUE(sps.heightInMaps)
+	if sps.frameMbsOnly {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+		w.writeBits(0, 1)
+	}
+	w.writeBits(1, 1)
+	if sps.cropping {
+		w.writeBits(1, 1)
+		for _, value := range sps.crop {
+			w.writeUE(value)
+		}
+	} else {
+		w.writeBits(0, 1)
+	}
+	w.writeBits(0, 1)
+	w.writeBits(1, 1)
+
+	data := w.data
+	if sps.truncateToBits > 0 {
+		data = data[:(sps.truncateToBits+7)/8]
+	}
+	return append([]byte{0x67}, data...)
+}
+
+// h264Escape clears the level and inserts the emulation prevention byte the
+// zero constraint flags and level then call for.
+func h264Escape(sps []byte) []byte {
+	escaped := append([]byte{}, sps[:3]...)
+	escaped = append(escaped, 0x00, 0x03)
+	return append(escaped, sps[4:]...)
+}
+
+func TestH264PictureSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		sps    []byte
+		width  uint16
+		height uint16
+		fails  bool
+	}{
+		{
+			name:   "x264 high profile 720p",
+			sps:    []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60},
+			width:  1280,
+			height: 720,
+		},
+		{
+			name:   "baseline",
+			sps:    h264TestSPS{profile: 66, pocType: 2, widthInMbs: 39, heightInMaps: 29, frameMbsOnly: true}.bytes(),
+			width:  640,
+			height: 480,
+		},
+		{
+			name:   "cropped 1080p",
+			sps:    h264TestSPS{profile: 100, chromaFormat: 1, widthInMbs: 119, heightInMaps: 67, frameMbsOnly: true, cropping: true, crop: [4]uint32{0, 0, 0, 4}}.bytes(),
+			width:  1920,
+			height: 1080,
+		},
+		{
+			name:   "interlaced",
+			sps:    h264TestSPS{profile: 66, widthInMbs: 44, heightInMaps: 17, cropping: true, crop: [4]uint32{0, 0, 0, 2}}.bytes(),
+			width:  720,
+			height: 568,
+		},
+		{
+			name:   "4:4:4 with cropping",
+			sps:    h264TestSPS{profile: 100, chromaFormat: 3, widthInMbs: 9, heightInMaps: 9, frameMbsOnly: true, cropping: true, crop: [4]uint32{1, 1, 2, 2}}.bytes(),
+			width:  158,
+			height: 156,
+		},
+		{
+			name:   "scaling matrix",
+			sps:    h264TestSPS{profile: 100, chromaFormat: 1, scalingMatrix: true, widthInMbs: 19, heightInMaps: 14, frameMbsOnly: true}.bytes(),
+			width:  320,
+			height: 240,
+		},
+		{
+			name:   "pic order count cycle",
+			sps:    h264TestSPS{profile: 66, pocType: 1, pocCycle: 4, widthInMbs: 19, heightInMaps: 14, frameMbsOnly: true}.bytes(),
+			width:  320,
+			height: 240,
+		},
+		{
+			name:   "emulation prevention bytes",
+			sps:    h264Escape(h264TestSPS{profile: 66, widthInMbs: 39, heightInMaps: 29, frameMbsOnly: true}.bytes()),
+			width:  640,
+			height: 480,
+		},
+		{name: "empty", sps: []byte{}, fails: true},
+		{name: "header only", sps: []byte{0x67, 0x42, 0x00}, fails: true},
+		{name: "truncated id", sps: []byte{0x67, 0x42, 0x00, 0x1f}, fails: true},
+		{name: "invalid exp-golomb code", sps: []byte{0x67, 0x42, 0x00, 0x1f, 0, 0, 0, 0, 0, 0}, fails: true},
+		{
+			name:  "pic order count cycle too long",
+			sps:   h264TestSPS{profile: 66, pocType: 1, pocCycle: 256, widthInMbs: 19, heightInMaps: 14, frameMbsOnly: true}.bytes(),
+			fails: true,
+		},
+		{
+			name:  "truncated before the size",
+			sps:   h264TestSPS{profile: 66, widthInMbs: 19, heightInMaps: 14, frameMbsOnly: true, truncateToBits: 30}.bytes(),
+			fails: true,
+		},
+		{
+			name:  "truncated scaling matrix",
+			sps:   h264TestSPS{profile: 100, chromaFormat: 1, scalingMatrix: true, widthInMbs: 19, heightInMaps: 14, frameMbsOnly: true, truncateToBits: 40}.bytes(),
+			fails: true,
+		},
+		{
+			name:  "truncated cropping",
+			sps:   h264TestSPS{profile: 66, pocType: 2, widthInMbs: 19, heightInMaps: 14, frameMbsOnly: true, cropping: true, crop: [4]uint32{0, 0, 0, 200}, truncateToBits: 60}.bytes(),
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height, err := h264PictureSize(test.sps)
+			if test.fails {
+				if err == nil {
+					t.Errorf("read %dx%d, want an error", width, height)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if width != test.width || height != test.height {
+				t.Errorf("read %dx%d, want %dx%d", width, height, test.width, test.height)
+			}
+		})
+	}
+}
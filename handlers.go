@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 )
 
@@ -18,14 +19,30 @@ func (user *User) handleMessage(msg []byte) {
 	switch payload.Type {
 	case "users_list":
 		user.handleUsersList()
+	case "rooms_list":
+		user.handleRoomsList()
 	case "create_room":
 		user.handleCreateRoom(msg)
 	case "leave_room":
 		user.handleLeaveRoom()
 	case "join_room":
 		user.handleJoinRoom(msg)
+	case "create_invite":
+		user.handleCreateInvite(msg)
+	case "open_breakouts", "close_breakouts", "breakouts_list", "broadcast_breakouts":
+		user.handleBreakouts(payload.Type, msg)
+	case "send_message":
+		user.handleSendMessage(msg)
 	case "publish":
 		user.handlePublish(msg)
+	case "set_role", "kick_user", "ban_user", "mute_remote_track", "stop_remote_publish", "transfer_ownership", "admit", "deny":
+		user.handleModeration(payload.Type, msg)
+	case "subscribe", "subscribe_answer", "unsubscribe":
+		user.handleSubscribe(payload.Type, msg)
+	case "start_recording", "stop_recording":
+		user.handleRecording(payload.Type, msg)
+	case "forward_stream", "stop_forward":
+		user.handleForward(payload.Type, msg)
 	case "icecandidate":
 		user.handleIceCandidate(msg)
 	default:
@@ -37,26 +54,51 @@ func (user *User) handleUsersList() {
 	SendUsersList(user.SendMessage)
 }
 
+func (user *User) handleRoomsList() {
+	rooms := make([]*Room, 0)
+	for _, room := range GetRooms() {
+		if room.VisibleTo(user) {
+			rooms = append(rooms, room)
+		}
+	}
+
+	user.SendMessageJson(NewReplyRoomsList(rooms))
+}
+
 func (user *User) handleCreateRoom(msg []byte) {
 	if user.Room != nil {
 		user.SendMessageJson(NewReplyErrorRoomCreate("you are already in a room"))
 		return
 	}
 
-	newRoomOptions := new(NewRoomOptions)
-	err := json.Unmarshal(msg, newRoomOptions)
+	request, err := NewRequestRoomCreate(msg)
 	if err != nil {
 		user.SendMessageJson(NewReplyErrorRoomCreate("you provided wrongly formatted options"))
+		return
 	}
 
-	room, err := NewRoom(&NewRoomOptions{
-		VideoCodec: newRoomOptions.VideoCodec,
-	})
+	request.OwnerId = user.Id
+	room, created, err := GetOrCreateRoom(&request.NewRoomOptions)
 	if err != nil {
 		user.SendMessageJson(NewReplyErrorRoomCreate(err.Error()))
 		return
 	}
 
+	if !created {
+		if _, err := room.CheckAccess(user, request.Passcode, ""); err != nil {
+			user.SendMessageJson(NewReplyErrorRoomAccessDenied(err.Error()))
+			return
+		}
+		if err := user.RequestJoin(room, nil); err != nil {
+			if errors.Is(err, ErrRoomFull) {
+				user.SendMessageJson(NewReplyErrorRoomFull(err.Error()))
+				return
+			}
+			user.SendMessageJson(NewReplyErrorRoomJoin(err.Error()))
+		}
+		return
+	}
+
 	logger.Info(fmt.Sprintf("user %s create a new room %s", user.Id, room.Id))
 
 	if err := user.JoinRoom(room); err != nil {
@@ -67,6 +109,11 @@ func (user *User) handleCreateRoom(msg []byte) {
 }
 
 func (user *User) handleLeaveRoom() {
+	if user.Room == nil && user.LobbyRoom != nil {
+		user.LeaveLobby()
+		return
+	}
+
 	if user.Room == nil {
 		user.SendMessageJson(NewReplyErrorRoomLeave("you are not in a room"))
 		return
@@ -91,12 +138,98 @@ func (user *User) handleJoinRoom(msg []byte) {
 		return
 	}
 
-	if err := user.JoinRoom(room); err != nil {
+	invite, err := room.CheckAccess(user, request.Passcode, request.InviteToken)
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorRoomAccessDenied(err.Error()))
+		return
+	}
+
+	if err := user.RequestJoin(room, invite); err != nil {
+		room.refundInvite(invite)
+		if errors.Is(err, ErrRoomFull) {
+			user.SendMessageJson(NewReplyErrorRoomFull(err.Error()))
+			return
+		}
 		user.SendMessageJson(NewReplyErrorRoomJoin(err.Error()))
 		return
 	}
 }
 
+func (user *User) handleCreateInvite(msg []byte) {
+	request, err := NewRequestInviteCreate(msg)
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorInviteCreate(err.Error()))
+		return
+	}
+
+	if user.Room == nil {
+		user.SendMessageJson(NewReplyErrorInviteCreate("you are not in a room"))
+		return
+	}
+
+	invite, err := user.Room.CreateInvite(user, request.ExpiresIn.Duration, request.MaxUses)
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorInviteCreate(err.Error()))
+		return
+	}
+
+	user.SendMessageJson(NewReplyInviteCreated(invite))
+}
+
+func (user *User) handleBreakouts(action string, msg []byte) {
+	request, err := NewRequestBreakouts(msg)
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorBreakouts(action, err.Error()))
+		return
+	}
+
+	room := user.Room
+	if room == nil {
+		user.SendMessageJson(NewReplyErrorBreakouts(action, "you are not in a room"))
+		return
+	}
+	if room.parent != nil {
+		room = room.parent
+	}
+
+	switch action {
+	case "open_breakouts":
+		err = room.OpenBreakouts(user, request.Count, request.Assignments, request.Duration.Duration)
+	case "close_breakouts":
+		err = room.CloseBreakouts(user)
+	case "breakouts_list":
+		if !room.RoleOf(user).CanModerate() {
+			err = ErrNotAllowed
+			break
+		}
+		user.SendMessageJson(NewMessageBreakoutsState(room))
+	case "broadcast_breakouts":
+		err = room.BroadcastToBreakouts(user, request.Payload)
+	}
+
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorBreakouts(action, err.Error()))
+	}
+}
+
+func (user *User) handleSendMessage(msg []byte) {
+	request, err := NewRequestSendMessage(msg)
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorSendMessage(err.Error()))
+		return
+	}
+
+	if user.Room == nil {
+		user.SendMessageJson(NewReplyErrorSendMessage("you are not in a room"))
+		return
+	}
+
+	if err := user.Room.SendRoomMessage(user, request.To, request.Payload); err != nil {
+		user.SendMessageJson(NewReplyErrorSendMessage(err.Error()))
+		return
+	}
+}
+
 func (user *User) handlePublish(msg []byte) {
 	payload, err := NewRequestPublish(msg)
 	if err != nil {
@@ -106,31 +239,196 @@ func (user *User) handlePublish(msg []byte) {
 
 	stream, err := NewIncomingStream(user)
 	if err != nil {
+		if errors.Is(err, ErrPublishLimitReached) {
+			user.SendMessageJson(NewReplyErrorPublishLimitReached(err.Error()))
+			return
+		}
 		user.SendMessageJson(NewReplyErrorPublish(err.Error()))
 		return
 	}
 
+	// The stream is already in the room, a failed negotiation must release
+	// it or it keeps counting against the publish limits.
+	abort := func(err error) {
+		stream.Teardown()
+		if err := stream.room.RemoveInStream(stream); err != nil {
+			logger.Warn(fmt.Sprintf("failed removing stream %s after a failed publish, %s", stream.Id, err.Error()))
+		}
+		user.SendMessageJson(NewReplyErrorPublish(err.Error()))
+	}
+
 	err = stream.PeerConnection.SetRemoteDescription(payload.SdpOffer)
 	if err != nil {
-		user.SendMessageJson(NewReplyErrorPublish(err.Error()))
+		abort(err)
 		return
 	}
 
 	sdpAnswer, err := stream.PeerConnection.CreateAnswer(nil)
 	if err != nil {
-		user.SendMessageJson(NewReplyErrorPublish(err.Error()))
+		abort(err)
 		return
 	}
 
 	err = stream.PeerConnection.SetLocalDescription(sdpAnswer)
 	if err != nil {
-		user.SendMessageJson(NewReplyErrorPublish(err.Error()))
+		abort(err)
 		return
 	}
 
 	user.SendMessageJson(NewReplyPublish(stream, sdpAnswer))
 }
 
+func (user *User) handleModeration(action string, msg []byte) {
+	request, err := NewRequestModeration(msg)
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorModeration(action, err.Error()))
+		return
+	}
+
+	room := user.Room
+	if room == nil {
+		user.SendMessageJson(NewReplyErrorModeration(action, "you are not in a room"))
+		return
+	}
+
+	switch action {
+	case "set_role":
+		var role Role
+		role, err = ParseRole(request.Role)
+		if err == nil {
+			err = room.SetRole(user, request.UserId, role)
+		}
+	case "kick_user":
+		err = room.Kick(user, request.UserId, request.Reason)
+	case "ban_user":
+		err = room.Ban(user, request.UserId, request.Reason)
+	case "mute_remote_track":
+		muted := request.Muted == nil || *request.Muted
+		err = room.MuteRemoteTrack(user, request.StreamId, request.TrackId, muted)
+	case "stop_remote_publish":
+		err = room.StopRemotePublish(user, request.StreamId, request.Reason)
+	case "transfer_ownership":
+		err = room.TransferOwnership(user, request.UserId)
+	case "admit":
+		err = room.Admit(user, request.UserId)
+	case "deny":
+		err = room.Deny(user, request.UserId, request.Reason)
+	}
+
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorModeration(action, err.Error()))
+	}
+}
+
+func (user *User) handleSubscribe(action string, msg []byte) {
+	request, err := NewRequestSubscribe(msg)
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorSubscribe(action, err.Error()))
+		return
+	}
+
+	if user.Room == nil {
+		user.SendMessageJson(NewReplyErrorSubscribe(action, "you are not in a room"))
+		return
+	}
+
+	switch action {
+	case "subscribe":
+		stream := user.Room.GetInStream(request.StreamId)
+		if stream == nil {
+			err = ErrStreamNotInRoom
+			break
+		}
+		_, err = NewOutgoingStream(user, stream)
+	case "subscribe_answer":
+		subscription := user.GetSubscription(request.SubscriptionId)
+		if subscription == nil {
+			err = ErrSubscriptionNotFound
+			break
+		}
+		err = subscription.SetAnswer(request.SdpAnswer)
+	case "unsubscribe":
+		subscription := user.GetSubscription(request.SubscriptionId)
+		if subscription == nil {
+			err = ErrSubscriptionNotFound
+			break
+		}
+		subscription.Close("unsubscribe action")
+	}
+
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorSubscribe(action, err.Error()))
+	}
+}
+
+func (user *User) handleRecording(action string, msg []byte) {
+	request, err := NewRequestRecording(msg)
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorRecording(action, err.Error()))
+		return
+	}
+
+	room := user.Room
+	if room == nil {
+		user.SendMessageJson(NewReplyErrorRecording(action, "you are not in a room"))
+		return
+	}
+
+	switch action {
+	case "start_recording":
+		var format RecordingFormat
+		format, err = ParseRecordingFormat(request.Format)
+		if err != nil {
+			break
+		}
+		_, err = room.StartRecording(user, request.StreamId, format)
+	case "stop_recording":
+		err = room.StopRecording(user, request.RecordingId)
+	}
+
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorRecording(action, err.Error()))
+	}
+}
+
+func (user *User) handleForward(action string, msg []byte) {
+	request, err := NewRequestForward(msg)
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorForward(action, err.Error()))
+		return
+	}
+
+	room := user.Room
+	if room == nil {
+		user.SendMessageJson(NewReplyErrorForward(action, "you are not in a room"))
+		return
+	}
+
+	switch action {
+	case "forward_stream":
+		var forward *Forward
+		forward, err = room.ForwardStream(user, ForwardOptions{
+			StreamId: request.StreamId,
+			Host:     request.Host,
+			Port:     request.Port,
+			RTCP:     request.RTCP,
+		})
+		if err == nil {
+			user.SendMessageJson(NewMessageForwardState(forward, "forwarding"))
+		}
+	case "stop_forward":
+		forward := GetForward(request.ForwardId)
+		err = room.StopForward(user, request.ForwardId)
+		if err == nil {
+			user.SendMessageJson(NewMessageForwardState(forward, "stopped"))
+		}
+	}
+
+	if err != nil {
+		user.SendMessageJson(NewReplyErrorForward(action, err.Error()))
+	}
+}
+
 func (user *User) handleIceCandidate(msg []byte) {
 	request, err := NewRequestIceCandidate(msg)
 	if err != nil {
@@ -138,5 +436,15 @@ func (user *User) handleIceCandidate(msg []byte) {
 		return
 	}
 
+	if request.SubscriptionId != "" {
+		subscription := user.GetSubscription(request.SubscriptionId)
+		if subscription == nil {
+			user.SendMessageJson(NewReplyErrorIceCandidate(ErrSubscriptionNotFound.Error()))
+			return
+		}
+		subscription.AddIceCandidate(request.IceCandidate)
+		return
+	}
+
 	user.AddIceCandidate(request.IceCandidate)
 }
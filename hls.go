@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+type HLSConfig struct {
+	SegmentDuration Duration `json:"segment_duration" yaml:"segment_duration" toml:"segment_duration"`
+	// PlaylistSize is the number of segments listed by the live playlist.
+	PlaylistSize int `json:"playlist_size" yaml:"playlist_size" toml:"playlist_size"`
+}
+
+func (cfg HLSConfig) Validate() error {
+	if cfg.SegmentDuration.Duration <= 0 {
+		return errors.New("segment_duration must be positive")
+	}
+	if cfg.PlaylistSize < 1 {
+		return errors.New("playlist_size must be at least 1")
+	}
+	return nil
+}
+
+// HLSPackager remuxes the h264 video and opus audio of a stream into fmp4
+// segments kept in memory, segments start on a keyframe once the segment
+// duration is reached. Timestamps are taken as decode times, b-frames aren't
+// supported.
+type HLSPackager struct {
+	Id          string    `json:"id"`
+	RoomId      string    `json:"room_id"`
+	StreamId    string    `json:"stream_id"`
+	PlaylistURL string    `json:"playlist_url"`
+	StartedAt   time.Time `json:"started_at"`
+
+	stream          *IncomingStream
+	segmentDuration time.Duration
+	playlistSize    int
+
+	video    *hlsTrack
+	audio    *hlsTrack
+	init     []byte
+	segments []*hlsSegment
+	sequence int
+
+	segmentStart      uint64
+	keyframeRequested bool
+	closed            bool
+	mutex             *sync.Mutex
+}
+
+type hlsTrack struct {
+	mp4     *mp4Track
+	track   *StreamTrack
+	builder *samplebuilder.SampleBuilder
+
+	started   bool
+	startTime uint64
+	// lastTimestamp is extended to 64 bits in elapsed, the ticks since the
+	// first sample, so the track outlives the rollover of rtp timestamps.
+	lastTimestamp uint32
+	elapsed       uint64
+	pending       *mp4Sample
+	samples       []mp4Sample
+}
+
+type hlsSegment struct {
+	sequence int
+	duration time.Duration
+	data     []byte
+}
+
+const (
+	hlsVideoTrackId = 1
+	hlsAudioTrackId = 2
+
+	// hlsKeptSegments are served after leaving the playlist for clients and
+	// caches lagging behind.
+	hlsKeptSegments = 3
+)
+
+var (
+	hlsPackagers      map[string]*HLSPackager = make(map[string]*HLSPackager)
+	hlsPackagersMutex *sync.Mutex             = new(sync.Mutex)
+
+	ErrHLSPackagerNotFound = errors.New("the hls packager does not exist")
+	ErrAlreadyPackaging    = errors.New("the stream is already packaged")
+)
+
+func RegisterHLSHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /hls/{id}/{file}", httpHandleHLSFile)
+}
+
+func StartHLSPackager(room *Room, streamId string) (*HLSPackager, error) {
+	stream := room.GetInStream(streamId)
+	if stream == nil {
+		return nil, ErrStreamNotInRoom
+	}
+
+	cfg := GetConfig().HLS
+	packager := &HLSPackager{
+		Id:        uuid.NewString(),
+		RoomId:    room.Id,
+		StreamId:  stream.Id,
+		StartedAt: time.Now(),
+
+		stream:          stream,
+		segmentDuration: cfg.SegmentDuration.Duration,
+		playlistSize:    cfg.PlaylistSize,
+		segments:        make([]*hlsSegment, 0),
+		mutex:           new(sync.Mutex),
+	}
+	packager.PlaylistURL = fmt.Sprintf("/hls/%s/index.m3u8", packager.Id)
+
+	for _, track := range stream.GetTracks() {
+		packager.trackFor(track)
+	}
+	if packager.video == nil {
+		return nil, errors.New("hls requires an h264 video track")
+	}
+
+	hlsPackagersMutex.Lock()
+	for _, other := range hlsPackagers {
+		if other.StreamId == stream.Id {
+			hlsPackagersMutex.Unlock()
+			return nil, ErrAlreadyPackaging
+		}
+	}
+	hlsPackagers[packager.Id] = packager
+	hlsPackagersMutex.Unlock()
+
+	if !stream.AddSink(packager) {
+		packager.Close()
+		return nil, ErrStreamNotInRoom
+	}
+	stream.RequestKeyframe()
+
+	logger.Info(fmt.Sprintf("hls packager %s of stream %s started", packager.Id, stream.Id))
+
+	return packager, nil
+}
+
+func GetHLSPackager(id string) *HLSPackager {
+	hlsPackagersMutex.Lock()
+	defer hlsPackagersMutex.Unlock()
+
+	return hlsPackagers[id]
+}
+
+func GetHLSPackagers() []*HLSPackager {
+	hlsPackagersMutex.Lock()
+	defer hlsPackagersMutex.Unlock()
+
+	return slices.Collect(maps.Values(hlsPackagers))
+}
+
+func (p *HLSPackager) Stop() {
+	p.stream.RemoveSink(p)
+}
+
+func (p *HLSPackager) Close() {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	p.closed = true
+	p.mutex.Unlock()
+
+	hlsPackagersMutex.Lock()
+	delete(hlsPackagers, p.Id)
+	hlsPackagersMutex.Unlock()
+
+	logger.Info(fmt.Sprintf("hls packager %s of stream %s stopped", p.Id, p.StreamId))
+}
+
+// trackFor returns the packaged track of a stream track, the tracks are
+// fixed once the init segment is written.
+func (p *HLSPackager) trackFor(track *StreamTrack) *hlsTrack {
+	for _, packaged := range []*hlsTrack{p.video, p.audio} {
+		if packaged != nil && packaged.track == track {
+			return packaged
+		}
+	}
+	if p.init != nil {
+		return nil
+	}
+
+	switch {
+	case p.video == nil && strings.EqualFold(track.Codec.MimeType, webrtc.MimeTypeH264):
+		p.video = &hlsTrack{
+			mp4:     &mp4Track{Id: hlsVideoTrackId, Timescale: track.Codec.ClockRate, Video: true},
+			track:   track,
+			builder: samplebuilder.New(512, &codecs.H264Packet{IsAVC: true}, track.Codec.ClockRate),
+		}
+		return p.video
+	case p.audio == nil && strings.EqualFold(track.Codec.MimeType, webrtc.MimeTypeOpus):
+		p.audio = &hlsTrack{
+			mp4:     &mp4Track{Id: hlsAudioTrackId, Timescale: track.Codec.ClockRate, Channels: uint16(max(track.Codec.Channels, 1))},
+			track:   track,
+			builder: samplebuilder.New(512, &codecs.OpusPacket{}, track.Codec.ClockRate),
+		}
+		return p.audio
+	}
+	return nil
+}
+
+func (p *HLSPackager) WriteRTP(track *StreamTrack, packet *rtp.Packet) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	packaged := p.trackFor(track)
+	if packaged == nil {
+		return
+	}
+
+	packaged.builder.Push(packet)
+	for sample := packaged.builder.Pop(); sample != nil; sample = packaged.builder.Pop() {
+		if packaged == p.video {
+			p.addVideoSample(sample.Data, sample.PacketTimestamp)
+		} else if p.init != nil {
+			p.addSample(packaged, mp4Sample{Data: sample.Data, Keyframe: true}, sample.PacketTimestamp)
+		}
+	}
+}
+
+// addVideoSample moves the parameter sets of the frame to the init segment,
+// which is written on the first keyframe.
+func (p *HLSPackager) addVideoSample(frame []byte, timestamp uint32) {
+	nalus := splitAVCC(frame)
+	data := make([]byte, 0, len(frame))
+	sps, pps := make([][]byte, 0), make([][]byte, 0)
+	keyframe := false
+	for _, nalu := range nalus {
+		switch nalu[0] & 0x1f {
+		case h264NaluSPS:
+			sps = append(sps, nalu)
+			continue
+		case h264NaluPPS:
+			pps = append(pps, nalu)
+			continue
+		case h264NaluAUD:
+			continue
+		case h264NaluIDR:
+			keyframe = true
+		}
+		data = mp4AppendNalu(data, nalu)
+	}
+
+	if p.init == nil {
+		if !keyframe || len(sps) == 0 || len(pps) == 0 || len(sps[0]) < 4 {
+			return
+		}
+		width, height, err := h264PictureSize(sps[0])
+		if err != nil {
+			logger.Warn(fmt.Sprintf("hls packager %s failed reading the sps, %s", p.Id, err.Error()))
+		}
+		p.video.mp4.SPS, p.video.mp4.PPS = sps, pps
+		p.video.mp4.Width, p.video.mp4.Height = width, height
+
+		tracks := []*mp4Track{p.video.mp4}
+		if p.audio != nil {
+			tracks = append(tracks, p.audio.mp4)
+		}
+		p.init = mp4InitSegment(tracks)
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	p.addSample(p.video, mp4Sample{Data: data, Keyframe: keyframe}, timestamp)
+}
+
+// addSample timestamps the sample from the start of the packager, its
+// duration is known once the next sample of the track arrives.
+func (p *HLSPackager) addSample(track *hlsTrack, sample mp4Sample, timestamp uint32) {
+	if !track.started {
+		track.started = true
+		track.lastTimestamp = timestamp
+		track.startTime = uint64(time.Since(p.StartedAt) * time.Duration(track.mp4.Timescale) / time.Second)
+	}
+	// The signed difference follows the rollovers and late samples, samples
+	// older than the first one are moved to its time.
+	delta := int64(int32(timestamp - track.lastTimestamp))
+	if delta < 0 && uint64(-delta) > track.elapsed {
+		delta = -int64(track.elapsed)
+		timestamp = track.lastTimestamp - uint32(track.elapsed)
+	}
+	track.elapsed = uint64(int64(track.elapsed) + delta)
+	track.lastTimestamp = timestamp
+	sample.Time = track.startTime + track.elapsed
+
+	if pending := track.pending; pending != nil {
+		pending.Duration = 1
+		if sample.Time > pending.Time {
+			pending.Duration = uint32(min(sample.Time-pending.Time, math.MaxUint32))
+		}
+		if track == p.video {
+			p.addCompleteVideoSample(*pending)
+		} else {
+			track.samples = append(track.samples, *pending)
+		}
+	}
+	track.pending = &sample
+}
+
+func (p *HLSPackager) addCompleteVideoSample(sample mp4Sample) {
+	target := uint64(p.segmentDuration.Seconds() * float64(p.video.mp4.Timescale))
+
+	if len(p.video.samples) == 0 {
+		p.segmentStart = sample.Time
+	} else if sample.Time-p.segmentStart >= target {
+		if sample.Keyframe {
+			p.cutSegment(sample.Time)
+		} else if !p.keyframeRequested {
+			p.keyframeRequested = true
+			go p.stream.RequestKeyframe()
+		}
+	}
+
+	p.video.samples = append(p.video.samples, sample)
+}
+
+// cutSegment writes the samples before end as a segment.
+func (p *HLSPackager) cutSegment(end uint64) {
+	fragments := []mp4Fragment{{Track: p.video.mp4, Samples: p.video.samples, BaseTime: p.video.samples[0].Time}}
+	if p.audio != nil && len(p.audio.samples) > 0 {
+		fragments = append(fragments, mp4Fragment{Track: p.audio.mp4, Samples: p.audio.samples, BaseTime: p.audio.samples[0].Time})
+		p.audio.samples = nil
+	}
+
+	p.sequence++
+	p.segments = append(p.segments, &hlsSegment{
+		sequence: p.sequence,
+		duration: time.Duration(end-p.segmentStart) * time.Second / time.Duration(p.video.mp4.Timescale),
+		data:     mp4MediaSegment(uint32(p.sequence), fragments),
+	})
+	if len(p.segments) > p.playlistSize+hlsKeptSegments {
+		p.segments = slices.Delete(p.segments, 0, len(p.segments)-p.playlistSize-hlsKeptSegments)
+	}
+
+	p.video.samples = nil
+	p.segmentStart = end
+	p.keyframeRequested = false
+}
+
+func (p *HLSPackager) Playlist() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	segments := p.segments[max(len(p.segments)-p.playlistSize, 0):]
+
+	targetDuration := math.Ceil(p.segmentDuration.Seconds())
+	for _, segment := range segments {
+		targetDuration = max(targetDuration, math.Round(segment.duration.Seconds()))
+	}
+	mediaSequence := 1
+	if len(segments) > 0 {
+		mediaSequence = segments[0].sequence
+	}
+
+	lines := []string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:7",
+		fmt.Sprintf("#EXT-X-TARGETDURATION:%d", int(targetDuration)),
+		fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d", mediaSequence),
+		"#EXT-X-INDEPENDENT-SEGMENTS",
+		`#EXT-X-MAP:URI="init.mp4"`,
+	}
+	for _, segment := range segments {
+		lines = append(lines,
+			fmt.Sprintf("#EXTINF:%.3f,", segment.duration.Seconds()),
+			fmt.Sprintf("segment_%d.m4s", segment.sequence),
+		)
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (p *HLSPackager) InitSegment() []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.init
+}
+
+func (p *HLSPackager) Segment(sequence int) []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, segment := range p.segments {
+		if segment.sequence == sequence {
+			return segment.data
+		}
+	}
+	return nil
+}
+
+func mp4AppendNalu(data []byte, nalu []byte) []byte {
+	data = append(data, mp4Uint32(uint32(len(nalu)))...)
+	return append(data, nalu...)
+}
+
+// httpHandleHLSFile serves the playlist, which changes with every segment,
+// and the init and media segments which never change once written.
+func httpHandleHLSFile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	packager := GetHLSPackager(r.PathValue("id"))
+	if packager == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	file := r.PathValue("file")
+	var data []byte
+	switch {
+	case file == "index.m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "max-age=1")
+		data = []byte(packager.Playlist())
+	case file == "init.mp4":
+		w.Header().Set("Content-Type", "video/mp4")
+		data = packager.InitSegment()
+	case strings.HasPrefix(file, "segment_") && strings.HasSuffix(file, ".m4s"):
+		sequence, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(file, "segment_"), ".m4s"))
+		if err == nil {
+			w.Header().Set("Content-Type", "video/iso.segment")
+			data = packager.Segment(sequence)
+		}
+	}
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if file != "index.m3u8" {
+		w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	}
+
+	if _, err := w.Write(data); err != nil {
+		logger.Debug(fmt.Sprintf("failed writing hls file %s, %s", file, err.Error()))
+	}
+}
+
+func httpHandleHLSStart(w http.ResponseWriter, r *http.Request) {
+	room := GetRoom(r.PathValue("id"))
+	if room == nil {
+		writeJsonError(w, http.StatusNotFound, "hls_failure", "the room does not exist")
+		return
+	}
+
+	request := struct {
+		StreamId string `json:"stream_id"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "hls_failure", err.Error())
+		return
+	}
+
+	packager, err := StartHLSPackager(room, request.StreamId)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrAlreadyPackaging) {
+			status = http.StatusConflict
+		}
+		writeJsonError(w, status, "hls_failure", err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusCreated, packager)
+}
+
+func httpHandleHLSList(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, GetHLSPackagers())
+}
+
+func httpHandleHLSStop(w http.ResponseWriter, r *http.Request) {
+	packager := GetHLSPackager(r.PathValue("id"))
+	if packager == nil {
+		writeJsonError(w, http.StatusNotFound, "hls_failure", ErrHLSPackagerNotFound.Error())
+		return
+	}
+
+	packager.Stop()
+	w.WriteHeader(http.StatusNoContent)
+}
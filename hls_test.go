@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHLSSampleTimes(t *testing.T) {
+	tests := []struct {
+		name       string
+		timestamps []uint32
+		durations  []uint32
+	}{
+		{
+			name:       "increasing",
+			timestamps: []uint32{1000, 1960, 2920},
+			durations:  []uint32{960, 960},
+		},
+		{
+			name:       "rollover",
+			timestamps: []uint32{0xffffff00, 0xffffffff, 0x000000c0, 0x00000180},
+			durations:  []uint32{0xff, 0xc1, 0xc0},
+		},
+		{
+			name:       "late sample",
+			timestamps: []uint32{5000, 6000, 5500, 7000},
+			durations:  []uint32{1000, 1, 1500},
+		},
+		{
+			name:       "late sample before the first one",
+			timestamps: []uint32{100, 0xfffffff0, 200},
+			durations:  []uint32{1, 100},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packager := &HLSPackager{StartedAt: time.Now()}
+			track := &hlsTrack{mp4: &mp4Track{Timescale: 48000}}
+			for _, timestamp := range test.timestamps {
+				packager.addSample(track, mp4Sample{}, timestamp)
+			}
+
+			if len(track.samples) != len(test.durations) {
+				t.Fatalf("%d samples, want %d", len(track.samples), len(test.durations))
+			}
+			for i, sample := range track.samples {
+				if sample.Duration != test.durations[i] {
+					t.Errorf("sample %d lasts %d, want %d", i, sample.Duration, test.durations[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHLSSampleTimesAfterManyRollovers(t *testing.T) {
+	packager := &HLSPackager{StartedAt: time.Now()}
+	track := &hlsTrack{mp4: &mp4Track{Timescale: 90000}}
+
+	// A frame every second of a 90 kHz clock rolls over every 13 hours.
+	const step = 90000
+	const frames = 3 * (1 << 32) / step
+	timestamp := uint32(0)
+	for range frames {
+		packager.addSample(track, mp4Sample{}, timestamp)
+		timestamp += step
+	}
+
+	last := track.samples[len(track.samples)-1]
+	if elapsed := last.Time - track.startTime; elapsed != uint64(frames-2)*step {
+		t.Errorf("last sample at %d ticks, want %d", elapsed, uint64(frames-2)*step)
+	}
+	for i, sample := range track.samples {
+		if sample.Duration != step {
+			t.Fatalf("sample %d lasts %d", i, sample.Duration)
+		}
+	}
+}
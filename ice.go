@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+type ICEServerConfig struct {
+	URLs       []string `json:"urls" yaml:"urls" toml:"urls"`
+	Username   string   `json:"username,omitempty" yaml:"username,omitempty" toml:"username,omitempty"`
+	Credential string   `json:"credential,omitempty" yaml:"credential,omitempty" toml:"credential,omitempty"`
+
+	// Secret enables time-limited credentials following the TURN REST API
+	// convention, username is "<expiry>:<user id>" and the credential is the
+	// base64 HMAC-SHA1 of the username keyed with the secret.
+	Secret string   `json:"secret,omitempty" yaml:"secret,omitempty" toml:"secret,omitempty"`
+	TTL    Duration `json:"ttl,omitempty" yaml:"ttl,omitempty" toml:"ttl,omitempty"`
+}
+
+func (server ICEServerConfig) Validate() error {
+	if len(server.URLs) == 0 {
+		return errors.New("at least one url is required")
+	}
+
+	isTurn := false
+	for _, url := range server.URLs {
+		switch {
+		case strings.HasPrefix(url, "stun:"), strings.HasPrefix(url, "stuns:"):
+		case strings.HasPrefix(url, "turn:"), strings.HasPrefix(url, "turns:"):
+			isTurn = true
+		default:
+			return fmt.Errorf("%q is not a stun or turn url", url)
+		}
+	}
+
+	if server.Secret != "" {
+		if server.Username != "" || server.Credential != "" {
+			return errors.New("secret can't be combined with a static username or credential")
+		}
+		if server.TTL.Duration <= 0 {
+			return errors.New("ttl must be positive when a secret is set")
+		}
+	} else if isTurn && (server.Username == "" || server.Credential == "") {
+		return errors.New("turn servers require a username and credential, or a secret")
+	}
+
+	return nil
+}
+
+func (server ICEServerConfig) ForUser(userId string, now time.Time) webrtc.ICEServer {
+	iceServer := webrtc.ICEServer{
+		URLs:       server.URLs,
+		Username:   server.Username,
+		Credential: server.Credential,
+	}
+
+	if server.Secret != "" {
+		iceServer.Username, iceServer.Credential = NewTurnCredentials(server.Secret, userId, now.Add(server.TTL.Duration))
+	}
+	if iceServer.Credential == "" {
+		iceServer.Credential = nil
+	}
+
+	return iceServer
+}
+
+func NewTurnCredentials(secret string, userId string, expiry time.Time) (string, string) {
+	username := fmt.Sprintf("%d:%s", expiry.Unix(), userId)
+	return username, TurnCredential(secret, username)
+}
+
+func TurnCredential(secret string, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func ICEServersFor(userId string) []webrtc.ICEServer {
+	now := time.Now()
+	cfg := GetConfig()
+
+	servers := cfg.ICE.Servers
+	if cfg.Turn.Enabled {
+		servers = append(slices.Clone(servers), cfg.Turn.ICEServer())
+	}
+
+	iceServers := make([]webrtc.ICEServer, 0, len(servers))
+	for _, server := range servers {
+		iceServers = append(iceServers, server.ForUser(userId, now))
+	}
+
+	return iceServers
+}
+
+func (cfg ICEConfig) Validate() error {
+	for i, server := range cfg.Servers {
+		if err := server.Validate(); err != nil {
+			return fmt.Errorf("servers[%d]: %w", i, err)
+		}
+	}
+
+	hasTCP := false
+	for _, name := range cfg.NetworkTypes {
+		networkType, err := webrtc.NewNetworkType(name)
+		if err != nil {
+			return fmt.Errorf("network_types: %w", err)
+		}
+		if networkType == webrtc.NetworkTypeTCP4 || networkType == webrtc.NetworkTypeTCP6 {
+			hasTCP = true
+		}
+	}
+	if hasTCP && cfg.TCPPort == 0 {
+		return errors.New("network_types: tcp candidates require tcp_port to be set")
+	}
+	if cfg.Lite && len(cfg.NAT1To1IPs) == 0 {
+		logger.Warn("ice lite is enabled without nat_1to1_ips, host candidates must be publicly reachable")
+	}
+
+	if cfg.UDPPort < 0 || cfg.UDPPort > 65535 {
+		return errors.New("udp_port: must be between 0 and 65535")
+	}
+	if cfg.TCPPort < 0 || cfg.TCPPort > 65535 {
+		return errors.New("tcp_port: must be between 0 and 65535")
+	}
+	for _, ip := range cfg.NAT1To1IPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("nat_1to1_ips: %q is not an ip address", ip)
+		}
+	}
+	for _, cidr := range cfg.IPFilter {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("ip_filter: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (cfg ICEConfig) sameTransport(other ICEConfig) bool {
+	cfg.Servers, other.Servers = nil, nil
+	return reflect.DeepEqual(cfg, other)
+}
+
+var settingEngine = webrtc.SettingEngine{}
+
+// InitICETransport builds the setting engine shared by every room, so all
+// peer connections go through the same udp and tcp muxes.
+func InitICETransport(cfg ICEConfig) error {
+	engine := webrtc.SettingEngine{}
+	engine.SetLite(cfg.Lite)
+
+	if cfg.UDPPort != 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: cfg.UDPPort})
+		if err != nil {
+			return fmt.Errorf("failed listening ice udp mux, %w", err)
+		}
+		engine.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+		logger.Info(fmt.Sprintf("ice udp mux listening on %s", conn.LocalAddr()))
+	}
+
+	if cfg.TCPPort != 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: cfg.TCPPort})
+		if err != nil {
+			return fmt.Errorf("failed listening ice tcp mux, %w", err)
+		}
+		engine.SetICETCPMux(webrtc.NewICETCPMux(nil, listener, 8))
+		logger.Info(fmt.Sprintf("ice tcp mux listening on %s", listener.Addr()))
+	}
+
+	engine.SetNetworkTypes(cfg.networkTypes())
+
+	if len(cfg.NAT1To1IPs) > 0 {
+		engine.SetNAT1To1IPs(cfg.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+
+	if len(cfg.Interfaces) > 0 {
+		interfaces := slices.Clone(cfg.Interfaces)
+		engine.SetInterfaceFilter(func(name string) bool {
+			return slices.Contains(interfaces, name)
+		})
+	}
+
+	if len(cfg.IPFilter) > 0 {
+		networks := make([]*net.IPNet, 0, len(cfg.IPFilter))
+		for _, cidr := range cfg.IPFilter {
+			_, network, _ := net.ParseCIDR(cidr)
+			networks = append(networks, network)
+		}
+		engine.SetIPFilter(func(ip net.IP) bool {
+			return slices.ContainsFunc(networks, func(network *net.IPNet) bool {
+				return network.Contains(ip)
+			})
+		})
+	}
+
+	settingEngine = engine
+
+	return nil
+}
+
+// networkTypes defaults to udp, plus passive tcp candidates when the tcp
+// mux is enabled.
+func (cfg ICEConfig) networkTypes() []webrtc.NetworkType {
+	if len(cfg.NetworkTypes) == 0 {
+		networkTypes := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+		if cfg.TCPPort != 0 {
+			networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+		}
+		return networkTypes
+	}
+
+	networkTypes := make([]webrtc.NetworkType, 0, len(cfg.NetworkTypes))
+	for _, name := range cfg.NetworkTypes {
+		networkType, _ := webrtc.NewNetworkType(name)
+		networkTypes = append(networkTypes, networkType)
+	}
+	return networkTypes
+}
+
+func PeerConnectionConfiguration(userId string) webrtc.Configuration {
+	configuration := webrtc.Configuration{
+		BundlePolicy: webrtc.BundlePolicyMaxBundle,
+	}
+
+	// A lite agent only offers host candidates, ice servers would be unused.
+	if !GetConfig().ICE.Lite {
+		configuration.ICEServers = ICEServersFor(userId)
+	}
+
+	return configuration
+}
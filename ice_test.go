@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestTurnCredential(t *testing.T) {
+	tests := []struct {
+		secret     string
+		username   string
+		credential string
+	}{
+		{secret: "secret", username: "1700000000:alice", credential: "d8soP47RbdIKLDUOpnJPVQyq5Ts="},
+		{secret: "north", username: "1433895918:user", credential: "/gk4t5tUc08OpM3NjrVjHSFVNmY="},
+		{secret: "", username: "0:", credential: "OMULkEY8i3k1y1l5jqF6MXE1eYs="},
+	}
+
+	for _, test := range tests {
+		t.Run(test.username, func(t *testing.T) {
+			if credential := TurnCredential(test.secret, test.username); credential != test.credential {
+				t.Errorf("credential %s, want %s", credential, test.credential)
+			}
+		})
+	}
+}
+
+func TestNewTurnCredentials(t *testing.T) {
+	username, credential := NewTurnCredentials("secret", "alice", time.Unix(1700000000, 0))
+	if username != "1700000000:alice" || credential != "d8soP47RbdIKLDUOpnJPVQyq5Ts=" {
+		t.Errorf("credentials %s %s", username, credential)
+	}
+
+	// A user id holding the separator stays in the username as is.
+	if username, _ := NewTurnCredentials("secret", "a:b", time.Unix(10, 0)); username != "10:a:b" {
+		t.Errorf("username %s", username)
+	}
+}
+
+func TestICEServerForUser(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name   string
+		server ICEServerConfig
+		ice    webrtc.ICEServer
+	}{
+		{
+			name:   "stun",
+			server: ICEServerConfig{URLs: []string{"stun:stun.example.com:3478"}},
+			ice:    webrtc.ICEServer{URLs: []string{"stun:stun.example.com:3478"}},
+		},
+		{
+			name:   "static credentials",
+			server: ICEServerConfig{URLs: []string{"turn:turn.example.com"}, Username: "user", Credential: "pass"},
+			ice:    webrtc.ICEServer{URLs: []string{"turn:turn.example.com"}, Username: "user", Credential: "pass"},
+		},
+		{
+			name:   "time limited credentials",
+			server: ICEServerConfig{URLs: []string{"turn:turn.example.com"}, Secret: "secret", TTL: Duration{time.Hour}},
+			ice: webrtc.ICEServer{
+				URLs:       []string{"turn:turn.example.com"},
+				Username:   "1700003600:alice",
+				Credential: TurnCredential("secret", "1700003600:alice"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ice := test.server.ForUser("alice", now); !reflect.DeepEqual(ice, test.ice) {
+				t.Errorf("ice server %+v, want %+v", ice, test.ice)
+			}
+		})
+	}
+}
+
+func TestICEServerConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		server ICEServerConfig
+		valid  bool
+	}{
+		{name: "stun", server: ICEServerConfig{URLs: []string{"stun:stun.example.com", "stuns:stun.example.com"}}, valid: true},
+		{name: "turn with credentials", server: ICEServerConfig{URLs: []string{"turns:turn.example.com"}, Username: "u", Credential: "c"}, valid: true},
+		{name: "turn with secret", server: ICEServerConfig{URLs: []string{"turn:turn.example.com"}, Secret: "s", TTL: Duration{time.Hour}}, valid: true},
+		{name: "no urls", server: ICEServerConfig{}},
+		{name: "unknown scheme", server: ICEServerConfig{URLs: []string{"http://turn.example.com"}}},
+		{name: "turn without credentials", server: ICEServerConfig{URLs: []string{"turn:turn.example.com"}, Username: "u"}},
+		{name: "secret and static credentials", server: ICEServerConfig{URLs: []string{"turn:turn.example.com"}, Secret: "s", TTL: Duration{time.Hour}, Username: "u"}},
+		{name: "secret without ttl", server: ICEServerConfig{URLs: []string{"turn:turn.example.com"}, Secret: "s"}},
+		{name: "secret with negative ttl", server: ICEServerConfig{URLs: []string{"turn:turn.example.com"}, Secret: "s", TTL: Duration{-time.Hour}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.server.Validate(); (err == nil) != test.valid {
+				t.Errorf("validated with %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrRoomAccessDenied = errors.New("a valid passcode or invite token is required to join this room")
+
+type RoomInvite struct {
+	Token     string    `json:"token"`
+	RoomId    string    `json:"room_id"`
+	CreatedBy string    `json:"created_by"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+}
+
+func (invite *RoomInvite) usable(now time.Time) bool {
+	if !invite.ExpiresAt.IsZero() && now.After(invite.ExpiresAt) {
+		return false
+	}
+	return invite.MaxUses == 0 || invite.Uses < invite.MaxUses
+}
+
+func hashPasscode(passcode string) ([]byte, error) {
+	if len(passcode) > 72 {
+		return nil, errors.New("passcode must not exceed 72 bytes")
+	}
+	return bcrypt.GenerateFromPassword([]byte(passcode), bcrypt.DefaultCost)
+}
+
+func (room *Room) IsProtected() bool {
+	return room.InviteOnly || room.PasscodeProtected
+}
+
+// RequiresToken tells if the players of the room need a token, lobby rooms
+// included as their players can't wait for a moderator to admit them.
+func (room *Room) RequiresToken() bool {
+	return room.IsProtected() || room.Lobby
+}
+
+func (room *Room) CreateInvite(user *User, expiresIn time.Duration, maxUses int) (*RoomInvite, error) {
+	if user.Id != room.Owner() {
+		return nil, errors.New("only the room owner can create invites")
+	}
+	if expiresIn < 0 || maxUses < 0 {
+		return nil, errors.New("invite expiry and max uses must not be negative")
+	}
+
+	buffer := make([]byte, 24)
+	if _, err := rand.Read(buffer); err != nil {
+		return nil, err
+	}
+
+	invite := &RoomInvite{
+		Token:     base64.RawURLEncoding.EncodeToString(buffer),
+		RoomId:    room.Id,
+		CreatedBy: user.Id,
+		MaxUses:   maxUses,
+		Uses:      0,
+	}
+	if expiresIn > 0 {
+		invite.ExpiresAt = time.Now().Add(expiresIn)
+	}
+
+	room.invitesMutex.Lock()
+	room.invites[invite.Token] = invite
+	room.invitesMutex.Unlock()
+
+	logger.Info(fmt.Sprintf("user %s create an invite for room %s", user.Id, room.Id))
+
+	return invite, nil
+}
+
+// CheckAccess lets the user in when the room is open, when the user owns it,
+// with the right passcode, or by consuming one use of an invite token. The
+// consumed invite is returned so the use can be refunded if the join fails.
+func (room *Room) CheckAccess(user *User, passcode string, inviteToken string) (*RoomInvite, error) {
+	if !room.IsProtected() || user.Id == room.Owner() {
+		return nil, nil
+	}
+
+	if inviteToken != "" {
+		if invite := room.consumeInvite(inviteToken); invite != nil {
+			return invite, nil
+		}
+	}
+
+	if room.PasscodeProtected && !room.InviteOnly && passcode != "" {
+		if bcrypt.CompareHashAndPassword(room.passcodeHash, []byte(passcode)) == nil {
+			return nil, nil
+		}
+	}
+
+	return nil, ErrRoomAccessDenied
+}
+
+// CheckToken authorizes the http apis on the room, the bearer token is either
+// the admin token or an invite of the room, consuming one of its uses.
+func (room *Room) CheckToken(token string) error {
+	if token != "" && (isAdminToken(token) || room.consumeInvite(token) != nil) {
+		return nil
+	}
+	return ErrRoomAccessDenied
+}
+
+func (room *Room) consumeInvite(token string) *RoomInvite {
+	room.invitesMutex.Lock()
+	defer room.invitesMutex.Unlock()
+
+	now := time.Now()
+	for key, invite := range room.invites {
+		if !invite.usable(now) {
+			delete(room.invites, key)
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(token)) != 1 {
+			continue
+		}
+
+		invite.Uses++
+		if !invite.usable(now) {
+			delete(room.invites, key)
+		}
+		return invite
+	}
+
+	return nil
+}
+
+// refundInvite gives back the use of an invite whose holder never got in,
+// restoring the invite if that use exhausted it.
+func (room *Room) refundInvite(invite *RoomInvite) {
+	if invite == nil {
+		return
+	}
+
+	room.invitesMutex.Lock()
+	defer room.invitesMutex.Unlock()
+
+	invite.Uses--
+	if invite.usable(time.Now()) {
+		room.invites[invite.Token] = invite
+	}
+}
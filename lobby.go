@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+type LobbyStatus string
+
+const (
+	LobbyStatusWaiting  LobbyStatus = "waiting"
+	LobbyStatusAdmitted LobbyStatus = "admitted"
+	LobbyStatusDenied   LobbyStatus = "denied"
+	LobbyStatusLeft     LobbyStatus = "left"
+)
+
+var ErrUserNotInLobby = errors.New("the target user is not waiting in the lobby")
+
+// RequestJoin joins the room or waits in its lobby, the invite the user got
+// in with is kept while waiting and refunded unless the user is admitted.
+func (user *User) RequestJoin(room *Room, invite *RoomInvite) error {
+	if !room.Lobby || room.RoleOf(user).CanModerate() {
+		return user.JoinRoom(room)
+	}
+
+	if room.IsBanned(user) {
+		return ErrUserBanned
+	}
+
+	if user.Room != nil {
+		if err := user.LeaveCurrentRoom("leave current room, because waiting in another room lobby"); err != nil {
+			return err
+		}
+	}
+	user.LeaveLobby()
+
+	user.lobbyInvite = invite
+	room.lobbyMutex.Lock()
+	room.lobby[user.Id] = user
+	room.lobbyMutex.Unlock()
+	user.LobbyRoom = room
+
+	logger.Info(fmt.Sprintf("user %s is waiting in the lobby of room %s", user.Id, room.Id))
+	user.SendMessageJson(NewMessageLobbyStatus(room, user, LobbyStatusWaiting, ""))
+	room.BroadcastToModeratorsJson(NewMessageLobbyRequest(room, user))
+
+	return nil
+}
+
+func (user *User) LeaveLobby() {
+	room := user.LobbyRoom
+	if room == nil {
+		return
+	}
+
+	if room.takeFromLobby(user.Id) != nil {
+		room.refundInvite(user.takeLobbyInvite())
+		logger.Info(fmt.Sprintf("user %s left the lobby of room %s", user.Id, room.Id))
+		room.BroadcastToModeratorsJson(NewMessageLobbyStatus(room, user, LobbyStatusLeft, ""))
+	}
+	user.LobbyRoom = nil
+}
+
+func (room *Room) Admit(actor *User, userId string) error {
+	if !room.RoleOf(actor).CanModerate() {
+		return ErrNotAllowed
+	}
+
+	user := room.takeFromLobby(userId)
+	if user == nil {
+		return ErrUserNotInLobby
+	}
+	user.LobbyRoom = nil
+	invite := user.takeLobbyInvite()
+
+	logger.Info(fmt.Sprintf("user %s admit %s in room %s", actor.Id, user.Id, room.Id))
+	user.SendMessageJson(NewMessageLobbyStatus(room, user, LobbyStatusAdmitted, ""))
+
+	if err := user.JoinRoom(room); err != nil {
+		room.refundInvite(invite)
+		user.SendMessageJson(NewReplyErrorRoomJoin(err.Error()))
+		return err
+	}
+
+	return nil
+}
+
+func (room *Room) Deny(actor *User, userId string, reason string) error {
+	if !room.RoleOf(actor).CanModerate() {
+		return ErrNotAllowed
+	}
+
+	user := room.takeFromLobby(userId)
+	if user == nil {
+		return ErrUserNotInLobby
+	}
+	user.LobbyRoom = nil
+	room.refundInvite(user.takeLobbyInvite())
+
+	logger.Info(fmt.Sprintf("user %s deny %s in room %s", actor.Id, user.Id, room.Id))
+	user.SendMessageJson(NewMessageLobbyStatus(room, user, LobbyStatusDenied, reason))
+
+	return nil
+}
+
+func (room *Room) GetLobbyUsers() []*User {
+	room.lobbyMutex.Lock()
+	defer room.lobbyMutex.Unlock()
+
+	users := make([]*User, 0, len(room.lobby))
+	for _, user := range room.lobby {
+		users = append(users, user)
+	}
+	return users
+}
+
+func (room *Room) BroadcastToModeratorsJson(msg any) {
+	for _, user := range room.GetUsers() {
+		if room.RoleOf(user).CanModerate() {
+			user.SendMessageJson(msg)
+		}
+	}
+}
+
+// sendLobbyRequests catches up a moderator on the users already waiting.
+func (room *Room) sendLobbyRequests(moderator *User) {
+	for _, user := range room.GetLobbyUsers() {
+		moderator.SendMessageJson(NewMessageLobbyRequest(room, user))
+	}
+}
+
+func (user *User) takeLobbyInvite() *RoomInvite {
+	invite := user.lobbyInvite
+	user.lobbyInvite = nil
+	return invite
+}
+
+func (room *Room) takeFromLobby(userId string) *User {
+	room.lobbyMutex.Lock()
+	defer room.lobbyMutex.Unlock()
+
+	user, ok := room.lobby[userId]
+	if !ok {
+		return nil
+	}
+	delete(room.lobby, userId)
+	return user
+}
+
+// clearLobby denies every waiting user when the room goes away.
+func (room *Room) clearLobby(reason string) {
+	room.lobbyMutex.Lock()
+	waiting := room.lobby
+	room.lobby = make(map[string]*User)
+	room.lobbyMutex.Unlock()
+
+	for _, user := range waiting {
+		user.LobbyRoom = nil
+		user.takeLobbyInvite()
+		user.SendMessageJson(NewMessageLobbyStatus(room, user, LobbyStatusDenied, reason))
+	}
+}
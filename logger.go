@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"strings"
+	"sync/atomic"
 )
 
 type LogLevel int
@@ -21,11 +23,14 @@ type Loggerer interface {
 	Warn(args ...any)
 	Error(args ...any)
 	Log(level LogLevel, args ...any)
+	SetLevel(level LogLevel)
 }
 
+// Logger keeps its level in an atomic, it is changed by config reloads while
+// every goroutine logs.
 type Logger struct {
 	Name  string
-	Level LogLevel
+	level *atomic.Int32
 }
 
 type LoggerOptions struct {
@@ -35,11 +40,12 @@ type LoggerOptions struct {
 func CreateLogger(name string, opts *LoggerOptions) Loggerer {
 	logger := &Logger{
 		Name:  name,
-		Level: Info,
+		level: new(atomic.Int32),
 	}
 
+	logger.SetLevel(Info)
 	if opts != nil {
-		logger.Level = opts.Level
+		logger.SetLevel(opts.Level)
 	}
 
 	return logger
@@ -62,8 +68,33 @@ func (l LogLevel) String() string {
 	}
 }
 
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "trace":
+		return Trace, nil
+	case "debug":
+		return Debug, nil
+	case "info":
+		return Info, nil
+	case "warn":
+		return Warn, nil
+	case "error":
+		return Error, nil
+	default:
+		return Info, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+func (l *Logger) SetLevel(level LogLevel) {
+	l.level.Store(int32(level))
+}
+
+func (l *Logger) Level() LogLevel {
+	return LogLevel(l.level.Load())
+}
+
 func (l *Logger) Log(level LogLevel, args ...any) {
-	if l.Level > level {
+	if l.Level() > level {
 		return
 	}
 	fmt.Printf("(%s)\t[%s]\t%v\n", l.Name, level.String(), args)
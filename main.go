@@ -1,8 +1,13 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 var logger = CreateLogger("main", &LoggerOptions{
@@ -21,13 +26,84 @@ func httpHandleRoot(w http.ResponseWriter, r *http.Request) {
 	logger.Info(fmt.Sprintf("new user created %s", user.Id))
 }
 
+func watchConfigReload(source *ConfigSource) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		logger.Info("received SIGHUP, reloading config")
+		if err := ReloadConfig(source); err != nil {
+			logger.Error(fmt.Sprintf("failed reloading config, keeping the current one, %s", err.Error()))
+		}
+	}
+}
+
 func main() {
+	source, err := ParseConfigSource(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+
+	cfg, err := source.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	if source.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	SetConfig(cfg)
+	go watchConfigReload(source)
+
+	if err := InitICETransport(cfg.ICE); err != nil {
+		panic(err)
+	}
+
+	if cfg.Turn.Enabled {
+		turnServer, err := NewTurnServer(cfg.Turn)
+		if err != nil {
+			panic(err)
+		}
+		defer turnServer.Close()
+	}
+
+	if cfg.RTMP.Listen != "" {
+		rtmpServer, err := NewRTMPServer(cfg.RTMP)
+		if err != nil {
+			panic(err)
+		}
+		defer rtmpServer.Close()
+	}
+
+	if cfg.RTSP.Listen != "" {
+		rtspServer, err := NewRTSPServer(cfg.RTSP)
+		if err != nil {
+			panic(err)
+		}
+		defer rtspServer.Close()
+	}
+
 	logger.Info("SKEWRTC SFU & Signaling server is up!")
 
 	mux := http.DefaultServeMux
 	mux.HandleFunc("/", httpHandleRoot)
+	RegisterAdminHandlers(mux)
+	RegisterWhipHandlers(mux)
+	RegisterWhepHandlers(mux)
+	RegisterHLSHandlers(mux)
+	RegisterMetricsHandlers(mux)
 
-	if err := http.ListenAndServe("0.0.0.0:8888", mux); err != nil {
+	if err := http.ListenAndServe(cfg.Listen, mux); err != nil {
 		panic(err)
 	}
 }
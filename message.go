@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 )
@@ -24,6 +26,22 @@ type ServerToUserMessage struct {
 	Type string `json:"type"`
 }
 
+type ServerHelloMessage struct {
+	ServerToUserMessage
+	UserId     string             `json:"user_id"`
+	IceServers []webrtc.ICEServer `json:"ice_servers"`
+}
+
+func NewMessageServerHello(user *User) ServerHelloMessage {
+	return ServerHelloMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "server_hello",
+		},
+		UserId:     user.Id,
+		IceServers: ICEServersFor(user.Id),
+	}
+}
+
 type UsersListReply struct {
 	ServerToUserMessage
 	Users []*User `json:"users"`
@@ -39,7 +57,7 @@ func NewReplyUsersList(users []*User) UsersListReply {
 }
 
 type RoomCreateRequest struct {
-	VideoCodec string `json:"video_codec,omitempty"`
+	NewRoomOptions
 }
 
 func NewReplyErrorRoomCreate(reason string) ErrorMessage {
@@ -62,6 +80,39 @@ func NewRequestRoomCreate(msg []byte) (RoomCreateRequest, error) {
 
 // TODO: Add reply once room has been created
 
+type RoomSummary struct {
+	Id           string `json:"id"`
+	Name         string `json:"name,omitempty"`
+	Participants int    `json:"participants"`
+	Publishers   int    `json:"publishers"`
+	Viewers      int    `json:"viewers"`
+}
+
+type RoomsListReply struct {
+	ServerToUserMessage
+	Rooms []RoomSummary `json:"rooms"`
+}
+
+func NewReplyRoomsList(rooms []*Room) RoomsListReply {
+	summaries := make([]RoomSummary, 0, len(rooms))
+	for _, room := range rooms {
+		summaries = append(summaries, RoomSummary{
+			Id:           room.Id,
+			Name:         room.Name,
+			Participants: room.ParticipantsCount(),
+			Publishers:   room.PublishersCount(),
+			Viewers:      room.ViewersCount(),
+		})
+	}
+
+	return RoomsListReply{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "rooms_list",
+		},
+		Rooms: summaries,
+	}
+}
+
 type RoomLeaveReply struct {
 	ServerToUserMessage
 	Room  *Room  `json:"room"`
@@ -85,14 +136,36 @@ func NewReplyRoomLeaved(room *Room, cause string) RoomLeaveReply {
 	}
 }
 
+type RoomExpiringMessage struct {
+	ServerToUserMessage
+	RoomId    string    `json:"room_id"`
+	Reason    string    `json:"reason"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func NewMessageRoomExpiring(room *Room, reason string, expiresAt time.Time) RoomExpiringMessage {
+	return RoomExpiringMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "room_expiring",
+		},
+		RoomId:    room.Id,
+		Reason:    reason,
+		ExpiresAt: expiresAt,
+	}
+}
+
 type RoomJoinRequest struct {
 	UserToServerMessage
-	RoomId string `json:"room_id"`
+	RoomId      string `json:"room_id"`
+	Passcode    string `json:"passcode,omitempty"`
+	InviteToken string `json:"invite_token,omitempty"`
 }
 
 type RoomJoinReply struct {
 	ServerToUserMessage
-	Room *Room `json:"room"`
+	Room     *Room         `json:"room"`
+	Role     Role          `json:"role"`
+	Messages []RoomMessage `json:"messages"`
 }
 
 func NewReplyErrorRoomJoin(reason string) ErrorMessage {
@@ -102,6 +175,20 @@ func NewReplyErrorRoomJoin(reason string) ErrorMessage {
 	}
 }
 
+func NewReplyErrorRoomFull(reason string) ErrorMessage {
+	return ErrorMessage{
+		Error:  "room_full",
+		Reason: reason,
+	}
+}
+
+func NewReplyErrorRoomAccessDenied(reason string) ErrorMessage {
+	return ErrorMessage{
+		Error:  "room_access_denied",
+		Reason: reason,
+	}
+}
+
 func NewRequestRoomJoin(msg []byte) (RoomJoinRequest, error) {
 	request := RoomJoinRequest{}
 
@@ -113,15 +200,257 @@ func NewRequestRoomJoin(msg []byte) (RoomJoinRequest, error) {
 	return request, nil
 }
 
-func NewReplyRoomJoined(room *Room) RoomJoinReply {
+func NewReplyRoomJoined(room *Room, role Role) RoomJoinReply {
 	return RoomJoinReply{
 		ServerToUserMessage: ServerToUserMessage{
 			Type: "room_joined",
 		},
-		Room: room,
+		Room:     room,
+		Role:     role,
+		Messages: room.GetHistory(),
+	}
+}
+
+type InviteCreateRequest struct {
+	UserToServerMessage
+	ExpiresIn Duration `json:"expires_in"`
+	MaxUses   int      `json:"max_uses"`
+}
+
+type InviteCreateReply struct {
+	ServerToUserMessage
+	Invite *RoomInvite `json:"invite"`
+}
+
+func NewReplyErrorInviteCreate(reason string) ErrorMessage {
+	return ErrorMessage{
+		Error:  "create_invite_failure",
+		Reason: reason,
+	}
+}
+
+func NewRequestInviteCreate(msg []byte) (InviteCreateRequest, error) {
+	request := InviteCreateRequest{}
+
+	err := json.Unmarshal(msg, &request)
+	if err != nil {
+		return request, err
+	}
+
+	return request, nil
+}
+
+func NewReplyInviteCreated(invite *RoomInvite) InviteCreateReply {
+	return InviteCreateReply{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "invite_created",
+		},
+		Invite: invite,
+	}
+}
+
+type ModerationRequest struct {
+	UserToServerMessage
+	UserId   string `json:"user_id,omitempty"`
+	StreamId string `json:"stream_id,omitempty"`
+	TrackId  string `json:"track_id,omitempty"`
+	Role     string `json:"role,omitempty"`
+	Muted    *bool  `json:"muted,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type RoleChangedMessage struct {
+	ServerToUserMessage
+	RoomId string `json:"room_id"`
+	UserId string `json:"user_id"`
+	Role   Role   `json:"role"`
+}
+
+type TrackMutedMessage struct {
+	ServerToUserMessage
+	StreamId string `json:"stream_id"`
+	TrackId  string `json:"track_id"`
+	Muted    bool   `json:"muted"`
+	By       string `json:"by"`
+}
+
+type PublishStoppedMessage struct {
+	ServerToUserMessage
+	StreamId string `json:"stream_id"`
+	Cause    string `json:"cause"`
+}
+
+func NewReplyErrorModeration(action string, reason string) ErrorMessage {
+	return ErrorMessage{
+		Error:  fmt.Sprintf("%s_failure", action),
+		Reason: reason,
+	}
+}
+
+func NewRequestModeration(msg []byte) (ModerationRequest, error) {
+	request := ModerationRequest{}
+
+	err := json.Unmarshal(msg, &request)
+	if err != nil {
+		return request, err
+	}
+
+	return request, nil
+}
+
+func NewMessageRoleChanged(room *Room, user *User, role Role) RoleChangedMessage {
+	return RoleChangedMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "role_changed",
+		},
+		RoomId: room.Id,
+		UserId: user.Id,
+		Role:   role,
+	}
+}
+
+func NewMessageTrackMuted(stream *IncomingStream, trackId string, muted bool, by *User) TrackMutedMessage {
+	return TrackMutedMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "track_muted",
+		},
+		StreamId: stream.Id,
+		TrackId:  trackId,
+		Muted:    muted,
+		By:       by.Id,
+	}
+}
+
+func NewMessagePublishStopped(stream *IncomingStream, cause string) PublishStoppedMessage {
+	return PublishStoppedMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "publish_stopped",
+		},
+		StreamId: stream.Id,
+		Cause:    cause,
+	}
+}
+
+type LobbyRequestMessage struct {
+	ServerToUserMessage
+	RoomId string `json:"room_id"`
+	User   *User  `json:"user"`
+}
+
+type LobbyStatusMessage struct {
+	ServerToUserMessage
+	RoomId string      `json:"room_id"`
+	UserId string      `json:"user_id"`
+	Status LobbyStatus `json:"status"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+func NewMessageLobbyRequest(room *Room, user *User) LobbyRequestMessage {
+	return LobbyRequestMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "lobby_request",
+		},
+		RoomId: room.Id,
+		User:   user,
 	}
 }
 
+func NewMessageLobbyStatus(room *Room, user *User, status LobbyStatus, reason string) LobbyStatusMessage {
+	return LobbyStatusMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "lobby_status",
+		},
+		RoomId: room.Id,
+		UserId: user.Id,
+		Status: status,
+		Reason: reason,
+	}
+}
+
+type BreakoutsRequest struct {
+	UserToServerMessage
+	Count       int             `json:"count,omitempty"`
+	Assignments map[string]int  `json:"assignments,omitempty"`
+	Duration    Duration        `json:"duration,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+type BreakoutsStateMessage struct {
+	ServerToUserMessage
+	RoomId    string            `json:"room_id"`
+	Breakouts []BreakoutSummary `json:"breakouts"`
+}
+
+type BreakoutBroadcastMessage struct {
+	ServerToUserMessage
+	RoomId  string          `json:"room_id"`
+	From    string          `json:"from"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func NewReplyErrorBreakouts(action string, reason string) ErrorMessage {
+	return ErrorMessage{
+		Error:  fmt.Sprintf("%s_failure", action),
+		Reason: reason,
+	}
+}
+
+func NewRequestBreakouts(msg []byte) (BreakoutsRequest, error) {
+	request := BreakoutsRequest{}
+
+	err := json.Unmarshal(msg, &request)
+	if err != nil {
+		return request, err
+	}
+
+	return request, nil
+}
+
+func NewMessageBreakoutsState(room *Room) BreakoutsStateMessage {
+	return BreakoutsStateMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "breakouts_state",
+		},
+		RoomId:    room.Id,
+		Breakouts: room.BreakoutsSummary(),
+	}
+}
+
+func NewMessageBreakoutBroadcast(room *Room, from *User, payload json.RawMessage) BreakoutBroadcastMessage {
+	return BreakoutBroadcastMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "breakout_broadcast",
+		},
+		RoomId:  room.Id,
+		From:    from.Id,
+		Payload: payload,
+	}
+}
+
+type SendMessageRequest struct {
+	UserToServerMessage
+	To      string          `json:"to,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func NewReplyErrorSendMessage(reason string) ErrorMessage {
+	return ErrorMessage{
+		Error:  "send_message_failure",
+		Reason: reason,
+	}
+}
+
+func NewRequestSendMessage(msg []byte) (SendMessageRequest, error) {
+	request := SendMessageRequest{}
+
+	err := json.Unmarshal(msg, &request)
+	if err != nil {
+		return request, err
+	}
+
+	return request, nil
+}
+
 type PublishRequest struct {
 	UserToServerMessage
 	SdpOffer webrtc.SessionDescription `json:"sdp_offer"`
@@ -140,6 +469,13 @@ func NewReplyErrorPublish(reason string) ErrorMessage {
 	}
 }
 
+func NewReplyErrorPublishLimitReached(reason string) ErrorMessage {
+	return ErrorMessage{
+		Error:  "publish_limit_reached",
+		Reason: reason,
+	}
+}
+
 func NewRequestPublish(msg []byte) (PublishRequest, error) {
 	request := PublishRequest{}
 
@@ -161,9 +497,214 @@ func NewReplyPublish(stream *IncomingStream, sdp webrtc.SessionDescription) Publ
 	}
 }
 
+type StreamEventMessage struct {
+	ServerToUserMessage
+	RoomId string          `json:"room_id"`
+	Stream *IncomingStream `json:"stream"`
+}
+
+func NewMessageStreamAdded(room *Room, stream *IncomingStream) StreamEventMessage {
+	return StreamEventMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "stream_added",
+		},
+		RoomId: room.Id,
+		Stream: stream,
+	}
+}
+
+func NewMessageStreamRemoved(room *Room, stream *IncomingStream) StreamEventMessage {
+	return StreamEventMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "stream_removed",
+		},
+		RoomId: room.Id,
+		Stream: stream,
+	}
+}
+
+type SubscribeRequest struct {
+	UserToServerMessage
+	StreamId       string                    `json:"stream_id,omitempty"`
+	SubscriptionId string                    `json:"subscription_id,omitempty"`
+	SdpAnswer      webrtc.SessionDescription `json:"sdp_answer,omitempty"`
+}
+
+type SubscribeOfferMessage struct {
+	ServerToUserMessage
+	SubscriptionId string                    `json:"subscription_id"`
+	StreamId       string                    `json:"stream_id"`
+	SdpOffer       webrtc.SessionDescription `json:"sdp_offer"`
+}
+
+type UnsubscribedMessage struct {
+	ServerToUserMessage
+	SubscriptionId string `json:"subscription_id"`
+	StreamId       string `json:"stream_id"`
+	Cause          string `json:"cause"`
+}
+
+func NewReplyErrorSubscribe(action string, reason string) ErrorMessage {
+	return ErrorMessage{
+		Error:  fmt.Sprintf("%s_failure", action),
+		Reason: reason,
+	}
+}
+
+func NewRequestSubscribe(msg []byte) (SubscribeRequest, error) {
+	request := SubscribeRequest{}
+
+	err := json.Unmarshal(msg, &request)
+	if err != nil {
+		return request, err
+	}
+
+	return request, nil
+}
+
+func NewMessageSubscribeOffer(sub *OutgoingStream, sdp webrtc.SessionDescription) SubscribeOfferMessage {
+	return SubscribeOfferMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "subscribe_offer",
+		},
+		SubscriptionId: sub.Id,
+		StreamId:       sub.StreamId,
+		SdpOffer:       sdp,
+	}
+}
+
+func NewMessageUnsubscribed(sub *OutgoingStream, cause string) UnsubscribedMessage {
+	return UnsubscribedMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "unsubscribed",
+		},
+		SubscriptionId: sub.Id,
+		StreamId:       sub.StreamId,
+		Cause:          cause,
+	}
+}
+
+type RecordingRequest struct {
+	UserToServerMessage
+	StreamId    string `json:"stream_id,omitempty"`
+	Format      string `json:"format,omitempty"`
+	RecordingId string `json:"recording_id,omitempty"`
+}
+
+type RecordingStateMessage struct {
+	ServerToUserMessage
+	RoomId      string          `json:"room_id"`
+	RecordingId string          `json:"recording_id"`
+	StreamId    string          `json:"stream_id,omitempty"`
+	Format      RecordingFormat `json:"format"`
+	State       string          `json:"state"`
+	StartedAt   time.Time       `json:"started_at"`
+	Cause       string          `json:"cause,omitempty"`
+}
+
+func NewReplyErrorRecording(action string, reason string) ErrorMessage {
+	return ErrorMessage{
+		Error:  fmt.Sprintf("%s_failure", action),
+		Reason: reason,
+	}
+}
+
+func NewRequestRecording(msg []byte) (RecordingRequest, error) {
+	request := RecordingRequest{}
+
+	err := json.Unmarshal(msg, &request)
+	if err != nil {
+		return request, err
+	}
+
+	return request, nil
+}
+
+func NewMessageRecordingState(recording *Recording, cause string) RecordingStateMessage {
+	state := "recording"
+	if recording.IsStopped() {
+		state = "stopped"
+	}
+
+	return RecordingStateMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "recording_state",
+		},
+		RoomId:      recording.RoomId,
+		RecordingId: recording.Id,
+		StreamId:    recording.StreamId,
+		Format:      recording.Format,
+		State:       state,
+		StartedAt:   recording.StartedAt,
+		Cause:       cause,
+	}
+}
+
+type ForwardRequest struct {
+	UserToServerMessage
+	StreamId  string `json:"stream_id,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	RTCP      bool   `json:"rtcp,omitempty"`
+	ForwardId string `json:"forward_id,omitempty"`
+}
+
+type ForwardStateMessage struct {
+	ServerToUserMessage
+	RoomId    string          `json:"room_id"`
+	ForwardId string          `json:"forward_id"`
+	StreamId  string          `json:"stream_id"`
+	Host      string          `json:"host"`
+	Port      int             `json:"port"`
+	RTCP      bool            `json:"rtcp"`
+	State     string          `json:"state"`
+	Tracks    []*ForwardTrack `json:"tracks,omitempty"`
+	SDP       string          `json:"sdp,omitempty"`
+}
+
+func NewReplyErrorForward(action string, reason string) ErrorMessage {
+	return ErrorMessage{
+		Error:  fmt.Sprintf("%s_failure", action),
+		Reason: reason,
+	}
+}
+
+func NewRequestForward(msg []byte) (ForwardRequest, error) {
+	request := ForwardRequest{}
+
+	err := json.Unmarshal(msg, &request)
+	if err != nil {
+		return request, err
+	}
+
+	return request, nil
+}
+
+func NewMessageForwardState(forward *Forward, state string) ForwardStateMessage {
+	message := ForwardStateMessage{
+		ServerToUserMessage: ServerToUserMessage{
+			Type: "forward_state",
+		},
+		RoomId:    forward.RoomId,
+		ForwardId: forward.Id,
+		StreamId:  forward.StreamId,
+		Host:      forward.Host,
+		Port:      forward.Port,
+		RTCP:      forward.RTCP,
+		State:     state,
+	}
+	if state != "stopped" {
+		message.SDP = forward.SDP()
+		message.Tracks = forward.GetTracks()
+	}
+
+	return message
+}
+
 type IceCandidateRequest struct {
 	UserToServerMessage
-	IceCandidate webrtc.ICECandidateInit `json:"candidate"`
+	SubscriptionId string                  `json:"subscription_id,omitempty"`
+	IceCandidate   webrtc.ICECandidateInit `json:"candidate"`
 }
 
 func NewReplyErrorIceCandidate(reason string) ErrorMessage {
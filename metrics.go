@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+type MetricsConfig struct {
+	// Token protects /metrics with a bearer token, the endpoint only answers
+	// loopback clients when it is empty.
+	Token string `json:"token" yaml:"token" toml:"token"`
+}
+
+// Every label of the metrics takes its values from a small fixed set, kinds,
+// codecs of the media engine, directions and reasons, never from ids.
+var (
+	metricsCounters   = make([]*counterVec, 0)
+	metricsHistograms = make([]*histogramVec, 0)
+
+	metricRTPPackets = newCounterVec("splash_rtp_packets_total",
+		"RTP packets received from publishers and sent to subscribers.", "direction", "kind", "codec")
+	metricRTPBytes = newCounterVec("splash_rtp_bytes_total",
+		"RTP bytes, headers included, received from publishers and sent to subscribers.", "direction", "kind", "codec")
+	metricRTPLost = newCounterVec("splash_rtp_packets_lost_total",
+		"RTP packets lost from publishers, and lost by subscribers according to their receiver reports.", "direction", "kind")
+	metricRTPJitter = newHistogramVec("splash_rtp_jitter_seconds",
+		"Interarrival jitter of the publishers, and of the subscribers according to their receiver reports.",
+		[]float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}, "direction", "kind")
+
+	metricNacks = newCounterVec("splash_rtcp_nacked_packets_total",
+		"RTP packets subscribers asked to retransmit.", "kind")
+	metricKeyframeRequests = newCounterVec("splash_rtcp_keyframe_requests_total",
+		"Keyframe requests received from subscribers and sent to publishers.", "direction", "type")
+
+	metricTransportFailures = newCounterVec("splash_transport_failures_total",
+		"Peer connections whose ICE or DTLS transport failed.", "peer", "reason")
+	metricRoomsDestroyed = newCounterVec("splash_rooms_destroyed_total",
+		"Destroyed rooms.", "reason")
+)
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	series map[string]*metricCounter
+	mutex  *sync.Mutex
+}
+
+type metricCounter struct {
+	values []string
+	value  atomic.Uint64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	vec := &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*metricCounter),
+		mutex:  new(sync.Mutex),
+	}
+	metricsCounters = append(metricsCounters, vec)
+	return vec
+}
+
+// With returns the counter of the label values, hot paths keep it instead of
+// looking it up for every packet.
+func (vec *counterVec) With(values ...string) *metricCounter {
+	key := strings.Join(values, "\xff")
+
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	counter, ok := vec.series[key]
+	if !ok {
+		counter = &metricCounter{values: values}
+		vec.series[key] = counter
+	}
+	return counter
+}
+
+func (counter *metricCounter) Add(delta uint64) {
+	counter.value.Add(delta)
+}
+
+func (counter *metricCounter) Inc() {
+	counter.value.Add(1)
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricHistogram
+	mutex   *sync.Mutex
+}
+
+type metricHistogram struct {
+	values []string
+	counts []uint64
+	sum    float64
+	count  uint64
+	mutex  *sync.Mutex
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	vec := &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricHistogram),
+		mutex:   new(sync.Mutex),
+	}
+	metricsHistograms = append(metricsHistograms, vec)
+	return vec
+}
+
+func (vec *histogramVec) With(values ...string) *metricHistogram {
+	key := strings.Join(values, "\xff")
+
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	histogram, ok := vec.series[key]
+	if !ok {
+		histogram = &metricHistogram{
+			values: values,
+			counts: make([]uint64, len(vec.buckets)),
+			mutex:  new(sync.Mutex),
+		}
+		vec.series[key] = histogram
+	}
+	return histogram
+}
+
+func (vec *histogramVec) Observe(value float64, values ...string) {
+	vec.With(values...).observe(vec.buckets, value)
+}
+
+func (histogram *metricHistogram) observe(buckets []float64, value float64) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	for i, bound := range buckets {
+		if value <= bound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.sum += value
+	histogram.count++
+}
+
+// gaugeSet holds the gauges computed while scraping.
+type gaugeSet struct {
+	name   string
+	help   string
+	labels []string
+	series map[string]float64
+	values map[string][]string
+}
+
+func newGaugeSet(name string, help string, labels ...string) *gaugeSet {
+	return &gaugeSet{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]float64),
+		values: make(map[string][]string),
+	}
+}
+
+func (gauges *gaugeSet) Add(delta float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	gauges.series[key] += delta
+	gauges.values[key] = values
+}
+
+func (gauges *gaugeSet) Max(value float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	gauges.series[key] = max(gauges.series[key], value)
+	gauges.values[key] = values
+}
+
+// codecLabel turns a mime type into the codec label, "video/VP8" into "vp8".
+func codecLabel(mimeType string) string {
+	_, codec, _ := strings.Cut(mimeType, "/")
+	return strings.ToLower(codec)
+}
+
+func kindLabel(mimeType string) string {
+	if strings.HasPrefix(strings.ToLower(mimeType), "video/") {
+		return webrtc.RTPCodecTypeVideo.String()
+	}
+	return webrtc.RTPCodecTypeAudio.String()
+}
+
+// rtpReceiveStats follows the sequence numbers and arrival times of a
+// published track, to count its lost packets and estimate its jitter the
+// way RFC 3550 receivers do.
+type rtpReceiveStats struct {
+	packets *metricCounter
+	bytes   *metricCounter
+	lost    *metricCounter
+	kind    string
+
+	clockRate     float64
+	started       bool
+	lastSequence  uint16
+	lastTimestamp uint32
+	lastArrival   time.Time
+	jitter        float64
+	lastReport    time.Time
+	mutex         *sync.Mutex
+}
+
+const metricsJitterInterval = time.Second
+
+func newRTPReceiveStats(codec webrtc.RTPCodecParameters) *rtpReceiveStats {
+	kind, name := kindLabel(codec.MimeType), codecLabel(codec.MimeType)
+	return &rtpReceiveStats{
+		packets:   metricRTPPackets.With("in", kind, name),
+		bytes:     metricRTPBytes.With("in", kind, name),
+		lost:      metricRTPLost.With("in", kind),
+		kind:      kind,
+		clockRate: float64(codec.ClockRate),
+		mutex:     new(sync.Mutex),
+	}
+}
+
+func (s *rtpReceiveStats) observe(packet *rtp.Packet, now time.Time) {
+	s.packets.Inc()
+	s.bytes.Add(uint64(packet.MarshalSize()))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.started {
+		s.started = true
+		s.lastSequence = packet.SequenceNumber
+		s.lastTimestamp = packet.Timestamp
+		s.lastArrival = now
+		s.lastReport = now
+		return
+	}
+
+	// Reordered and duplicated packets are left out, late packets were
+	// already counted as lost.
+	gap := packet.SequenceNumber - s.lastSequence
+	if gap == 0 || gap >= 0x8000 {
+		return
+	}
+	if gap > 1 {
+		s.lost.Add(uint64(gap - 1))
+	}
+	s.lastSequence = packet.SequenceNumber
+
+	// The difference of the transit times, computed from the deltas so the
+	// timestamp wrap doesn't show up as a spike.
+	transit := now.Sub(s.lastArrival).Seconds()*s.clockRate - float64(int32(packet.Timestamp-s.lastTimestamp))
+	s.jitter += (math.Abs(transit) - s.jitter) / 16
+	s.lastTimestamp = packet.Timestamp
+	s.lastArrival = now
+
+	if s.clockRate > 0 && now.Sub(s.lastReport) >= metricsJitterInterval {
+		s.lastReport = now
+		metricRTPJitter.Observe(s.jitter/s.clockRate, "in", s.kind)
+	}
+}
+
+// receiverFeedback accounts the rtcp a subscriber sends about one forwarded
+// track, the cumulative loss of its reports is turned into increments.
+type receiverFeedback struct {
+	ssrc      uint32
+	kind      string
+	clockRate uint32
+
+	lost      *metricCounter
+	nacks     *metricCounter
+	totalLost uint32
+	reported  bool
+}
+
+func newReceiverFeedback(sender *webrtc.RTPSender, kind string, clockRate uint32) *receiverFeedback {
+	feedback := &receiverFeedback{
+		kind:      kind,
+		clockRate: clockRate,
+		lost:      metricRTPLost.With("out", kind),
+		nacks:     metricNacks.With(kind),
+	}
+	if encodings := sender.GetParameters().Encodings; len(encodings) > 0 {
+		feedback.ssrc = uint32(encodings[0].SSRC)
+	}
+	return feedback
+}
+
+func (f *receiverFeedback) observe(packets []rtcp.Packet) {
+	for _, packet := range packets {
+		switch packet := packet.(type) {
+		case *rtcp.PictureLossIndication:
+			metricKeyframeRequests.With("in", "pli").Inc()
+		case *rtcp.FullIntraRequest:
+			metricKeyframeRequests.With("in", "fir").Inc()
+		case *rtcp.TransportLayerNack:
+			if packet.MediaSSRC != f.ssrc {
+				continue
+			}
+			for _, pair := range packet.Nacks {
+				f.nacks.Add(uint64(len(pair.PacketList())))
+			}
+		case *rtcp.ReceiverReport:
+			f.observeReports(packet.Reports)
+		case *rtcp.SenderReport:
+			f.observeReports(packet.Reports)
+		}
+	}
+}
+
+func (f *receiverFeedback) observeReports(reports []rtcp.ReceptionReport) {
+	for _, report := range reports {
+		if report.SSRC != f.ssrc {
+			continue
+		}
+		if f.reported && report.TotalLost > f.totalLost {
+			f.lost.Add(uint64(report.TotalLost - f.totalLost))
+		}
+		f.totalLost = report.TotalLost
+		f.reported = true
+
+		if f.clockRate > 0 {
+			metricRTPJitter.Observe(float64(report.Jitter)/float64(f.clockRate), "out", f.kind)
+		}
+	}
+}
+
+// metricsInterceptorFactory counts the rtp sent to every peer connection of
+// the rooms, the fan out of the local tracks happens inside pion.
+type metricsInterceptorFactory struct{}
+
+type metricsInterceptor struct {
+	interceptor.NoOp
+}
+
+func (f *metricsInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &metricsInterceptor{}, nil
+}
+
+func (i *metricsInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	kind, name := kindLabel(info.MimeType), codecLabel(info.MimeType)
+	packets := metricRTPPackets.With("out", kind, name)
+	bytes := metricRTPBytes.With("out", kind, name)
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, attributes)
+		if err == nil {
+			packets.Inc()
+			bytes.Add(uint64(header.MarshalSize() + len(payload)))
+		}
+		return n, err
+	})
+}
+
+// watchTransportFailures counts the ICE and DTLS failures of a peer
+// connection, peer tells what the connection is used for.
+func watchTransportFailures(pc *webrtc.PeerConnection, peer string) {
+	dtls := pc.SCTP().Transport()
+	dtls.OnStateChange(func(state webrtc.DTLSTransportState) {
+		if state == webrtc.DTLSTransportStateFailed {
+			metricTransportFailures.With(peer, "dtls_failed").Inc()
+		}
+	})
+	dtls.ICETransport().OnConnectionStateChange(func(state webrtc.ICETransportState) {
+		if state == webrtc.ICETransportStateFailed {
+			metricTransportFailures.With(peer, "ice_failed").Inc()
+		}
+	})
+}
+
+func RegisterMetricsHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /metrics", httpHandleMetrics)
+}
+
+func httpHandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if expected := GetConfig().Metrics.Token; expected != "" {
+		token, ok := bearerToken(r)
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			writeUnauthorized(w, "unauthorized", "invalid metrics token")
+			return
+		}
+	} else if !isLoopbackRequest(r) {
+		writeJsonError(w, http.StatusForbidden, "forbidden", "metrics are only served to other hosts with a metrics token")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
+
+func isLoopbackRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// writeMetrics writes every metric in the prometheus text format.
+func writeMetrics(w io.Writer) {
+	writer := bufio.NewWriter(w)
+	for _, gauges := range collectGauges() {
+		gauges.write(writer)
+	}
+	for _, counters := range metricsCounters {
+		counters.write(writer)
+	}
+	for _, histograms := range metricsHistograms {
+		histograms.write(writer)
+	}
+	if err := writer.Flush(); err != nil {
+		logger.Debug(fmt.Sprintf("failed writing metrics, %s", err.Error()))
+	}
+}
+
+func collectGauges() []*gaugeSet {
+	usersGauge := newGaugeSet("splash_users", "Users connected through a websocket.")
+	roomsGauge := newGaugeSet("splash_rooms", "Open rooms, breakout rooms included.", "type")
+	streamsGauge := newGaugeSet("splash_incoming_streams", "Published streams.")
+	tracksGauge := newGaugeSet("splash_incoming_tracks", "Tracks of the published streams.", "kind", "codec")
+	subscriptionsGauge := newGaugeSet("splash_subscriptions", "Subscriptions of users to published streams.")
+	viewersGauge := newGaugeSet("splash_whep_viewers", "Viewers playing a room through WHEP.")
+	queueGauge := newGaugeSet("splash_websocket_queue_depth", "Messages waiting to be written to the websockets.")
+	queueMaxGauge := newGaugeSet("splash_websocket_queue_depth_max", "Messages waiting to be written to the most backed up websocket.")
+
+	usersMutex.RLock()
+	connected := slices.Clone(users)
+	usersMutex.RUnlock()
+
+	usersGauge.Add(float64(len(connected)))
+	queueGauge.Add(0)
+	queueMaxGauge.Max(0)
+	for _, user := range connected {
+		pending := float64(user.pendingWrites.Load())
+		queueGauge.Add(pending)
+		queueMaxGauge.Max(pending)
+	}
+
+	roomsGauge.Add(0, "room")
+	roomsGauge.Add(0, "breakout")
+	streamsGauge.Add(0)
+	subscriptionsGauge.Add(0)
+	viewersGauge.Add(0)
+	for _, room := range GetRooms() {
+		roomType := "room"
+		if room.parent != nil {
+			roomType = "breakout"
+		}
+		roomsGauge.Add(1, roomType)
+		viewersGauge.Add(float64(room.ViewersCount()))
+
+		for _, stream := range room.GetInStreams() {
+			streamsGauge.Add(1)
+			subscriptionsGauge.Add(float64(len(stream.GetSubscribers())))
+			for _, track := range stream.GetTracks() {
+				tracksGauge.Add(1, track.Kind, codecLabel(track.MimeType))
+			}
+		}
+	}
+
+	return []*gaugeSet{usersGauge, roomsGauge, streamsGauge, tracksGauge, subscriptionsGauge, viewersGauge, queueGauge, queueMaxGauge}
+}
+
+func writeMetricHeader(w *bufio.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetricSample(w *bufio.Writer, name string, labels []string, values []string, value string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, metricLabelEscaper.Replace(values[i]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(value)
+	w.WriteByte('\n')
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (gauges *gaugeSet) write(w *bufio.Writer) {
+	writeMetricHeader(w, gauges.name, gauges.help, "gauge")
+	for _, key := range slices.Sorted(maps.Keys(gauges.series)) {
+		writeMetricSample(w, gauges.name, gauges.labels, gauges.values[key], formatMetricValue(gauges.series[key]))
+	}
+}
+
+func (vec *counterVec) write(w *bufio.Writer) {
+	vec.mutex.Lock()
+	series := make([]*metricCounter, 0, len(vec.series))
+	for _, key := range slices.Sorted(maps.Keys(vec.series)) {
+		series = append(series, vec.series[key])
+	}
+	vec.mutex.Unlock()
+
+	writeMetricHeader(w, vec.name, vec.help, "counter")
+	for _, counter := range series {
+		writeMetricSample(w, vec.name, vec.labels, counter.values, strconv.FormatUint(counter.value.Load(), 10))
+	}
+}
+
+func (vec *histogramVec) write(w *bufio.Writer) {
+	vec.mutex.Lock()
+	series := make([]*metricHistogram, 0, len(vec.series))
+	for _, key := range slices.Sorted(maps.Keys(vec.series)) {
+		series = append(series, vec.series[key])
+	}
+	vec.mutex.Unlock()
+
+	labels := append(slices.Clone(vec.labels), "le")
+	writeMetricHeader(w, vec.name, vec.help, "histogram")
+	for _, histogram := range series {
+		histogram.mutex.Lock()
+		counts, sum, count := slices.Clone(histogram.counts), histogram.sum, histogram.count
+		histogram.mutex.Unlock()
+
+		for i, bound := range vec.buckets {
+			values := append(slices.Clone(histogram.values), formatMetricValue(bound))
+			writeMetricSample(w, vec.name+"_bucket", labels, values, strconv.FormatUint(counts[i], 10))
+		}
+		writeMetricSample(w, vec.name+"_bucket", labels, append(slices.Clone(histogram.values), "+Inf"), strconv.FormatUint(count, 10))
+		writeMetricSample(w, vec.name+"_sum", vec.labels, histogram.values, formatMetricValue(sum))
+		writeMetricSample(w, vec.name+"_count", vec.labels, histogram.values, strconv.FormatUint(count, 10))
+	}
+}
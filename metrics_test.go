@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	tests := []struct {
+		name   string
+		fill   func(w *bufio.Writer)
+		output string
+	}{
+		{
+			name: "empty counter",
+			fill: func(w *bufio.Writer) {
+				newCounterVec("test_empty_total", "Nothing counted.", "kind").write(w)
+			},
+			output: "# HELP test_empty_total Nothing counted.\n" +
+				"# TYPE test_empty_total counter\n",
+		},
+		{
+			name: "counter series sorted by labels",
+			fill: func(w *bufio.Writer) {
+				vec := newCounterVec("test_packets_total", "Packets.", "direction", "kind")
+				vec.With("out", "video").Add(3)
+				vec.With("in", "audio").Inc()
+				vec.With("in", "video").Add(2)
+				vec.write(w)
+			},
+			output: "# HELP test_packets_total Packets.\n" +
+				"# TYPE test_packets_total counter\n" +
+				"test_packets_total{direction=\"in\",kind=\"audio\"} 1\n" +
+				"test_packets_total{direction=\"in\",kind=\"video\"} 2\n" +
+				"test_packets_total{direction=\"out\",kind=\"video\"} 3\n",
+		},
+		{
+			name: "escaped label values",
+			fill: func(w *bufio.Writer) {
+				vec := newCounterVec("test_reasons_total", "Reasons.", "reason")
+				vec.With("a \"quoted\\\" \nreason").Inc()
+				vec.write(w)
+			},
+			output: "# HELP test_reasons_total Reasons.\n" +
+				"# TYPE test_reasons_total counter\n" +
+				"test_reasons_total{reason=\"a \\\"quoted\\\\\\\" \\nreason\"} 1\n",
+		},
+		{
+			name: "cumulative histogram",
+			fill: func(w *bufio.Writer) {
+				vec := newHistogramVec("test_jitter_seconds", "Jitter.", []float64{0.01, 0.1}, "kind")
+				vec.Observe(0.005, "audio")
+				vec.Observe(0.05, "audio")
+				vec.Observe(1, "audio")
+				vec.write(w)
+			},
+			output: "# HELP test_jitter_seconds Jitter.\n" +
+				"# TYPE test_jitter_seconds histogram\n" +
+				"test_jitter_seconds_bucket{kind=\"audio\",le=\"0.01\"} 1\n" +
+				"test_jitter_seconds_bucket{kind=\"audio\",le=\"0.1\"} 2\n" +
+				"test_jitter_seconds_bucket{kind=\"audio\",le=\"+Inf\"} 3\n" +
+				"test_jitter_seconds_sum{kind=\"audio\"} 1.055\n" +
+				"test_jitter_seconds_count{kind=\"audio\"} 3\n",
+		},
+		{
+			name: "gauges without labels and with max",
+			fill: func(w *bufio.Writer) {
+				gauges := newGaugeSet("test_depth", "Depth.")
+				gauges.Max(2)
+				gauges.Max(5)
+				gauges.Max(1)
+				gauges.write(w)
+
+				rooms := newGaugeSet("test_rooms", "Rooms.", "type")
+				rooms.Add(0, "room")
+				rooms.Add(0, "breakout")
+				rooms.Add(1, "room")
+				rooms.Add(1, "room")
+				rooms.write(w)
+			},
+			output: "# HELP test_depth Depth.\n" +
+				"# TYPE test_depth gauge\n" +
+				"test_depth 5\n" +
+				"# HELP test_rooms Rooms.\n" +
+				"# TYPE test_rooms gauge\n" +
+				"test_rooms{type=\"breakout\"} 0\n" +
+				"test_rooms{type=\"room\"} 2\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var output strings.Builder
+			w := bufio.NewWriter(&output)
+			test.fill(w)
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if output.String() != test.output {
+				t.Errorf("got\n%s\nwant\n%s", output.String(), test.output)
+			}
+		})
+	}
+}
+
+func TestMetricsAccess(t *testing.T) {
+	previous := GetConfig()
+	t.Cleanup(func() { SetConfig(previous) })
+
+	tests := []struct {
+		name          string
+		token         string
+		remoteAddr    string
+		authorization string
+		status        int
+	}{
+		{name: "loopback without token", remoteAddr: "127.0.0.1:4000", status: http.StatusOK},
+		{name: "ipv6 loopback without token", remoteAddr: "[::1]:4000", status: http.StatusOK},
+		{name: "remote without token", remoteAddr: "192.0.2.10:4000", status: http.StatusForbidden},
+		{name: "malformed remote address", remoteAddr: "localhost", status: http.StatusForbidden},
+		{name: "missing token", token: "secret", remoteAddr: "127.0.0.1:4000", status: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", remoteAddr: "192.0.2.10:4000", authorization: "Bearer other", status: http.StatusUnauthorized},
+		{name: "valid token", token: "secret", remoteAddr: "192.0.2.10:4000", authorization: "Bearer secret", status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Metrics.Token = test.token
+			SetConfig(cfg)
+
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			r.RemoteAddr = test.remoteAddr
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			httpHandleMetrics(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+			if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), "# TYPE splash_users gauge\n") {
+				t.Errorf("missing the users gauge in\n%s", w.Body.String())
+			}
+		})
+	}
+}
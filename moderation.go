@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+type Role string
+
+const (
+	RoleOwner       Role = "owner"
+	RoleModerator   Role = "moderator"
+	RoleParticipant Role = "participant"
+	RoleViewer      Role = "viewer"
+)
+
+var (
+	ErrUserBanned        = errors.New("you are banned from this room")
+	ErrNotAllowed        = errors.New("you are not allowed to perform this action")
+	ErrUserNotInRoom     = errors.New("the target user is not in the room")
+	ErrStreamNotInRoom   = errors.New("the target stream is not in the room")
+	ErrTrackNotInStream  = errors.New("the target track is not in the stream")
+	ErrViewerCantPublish = errors.New("viewers can't publish streams")
+)
+
+func ParseRole(name string) (Role, error) {
+	switch role := Role(name); role {
+	case RoleModerator, RoleParticipant, RoleViewer:
+		return role, nil
+	case RoleOwner:
+		return role, errors.New("use transfer_ownership to change the room owner")
+	default:
+		return role, fmt.Errorf("unknown role %q", name)
+	}
+}
+
+func (role Role) CanModerate() bool {
+	return role == RoleOwner || role == RoleModerator
+}
+
+func (role Role) CanPublish() bool {
+	return role != RoleViewer
+}
+
+func (room *Room) RoleOf(user *User) Role {
+	room.rolesMutex.Lock()
+	defer room.rolesMutex.Unlock()
+
+	if user.Id == room.OwnerId {
+		return RoleOwner
+	}
+	if role, ok := room.roles[user.Id]; ok {
+		return role
+	}
+	return room.DefaultRole
+}
+
+func (room *Room) Owner() string {
+	room.rolesMutex.Lock()
+	defer room.rolesMutex.Unlock()
+
+	return room.OwnerId
+}
+
+// IsBanned matches the user, or the address it connects from, so a banned
+// user can't come back by reconnecting.
+func (room *Room) IsBanned(user *User) bool {
+	room.rolesMutex.Lock()
+	defer room.rolesMutex.Unlock()
+
+	return room.banned[user.Id] || (user.remoteIP != "" && room.bannedIPs[user.remoteIP])
+}
+
+func (room *Room) getMember(userId string) *User {
+	for _, member := range room.GetUsers() {
+		if member.Id == userId {
+			return member
+		}
+	}
+	return nil
+}
+
+// moderate checks that actor may act upon target, a moderator can't act upon
+// the owner or another moderator.
+func (room *Room) moderate(actor *User, targetId string) (*User, error) {
+	actorRole := room.RoleOf(actor)
+	if !actorRole.CanModerate() {
+		return nil, ErrNotAllowed
+	}
+
+	target := room.getMember(targetId)
+	if target == nil {
+		return nil, ErrUserNotInRoom
+	}
+	if target == actor {
+		return nil, errors.New("you can't moderate yourself")
+	}
+	if actorRole != RoleOwner && room.RoleOf(target).CanModerate() {
+		return nil, ErrNotAllowed
+	}
+
+	return target, nil
+}
+
+func (room *Room) SetRole(actor *User, targetId string, role Role) error {
+	if room.RoleOf(actor) != RoleOwner {
+		return ErrNotAllowed
+	}
+
+	target := room.getMember(targetId)
+	if target == nil {
+		return ErrUserNotInRoom
+	}
+	if target == actor {
+		return errors.New("use transfer_ownership to change your own role")
+	}
+
+	room.rolesMutex.Lock()
+	room.roles[target.Id] = role
+	room.rolesMutex.Unlock()
+
+	if !role.CanPublish() {
+		room.stopUserPublish(target, fmt.Sprintf("role changed to %s", role))
+	}
+
+	logger.Info(fmt.Sprintf("user %s set role of %s to %s in room %s", actor.Id, target.Id, role, room.Id))
+	room.BroadcastJson(NewMessageRoleChanged(room, target, role))
+
+	return nil
+}
+
+func (room *Room) Kick(actor *User, targetId string, reason string) error {
+	target, err := room.moderate(actor, targetId)
+	if err != nil {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("user %s kick %s from room %s", actor.Id, target.Id, room.Id))
+	return target.LeaveCurrentRoom(moderationCause("kicked", actor, reason))
+}
+
+func (room *Room) Ban(actor *User, targetId string, reason string) error {
+	target, err := room.moderate(actor, targetId)
+	if err != nil {
+		return err
+	}
+
+	room.rolesMutex.Lock()
+	room.banned[target.Id] = true
+	if target.remoteIP != "" {
+		room.bannedIPs[target.remoteIP] = true
+	}
+	room.rolesMutex.Unlock()
+
+	logger.Info(fmt.Sprintf("user %s ban %s from room %s", actor.Id, target.Id, room.Id))
+	return target.LeaveCurrentRoom(moderationCause("banned", actor, reason))
+}
+
+func (room *Room) MuteRemoteTrack(actor *User, streamId string, trackId string, muted bool) error {
+	stream := room.GetInStream(streamId)
+	if stream == nil {
+		return ErrStreamNotInRoom
+	}
+	if _, err := room.moderate(actor, stream.Publisher.Id); err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(stream.GetTracks(), func(track *StreamTrack) bool { return track.Id == trackId }) {
+		return ErrTrackNotInStream
+	}
+
+	stream.SetTrackMuted(trackId, muted)
+
+	logger.Info(fmt.Sprintf("user %s set track %s of stream %s muted=%t", actor.Id, trackId, stream.Id, muted))
+	room.BroadcastJson(NewMessageTrackMuted(stream, trackId, muted, actor))
+
+	return nil
+}
+
+func (room *Room) StopRemotePublish(actor *User, streamId string, reason string) error {
+	stream := room.GetInStream(streamId)
+	if stream == nil {
+		return ErrStreamNotInRoom
+	}
+	if _, err := room.moderate(actor, stream.Publisher.Id); err != nil {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("user %s stop stream %s in room %s", actor.Id, stream.Id, room.Id))
+	return room.stopPublish(stream, moderationCause("publish stopped", actor, reason))
+}
+
+func (room *Room) TransferOwnership(actor *User, targetId string) error {
+	if room.RoleOf(actor) != RoleOwner {
+		return ErrNotAllowed
+	}
+
+	if targetId == actor.Id {
+		return errors.New("you already own this room")
+	}
+
+	target := room.getMember(targetId)
+	if target == nil {
+		return ErrUserNotInRoom
+	}
+
+	room.rolesMutex.Lock()
+	room.OwnerId = target.Id
+	room.roles[actor.Id] = RoleModerator
+	delete(room.roles, target.Id)
+	room.rolesMutex.Unlock()
+
+	logger.Info(fmt.Sprintf("user %s transfer ownership of room %s to %s", actor.Id, room.Id, target.Id))
+	room.BroadcastJson(NewMessageRoleChanged(room, target, RoleOwner))
+	room.BroadcastJson(NewMessageRoleChanged(room, actor, RoleModerator))
+
+	return nil
+}
+
+func (room *Room) stopUserPublish(user *User, cause string) {
+	for _, stream := range room.GetInStreamsByPublisher(user) {
+		if err := room.stopPublish(stream, cause); err != nil {
+			logger.Warn(fmt.Sprintf("failed stopping stream %s, %s", stream.Id, err.Error()))
+		}
+	}
+}
+
+func (room *Room) stopPublish(stream *IncomingStream, cause string) error {
+	stream.Teardown()
+	if err := room.RemoveInStream(stream); err != nil {
+		return err
+	}
+
+	stream.Publisher.SendMessageJson(NewMessagePublishStopped(stream, cause))
+	return nil
+}
+
+func moderationCause(action string, actor *User, reason string) string {
+	if reason == "" {
+		return fmt.Sprintf("%s by %s", action, actor.Id)
+	}
+	return fmt.Sprintf("%s by %s, %s", action, actor.Id, reason)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+const (
+	mp4SampleFlagsSync    = 0x02000000
+	mp4SampleFlagsNonSync = 0x01010000
+)
+
+// mp4Track describes a track of a fragmented mp4, h264 tracks carry their
+// parameter sets and opus tracks their channel count.
+type mp4Track struct {
+	Id        uint32
+	Timescale uint32
+	Video     bool
+
+	Width  uint16
+	Height uint16
+	SPS    [][]byte
+	PPS    [][]byte
+
+	Channels uint16
+}
+
+type mp4Sample struct {
+	Time     uint64
+	Duration uint32
+	Keyframe bool
+	Data     []byte
+}
+
+// mp4Fragment is one moof and mdat pair with the samples of each track.
+type mp4Fragment struct {
+	Track    *mp4Track
+	Samples  []mp4Sample
+	BaseTime uint64
+}
+
+func mp4Box(boxType string, parts ...[]byte) []byte {
+	size := 8
+	for _, part := range parts {
+		size += len(part)
+	}
+	box := make([]byte, 0, size)
+	box = binary.BigEndian.AppendUint32(box, uint32(size))
+	box = append(box, boxType...)
+	for _, part := range parts {
+		box = append(box, part...)
+	}
+	return box
+}
+
+func mp4FullBox(boxType string, version uint8, flags uint32, parts ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags&0xffffff)
+	return mp4Box(boxType, append([][]byte{header}, parts...)...)
+}
+
+func mp4Uint16(value uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, value)
+}
+
+func mp4Uint32(value uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, value)
+}
+
+func mp4Uint64(value uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, value)
+}
+
+var mp4Matrix = concatBytes(
+	mp4Uint32(0x00010000), mp4Uint32(0), mp4Uint32(0),
+	mp4Uint32(0), mp4Uint32(0x00010000), mp4Uint32(0),
+	mp4Uint32(0), mp4Uint32(0), mp4Uint32(0x40000000),
+)
+
+// mp4InitSegment writes the ftyp and moov of a fragmented mp4 without
+// samples, the media is carried by the fragments.
+func mp4InitSegment(tracks []*mp4Track) []byte {
+	ftyp := mp4Box("ftyp", []byte("iso6"), mp4Uint32(0), []byte("iso6cmfcmp41"))
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		mp4Uint32(0), mp4Uint32(0), mp4Uint32(1000), mp4Uint32(0),
+		mp4Uint32(0x00010000), mp4Uint16(0x0100), make([]byte, 10),
+		mp4Matrix, make([]byte, 24),
+		mp4Uint32(uint32(len(tracks)+1)),
+	)
+
+	traks := make([]byte, 0)
+	trexs := make([]byte, 0)
+	for _, track := range tracks {
+		traks = append(traks, track.trak()...)
+		trexs = append(trexs, mp4FullBox("trex", 0, 0,
+			mp4Uint32(track.Id), mp4Uint32(1), mp4Uint32(0), mp4Uint32(0), mp4Uint32(0),
+		)...)
+	}
+
+	return concatBytes(ftyp, mp4Box("moov", mvhd, traks, mp4Box("mvex", trexs)))
+}
+
+func (track *mp4Track) trak() []byte {
+	volume, handler, name := uint16(0x0100), "soun", "SoundHandler"
+	mediaHeader := mp4FullBox("smhd", 0, 0, mp4Uint32(0))
+	if track.Video {
+		volume, handler, name = 0, "vide", "VideoHandler"
+		mediaHeader = mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	}
+
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		mp4Uint32(0), mp4Uint32(0), mp4Uint32(track.Id), mp4Uint32(0), mp4Uint32(0),
+		make([]byte, 8), mp4Uint16(0), mp4Uint16(0), mp4Uint16(volume), mp4Uint16(0),
+		mp4Matrix,
+		mp4Uint32(uint32(track.Width)<<16), mp4Uint32(uint32(track.Height)<<16),
+	)
+	mdhd := mp4FullBox("mdhd", 0, 0,
+		mp4Uint32(0), mp4Uint32(0), mp4Uint32(track.Timescale), mp4Uint32(0),
+		mp4Uint16(0x55c4), mp4Uint16(0),
+	)
+	hdlr := mp4FullBox("hdlr", 0, 0,
+		mp4Uint32(0), []byte(handler), make([]byte, 12), []byte(name), []byte{0},
+	)
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, mp4Uint32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, mp4Uint32(1), track.sampleEntry()),
+		mp4FullBox("stts", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsc", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsz", 0, 0, mp4Uint32(0), mp4Uint32(0)),
+		mp4FullBox("stco", 0, 0, mp4Uint32(0)),
+	)
+
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", mediaHeader, dinf, stbl)))
+}
+
+func (track *mp4Track) sampleEntry() []byte {
+	if !track.Video {
+		dOps := mp4Box("dOps",
+			[]byte{0, byte(track.Channels)}, mp4Uint16(0), mp4Uint32(48000), mp4Uint16(0), []byte{0},
+		)
+		return mp4Box("Opus",
+			make([]byte, 6), mp4Uint16(1), make([]byte, 8),
+			mp4Uint16(track.Channels), mp4Uint16(16), mp4Uint32(0), mp4Uint32(48000<<16),
+			dOps,
+		)
+	}
+
+	avcC := []byte{1, track.SPS[0][1], track.SPS[0][2], track.SPS[0][3], 0xff, 0xe0 | byte(len(track.SPS))}
+	for _, sps := range track.SPS {
+		avcC = append(avcC, mp4Uint16(uint16(len(sps)))...)
+		avcC = append(avcC, sps...)
+	}
+	avcC = append(avcC, byte(len(track.PPS)))
+	for _, pps := range track.PPS {
+		avcC = append(avcC, mp4Uint16(uint16(len(pps)))...)
+		avcC = append(avcC, pps...)
+	}
+
+	return mp4Box("avc1",
+		make([]byte, 6), mp4Uint16(1), make([]byte, 16),
+		mp4Uint16(track.Width), mp4Uint16(track.Height),
+		mp4Uint32(0x00480000), mp4Uint32(0x00480000), mp4Uint32(0), mp4Uint16(1),
+		make([]byte, 32), mp4Uint16(0x0018), mp4Uint16(0xffff),
+		mp4Box("avcC", avcC),
+	)
+}
+
+// mp4MediaSegment writes the fragments as a single moof followed by the
+// mdat holding the samples of every track in order.
+func mp4MediaSegment(sequence uint32, fragments []mp4Fragment) []byte {
+	mfhd := mp4FullBox("mfhd", 0, 0, mp4Uint32(sequence))
+
+	trafs := func(dataOffset uint32) []byte {
+		boxes := make([]byte, 0)
+		for _, fragment := range fragments {
+			entries := make([]byte, 0, len(fragment.Samples)*12)
+			for _, sample := range fragment.Samples {
+				flags := uint32(mp4SampleFlagsNonSync)
+				if sample.Keyframe {
+					flags = mp4SampleFlagsSync
+				}
+				entries = append(entries, mp4Uint32(sample.Duration)...)
+				entries = append(entries, mp4Uint32(uint32(len(sample.Data)))...)
+				entries = append(entries, mp4Uint32(flags)...)
+				dataOffset += uint32(len(sample.Data))
+			}
+			boxes = append(boxes, mp4Box("traf",
+				mp4FullBox("tfhd", 0, 0x020000, mp4Uint32(fragment.Track.Id)),
+				mp4FullBox("tfdt", 1, 0, mp4Uint64(fragment.BaseTime)),
+				mp4FullBox("trun", 0, 0x000701,
+					mp4Uint32(uint32(len(fragment.Samples))),
+					mp4Uint32(dataOffset-fragment.size()),
+					entries,
+				),
+			)...)
+		}
+		return boxes
+	}
+
+	// The data offsets are relative to the moof, its size doesn't depend on
+	// their values.
+	moofSize := uint32(len(mp4Box("moof", mfhd, trafs(0))))
+	moof := mp4Box("moof", mfhd, trafs(moofSize+8))
+
+	data := make([][]byte, 0)
+	for _, fragment := range fragments {
+		for _, sample := range fragment.Samples {
+			data = append(data, sample.Data)
+		}
+	}
+
+	return concatBytes(moof, mp4Box("mdat", data...))
+}
+
+func (fragment mp4Fragment) size() uint32 {
+	size := 0
+	for _, sample := range fragment.Samples {
+		size += len(sample.Data)
+	}
+	return uint32(size)
+}
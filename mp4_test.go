@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+type mp4TestBox struct {
+	Type    string
+	Payload []byte
+	Offset  int
+}
+
+// mp4TestBoxes splits data into boxes, their sizes must cover it exactly.
+func mp4TestBoxes(data []byte, base int) ([]mp4TestBox, error) {
+	boxes := make([]mp4TestBox, 0)
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < 8 {
+			return nil, fmt.Errorf("truncated box header at %d", base+offset)
+		}
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		if size < 8 || offset+size > len(data) {
+			return nil, fmt.Errorf("box of %d bytes at %d overflows", size, base+offset)
+		}
+		boxes = append(boxes, mp4TestBox{
+			Type:    string(data[offset+4 : offset+8]),
+			Payload: data[offset+8 : offset+size],
+			Offset:  base + offset,
+		})
+		offset += size
+	}
+	return boxes, nil
+}
+
+// mp4TestFind walks down the path of container boxes.
+func mp4TestFind(t *testing.T, data []byte, path ...string) []mp4TestBox {
+	t.Helper()
+
+	boxes, err := mp4TestBoxes(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, boxType := range path {
+		matches := make([]mp4TestBox, 0)
+		for _, box := range boxes {
+			if box.Type == boxType {
+				matches = append(matches, box)
+			}
+		}
+		if i == len(path)-1 || len(matches) == 0 {
+			return matches
+		}
+		boxes = nil
+		for _, match := range matches {
+			boxes = append(boxes, mp4TestChildren(t, match)...)
+		}
+	}
+	return boxes
+}
+
+func mp4TestChildren(t *testing.T, box mp4TestBox) []mp4TestBox {
+	t.Helper()
+
+	children, err := mp4TestBoxes(box.Payload, box.Offset+8)
+	if err != nil {
+		t.Fatalf("%s, %s", box.Type, err)
+	}
+	return children
+}
+
+func mp4TestTypes(boxes []mp4TestBox) []string {
+	types := make([]string, 0, len(boxes))
+	for _, box := range boxes {
+		types = append(types, box.Type)
+	}
+	return types
+}
+
+func TestMp4InitSegment(t *testing.T) {
+	video := &mp4Track{
+		Id: 1, Timescale: 90000, Video: true, Width: 1280, Height: 720,
+		SPS: [][]byte{{0x67, 0x64, 0x00, 0x1f, 0xac}},
+		PPS: [][]byte{{0x68, 0xeb}},
+	}
+	audio := &mp4Track{Id: 2, Timescale: 48000, Channels: 2}
+
+	tests := []struct {
+		name    string
+		tracks  []*mp4Track
+		entries []string
+	}{
+		{name: "video", tracks: []*mp4Track{video}, entries: []string{"avc1"}},
+		{name: "video and audio", tracks: []*mp4Track{video, audio}, entries: []string{"avc1", "Opus"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			segment := mp4InitSegment(test.tracks)
+
+			if types := mp4TestTypes(mp4TestFind(t, segment)); !slices.Equal(types, []string{"ftyp", "moov"}) {
+				t.Fatalf("top level boxes %v", types)
+			}
+			moov := mp4TestTypes(mp4TestChildren(t, mp4TestFind(t, segment, "moov")[0]))
+			if moov[0] != "mvhd" || moov[len(moov)-1] != "mvex" || len(moov) != len(test.tracks)+2 {
+				t.Errorf("moov boxes %v", moov)
+			}
+			if trex := mp4TestFind(t, segment, "moov", "mvex", "trex"); len(trex) != len(test.tracks) {
+				t.Errorf("%d trex boxes", len(trex))
+			}
+
+			stsd := mp4TestFind(t, segment, "moov", "trak", "mdia", "minf", "stbl", "stsd")
+			entries := make([]string, 0)
+			for _, box := range stsd {
+				children, err := mp4TestBoxes(box.Payload[8:], box.Offset+16)
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries = append(entries, mp4TestTypes(children)...)
+			}
+			if !slices.Equal(entries, test.entries) {
+				t.Errorf("sample entries %v, want %v", entries, test.entries)
+			}
+
+			for _, box := range mp4TestFind(t, segment, "moov", "trak", "tkhd") {
+				id := binary.BigEndian.Uint32(box.Payload[12:16])
+				if id != test.tracks[0].Id && id != audio.Id {
+					t.Errorf("track id %d", id)
+				}
+			}
+		})
+	}
+}
+
+func TestMp4AvcConfiguration(t *testing.T) {
+	video := &mp4Track{
+		Id: 1, Timescale: 90000, Video: true,
+		SPS: [][]byte{{0x67, 0x64, 0x00, 0x1f, 0xac}},
+		PPS: [][]byte{{0x68, 0xeb}, {0x68, 0xee, 0x3c}},
+	}
+
+	avc1 := video.sampleEntry()
+	index := bytes.Index(avc1, []byte("avcC"))
+	if index < 0 {
+		t.Fatal("missing avcC")
+	}
+	avcC := avc1[index+4:]
+	expected := []byte{
+		1, 0x64, 0x00, 0x1f, 0xff, 0xe1,
+		0, 5, 0x67, 0x64, 0x00, 0x1f, 0xac,
+		2, 0, 2, 0x68, 0xeb, 0, 3, 0x68, 0xee, 0x3c,
+	}
+	if !bytes.Equal(avcC, expected) {
+		t.Errorf("avcC %x, want %x", avcC, expected)
+	}
+}
+
+func TestMp4MediaSegment(t *testing.T) {
+	video := &mp4Track{Id: 1, Timescale: 90000, Video: true}
+	audio := &mp4Track{Id: 2, Timescale: 48000}
+
+	tests := []struct {
+		name      string
+		fragments []mp4Fragment
+	}{
+		{
+			name: "single track",
+			fragments: []mp4Fragment{
+				{Track: video, BaseTime: 9000, Samples: []mp4Sample{
+					{Time: 9000, Duration: 3000, Keyframe: true, Data: []byte{1, 2, 3}},
+					{Time: 12000, Duration: 3000, Data: []byte{4, 5}},
+				}},
+			},
+		},
+		{
+			name: "two tracks",
+			fragments: []mp4Fragment{
+				{Track: video, BaseTime: 0, Samples: []mp4Sample{
+					{Duration: 3000, Keyframe: true, Data: []byte{1, 2, 3, 4}},
+				}},
+				{Track: audio, BaseTime: 1 << 33, Samples: []mp4Sample{
+					{Time: 1 << 33, Duration: 960, Data: []byte{9}},
+					{Time: 1<<33 + 960, Duration: 960, Data: []byte{8, 7}},
+				}},
+			},
+		},
+		{
+			name: "empty fragment",
+			fragments: []mp4Fragment{
+				{Track: video, BaseTime: 0},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			segment := mp4MediaSegment(7, test.fragments)
+
+			if types := mp4TestTypes(mp4TestFind(t, segment)); !slices.Equal(types, []string{"moof", "mdat"}) {
+				t.Fatalf("top level boxes %v", types)
+			}
+			mfhd := mp4TestFind(t, segment, "moof", "mfhd")
+			if len(mfhd) != 1 || binary.BigEndian.Uint32(mfhd[0].Payload[4:]) != 7 {
+				t.Error("wrong sequence number")
+			}
+
+			tfdts := mp4TestFind(t, segment, "moof", "traf", "tfdt")
+			truns := mp4TestFind(t, segment, "moof", "traf", "trun")
+			if len(truns) != len(test.fragments) || len(tfdts) != len(test.fragments) {
+				t.Fatalf("%d trun boxes for %d fragments", len(truns), len(test.fragments))
+			}
+
+			for i, fragment := range test.fragments {
+				if base := binary.BigEndian.Uint64(tfdts[i].Payload[4:]); base != fragment.BaseTime {
+					t.Errorf("fragment %d base time %d, want %d", i, base, fragment.BaseTime)
+				}
+
+				trun := truns[i].Payload
+				count := binary.BigEndian.Uint32(trun[4:8])
+				if int(count) != len(fragment.Samples) {
+					t.Fatalf("fragment %d has %d samples, want %d", i, count, len(fragment.Samples))
+				}
+				// The data offset is relative to the start of the moof.
+				offset := int(binary.BigEndian.Uint32(trun[8:12]))
+				for j, sample := range fragment.Samples {
+					entry := trun[12+j*12:]
+					duration := binary.BigEndian.Uint32(entry[0:4])
+					size := int(binary.BigEndian.Uint32(entry[4:8]))
+					flags := binary.BigEndian.Uint32(entry[8:12])
+
+					if duration != sample.Duration || size != len(sample.Data) {
+						t.Errorf("sample %d of fragment %d, duration %d size %d", j, i, duration, size)
+					}
+					if (flags == mp4SampleFlagsSync) != sample.Keyframe {
+						t.Errorf("sample %d of fragment %d, flags %x", j, i, flags)
+					}
+					if offset+size > len(segment) || !bytes.Equal(segment[offset:offset+size], sample.Data) {
+						t.Errorf("sample %d of fragment %d isn't at offset %d", j, i, offset)
+					}
+					offset += size
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+const oggPageHeaderSize = 27
+
+// oggOpusReader returns the opus packets of the first logical stream of an
+// ogg file, packets may span several pages.
+type oggOpusReader struct {
+	in       io.Reader
+	Channels uint16
+
+	serial      uint32
+	serialKnown bool
+	packets     [][]byte
+	partial     []byte
+	elapsed     time.Duration
+}
+
+func newOggOpusReader(in io.Reader) (*oggOpusReader, error) {
+	reader := &oggOpusReader{in: in}
+
+	head, err := reader.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if len(head) < 19 || !bytes.HasPrefix(head, []byte("OpusHead")) {
+		return nil, errors.New("not an ogg opus file")
+	}
+	reader.Channels = uint16(head[9])
+
+	// The comment header comes right after.
+	if _, err := reader.readPacket(); err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// ReadFrame returns the next opus packet and its time from the start of the
+// file, computed from the durations of the previous packets.
+func (r *oggOpusReader) ReadFrame() ([]byte, time.Duration, error) {
+	packet, err := r.readPacket()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	at := r.elapsed
+	r.elapsed += opusPacketDuration(packet)
+
+	return packet, at, nil
+}
+
+func (r *oggOpusReader) readPacket() ([]byte, error) {
+	for len(r.packets) == 0 {
+		if err := r.readPage(); err != nil {
+			return nil, err
+		}
+	}
+
+	packet := r.packets[0]
+	r.packets = r.packets[1:]
+	return packet, nil
+}
+
+func (r *oggOpusReader) readPage() error {
+	header := make([]byte, oggPageHeaderSize)
+	if _, err := io.ReadFull(r.in, header); err != nil {
+		return err
+	}
+	if string(header[0:4]) != "OggS" {
+		return errors.New("invalid ogg page")
+	}
+
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(r.in, segments); err != nil {
+		return err
+	}
+	size := 0
+	for _, segment := range segments {
+		size += int(segment)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r.in, payload); err != nil {
+		return err
+	}
+
+	serial := binary.LittleEndian.Uint32(header[14:18])
+	if !r.serialKnown {
+		r.serial, r.serialKnown = serial, true
+	}
+	if serial != r.serial {
+		return nil
+	}
+
+	// A segment shorter than 255 bytes ends a packet.
+	offset := 0
+	for _, segment := range segments {
+		r.partial = append(r.partial, payload[offset:offset+int(segment)]...)
+		offset += int(segment)
+		if segment < 255 {
+			r.packets = append(r.packets, r.partial)
+			r.partial = nil
+		}
+	}
+
+	return nil
+}
+
+// opusPacketDuration reads the frame size and count of the toc byte, see
+// RFC 6716 section 3.1.
+func opusPacketDuration(packet []byte) time.Duration {
+	if len(packet) == 0 {
+		return 0
+	}
+
+	config := packet[0] >> 3
+	var frame time.Duration
+	switch {
+	case config < 12:
+		frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16:
+		frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default:
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+
+	frames := 1
+	switch packet[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = int(packet[1] & 0x3F)
+	}
+
+	return frame * time.Duration(frames)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// oggTestPage builds a page holding the packets, the last one is left open
+// when continued is set.
+func oggTestPage(serial uint32, continued bool, packets ...[]byte) []byte {
+	segments := make([]byte, 0)
+	for i, packet := range packets {
+		size := len(packet)
+		for ; size >= 255; size -= 255 {
+			segments = append(segments, 255)
+		}
+		if !continued || i < len(packets)-1 {
+			segments = append(segments, byte(size))
+		}
+	}
+
+	header := make([]byte, oggPageHeaderSize)
+	copy(header, "OggS")
+	binary.LittleEndian.PutUint32(header[14:18], serial)
+	header[26] = byte(len(segments))
+
+	return slices.Concat(header, segments, bytes.Join(packets, nil))
+}
+
+var (
+	oggTestHead    = []byte("OpusHead\x01\x02\x38\x01\x80\xbb\x00\x00\x00\x00\x00")
+	oggTestComment = []byte("OpusTags\x00\x00\x00\x00\x00\x00\x00\x00")
+)
+
+func TestOggOpusReader(t *testing.T) {
+	// 20 ms frames, a single one then two of them.
+	single := []byte{0x09 << 3, 1, 2}
+	double := []byte{0x09<<3 | 1, 3, 4}
+	large := append([]byte{0x0a << 3}, bytes.Repeat([]byte{5}, 600)...)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		channels uint16
+		packets  [][]byte
+		times    []time.Duration
+	}{
+		{
+			name:     "packets of a page",
+			data:     slices.Concat(oggTestPage(1, false, oggTestHead), oggTestPage(1, false, oggTestComment), oggTestPage(1, false, single, double)),
+			channels: 2,
+			packets:  [][]byte{single, double},
+			times:    []time.Duration{0, 20 * time.Millisecond},
+		},
+		{
+			name: "packet spanning pages",
+			data: slices.Concat(
+				oggTestPage(1, false, oggTestHead, oggTestComment),
+				oggTestPage(1, true, large[:510]),
+				oggTestPage(1, false, large[510:], single),
+			),
+			channels: 2,
+			packets:  [][]byte{large, single},
+			times:    []time.Duration{0, 40 * time.Millisecond},
+		},
+		{
+			name: "other logical streams skipped",
+			data: slices.Concat(
+				oggTestPage(1, false, oggTestHead), oggTestPage(1, false, oggTestComment),
+				oggTestPage(2, false, double), oggTestPage(1, false, single),
+			),
+			channels: 2,
+			packets:  [][]byte{single},
+			times:    []time.Duration{0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := newOggOpusReader(bytes.NewReader(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reader.Channels != test.channels {
+				t.Errorf("%d channels, want %d", reader.Channels, test.channels)
+			}
+
+			packets := make([][]byte, 0)
+			times := make([]time.Duration, 0)
+			for {
+				packet, at, err := reader.ReadFrame()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				packets = append(packets, packet)
+				times = append(times, at)
+			}
+			if !reflect.DeepEqual(packets, test.packets) || !slices.Equal(times, test.times) {
+				t.Errorf("read %x at %v, want %x at %v", packets, times, test.packets, test.times)
+			}
+		})
+	}
+}
+
+func TestOggOpusReaderMalformed(t *testing.T) {
+	valid := oggTestPage(1, false, oggTestHead)
+	badPattern := slices.Clone(valid)
+	copy(badPattern, "OggX")
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "truncated page header", data: valid[:10]},
+		{name: "invalid capture pattern", data: badPattern},
+		{name: "truncated segment table", data: valid[:oggPageHeaderSize]},
+		{name: "truncated payload", data: valid[:len(valid)-4]},
+		{name: "not opus", data: oggTestPage(1, false, []byte("\x01vorbis\x00\x00\x00\x00\x02\x44\xac\x00\x00\x00\x00"))},
+		{name: "short opus head", data: oggTestPage(1, false, []byte("OpusHead\x01\x02"))},
+		{name: "missing comment header", data: valid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newOggOpusReader(bytes.NewReader(test.data)); err == nil {
+				t.Error("read the headers, want an error")
+			}
+		})
+	}
+}
+
+func TestOggOpusReaderReadsOggWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audio.ogg")
+	writer, err := oggwriter.New(path, 48000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloads := [][]byte{{0x09 << 3, 1}, {0x09 << 3, 2}, {0x09 << 3, 3}}
+	for i, payload := range payloads {
+		packet := &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i), Timestamp: uint32(i * 960)}, Payload: payload}
+		if err := writer.WriteRTP(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := newOggOpusReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, payload := range payloads {
+		packet, at, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(packet, payload) || at != time.Duration(i)*20*time.Millisecond {
+			t.Errorf("packet %d is %x at %s", i, packet, at)
+		}
+	}
+}
+
+func TestOpusPacketDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		packet   []byte
+		duration time.Duration
+	}{
+		{name: "empty", packet: []byte{}, duration: 0},
+		{name: "silk 10 ms", packet: []byte{0 << 3}, duration: 10 * time.Millisecond},
+		{name: "silk 60 ms", packet: []byte{3 << 3}, duration: 60 * time.Millisecond},
+		{name: "hybrid 20 ms", packet: []byte{13 << 3}, duration: 20 * time.Millisecond},
+		{name: "celt 2.5 ms", packet: []byte{16 << 3}, duration: 2500 * time.Microsecond},
+		{name: "two frames", packet: []byte{31<<3 | 1}, duration: 40 * time.Millisecond},
+		{name: "two frames of different sizes", packet: []byte{1<<3 | 2}, duration: 40 * time.Millisecond},
+		{name: "frame count", packet: []byte{19<<3 | 3, 0x83}, duration: 60 * time.Millisecond},
+		{name: "truncated frame count", packet: []byte{19<<3 | 3}, duration: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if duration := opusPacketDuration(test.packet); duration != test.duration {
+				t.Errorf("lasts %s, want %s", duration, test.duration)
+			}
+		})
+	}
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+type RecordingConfig struct {
+	Directory string `json:"directory" yaml:"directory" toml:"directory"`
+}
+
+type RecordingFormat string
+
+const (
+	// RecordingFormatTracks writes one ivf or ogg file per track.
+	RecordingFormatTracks RecordingFormat = "tracks"
+	// RecordingFormatWebm writes one webm file per published stream.
+	RecordingFormatWebm RecordingFormat = "webm"
+)
+
+const recordingManifestName = "manifest.json"
+
+var (
+	ErrRecordingNotFound = errors.New("the recording does not exist")
+	ErrAlreadyRecording  = errors.New("this is already being recorded")
+)
+
+// Recording stores the streams of a room, or a single stream when StreamId
+// is set, under its own directory along with a manifest describing the files.
+type Recording struct {
+	Id        string           `json:"id"`
+	RoomId    string           `json:"room_id"`
+	StreamId  string           `json:"stream_id,omitempty"`
+	Format    RecordingFormat  `json:"format"`
+	StartedBy string           `json:"started_by"`
+	StartedAt time.Time        `json:"started_at"`
+	StoppedAt *time.Time       `json:"stopped_at,omitempty"`
+	Files     []*RecordingFile `json:"files"`
+
+	room      *Room
+	directory string
+	recorders map[string]*streamRecorder
+	stopped   bool
+	mutex     *sync.Mutex
+}
+
+type RecordingFile struct {
+	Path        string            `json:"path"`
+	Container   string            `json:"container"`
+	StreamId    string            `json:"stream_id"`
+	PublisherId string            `json:"publisher_id"`
+	Tracks      []*RecordingTrack `json:"tracks"`
+}
+
+// RecordingTrack aligns a track with the others, StartOffset is the delay
+// between the start of the recording and the first media written for it.
+type RecordingTrack struct {
+	Id                string   `json:"id"`
+	Kind              string   `json:"kind"`
+	MimeType          string   `json:"mime_type"`
+	ClockRate         uint32   `json:"clock_rate"`
+	Started           bool     `json:"started"`
+	StartOffset       Duration `json:"start_offset"`
+	FirstRTPTimestamp uint32   `json:"first_rtp_timestamp"`
+}
+
+func ParseRecordingFormat(value string) (RecordingFormat, error) {
+	switch RecordingFormat(value) {
+	case "", RecordingFormatTracks:
+		return RecordingFormatTracks, nil
+	case RecordingFormatWebm:
+		return RecordingFormatWebm, nil
+	default:
+		return "", fmt.Errorf("unknown recording format %q", value)
+	}
+}
+
+// StartRecording records every stream of the room, including the ones
+// published later, or only streamId when it isn't empty.
+func (room *Room) StartRecording(actor *User, streamId string, format RecordingFormat) (*Recording, error) {
+	if !room.RoleOf(actor).CanModerate() {
+		return nil, ErrNotAllowed
+	}
+
+	streams := room.GetInStreams()
+	if streamId != "" {
+		stream := room.GetInStream(streamId)
+		if stream == nil {
+			return nil, ErrStreamNotInRoom
+		}
+		streams = []*IncomingStream{stream}
+	}
+
+	recording := &Recording{
+		Id:        uuid.NewString(),
+		RoomId:    room.Id,
+		StreamId:  streamId,
+		Format:    format,
+		StartedBy: actor.Id,
+		StartedAt: time.Now(),
+		Files:     make([]*RecordingFile, 0),
+
+		room:      room,
+		recorders: make(map[string]*streamRecorder),
+		mutex:     new(sync.Mutex),
+	}
+	recording.directory = filepath.Join(GetConfig().Recording.Directory, room.Id, recording.Id)
+
+	// A room wide recording already holds every stream, overlapping it with
+	// one of a stream would write the media twice.
+	room.recordingsMutex.Lock()
+	for _, other := range room.recordings {
+		if streamId == "" || other.StreamId == "" || other.StreamId == streamId {
+			room.recordingsMutex.Unlock()
+			return nil, ErrAlreadyRecording
+		}
+	}
+	if err := os.MkdirAll(recording.directory, 0o755); err != nil {
+		room.recordingsMutex.Unlock()
+		return nil, err
+	}
+	room.recordings[recording.Id] = recording
+	room.recordingsMutex.Unlock()
+
+	for _, stream := range streams {
+		recording.addStream(stream)
+	}
+	recording.writeManifest()
+
+	logger.Info(fmt.Sprintf("user %s started recording %s in room %s", actor.Id, recording.Id, room.Id))
+	room.BroadcastJson(NewMessageRecordingState(recording, ""))
+
+	return recording, nil
+}
+
+func (room *Room) StopRecording(actor *User, recordingId string) error {
+	if !room.RoleOf(actor).CanModerate() {
+		return ErrNotAllowed
+	}
+
+	recording := room.GetRecording(recordingId)
+	if recording == nil {
+		return ErrRecordingNotFound
+	}
+
+	recording.Stop(fmt.Sprintf("recording stopped by %s", actor.Id))
+	return nil
+}
+
+func (room *Room) GetRecording(id string) *Recording {
+	room.recordingsMutex.Lock()
+	defer room.recordingsMutex.Unlock()
+
+	return room.recordings[id]
+}
+
+func (room *Room) GetRecordings() []*Recording {
+	room.recordingsMutex.Lock()
+	defer room.recordingsMutex.Unlock()
+
+	return slices.Collect(maps.Values(room.recordings))
+}
+
+// recordInStream adds a newly published stream to the room wide recordings.
+func (room *Room) recordInStream(stream *IncomingStream) {
+	for _, recording := range room.GetRecordings() {
+		if recording.StreamId == "" {
+			recording.addStream(stream)
+		}
+	}
+}
+
+func (room *Room) stopRecordings(cause string) {
+	for _, recording := range room.GetRecordings() {
+		recording.Stop(cause)
+	}
+}
+
+func (rec *Recording) Stop(cause string) {
+	rec.mutex.Lock()
+	if rec.stopped {
+		rec.mutex.Unlock()
+		return
+	}
+	rec.stopped = true
+	now := time.Now()
+	rec.StoppedAt = &now
+	recorders := rec.recorders
+	rec.recorders = make(map[string]*streamRecorder)
+	rec.mutex.Unlock()
+
+	for _, recorder := range recorders {
+		recorder.stream.RemoveSink(recorder)
+	}
+	rec.writeManifest()
+
+	rec.room.recordingsMutex.Lock()
+	delete(rec.room.recordings, rec.Id)
+	rec.room.recordingsMutex.Unlock()
+
+	logger.Info(fmt.Sprintf("recording %s of room %s stopped, %s", rec.Id, rec.RoomId, cause))
+	rec.room.BroadcastJson(NewMessageRecordingState(rec, cause))
+}
+
+func (rec *Recording) IsStopped() bool {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	return rec.stopped
+}
+
+func (rec *Recording) addStream(stream *IncomingStream) {
+	recorder := &streamRecorder{
+		recording: rec,
+		stream:    stream,
+		tracks:    make(map[*StreamTrack]*trackRecorder),
+		mutex:     new(sync.Mutex),
+	}
+
+	rec.mutex.Lock()
+	if rec.stopped {
+		rec.mutex.Unlock()
+		return
+	}
+	if _, ok := rec.recorders[stream.Id]; ok {
+		rec.mutex.Unlock()
+		return
+	}
+	rec.recorders[stream.Id] = recorder
+	rec.mutex.Unlock()
+
+	if !stream.AddSink(recorder) {
+		rec.removeRecorder(recorder)
+		return
+	}
+	if rec.IsStopped() {
+		stream.RemoveSink(recorder)
+		return
+	}
+	stream.RequestKeyframe()
+}
+
+func (rec *Recording) removeRecorder(recorder *streamRecorder) {
+	rec.mutex.Lock()
+	if rec.recorders[recorder.stream.Id] == recorder {
+		delete(rec.recorders, recorder.stream.Id)
+	}
+	rec.mutex.Unlock()
+}
+
+func (rec *Recording) addFile(file *RecordingFile) {
+	rec.mutex.Lock()
+	rec.Files = append(rec.Files, file)
+	rec.mutex.Unlock()
+
+	rec.writeManifest()
+}
+
+// startTrack records when the first media of a track has been written.
+func (rec *Recording) startTrack(track *RecordingTrack, timestamp uint32) {
+	rec.mutex.Lock()
+	track.Started = true
+	track.StartOffset = Duration{time.Since(rec.StartedAt)}
+	track.FirstRTPTimestamp = timestamp
+	rec.mutex.Unlock()
+}
+
+func (rec *Recording) writeManifest() {
+	rec.mutex.Lock()
+	manifest, err := json.MarshalIndent(rec, "", "  ")
+	rec.mutex.Unlock()
+	if err != nil {
+		logger.Warn(fmt.Sprintf("failed encoding manifest of recording %s, %s", rec.Id, err.Error()))
+		return
+	}
+
+	// Written aside then renamed so a crash never leaves a truncated manifest.
+	path := filepath.Join(rec.directory, recordingManifestName)
+	if err := os.WriteFile(path+".tmp", manifest, 0o644); err != nil {
+		logger.Warn(fmt.Sprintf("failed writing manifest of recording %s, %s", rec.Id, err.Error()))
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		logger.Warn(fmt.Sprintf("failed writing manifest of recording %s, %s", rec.Id, err.Error()))
+	}
+}
+
+// streamRecorder is the RTPSink of a recording on a stream, files are opened
+// once the first packet of a track arrives.
+type streamRecorder struct {
+	recording *Recording
+	stream    *IncomingStream
+
+	tracks map[*StreamTrack]*trackRecorder
+	webm   *webmWriter
+	closed bool
+	mutex  *sync.Mutex
+}
+
+type trackRecorder struct {
+	writer   rtpWriter
+	track    *RecordingTrack
+	disabled bool
+
+	// path and headerSize tell when the writer, which may wait for a
+	// keyframe, stores its first frame.
+	path       string
+	headerSize int64
+}
+
+type rtpWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+	Close() error
+}
+
+func (r *streamRecorder) WriteRTP(track *StreamTrack, packet *rtp.Packet) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	recorder, ok := r.tracks[track]
+	if !ok {
+		var err error
+		recorder, err = r.openTrack(track)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("recording %s can't record track %s, %s", r.recording.Id, track.Id, err.Error()))
+			recorder = &trackRecorder{disabled: true}
+		}
+		r.tracks[track] = recorder
+	}
+	if recorder.disabled {
+		return
+	}
+
+	if err := recorder.writer.WriteRTP(packet); err != nil {
+		logger.Trace(fmt.Sprintf("recording %s failed writing track %s, %s", r.recording.Id, track.Id, err.Error()))
+		return
+	}
+	if recorder.path != "" && !recorder.track.Started {
+		if info, err := os.Stat(recorder.path); err == nil && info.Size() > recorder.headerSize {
+			r.recording.startTrack(recorder.track, packet.Timestamp)
+		}
+	}
+}
+
+func (r *streamRecorder) Close() {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return
+	}
+	r.closed = true
+	for track, recorder := range r.tracks {
+		if recorder.disabled {
+			continue
+		}
+		if err := recorder.writer.Close(); err != nil {
+			logger.Warn(fmt.Sprintf("recording %s failed closing track %s, %s", r.recording.Id, track.Id, err.Error()))
+		}
+	}
+	if r.webm != nil {
+		if err := r.webm.Close(); err != nil {
+			logger.Warn(fmt.Sprintf("recording %s failed closing stream %s, %s", r.recording.Id, r.stream.Id, err.Error()))
+		}
+	}
+	r.mutex.Unlock()
+
+	r.recording.removeRecorder(r)
+	if r.recording.StreamId == r.stream.Id {
+		r.recording.Stop("the stream has been unpublished")
+		return
+	}
+	r.recording.writeManifest()
+}
+
+func (r *streamRecorder) openTrack(track *StreamTrack) (*trackRecorder, error) {
+	codec := track.Codec
+	recorded := &RecordingTrack{
+		Id:        track.Id,
+		Kind:      track.Kind,
+		MimeType:  codec.MimeType,
+		ClockRate: codec.ClockRate,
+	}
+
+	if r.recording.Format == RecordingFormatWebm {
+		return r.openWebmTrack(track, recorded)
+	}
+
+	var container string
+	var open func(path string) (rtpWriter, error)
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9), strings.ToLower(webrtc.MimeTypeAV1):
+		container = "ivf"
+		open = func(path string) (rtpWriter, error) {
+			return ivfwriter.New(path, ivfwriter.WithCodec(codec.MimeType))
+		}
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		container = "ogg"
+		open = func(path string) (rtpWriter, error) {
+			return oggwriter.New(path, codec.ClockRate, max(codec.Channels, 1))
+		}
+	default:
+		return nil, fmt.Errorf("codec %s can't be recorded", codec.MimeType)
+	}
+
+	name := fmt.Sprintf("%s_%s_%s.%s", r.stream.Publisher.Id, r.stream.Id, sanitizeFileName(track.Id), container)
+	path := filepath.Join(r.recording.directory, name)
+	writer, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+
+	r.recording.addFile(&RecordingFile{
+		Path:        name,
+		Container:   container,
+		StreamId:    r.stream.Id,
+		PublisherId: r.stream.Publisher.Id,
+		Tracks:      []*RecordingTrack{recorded},
+	})
+
+	return &trackRecorder{
+		writer:     writer,
+		path:       path,
+		headerSize: info.Size(),
+		track:      recorded,
+	}, nil
+}
+
+// openWebmTrack shares a single webm file between the tracks of the stream,
+// the file holds the tracks known when the first one starts.
+func (r *streamRecorder) openWebmTrack(track *StreamTrack, recorded *RecordingTrack) (*trackRecorder, error) {
+	if r.webm != nil {
+		return nil, errors.New("the track started after the webm file was created")
+	}
+
+	name := fmt.Sprintf("%s_%s.webm", r.stream.Publisher.Id, r.stream.Id)
+	file := &RecordingFile{
+		Path:        name,
+		Container:   "webm",
+		StreamId:    r.stream.Id,
+		PublisherId: r.stream.Publisher.Id,
+		Tracks:      make([]*RecordingTrack, 0),
+	}
+
+	webmTracks := make([]*webmTrack, 0)
+	recorders := make(map[*StreamTrack]*trackRecorder)
+	for _, streamTrack := range r.stream.GetTracks() {
+		codec := streamTrack.Codec
+		codecId, ok := webmCodecId(strings.ToLower(codec.MimeType))
+		if !ok {
+			logger.Warn(fmt.Sprintf("recording %s can't record track %s, %s", r.recording.Id, streamTrack.Id, errWebmUnsupportedCodec.Error()))
+			recorders[streamTrack] = &trackRecorder{disabled: true}
+			continue
+		}
+
+		entry := &webmTrack{
+			Number:   uint64(len(webmTracks) + 1),
+			Video:    streamTrack.Kind == webrtc.RTPCodecTypeVideo.String(),
+			CodecId:  codecId,
+			Channels: max(codec.Channels, 1),
+		}
+		webmTracks = append(webmTracks, entry)
+
+		trackInfo := recorded
+		if streamTrack != track {
+			trackInfo = &RecordingTrack{
+				Id:        streamTrack.Id,
+				Kind:      streamTrack.Kind,
+				MimeType:  codec.MimeType,
+				ClockRate: codec.ClockRate,
+			}
+		}
+		file.Tracks = append(file.Tracks, trackInfo)
+
+		recorders[streamTrack] = &trackRecorder{
+			writer: newWebmTrackRecorder(r.recording, entry, trackInfo, codec),
+			track:  trackInfo,
+		}
+	}
+
+	recorder, ok := recorders[track]
+	if !ok || recorder.disabled {
+		return nil, errWebmUnsupportedCodec
+	}
+
+	writer, err := newWebmWriter(filepath.Join(r.recording.directory, name), webmTracks)
+	if err != nil {
+		return nil, err
+	}
+	r.webm = writer
+	for streamTrack, trackRecorder := range recorders {
+		if webmRecorder, ok := trackRecorder.writer.(*webmTrackRecorder); ok {
+			webmRecorder.writer = writer
+		}
+		if streamTrack != track {
+			r.tracks[streamTrack] = trackRecorder
+		}
+	}
+
+	r.recording.addFile(file)
+
+	return recorder, nil
+}
+
+// webmTrackRecorder rebuilds frames from the rtp packets of a track and
+// timestamps them from the start of the recording.
+type webmTrackRecorder struct {
+	recording *Recording
+	writer    *webmWriter
+	entry     *webmTrack
+	track     *RecordingTrack
+	builder   *samplebuilder.SampleBuilder
+	clockRate uint32
+
+	started        bool
+	startOffset    time.Duration
+	firstTimestamp uint32
+}
+
+func newWebmTrackRecorder(recording *Recording, entry *webmTrack, track *RecordingTrack, codec webrtc.RTPCodecParameters) *webmTrackRecorder {
+	var depacketizer rtp.Depacketizer
+	maxLate := uint16(512)
+	switch entry.CodecId {
+	case "V_VP8":
+		depacketizer = &codecs.VP8Packet{}
+	case "V_VP9":
+		depacketizer = &codecs.VP9Packet{}
+	case "V_AV1":
+		depacketizer = &codecs.AV1Depacketizer{}
+	default:
+		depacketizer = &codecs.OpusPacket{}
+		maxLate = 32
+	}
+
+	return &webmTrackRecorder{
+		recording: recording,
+		entry:     entry,
+		track:     track,
+		builder:   samplebuilder.New(maxLate, depacketizer, codec.ClockRate),
+		clockRate: codec.ClockRate,
+	}
+}
+
+func (w *webmTrackRecorder) WriteRTP(packet *rtp.Packet) error {
+	w.builder.Push(packet)
+
+	for sample := w.builder.Pop(); sample != nil; sample = w.builder.Pop() {
+		if !w.started {
+			w.started = true
+			w.firstTimestamp = sample.PacketTimestamp
+			w.startOffset = time.Since(w.recording.StartedAt)
+			w.recording.startTrack(w.track, sample.PacketTimestamp)
+		}
+
+		elapsed := time.Duration(sample.PacketTimestamp-w.firstTimestamp) * time.Second / time.Duration(w.clockRate)
+		timecode := (w.startOffset + elapsed).Milliseconds()
+
+		if err := w.writer.WriteFrame(w.entry, timecode, w.isKeyframe(sample.Data), sample.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *webmTrackRecorder) Close() error {
+	return nil
+}
+
+func (w *webmTrackRecorder) isKeyframe(frame []byte) bool {
+	return !w.entry.Video || isVideoKeyframe(w.track.MimeType, frame)
+}
+
+func isVideoKeyframe(mimeType string, frame []byte) bool {
+	if len(frame) == 0 {
+		return false
+	}
+
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return frame[0]&0x01 == 0
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		// frame_marker, profile, show_existing_frame then frame_type.
+		profile := (frame[0]>>5)&0x01 | (frame[0]>>3)&0x02
+		bit := 4
+		if profile == 3 {
+			bit++
+		}
+		if frame[0]>>(7-bit)&0x01 == 1 {
+			return false
+		}
+		bit++
+		return frame[0]>>(7-bit)&0x01 == 0
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		// Keyframes of a webrtc stream start with a sequence header.
+		return (frame[0]>>3)&0x0F == 1
+	default:
+		return true
+	}
+}
+
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
@@ -1,19 +1,44 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"regexp"
 	"slices"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/pion/interceptor"
 	"github.com/pion/webrtc/v4"
 )
 
 type NewRoomOptions struct {
-	VideoCodec string `json:"video_codec,omitempty"`
+	Id          string          `json:"id,omitempty"`
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Metadata    json.RawMessage `json:"metadata,omitempty"`
+	Unlisted    bool            `json:"unlisted,omitempty"`
+	OwnerId     string          `json:"-"`
+	DefaultRole string          `json:"default_role,omitempty"`
+
+	Passcode   string `json:"passcode,omitempty"`
+	InviteOnly bool   `json:"invite_only,omitempty"`
+	Lobby      bool   `json:"lobby,omitempty"`
+
+	VideoCodec   string    `json:"video_codec,omitempty"`
+	EmptyTimeout *Duration `json:"empty_timeout,omitempty"`
+	MaxLifetime  *Duration `json:"max_lifetime,omitempty"`
+	IdleTimeout  *Duration `json:"idle_timeout,omitempty"`
+	Persistent   bool      `json:"persistent,omitempty"`
+
+	MaxParticipants   *int `json:"max_participants,omitempty"`
+	MaxPublishers     *int `json:"max_publishers,omitempty"`
+	MaxStreamsPerUser *int `json:"max_streams_per_user,omitempty"`
+
+	HistorySize *int `json:"history_size,omitempty"`
 }
 
 type Room struct {
@@ -21,7 +46,29 @@ type Room struct {
 	Users      []*User `json:"users"`
 	usersMutex *sync.Mutex
 
-	Api *webrtc.API `json:"-"`
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Metadata    json.RawMessage `json:"metadata,omitempty"`
+	Unlisted    bool            `json:"unlisted"`
+	OwnerId     string          `json:"owner_id"`
+	DefaultRole Role            `json:"default_role"`
+	roles       map[string]Role
+	banned      map[string]bool
+	bannedIPs   map[string]bool
+	rolesMutex  *sync.Mutex
+
+	PasscodeProtected bool `json:"passcode_protected"`
+	InviteOnly        bool `json:"invite_only"`
+	passcodeHash      []byte
+	invites           map[string]*RoomInvite
+	invitesMutex      *sync.Mutex
+
+	Lobby      bool `json:"lobby"`
+	lobby      map[string]*User
+	lobbyMutex *sync.Mutex
+
+	mediaEngine  *webrtc.MediaEngine
+	interceptors *interceptor.Registry
 
 	VideoCodec string `json:"video_codec"`
 	AudioCodec string `json:"audio_codec"`
@@ -29,19 +76,92 @@ type Room struct {
 	InStreams      map[string]*IncomingStream `json:"in_streams"`
 	inStreamsMutex *sync.Mutex
 
-	timeoutDestroyStarted       *atomic.Bool
-	cancelTimeoutDestroyChannel chan bool
+	CreatedAt    time.Time `json:"created_at"`
+	EmptyTimeout Duration  `json:"empty_timeout"`
+	MaxLifetime  Duration  `json:"max_lifetime"`
+	IdleTimeout  Duration  `json:"idle_timeout"`
+	Persistent   bool      `json:"persistent"`
+
+	MaxParticipants   int `json:"max_participants"`
+	MaxPublishers     int `json:"max_publishers"`
+	MaxStreamsPerUser int `json:"max_streams_per_user"`
+
+	HistorySize  int `json:"history_size"`
+	history      []RoomMessage
+	historyMutex *sync.Mutex
+
+	emptyDestroy   *time.Timer
+	lifetimeExpiry *roomExpiry
+	idleExpiry     *roomExpiry
+	expiryMutex    *sync.Mutex
+	destroyed      bool
+
+	ParentId       string `json:"parent_id,omitempty"`
+	parent         *Room
+	breakouts      []*Room
+	breakoutsTimer *time.Timer
+	breakoutsMutex *sync.Mutex
+
+	recordings      map[string]*Recording
+	recordingsMutex *sync.Mutex
+
+	viewers      map[string]*WhepViewer
+	viewersMutex *sync.Mutex
+
+	options     NewRoomOptions
+	destroyOnce *sync.Once
 }
 
+// roomExpiry warns the room members before destroying the room.
+type roomExpiry struct {
+	warnTimer    *time.Timer
+	destroyTimer *time.Timer
+}
+
+var (
+	ErrRoomExists          = errors.New("a room with this id already exists")
+	ErrRoomFull            = errors.New("the room is full")
+	ErrPublishLimitReached = errors.New("the publish limit of the room has been reached")
+)
+
 var (
 	rooms      map[string]*Room = make(map[string]*Room)
 	roomsMutex *sync.RWMutex    = new(sync.RWMutex)
 )
 
+const (
+	roomCauseDestroyed = "room has been destroyed"
+	roomCauseEmpty     = "room has been empty for too long"
+	roomCauseLifetime  = "room lifetime reached"
+	roomCauseIdle      = "room idle without publishers"
+)
+
+var roomIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// newInterceptorRegistry registers the interceptors pion adds by default,
+// nacks, reports and twcc, under the metrics one, which counts the packets
+// written by the tracks, retransmissions left out. Every peer connection
+// adds its capture tap under them, see newCapturedPeerConnection.
+func newInterceptorRegistry(mediaEngine *webrtc.MediaEngine) (*interceptor.Registry, error) {
+	registry := new(interceptor.Registry)
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+	registry.Add(&metricsInterceptorFactory{})
+	return registry, nil
+}
+
 func NewRoom(opts *NewRoomOptions) (*Room, error) {
+	if opts == nil {
+		opts = new(NewRoomOptions)
+	}
+	if err := opts.validateDescription(); err != nil {
+		return nil, err
+	}
+
 	mediaEngine := new(webrtc.MediaEngine)
 
-	if opts != nil && opts.VideoCodec != "" {
+	if opts.VideoCodec != "" {
 		switch opts.VideoCodec {
 		case "av1":
 			if err := addVideoCodecAV1(mediaEngine); err != nil {
@@ -56,29 +176,240 @@ func NewRoom(opts *NewRoomOptions) (*Room, error) {
 		}
 	}
 
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+	roomConfig := GetConfig().Room
+	emptyTimeout, maxLifetime, idleTimeout := roomConfig.DestroyTimeout, roomConfig.MaxLifetime, roomConfig.IdleTimeout
+	maxParticipants, maxPublishers, maxStreamsPerUser := roomConfig.MaxParticipants, roomConfig.MaxPublishers, roomConfig.MaxStreamsPerUser
+	if opts.EmptyTimeout != nil {
+		emptyTimeout = *opts.EmptyTimeout
+	}
+	if opts.MaxLifetime != nil {
+		maxLifetime = *opts.MaxLifetime
+	}
+	if opts.IdleTimeout != nil {
+		idleTimeout = *opts.IdleTimeout
+	}
+	if opts.MaxParticipants != nil {
+		maxParticipants = *opts.MaxParticipants
+	}
+	if opts.MaxPublishers != nil {
+		maxPublishers = *opts.MaxPublishers
+	}
+	if opts.MaxStreamsPerUser != nil {
+		maxStreamsPerUser = *opts.MaxStreamsPerUser
+	}
+	historySize := roomConfig.HistorySize
+	if opts.HistorySize != nil {
+		historySize = min(*opts.HistorySize, roomConfig.HistorySize)
+	}
+	if emptyTimeout.Duration < 0 || maxLifetime.Duration < 0 || idleTimeout.Duration < 0 {
+		return nil, errors.New("room timeouts must not be negative")
+	}
+	if maxParticipants < 0 || maxPublishers < 0 || maxStreamsPerUser < 0 || historySize < 0 {
+		return nil, errors.New("room limits must not be negative")
+	}
+
+	registry, err := newInterceptorRegistry(mediaEngine)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultRole := RoleParticipant
+	if opts.DefaultRole != "" {
+		role, err := ParseRole(opts.DefaultRole)
+		if err != nil {
+			return nil, err
+		}
+		if role.CanModerate() {
+			return nil, errors.New("the default role can't be a moderation role")
+		}
+		defaultRole = role
+	}
+
+	var passcodeHash []byte
+	if opts.Passcode != "" {
+		hash, err := hashPasscode(opts.Passcode)
+		if err != nil {
+			return nil, err
+		}
+		passcodeHash = hash
+	}
+
+	id := opts.Id
+	if id == "" {
+		id = uuid.NewString()
+	}
 
 	room := &Room{
-		Id:         uuid.NewString(),
+		Id:         id,
 		Users:      make([]*User, 0),
 		usersMutex: new(sync.Mutex),
 
-		Api: api,
+		Name:        opts.Name,
+		Description: opts.Description,
+		Metadata:    opts.Metadata,
+		Unlisted:    opts.Unlisted,
+		OwnerId:     opts.OwnerId,
+		DefaultRole: defaultRole,
+		roles:       make(map[string]Role),
+		banned:      make(map[string]bool),
+		bannedIPs:   make(map[string]bool),
+		rolesMutex:  new(sync.Mutex),
+
+		PasscodeProtected: passcodeHash != nil,
+		InviteOnly:        opts.InviteOnly,
+		passcodeHash:      passcodeHash,
+		invites:           make(map[string]*RoomInvite),
+		invitesMutex:      new(sync.Mutex),
+
+		Lobby:      opts.Lobby,
+		lobby:      make(map[string]*User),
+		lobbyMutex: new(sync.Mutex),
+
+		mediaEngine:  mediaEngine,
+		interceptors: registry,
 
 		InStreams:      make(map[string]*IncomingStream),
 		inStreamsMutex: new(sync.Mutex),
 
-		timeoutDestroyStarted:       new(atomic.Bool),
-		cancelTimeoutDestroyChannel: make(chan bool),
+		CreatedAt:    time.Now(),
+		EmptyTimeout: emptyTimeout,
+		MaxLifetime:  maxLifetime,
+		IdleTimeout:  idleTimeout,
+		Persistent:   opts.Persistent,
+
+		MaxParticipants:   maxParticipants,
+		MaxPublishers:     maxPublishers,
+		MaxStreamsPerUser: maxStreamsPerUser,
+
+		HistorySize:  historySize,
+		history:      make([]RoomMessage, 0),
+		historyMutex: new(sync.Mutex),
+
+		expiryMutex: new(sync.Mutex),
+
+		breakoutsMutex: new(sync.Mutex),
+
+		recordings:      make(map[string]*Recording),
+		recordingsMutex: new(sync.Mutex),
+
+		viewers:      make(map[string]*WhepViewer),
+		viewersMutex: new(sync.Mutex),
+
+		options:     *opts,
+		destroyOnce: new(sync.Once),
+	}
+	if !addRoomIfAbsent(room) {
+		return nil, ErrRoomExists
 	}
-	room.timeoutDestroyStarted.Store(false)
 
-	AddRoom(room)
+	if !room.Persistent && room.MaxLifetime.Duration > 0 {
+		room.lifetimeExpiry = room.scheduleExpiry(room.MaxLifetime.Duration, roomCauseLifetime)
+	}
+	room.startIdleExpiry()
 
 	return room, nil
 }
 
+// GetOrCreateRoom returns the room matching opts.Id when it already exists,
+// otherwise it creates it. The boolean reports whether the room was created.
+func GetOrCreateRoom(opts *NewRoomOptions) (*Room, bool, error) {
+	if opts != nil && opts.Id != "" {
+		if room := GetRoom(opts.Id); room != nil {
+			return room, false, nil
+		}
+	}
+
+	room, err := NewRoom(opts)
+	if errors.Is(err, ErrRoomExists) {
+		if room := GetRoom(opts.Id); room != nil {
+			return room, false, nil
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return room, true, nil
+}
+
+func (opts *NewRoomOptions) validateDescription() error {
+	if opts.Id != "" && !roomIdPattern.MatchString(opts.Id) {
+		return errors.New("room id must be 1 to 64 letters, digits, dashes or underscores")
+	}
+	if len(opts.Name) > 128 {
+		return errors.New("room name must not exceed 128 bytes")
+	}
+	if len(opts.Description) > 1024 {
+		return errors.New("room description must not exceed 1024 bytes")
+	}
+	if len(opts.Metadata) > 4096 {
+		return errors.New("room metadata must not exceed 4096 bytes")
+	}
+	return nil
+}
+
+// MarshalJSON reads the owner under its lock, it changes with transfers.
+func (room *Room) MarshalJSON() ([]byte, error) {
+	type roomJson Room
+
+	return json.Marshal(struct {
+		*roomJson
+		OwnerId string `json:"owner_id"`
+	}{
+		roomJson: (*roomJson)(room),
+		OwnerId:  room.Owner(),
+	})
+}
+
+func (room *Room) VisibleTo(user *User) bool {
+	return !room.Unlisted || user.Room == room
+}
+
+func (room *Room) ParticipantsCount() int {
+	room.usersMutex.Lock()
+	defer room.usersMutex.Unlock()
+
+	return len(room.Users)
+}
+
+func (room *Room) humansCountLocked() int {
+	count := 0
+	for _, user := range room.Users {
+		if !user.Synthetic {
+			count++
+		}
+	}
+	return count
+}
+
+func (room *Room) PublishersCount() int {
+	room.inStreamsMutex.Lock()
+	defer room.inStreamsMutex.Unlock()
+
+	return len(room.streamsByPublisherLocked())
+}
+
+func (room *Room) streamsByPublisherLocked() map[*User]int {
+	publishers := make(map[*User]int)
+	for _, stream := range room.InStreams {
+		publishers[stream.Publisher]++
+	}
+	return publishers
+}
+
 func (room *Room) AddUser(user *User) error {
+	if err := room.addUser(user); err != nil {
+		return err
+	}
+
+	if room.stopDestroyTimeout() {
+		logger.Info(fmt.Sprintf("room %s destroy cancel, new user joined the room", room.Id))
+	}
+
+	return nil
+}
+
+func (room *Room) addUser(user *User) error {
 	room.usersMutex.Lock()
 	defer room.usersMutex.Unlock()
 
@@ -86,9 +417,13 @@ func (room *Room) AddUser(user *User) error {
 		return errors.New("user already is the room")
 	}
 
-	if room.timeoutDestroyStarted.Load() {
-		room.stopDestroyTimeout()
-		logger.Info(fmt.Sprintf("room %s destroy cancel, new user joined the room", room.Id))
+	if room.IsBanned(user) {
+		return ErrUserBanned
+	}
+
+	// The synthetic users of the ingests don't take the seat of a participant.
+	if !user.Synthetic && room.MaxParticipants > 0 && room.humansCountLocked() >= room.MaxParticipants {
+		return ErrRoomFull
 	}
 
 	room.Users = append(room.Users, user)
@@ -99,11 +434,14 @@ func (room *Room) AddUser(user *User) error {
 
 func (room *Room) RemoveUser(user *User) error {
 	room.usersMutex.Lock()
-	defer room.usersMutex.Unlock()
-
-	if !slices.Contains(room.Users, user) {
+	idx := slices.Index(room.Users, user)
+	if idx == -1 {
+		room.usersMutex.Unlock()
 		return errors.New("user is not in the room")
 	}
+	room.Users = slices.Delete(room.Users, idx, idx+1)
+	empty := len(room.Users) == 0
+	room.usersMutex.Unlock()
 
 	for _, stream := range room.GetInStreamsByPublisher(user) {
 		stream.Teardown()
@@ -113,36 +451,96 @@ func (room *Room) RemoveUser(user *User) error {
 		}
 	}
 
-	idx := slices.Index(room.Users, user)
-	room.Users = slices.Delete(room.Users, idx, idx+1)
-
-	if len(room.Users) == 0 {
-		logger.Info(fmt.Sprintf("room %s is empty, leaving timeout of 30 seconds before destroy", room.Id))
-
-		room.timeoutDestroyStarted.Store(true)
-		go room.startDestroyTimeout()
+	if empty {
+		room.startEmptyDestroy()
 	}
 
 	return nil
 }
 
 func (room *Room) Destroy() {
-	close(room.cancelTimeoutDestroyChannel)
+	room.DestroyWithCause(roomCauseDestroyed)
+}
 
-	for _, user := range room.Users {
-		if err := user.LeaveCurrentRoom("room has been destroyed"); err != nil {
-			logger.Warn(fmt.Sprintf("user %s failed leaving room %s, %s", user.Id, room.Id, err.Error()))
+func (room *Room) DestroyWithCause(cause string) {
+	room.destroyOnce.Do(func() {
+		room.expiryMutex.Lock()
+		room.destroyed = true
+		if room.emptyDestroy != nil {
+			room.emptyDestroy.Stop()
+		}
+		room.lifetimeExpiry.Stop()
+		room.idleExpiry.Stop()
+		room.expiryMutex.Unlock()
+
+		room.clearLobby(cause)
+		room.destroyBreakouts(cause)
+		room.stopRecordings(cause)
+		room.closeViewers(cause)
+		revokeRoomRTMPKeys(room.Id)
+
+		for _, user := range room.GetUsers() {
+			if err := user.LeaveCurrentRoom(cause); err != nil {
+				logger.Warn(fmt.Sprintf("user %s failed leaving room %s, %s", user.Id, room.Id, err.Error()))
+			}
+		}
+
+		roomsMutex.Lock()
+		delete(rooms, room.Id)
+		roomsMutex.Unlock()
+
+		if room.parent != nil {
+			room.parent.removeBreakout(room)
 		}
+
+		metricRoomsDestroyed.With(room.destroyReason(cause)).Inc()
+		logger.Info(fmt.Sprintf("room %s has been destroyed, %s", room.Id, cause))
+	})
+}
+
+// destroyReason maps the cause of the destruction to the label of the
+// metrics, the causes of closed breakouts are free text.
+func (room *Room) destroyReason(cause string) string {
+	switch {
+	case room.parent != nil:
+		return "breakout"
+	case cause == roomCauseEmpty:
+		return "empty"
+	case cause == roomCauseLifetime:
+		return "lifetime"
+	case cause == roomCauseIdle:
+		return "idle"
+	default:
+		return "other"
 	}
+}
 
-	roomsMutex.Lock()
-	delete(rooms, room.Id)
-	roomsMutex.Unlock()
+func (room *Room) GetUsers() []*User {
+	room.usersMutex.Lock()
+	defer room.usersMutex.Unlock()
+
+	return slices.Clone(room.Users)
+}
 
-	logger.Info(fmt.Sprintf("room %s has been destroyed", room.Id))
+func (room *Room) BroadcastJson(msg any) {
+	for _, user := range room.GetUsers() {
+		user.SendMessageJson(msg)
+	}
 }
 
 func (room *Room) AddInStream(stream *IncomingStream) error {
+	if err := room.addInStream(stream); err != nil {
+		return err
+	}
+
+	room.BroadcastJson(NewMessageStreamAdded(room, stream))
+	room.recordInStream(stream)
+	room.refreshViewers()
+
+	return nil
+}
+
+func (room *Room) addInStream(stream *IncomingStream) error {
 	room.inStreamsMutex.Lock()
 	defer room.inStreamsMutex.Unlock()
 
@@ -150,14 +548,33 @@ func (room *Room) AddInStream(stream *IncomingStream) error {
 		return errors.New("this stream has already been published in this room")
 	}
 
-	room.InStreams[stream.Id] = stream
+	publishers := room.streamsByPublisherLocked()
+	if streams, ok := publishers[stream.Publisher]; ok {
+		if room.MaxStreamsPerUser > 0 && streams >= room.MaxStreamsPerUser {
+			return ErrPublishLimitReached
+		}
+	} else if room.MaxPublishers > 0 && len(publishers) >= room.MaxPublishers {
+		return ErrPublishLimitReached
+	}
 
-	// TODO: broadcast message in room to update streams
+	room.InStreams[stream.Id] = stream
+	room.stopIdleExpiry()
 
 	return nil
 }
 
 func (room *Room) RemoveInStream(stream *IncomingStream) error {
+	if err := room.removeInStream(stream); err != nil {
+		return err
+	}
+
+	room.BroadcastJson(NewMessageStreamRemoved(room, stream))
+	room.refreshViewers()
+
+	return nil
+}
+
+func (room *Room) removeInStream(stream *IncomingStream) error {
 	room.inStreamsMutex.Lock()
 	defer room.inStreamsMutex.Unlock()
 
@@ -168,11 +585,27 @@ func (room *Room) RemoveInStream(stream *IncomingStream) error {
 	delete(room.InStreams, stream.Id)
 	logger.Debug(fmt.Sprintf("remove in stream %s from %s", stream.Id, stream.Publisher.Id))
 
-	// TODO: broadcast message in room to update streams
+	if len(room.InStreams) == 0 {
+		room.startIdleExpiry()
+	}
 
 	return nil
 }
 
+func (room *Room) GetInStream(id string) *IncomingStream {
+	room.inStreamsMutex.Lock()
+	defer room.inStreamsMutex.Unlock()
+
+	return room.InStreams[id]
+}
+
+func (room *Room) GetInStreams() []*IncomingStream {
+	room.inStreamsMutex.Lock()
+	defer room.inStreamsMutex.Unlock()
+
+	return slices.Collect(maps.Values(room.InStreams))
+}
+
 func (room *Room) GetInStreamsByPublisher(user *User) []*IncomingStream {
 	room.inStreamsMutex.Lock()
 	defer room.inStreamsMutex.Unlock()
@@ -188,29 +621,93 @@ func (room *Room) GetInStreamsByPublisher(user *User) []*IncomingStream {
 	return streams
 }
 
-func (room *Room) startDestroyTimeout() {
-	timer := time.NewTimer(30 * time.Second)
+// startEmptyDestroy starts the destroy timeout of an empty room, rooms with
+// breakouts wait for them to be closed. The room is checked empty under the
+// expiry lock, so a user added before stopDestroyTimeout is always seen.
+func (room *Room) startEmptyDestroy() {
+	if room.Persistent {
+		return
+	}
 
-	defer func() {
-		timer.Stop()
-		room.timeoutDestroyStarted.Store(false)
-	}()
+	room.expiryMutex.Lock()
+	defer room.expiryMutex.Unlock()
 
-	select {
-	case <-room.cancelTimeoutDestroyChannel:
+	if room.destroyed || room.emptyDestroy != nil || room.ParticipantsCount() > 0 || room.HasBreakouts() {
 		return
-	case <-timer.C:
-		room.Destroy()
+	}
+
+	logger.Info(fmt.Sprintf("room %s is empty, leaving timeout of %s before destroy", room.Id, room.EmptyTimeout))
+	room.emptyDestroy = time.AfterFunc(room.EmptyTimeout.Duration, func() {
+		room.DestroyWithCause(roomCauseEmpty)
+	})
+}
+
+// stopDestroyTimeout cancels the destroy timeout of the room, it reports
+// whether one was running.
+func (room *Room) stopDestroyTimeout() bool {
+	room.expiryMutex.Lock()
+	defer room.expiryMutex.Unlock()
+
+	if room.emptyDestroy == nil {
+		return false
+	}
+	room.emptyDestroy.Stop()
+	room.emptyDestroy = nil
+
+	return true
+}
+
+// scheduleExpiry destroys the room after the delay, the users are warned
+// beforehand unless the expiry warning is disabled.
+func (room *Room) scheduleExpiry(after time.Duration, cause string) *roomExpiry {
+	expiry := &roomExpiry{
+		destroyTimer: time.AfterFunc(after, func() {
+			room.DestroyWithCause(cause)
+		}),
+	}
+
+	if warning := min(GetConfig().Room.ExpiryWarning.Duration, after); warning > 0 {
+		expiry.warnTimer = time.AfterFunc(after-warning, func() {
+			logger.Info(fmt.Sprintf("room %s expiring in %s, %s", room.Id, warning, cause))
+			room.BroadcastJson(NewMessageRoomExpiring(room, cause, time.Now().Add(warning)))
+		})
+	}
+
+	return expiry
+}
+
+func (expiry *roomExpiry) Stop() {
+	if expiry == nil {
 		return
 	}
+	if expiry.warnTimer != nil {
+		expiry.warnTimer.Stop()
+	}
+	expiry.destroyTimer.Stop()
 }
 
-func (room *Room) stopDestroyTimeout() {
-	if !room.timeoutDestroyStarted.Load() {
+func (room *Room) startIdleExpiry() {
+	if room.Persistent || room.IdleTimeout.Duration == 0 {
+		return
+	}
+
+	room.expiryMutex.Lock()
+	defer room.expiryMutex.Unlock()
+
+	if room.destroyed {
 		return
 	}
 
-	room.cancelTimeoutDestroyChannel <- true
+	room.idleExpiry.Stop()
+	room.idleExpiry = room.scheduleExpiry(room.IdleTimeout.Duration, roomCauseIdle)
+}
+
+func (room *Room) stopIdleExpiry() {
+	room.expiryMutex.Lock()
+	defer room.expiryMutex.Unlock()
+
+	room.idleExpiry.Stop()
+	room.idleExpiry = nil
 }
 
 func AddRoom(room *Room) {
@@ -219,6 +716,28 @@ func AddRoom(room *Room) {
 	roomsMutex.Unlock()
 }
 
+func addRoomIfAbsent(room *Room) bool {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	if _, ok := rooms[room.Id]; ok {
+		return false
+	}
+	rooms[room.Id] = room
+	return true
+}
+
+func GetRooms() []*Room {
+	roomsMutex.RLock()
+	defer roomsMutex.RUnlock()
+
+	list := make([]*Room, 0, len(rooms))
+	for _, room := range rooms {
+		list = append(list, room)
+	}
+	return list
+}
+
 func GetRoom(id string) *Room {
 	roomsMutex.RLock()
 	defer roomsMutex.RUnlock()
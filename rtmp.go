@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	rtmpHandshakeSize = 1536
+	rtmpVersion       = 3
+
+	rtmpDefaultChunkSize = 128
+	rtmpOutChunkSize     = 4096
+	rtmpMaxChunkSize     = 1 << 24
+	rtmpMaxCommandSize   = 64 * 1024
+	rtmpWindowSize       = 2500000
+
+	rtmpTypeSetChunkSize     = 1
+	rtmpTypeAbort            = 2
+	rtmpTypeAcknowledgement  = 3
+	rtmpTypeUserControl      = 4
+	rtmpTypeWindowAckSize    = 5
+	rtmpTypeSetPeerBandwidth = 6
+	rtmpTypeAudio            = 8
+	rtmpTypeVideo            = 9
+	rtmpTypeDataAmf3         = 15
+	rtmpTypeCommandAmf3      = 17
+	rtmpTypeDataAmf0         = 18
+	rtmpTypeCommandAmf0      = 20
+
+	rtmpChunkStreamControl = 2
+	rtmpChunkStreamCommand = 3
+	rtmpChunkStreamStatus  = 5
+
+	rtmpExtendedTimestamp = 0xffffff
+)
+
+type rtmpMessage struct {
+	Type      uint8
+	StreamId  uint32
+	Timestamp uint32
+	Payload   []byte
+}
+
+// rtmpChunkStream holds the header of the last chunk of a chunk stream, the
+// next chunks only carry the fields that changed.
+type rtmpChunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	msgType   uint8
+	streamId  uint32
+	extended  bool
+	payload   []byte
+}
+
+// rtmpConn reads and writes the messages of the rtmp chunk stream protocol
+// and handles the protocol control messages itself.
+type rtmpConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	inChunkSize  uint32
+	outChunkSize int
+	chunkStreams map[uint32]*rtmpChunkStream
+	windowSize   uint32
+	received     uint32
+	acknowledged uint32
+	readTimeout  time.Duration
+}
+
+func newRTMPConn(conn net.Conn, readTimeout time.Duration) *rtmpConn {
+	c := &rtmpConn{
+		conn:         conn,
+		writer:       bufio.NewWriter(conn),
+		inChunkSize:  rtmpDefaultChunkSize,
+		outChunkSize: rtmpDefaultChunkSize,
+		chunkStreams: make(map[uint32]*rtmpChunkStream),
+		readTimeout:  readTimeout,
+	}
+	c.reader = bufio.NewReader(rtmpCountingReader{c})
+	return c
+}
+
+type rtmpCountingReader struct {
+	c *rtmpConn
+}
+
+func (r rtmpCountingReader) Read(p []byte) (int, error) {
+	n, err := r.c.conn.Read(p)
+	r.c.received += uint32(n)
+	return n, err
+}
+
+// Handshake runs the simple handshake, S2 echoes C1 which is all publishers
+// check.
+func (c *rtmpConn) Handshake() error {
+	c.conn.SetDeadline(time.Now().Add(c.readTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(c.reader, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != rtmpVersion {
+		return fmt.Errorf("unsupported rtmp version %d", c0c1[0])
+	}
+
+	s0s1 := make([]byte, 1+rtmpHandshakeSize)
+	s0s1[0] = rtmpVersion
+	if _, err := rand.Read(s0s1[9:]); err != nil {
+		return err
+	}
+	c.writer.Write(s0s1)
+	c.writer.Write(c0c1[1:])
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+
+	c2 := make([]byte, rtmpHandshakeSize)
+	if _, err := io.ReadFull(c.reader, c2); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReadMessage returns the next complete message which isn't a protocol
+// control message.
+func (c *rtmpConn) ReadMessage() (*rtmpMessage, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+
+		message, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.acknowledge(); err != nil {
+			return nil, err
+		}
+		if message == nil {
+			continue
+		}
+
+		switch message.Type {
+		case rtmpTypeSetChunkSize:
+			if len(message.Payload) < 4 {
+				return nil, errors.New("invalid set chunk size message")
+			}
+			size := binary.BigEndian.Uint32(message.Payload) & 0x7fffffff
+			if size == 0 || size > rtmpMaxChunkSize {
+				return nil, fmt.Errorf("invalid chunk size %d", size)
+			}
+			c.inChunkSize = size
+		case rtmpTypeAbort:
+			if len(message.Payload) >= 4 {
+				if cs, ok := c.chunkStreams[binary.BigEndian.Uint32(message.Payload)]; ok {
+					cs.payload = nil
+				}
+			}
+		case rtmpTypeWindowAckSize:
+			if len(message.Payload) >= 4 {
+				c.windowSize = binary.BigEndian.Uint32(message.Payload)
+			}
+		case rtmpTypeAcknowledgement, rtmpTypeSetPeerBandwidth:
+		default:
+			return message, nil
+		}
+	}
+}
+
+// readChunk returns the message completed by the chunk, if any.
+func (c *rtmpConn) readChunk() (*rtmpMessage, error) {
+	basic, err := c.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	format := basic >> 6
+	id := uint32(basic & 0x3f)
+	switch id {
+	case 0:
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		id = 64 + uint32(b)
+	case 1:
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, b); err != nil {
+			return nil, err
+		}
+		id = 64 + uint32(b[0]) + uint32(b[1])*256
+	}
+
+	cs, ok := c.chunkStreams[id]
+	if !ok {
+		if format != 0 {
+			return nil, fmt.Errorf("chunk stream %d starts without a full header", id)
+		}
+		cs = &rtmpChunkStream{}
+		c.chunkStreams[id] = cs
+	}
+
+	headerSizes := [4]int{11, 7, 3, 0}
+	header := make([]byte, headerSizes[format])
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return nil, err
+	}
+
+	var field uint32
+	if format < 3 {
+		field = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+		cs.extended = field == rtmpExtendedTimestamp
+	}
+	if format < 2 {
+		cs.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+		cs.msgType = header[6]
+		if (cs.msgType == rtmpTypeCommandAmf0 || cs.msgType == rtmpTypeCommandAmf3) && cs.length > rtmpMaxCommandSize {
+			return nil, fmt.Errorf("command message of %d bytes is too large", cs.length)
+		}
+	}
+	if format == 0 {
+		cs.streamId = binary.LittleEndian.Uint32(header[7:11])
+	}
+	if cs.extended {
+		extended := make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return nil, err
+		}
+		if format < 3 {
+			field = binary.BigEndian.Uint32(extended)
+		}
+	}
+
+	if format < 3 || cs.payload == nil {
+		switch format {
+		case 0:
+			cs.timestamp = field
+			cs.delta = field
+		case 1, 2:
+			cs.delta = field
+			cs.timestamp += field
+		case 3:
+			cs.timestamp += cs.delta
+		}
+		cs.payload = make([]byte, 0, min(cs.length, 65536))
+	}
+
+	size := min(c.inChunkSize, cs.length-uint32(len(cs.payload)))
+	start := len(cs.payload)
+	cs.payload = append(cs.payload, make([]byte, size)...)
+	if _, err := io.ReadFull(c.reader, cs.payload[start:]); err != nil {
+		return nil, err
+	}
+
+	if uint32(len(cs.payload)) < cs.length {
+		return nil, nil
+	}
+
+	message := &rtmpMessage{
+		Type:      cs.msgType,
+		StreamId:  cs.streamId,
+		Timestamp: cs.timestamp,
+		Payload:   cs.payload,
+	}
+	cs.payload = nil
+	return message, nil
+}
+
+func (c *rtmpConn) acknowledge() error {
+	if c.windowSize == 0 || c.received-c.acknowledged < c.windowSize/2 {
+		return nil
+	}
+	c.acknowledged = c.received
+	return c.WriteMessage(rtmpChunkStreamControl, &rtmpMessage{
+		Type:    rtmpTypeAcknowledgement,
+		Payload: binary.BigEndian.AppendUint32(nil, c.received),
+	})
+}
+
+// WriteMessage sends the message in chunks of the size announced to the
+// peer by WriteControl.
+func (c *rtmpConn) WriteMessage(chunkStream uint8, message *rtmpMessage) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.readTimeout))
+
+	timestamp := min(message.Timestamp, rtmpExtendedTimestamp)
+	header := []byte{
+		chunkStream & 0x3f,
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp),
+		byte(len(message.Payload) >> 16), byte(len(message.Payload) >> 8), byte(len(message.Payload)),
+		message.Type,
+	}
+	header = binary.LittleEndian.AppendUint32(header, message.StreamId)
+	if timestamp == rtmpExtendedTimestamp {
+		header = binary.BigEndian.AppendUint32(header, message.Timestamp)
+	}
+	c.writer.Write(header)
+
+	chunkSize := c.outChunkSize
+	for offset := 0; offset < len(message.Payload); offset += chunkSize {
+		if offset > 0 {
+			c.writer.WriteByte(0xc0 | chunkStream&0x3f)
+			if timestamp == rtmpExtendedTimestamp {
+				c.writer.Write(binary.BigEndian.AppendUint32(nil, message.Timestamp))
+			}
+		}
+		c.writer.Write(message.Payload[offset:min(offset+chunkSize, len(message.Payload))])
+	}
+
+	return c.writer.Flush()
+}
+
+func (c *rtmpConn) WriteCommand(chunkStream uint8, streamId uint32, values ...any) error {
+	return c.WriteMessage(chunkStream, &rtmpMessage{
+		Type:     rtmpTypeCommandAmf0,
+		StreamId: streamId,
+		Payload:  encodeAmf(values...),
+	})
+}
+
+// WriteControl sends the window, bandwidth and chunk size a publisher
+// expects before the reply to connect.
+func (c *rtmpConn) WriteControl() error {
+	messages := []*rtmpMessage{
+		{Type: rtmpTypeWindowAckSize, Payload: binary.BigEndian.AppendUint32(nil, rtmpWindowSize)},
+		{Type: rtmpTypeSetPeerBandwidth, Payload: append(binary.BigEndian.AppendUint32(nil, rtmpWindowSize), 2)},
+		{Type: rtmpTypeSetChunkSize, Payload: binary.BigEndian.AppendUint32(nil, rtmpOutChunkSize)},
+	}
+	for _, message := range messages {
+		if err := c.WriteMessage(rtmpChunkStreamControl, message); err != nil {
+			return err
+		}
+	}
+	c.outChunkSize = rtmpOutChunkSize
+	return nil
+}
+
+func (c *rtmpConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// rtmpTestConn reads the bytes given to it and collects the bytes written.
+type rtmpTestConn struct {
+	net.Conn
+	in  *bytes.Reader
+	out *bytes.Buffer
+}
+
+func newRTMPTestConn(data []byte) *rtmpConn {
+	return newRTMPConn(&rtmpTestConn{in: bytes.NewReader(data), out: new(bytes.Buffer)}, time.Second)
+}
+
+func (c *rtmpTestConn) Read(p []byte) (int, error)         { return c.in.Read(p) }
+func (c *rtmpTestConn) Write(p []byte) (int, error)        { return c.out.Write(p) }
+func (c *rtmpTestConn) Close() error                       { return nil }
+func (c *rtmpTestConn) SetDeadline(_ time.Time) error      { return nil }
+func (c *rtmpTestConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (c *rtmpTestConn) SetWriteDeadline(_ time.Time) error { return nil }
+
+// rtmpChunk builds a chunk with a full header.
+func rtmpChunk(chunkStream byte, msgType byte, length int, timestamp uint32, payload []byte) []byte {
+	chunk := []byte{
+		chunkStream,
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp),
+		byte(length >> 16), byte(length >> 8), byte(length),
+		msgType,
+		1, 0, 0, 0,
+	}
+	return append(chunk, payload...)
+}
+
+func TestRTMPMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		control bool
+		message *rtmpMessage
+	}{
+		{
+			name:    "single chunk",
+			message: &rtmpMessage{Type: rtmpTypeCommandAmf0, StreamId: 1, Timestamp: 40, Payload: encodeAmf("publish", 5)},
+		},
+		{
+			name:    "several chunks",
+			message: &rtmpMessage{Type: rtmpTypeVideo, StreamId: 1, Timestamp: 1000, Payload: bytes.Repeat([]byte{7}, 300)},
+		},
+		{
+			name:    "extended timestamp",
+			message: &rtmpMessage{Type: rtmpTypeAudio, StreamId: 1, Timestamp: 0x1234567, Payload: bytes.Repeat([]byte{9}, 300)},
+		},
+		{
+			name:    "announced chunk size",
+			control: true,
+			message: &rtmpMessage{Type: rtmpTypeVideo, StreamId: 1, Timestamp: 80, Payload: bytes.Repeat([]byte{3}, 10000)},
+		},
+		{
+			name:    "empty payload",
+			message: &rtmpMessage{Type: rtmpTypeDataAmf0, StreamId: 1, Payload: []byte{}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer := newRTMPTestConn(nil)
+			if test.control {
+				if err := writer.WriteControl(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.WriteMessage(rtmpChunkStreamCommand, test.message); err != nil {
+				t.Fatal(err)
+			}
+
+			reader := newRTMPTestConn(writer.conn.(*rtmpTestConn).out.Bytes())
+			message, err := reader.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(message, test.message) {
+				t.Errorf("read %+v, want %+v", message, test.message)
+			}
+			if _, err := reader.ReadMessage(); err != io.EOF {
+				t.Errorf("read past the message, %v", err)
+			}
+		})
+	}
+}
+
+func TestRTMPReadChunks(t *testing.T) {
+	payload := bytes.Repeat([]byte{1}, 200)
+
+	// A type 1 header on chunk stream 4 keeps the stream id and adds the
+	// delta to the timestamp.
+	var deltas []byte
+	deltas = append(deltas, rtmpChunk(4, rtmpTypeAudio, 2, 100, []byte{1, 2})...)
+	deltas = append(deltas, 0x44, 0, 0, 20, 0, 0, 1, rtmpTypeAudio, 3)
+	deltas = append(deltas, 0xc4)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		messages []*rtmpMessage
+	}{
+		{
+			name: "continuation chunks",
+			data: append(append(rtmpChunk(3, rtmpTypeVideo, 200, 10, payload[:128]), 0xc3), payload[128:]...),
+			messages: []*rtmpMessage{
+				{Type: rtmpTypeVideo, StreamId: 1, Timestamp: 10, Payload: payload},
+			},
+		},
+		{
+			name: "new chunk size",
+			data: append(
+				rtmpChunk(2, rtmpTypeSetChunkSize, 4, 0, binary.BigEndian.AppendUint32(nil, 256)),
+				rtmpChunk(3, rtmpTypeVideo, 200, 10, payload)...,
+			),
+			messages: []*rtmpMessage{
+				{Type: rtmpTypeVideo, StreamId: 1, Timestamp: 10, Payload: payload},
+			},
+		},
+		{
+			name: "two byte chunk stream id",
+			data: append([]byte{0, 10}, rtmpChunk(0, rtmpTypeAudio, 1, 5, []byte{4})[1:]...),
+			messages: []*rtmpMessage{
+				{Type: rtmpTypeAudio, StreamId: 1, Timestamp: 5, Payload: []byte{4}},
+			},
+		},
+		{
+			name: "timestamp deltas",
+			data: deltas,
+			messages: []*rtmpMessage{
+				{Type: rtmpTypeAudio, StreamId: 1, Timestamp: 100, Payload: []byte{1, 2}},
+				{Type: rtmpTypeAudio, StreamId: 1, Timestamp: 120, Payload: []byte{3}},
+			},
+		},
+		{
+			name: "aborted message",
+			data: append(append(
+				rtmpChunk(3, rtmpTypeVideo, 200, 10, payload[:128]),
+				rtmpChunk(2, rtmpTypeAbort, 4, 0, binary.BigEndian.AppendUint32(nil, 3))...),
+				rtmpChunk(3, rtmpTypeAudio, 1, 20, []byte{5})...,
+			),
+			messages: []*rtmpMessage{
+				{Type: rtmpTypeAudio, StreamId: 1, Timestamp: 20, Payload: []byte{5}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := newRTMPTestConn(test.data)
+			for _, expected := range test.messages {
+				message, err := conn.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(message, expected) {
+					t.Errorf("read %+v, want %+v", message, expected)
+				}
+			}
+			if _, err := conn.ReadMessage(); err != io.EOF {
+				t.Errorf("read past the messages, %v", err)
+			}
+		})
+	}
+}
+
+func TestRTMPReadMalformedChunks(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "truncated basic header", data: []byte{0x01}},
+		{name: "truncated three byte chunk stream id", data: []byte{0x01, 0x00}},
+		{name: "stream starting without a full header", data: []byte{0x43, 0, 0, 0, 0, 0, 1, rtmpTypeAudio, 0}},
+		{name: "truncated message header", data: []byte{0x03, 0, 0, 0, 0}},
+		{name: "truncated extended timestamp", data: rtmpChunk(3, rtmpTypeAudio, 1, rtmpExtendedTimestamp, []byte{0, 0})},
+		{name: "truncated payload", data: rtmpChunk(3, rtmpTypeAudio, 10, 0, []byte{1, 2, 3})},
+		{name: "missing continuation", data: rtmpChunk(3, rtmpTypeVideo, 200, 0, bytes.Repeat([]byte{1}, 128))},
+		{name: "command too large", data: rtmpChunk(3, rtmpTypeCommandAmf0, rtmpMaxCommandSize+1, 0, nil)},
+		{name: "short set chunk size", data: rtmpChunk(2, rtmpTypeSetChunkSize, 2, 0, []byte{0, 1})},
+		{name: "zero chunk size", data: rtmpChunk(2, rtmpTypeSetChunkSize, 4, 0, []byte{0, 0, 0, 0})},
+		{name: "chunk size too large", data: rtmpChunk(2, rtmpTypeSetChunkSize, 4, 0, binary.BigEndian.AppendUint32(nil, rtmpMaxChunkSize+1))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := newRTMPTestConn(test.data)
+			if message, err := conn.ReadMessage(); err == nil {
+				t.Errorf("read %+v, want an error", message)
+			}
+		})
+	}
+}
+
+func TestRTMPHandshake(t *testing.T) {
+	c1 := bytes.Repeat([]byte{0x5a}, rtmpHandshakeSize)
+	c2 := make([]byte, rtmpHandshakeSize)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		fails bool
+	}{
+		{name: "simple handshake", data: slices.Concat([]byte{rtmpVersion}, c1, c2)},
+		{name: "unsupported version", data: slices.Concat([]byte{6}, c1, c2), fails: true},
+		{name: "truncated c1", data: slices.Concat([]byte{rtmpVersion}, c1[:100]), fails: true},
+		{name: "missing c2", data: slices.Concat([]byte{rtmpVersion}, c1), fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := newRTMPTestConn(test.data)
+			err := conn.Handshake()
+			if test.fails {
+				if err == nil {
+					t.Error("handshake succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out := conn.conn.(*rtmpTestConn).out.Bytes()
+			if len(out) != 1+2*rtmpHandshakeSize || out[0] != rtmpVersion {
+				t.Fatalf("wrote %d bytes", len(out))
+			}
+			if !bytes.Equal(out[1+rtmpHandshakeSize:], c1) {
+				t.Error("s2 doesn't echo c1")
+			}
+		})
+	}
+}
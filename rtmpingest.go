@@ -0,0 +1,687 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	mathrand "math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+type RTMPConfig struct {
+	// Listen is the address of the rtmp listener, it is disabled when empty.
+	Listen string `json:"listen" yaml:"listen" toml:"listen"`
+}
+
+// RTMPKey maps the stream key of a publisher to a room.
+type RTMPKey struct {
+	Key       string    `json:"key"`
+	RoomId    string    `json:"room_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RTMPSession publishes the h264 video and the opus audio of an rtmp
+// publisher as a stream of the room. AAC can't be forwarded to webrtc
+// without transcoding, streams with AAC audio are published without audio.
+// Keyframe requests can't be relayed, new subscribers wait for the next
+// keyframe of the encoder.
+type RTMPSession struct {
+	Id         string    `json:"id"`
+	RoomId     string    `json:"room_id"`
+	UserId     string    `json:"user_id"`
+	StreamId   string    `json:"stream_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Started    time.Time `json:"started_at"`
+
+	key    string
+	conn   *rtmpConn
+	room   *Room
+	user   *User
+	stream *IncomingStream
+	video  *rtmpTrack
+	audio  *rtmpTrack
+	once   *sync.Once
+
+	sps    [][]byte
+	pps    [][]byte
+	warned map[string]bool
+}
+
+type rtmpTrack struct {
+	track     *StreamTrack
+	payloader rtp.Payloader
+	sequencer rtp.Sequencer
+	ssrc      uint32
+	timestamp uint32
+}
+
+type RTMPServer struct {
+	listener net.Listener
+}
+
+const (
+	rtmpTimeout = 30 * time.Second
+	rtmpMTU     = 1200
+
+	flvVideoH264    = 7
+	flvAudioAAC     = 10
+	flvAudioExtHead = 9
+	flvKeyframe     = 1
+)
+
+var (
+	rtmpKeys          map[string]*RTMPKey     = make(map[string]*RTMPKey)
+	rtmpKeysMutex     *sync.Mutex             = new(sync.Mutex)
+	rtmpSessions      map[string]*RTMPSession = make(map[string]*RTMPSession)
+	rtmpSessionsMutex *sync.Mutex             = new(sync.Mutex)
+
+	ErrRTMPKeyNotFound   = errors.New("the stream key does not exist")
+	ErrRTMPKeyPublishing = errors.New("the stream key is already publishing")
+)
+
+func NewRTMPServer(cfg RTMPConfig) (*RTMPServer, error) {
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed listening rtmp, %w", err)
+	}
+
+	server := &RTMPServer{listener: listener}
+	go server.accept()
+
+	logger.Info(fmt.Sprintf("rtmp ingest listening on %s", listener.Addr().String()))
+
+	return server, nil
+}
+
+func (server *RTMPServer) Close() error {
+	return server.listener.Close()
+}
+
+func (server *RTMPServer) accept() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Warn(fmt.Sprintf("failed accepting rtmp connection, %s", err.Error()))
+			continue
+		}
+		go serveRTMP(conn)
+	}
+}
+
+func CreateRTMPKey(room *Room) (*RTMPKey, error) {
+	buffer := make([]byte, 24)
+	if _, err := rand.Read(buffer); err != nil {
+		return nil, err
+	}
+
+	key := &RTMPKey{
+		Key:       base64.RawURLEncoding.EncodeToString(buffer),
+		RoomId:    room.Id,
+		CreatedAt: time.Now(),
+	}
+
+	rtmpKeysMutex.Lock()
+	rtmpKeys[key.Key] = key
+	rtmpKeysMutex.Unlock()
+
+	return key, nil
+}
+
+func GetRTMPKeys() []*RTMPKey {
+	rtmpKeysMutex.Lock()
+	defer rtmpKeysMutex.Unlock()
+
+	return slices.Collect(maps.Values(rtmpKeys))
+}
+
+// RevokeRTMPKey also stops the session publishing with the key.
+func RevokeRTMPKey(key string) error {
+	rtmpKeysMutex.Lock()
+	_, ok := rtmpKeys[key]
+	delete(rtmpKeys, key)
+	rtmpKeysMutex.Unlock()
+
+	if !ok {
+		return ErrRTMPKeyNotFound
+	}
+	for _, session := range GetRTMPSessions() {
+		if session.key == key {
+			session.stop("the stream key has been revoked")
+		}
+	}
+	return nil
+}
+
+// revokeRoomRTMPKeys drops the stream keys of a destroyed room.
+func revokeRoomRTMPKeys(roomId string) {
+	rtmpKeysMutex.Lock()
+	defer rtmpKeysMutex.Unlock()
+
+	maps.DeleteFunc(rtmpKeys, func(_ string, key *RTMPKey) bool {
+		return key.RoomId == roomId
+	})
+}
+
+func rtmpKeyExists(key string) bool {
+	rtmpKeysMutex.Lock()
+	defer rtmpKeysMutex.Unlock()
+
+	_, ok := rtmpKeys[key]
+	return ok
+}
+
+func isRTMPKeyPublishing(key string) bool {
+	rtmpSessionsMutex.Lock()
+	defer rtmpSessionsMutex.Unlock()
+
+	for _, session := range rtmpSessions {
+		if session.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func GetRTMPSession(id string) *RTMPSession {
+	rtmpSessionsMutex.Lock()
+	defer rtmpSessionsMutex.Unlock()
+
+	return rtmpSessions[id]
+}
+
+func GetRTMPSessions() []*RTMPSession {
+	rtmpSessionsMutex.Lock()
+	defer rtmpSessionsMutex.Unlock()
+
+	return slices.Collect(maps.Values(rtmpSessions))
+}
+
+func serveRTMP(conn net.Conn) {
+	c := newRTMPConn(conn, rtmpTimeout)
+	defer c.Close()
+
+	if err := c.Handshake(); err != nil {
+		logger.Debug(fmt.Sprintf("rtmp handshake with %s failed, %s", conn.RemoteAddr().String(), err.Error()))
+		return
+	}
+
+	var session *RTMPSession
+	defer func() {
+		if session != nil {
+			session.stop("the rtmp publisher disconnected")
+		}
+	}()
+
+	for {
+		message, err := c.ReadMessage()
+		if err != nil {
+			logger.Debug(fmt.Sprintf("rtmp connection of %s closed, %s", conn.RemoteAddr().String(), err.Error()))
+			return
+		}
+
+		switch message.Type {
+		case rtmpTypeCommandAmf0, rtmpTypeCommandAmf3:
+			payload := message.Payload
+			if message.Type == rtmpTypeCommandAmf3 && len(payload) > 0 {
+				payload = payload[1:]
+			}
+			values, err := decodeAmf(payload)
+			if err != nil || len(values) < 2 {
+				logger.Debug(fmt.Sprintf("invalid rtmp command from %s", conn.RemoteAddr().String()))
+				return
+			}
+			name, _ := values[0].(string)
+			transaction, _ := values[1].(float64)
+
+			switch name {
+			case "connect":
+				err = c.WriteControl()
+				if err == nil {
+					err = c.WriteCommand(rtmpChunkStreamCommand, 0, "_result", transaction,
+						amfObjectMap{{"fmsVer", "FMS/3,0,1,123"}, {"capabilities", 31}},
+						amfObjectMap{{"level", "status"}, {"code", "NetConnection.Connect.Success"}, {"description", "Connection succeeded."}, {"objectEncoding", 0}},
+					)
+				}
+			case "releaseStream", "FCPublish":
+				err = c.WriteCommand(rtmpChunkStreamCommand, 0, "_result", transaction, nil)
+			case "createStream":
+				err = c.WriteCommand(rtmpChunkStreamCommand, 0, "_result", transaction, nil, 1)
+			case "publish":
+				if session != nil {
+					break
+				}
+				key := ""
+				if len(values) > 3 {
+					key, _ = values[3].(string)
+				}
+				key, _, _ = strings.Cut(key, "?")
+
+				session, err = startRTMPSession(c, key)
+				if err != nil {
+					c.WriteCommand(rtmpChunkStreamStatus, message.StreamId, "onStatus", 0, nil,
+						amfObjectMap{{"level", "error"}, {"code", "NetStream.Publish.BadName"}, {"description", err.Error()}},
+					)
+					logger.Info(fmt.Sprintf("rtmp publish of %s rejected, %s", conn.RemoteAddr().String(), err.Error()))
+					return
+				}
+				err = c.WriteCommand(rtmpChunkStreamStatus, message.StreamId, "onStatus", 0, nil,
+					amfObjectMap{{"level", "status"}, {"code", "NetStream.Publish.Start"}, {"description", fmt.Sprintf("publishing stream %s", session.StreamId)}},
+				)
+			case "play":
+				c.WriteCommand(rtmpChunkStreamStatus, message.StreamId, "onStatus", 0, nil,
+					amfObjectMap{{"level", "error"}, {"code", "NetStream.Play.Failed"}, {"description", "rtmp playback is not supported"}},
+				)
+				return
+			case "FCUnpublish", "deleteStream", "closeStream":
+				return
+			}
+			if err != nil {
+				logger.Debug(fmt.Sprintf("failed replying to rtmp command %s, %s", name, err.Error()))
+				return
+			}
+		case rtmpTypeVideo:
+			if session != nil {
+				session.handleVideo(message)
+			}
+		case rtmpTypeAudio:
+			if session != nil {
+				session.handleAudio(message)
+			}
+		}
+	}
+}
+
+func startRTMPSession(c *rtmpConn, key string) (*RTMPSession, error) {
+	rtmpKeysMutex.Lock()
+	rtmpKey, ok := rtmpKeys[key]
+	rtmpKeysMutex.Unlock()
+	if !ok {
+		return nil, ErrRTMPKeyNotFound
+	}
+
+	room := GetRoom(rtmpKey.RoomId)
+	if room == nil {
+		return nil, errors.New("the room of the stream key does not exist")
+	}
+
+	session := &RTMPSession{
+		Id:         uuid.NewString(),
+		RoomId:     room.Id,
+		RemoteAddr: c.conn.RemoteAddr().String(),
+		Started:    time.Now(),
+
+		key:    key,
+		conn:   c,
+		room:   room,
+		once:   new(sync.Once),
+		warned: make(map[string]bool),
+	}
+
+	if isRTMPKeyPublishing(key) {
+		return nil, ErrRTMPKeyPublishing
+	}
+
+	user, err := JoinSyntheticUser(room, RoleParticipant)
+	if err != nil {
+		return nil, err
+	}
+	session.user = user
+	session.UserId = user.Id
+
+	stream := newIncomingStream(user)
+	if err := room.AddInStream(stream); err != nil {
+		session.stop("rtmp session failed starting")
+		return nil, err
+	}
+	session.stream = stream
+	session.StreamId = stream.Id
+
+	// The session is only listed once complete, the key is checked again as
+	// it may have been revoked, or another publisher started, meanwhile.
+	rtmpSessionsMutex.Lock()
+	if !rtmpKeyExists(key) {
+		rtmpSessionsMutex.Unlock()
+		session.stop("the stream key has been revoked")
+		return nil, ErrRTMPKeyNotFound
+	}
+	for _, other := range rtmpSessions {
+		if other.key == key {
+			rtmpSessionsMutex.Unlock()
+			session.stop("the stream key is already publishing")
+			return nil, ErrRTMPKeyPublishing
+		}
+	}
+	rtmpSessions[session.Id] = session
+	rtmpSessionsMutex.Unlock()
+
+	go func() {
+		<-stream.Done()
+		session.stop("the stream has been unpublished")
+	}()
+
+	logger.Info(fmt.Sprintf("rtmp session %s of %s publishing in room %s", session.Id, session.RemoteAddr, room.Id))
+
+	return session, nil
+}
+
+func (session *RTMPSession) Stop() {
+	session.stop("rtmp session stopped")
+}
+
+func (session *RTMPSession) stop(cause string) {
+	session.once.Do(func() {
+		rtmpSessionsMutex.Lock()
+		delete(rtmpSessions, session.Id)
+		rtmpSessionsMutex.Unlock()
+
+		session.conn.Close()
+		if session.user != nil {
+			LeaveSyntheticUser(session.room, session.user, cause)
+		}
+		logger.Info(fmt.Sprintf("rtmp session %s stopped, %s", session.Id, cause))
+	})
+}
+
+// warn logs each unsupported feature of the publisher once.
+func (session *RTMPSession) warn(feature string) {
+	if session.warned[feature] {
+		return
+	}
+	session.warned[feature] = true
+	logger.Warn(fmt.Sprintf("rtmp session %s sends %s", session.Id, feature))
+}
+
+// handleVideo reads the flv video tags of legacy and enhanced rtmp, only
+// h264 is published.
+func (session *RTMPSession) handleVideo(message *rtmpMessage) {
+	payload := message.Payload
+	if len(payload) < 5 {
+		return
+	}
+
+	var packetType byte
+	var cts int32
+	var data []byte
+	keyframe := (payload[0]>>4)&0x07 == flvKeyframe
+	if payload[0]&0x80 != 0 {
+		if fourCC := string(payload[1:5]); fourCC != "avc1" {
+			session.warn(fmt.Sprintf("unsupported %s video, only h264 is published", fourCC))
+			return
+		}
+		switch payload[0] & 0x0f {
+		case 0:
+			packetType, data = 0, payload[5:]
+		case 1:
+			if len(payload) < 8 {
+				return
+			}
+			packetType, cts, data = 1, int32(uint32(payload[5])<<16|uint32(payload[6])<<8|uint32(payload[7]))<<8>>8, payload[8:]
+		case 3:
+			packetType, data = 1, payload[5:]
+		default:
+			return
+		}
+	} else {
+		if payload[0]&0x0f != flvVideoH264 {
+			session.warn(fmt.Sprintf("unsupported video codec %d, only h264 is published", payload[0]&0x0f))
+			return
+		}
+		packetType = payload[1]
+		cts = int32(uint32(payload[2])<<16|uint32(payload[3])<<8|uint32(payload[4])) << 8 >> 8
+		data = payload[5:]
+	}
+
+	switch packetType {
+	case 0:
+		sps, pps, err := parseAVCDecoderConfiguration(data)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("rtmp session %s sent an invalid avc configuration, %s", session.Id, err.Error()))
+			return
+		}
+		session.sps, session.pps = sps, pps
+		if session.video == nil {
+			codec := webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:    webrtc.MimeTypeH264,
+					ClockRate:   90000,
+					SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + hex.EncodeToString(sps[0][1:4]),
+				},
+				PayloadType: 102,
+			}
+			session.video = session.addTrack("rtmp-video", codec, &codecs.H264Payloader{})
+		}
+	case 1:
+		if session.video == nil {
+			return
+		}
+		frame := make([]byte, 0, len(data)+64)
+		hasParameterSets := false
+		nalus := splitAVCC(data)
+		for _, nalu := range nalus {
+			switch nalu[0] & 0x1f {
+			case h264NaluIDR:
+				keyframe = true
+			case h264NaluSPS:
+				hasParameterSets = true
+			}
+		}
+		// Rtmp only sends the parameter sets once, webrtc decoders need
+		// them before every keyframe.
+		if keyframe && !hasParameterSets {
+			for _, nalu := range slices.Concat(session.sps, session.pps) {
+				frame = append(frame, 0, 0, 0, 1)
+				frame = append(frame, nalu...)
+			}
+		}
+		for _, nalu := range nalus {
+			frame = append(frame, 0, 0, 0, 1)
+			frame = append(frame, nalu...)
+		}
+		session.send(session.video, frame, int64(message.Timestamp)+int64(cts))
+	}
+}
+
+// handleAudio publishes the opus audio of enhanced rtmp and drops the rest.
+func (session *RTMPSession) handleAudio(message *rtmpMessage) {
+	payload := message.Payload
+	if len(payload) < 1 {
+		return
+	}
+
+	switch payload[0] >> 4 {
+	case flvAudioAAC:
+		session.warn("aac audio which can't be forwarded, the stream is published without audio")
+		return
+	case flvAudioExtHead:
+		if len(payload) < 5 {
+			return
+		}
+		if fourCC := string(payload[1:5]); fourCC != "Opus" {
+			session.warn(fmt.Sprintf("unsupported %s audio, only opus is published", fourCC))
+			return
+		}
+	default:
+		session.warn(fmt.Sprintf("unsupported audio format %d, only opus is published", payload[0]>>4))
+		return
+	}
+
+	if session.audio == nil {
+		codec := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeOpus,
+				ClockRate:   48000,
+				Channels:    2,
+				SDPFmtpLine: "minptime=10;useinbandfec=1",
+			},
+			PayloadType: 111,
+		}
+		session.audio = session.addTrack("rtmp-audio", codec, &codecs.OpusPayloader{})
+	}
+
+	// Packet type 1 carries coded frames, 0 the OpusHead.
+	if payload[0]&0x0f == 1 && len(payload) > 5 {
+		session.send(session.audio, payload[5:], int64(message.Timestamp))
+	}
+}
+
+func (session *RTMPSession) addTrack(id string, codec webrtc.RTPCodecParameters, payloader rtp.Payloader) *rtmpTrack {
+	track, err := session.stream.addTrack(id, codec, nil)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("rtmp session %s failed adding track %s, %s", session.Id, id, err.Error()))
+		return nil
+	}
+
+	return &rtmpTrack{
+		track:     track,
+		payloader: payloader,
+		sequencer: rtp.NewRandomSequencer(),
+		ssrc:      mathrand.Uint32(),
+		timestamp: mathrand.Uint32(),
+	}
+}
+
+// send packetizes a frame presented at the given rtmp time in milliseconds.
+func (session *RTMPSession) send(track *rtmpTrack, frame []byte, milliseconds int64) {
+	if track == nil {
+		return
+	}
+
+	timestamp := track.timestamp + uint32(milliseconds*int64(track.track.Codec.ClockRate)/1000)
+	payloads := track.payloader.Payload(rtmpMTU, frame)
+	for i, payload := range payloads {
+		packet := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				PayloadType:    uint8(track.track.Codec.PayloadType),
+				SequenceNumber: track.sequencer.NextSequenceNumber(),
+				Timestamp:      timestamp,
+				SSRC:           track.ssrc,
+			},
+			Payload: payload,
+		}
+		session.stream.forwardRTP(track.track, packet)
+	}
+}
+
+// parseAVCDecoderConfiguration returns the parameter sets of the h264
+// sequence header, nalus are expected with a 4 bytes length.
+func parseAVCDecoderConfiguration(data []byte) ([][]byte, [][]byte, error) {
+	if len(data) < 7 {
+		return nil, nil, errors.New("configuration too short")
+	}
+	if data[4]&0x03 != 3 {
+		return nil, nil, errors.New("only 4 bytes nalu lengths are supported")
+	}
+
+	offset := 6
+	readSets := func(count int) ([][]byte, error) {
+		sets := make([][]byte, 0, count)
+		for range count {
+			if offset+2 > len(data) {
+				return nil, errors.New("configuration truncated")
+			}
+			length := int(binary.BigEndian.Uint16(data[offset:]))
+			offset += 2
+			if offset+length > len(data) || length == 0 {
+				return nil, errors.New("configuration truncated")
+			}
+			sets = append(sets, data[offset:offset+length])
+			offset += length
+		}
+		return sets, nil
+	}
+
+	sps, err := readSets(int(data[5] & 0x1f))
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset >= len(data) {
+		return nil, nil, errors.New("configuration truncated")
+	}
+	offset++
+	pps, err := readSets(int(data[offset-1]))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(sps) == 0 || len(sps[0]) < 4 {
+		return nil, nil, errors.New("configuration has no sps")
+	}
+
+	return sps, pps, nil
+}
+
+func splitAVCC(data []byte) [][]byte {
+	nalus := make([][]byte, 0)
+	for len(data) >= 4 {
+		length := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if length == 0 || length > len(data) {
+			break
+		}
+		nalus = append(nalus, data[:length])
+		data = data[length:]
+	}
+	return nalus
+}
+
+func httpHandleRTMPKeyCreate(w http.ResponseWriter, r *http.Request) {
+	room := GetRoom(r.PathValue("id"))
+	if room == nil {
+		writeJsonError(w, http.StatusNotFound, "rtmp_key_failure", "the room does not exist")
+		return
+	}
+
+	key, err := CreateRTMPKey(room)
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, "rtmp_key_failure", err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusCreated, key)
+}
+
+func httpHandleRTMPKeysList(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, GetRTMPKeys())
+}
+
+func httpHandleRTMPKeyRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := RevokeRTMPKey(r.PathValue("key")); err != nil {
+		writeJsonError(w, http.StatusNotFound, "rtmp_key_failure", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func httpHandleRTMPSessionsList(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, GetRTMPSessions())
+}
+
+func httpHandleRTMPSessionStop(w http.ResponseWriter, r *http.Request) {
+	session := GetRTMPSession(r.PathValue("id"))
+	if session == nil {
+		writeJsonError(w, http.StatusNotFound, "rtmp_session_failure", "the rtmp session does not exist")
+		return
+	}
+
+	session.Stop()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+type RTPIngestConfig struct {
+	// Host is the address the ingest sockets bind to, the default only
+	// accepts encoders running on the same box.
+	Host string `json:"host" yaml:"host" toml:"host"`
+}
+
+type RTPIngestOptions struct {
+	Host   string           `json:"host,omitempty"`
+	Tracks []RTPIngestTrack `json:"tracks,omitempty"`
+	SDP    string           `json:"sdp,omitempty"`
+}
+
+// RTPIngestTrack maps the packets received on a port with a payload type, and
+// optionally a ssrc, to a track of the stream. Tracks sharing a port share
+// its socket, port 0 binds a free port.
+type RTPIngestTrack struct {
+	Port        int    `json:"port"`
+	Codec       string `json:"codec"`
+	PayloadType uint8  `json:"payload_type"`
+	SSRC        uint32 `json:"ssrc,omitempty"`
+	ClockRate   uint32 `json:"clock_rate,omitempty"`
+	Fmtp        string `json:"fmtp,omitempty"`
+
+	track *StreamTrack
+}
+
+type RTPIngest struct {
+	Id       string           `json:"id"`
+	RoomId   string           `json:"room_id"`
+	UserId   string           `json:"user_id"`
+	StreamId string           `json:"stream_id"`
+	Host     string           `json:"host"`
+	Tracks   []RTPIngestTrack `json:"tracks"`
+	Started  time.Time        `json:"started_at"`
+
+	room   *Room
+	user   *User
+	stream *IncomingStream
+	conns  []*net.UDPConn
+	once   *sync.Once
+}
+
+var rtpIngestCodecs = map[string]webrtc.RTPCodecCapability{
+	"vp8":  {MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+	"vp9":  {MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"},
+	"av1":  {MimeType: webrtc.MimeTypeAV1, ClockRate: 90000},
+	"h264": {MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+	"opus": {MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+	"pcmu": {MimeType: webrtc.MimeTypePCMU, ClockRate: 8000},
+	"pcma": {MimeType: webrtc.MimeTypePCMA, ClockRate: 8000},
+	"g722": {MimeType: webrtc.MimeTypeG722, ClockRate: 8000},
+}
+
+var (
+	rtpIngests      map[string]*RTPIngest = make(map[string]*RTPIngest)
+	rtpIngestsMutex *sync.Mutex           = new(sync.Mutex)
+
+	ErrRTPIngestNotFound = errors.New("the rtp ingest does not exist")
+)
+
+func StartRTPIngest(room *Room, opts RTPIngestOptions) (*RTPIngest, error) {
+	host := cmp.Or(opts.Host, GetConfig().RTPIngest.Host)
+	tracks := opts.Tracks
+	if opts.SDP != "" {
+		if len(tracks) > 0 {
+			return nil, errors.New("tracks and sdp can't be combined")
+		}
+		sdpHost, sdpTracks, err := parseRTPIngestSdp(opts.SDP)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Host == "" && sdpHost != "" {
+			host = sdpHost
+		}
+		tracks = sdpTracks
+	}
+	if len(tracks) == 0 {
+		return nil, errors.New("at least one track is required")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("host %q is not an ip address", host)
+	}
+
+	ingest := &RTPIngest{
+		Id:      uuid.NewString(),
+		RoomId:  room.Id,
+		Host:    host,
+		Tracks:  slices.Clone(tracks),
+		Started: time.Now(),
+
+		room: room,
+		once: new(sync.Once),
+	}
+
+	codecs := make([]webrtc.RTPCodecParameters, len(ingest.Tracks))
+	for i, track := range ingest.Tracks {
+		codec, err := track.codecParameters()
+		if err != nil {
+			return nil, fmt.Errorf("track %d, %w", i, err)
+		}
+		for _, other := range ingest.Tracks[:i] {
+			if other.Port == track.Port && track.Port != 0 && other.PayloadType == track.PayloadType && other.SSRC == track.SSRC {
+				return nil, fmt.Errorf("track %d, another track of port %d has the same payload type and ssrc", i, track.Port)
+			}
+		}
+		codecs[i] = codec
+	}
+
+	// Sockets are bound before joining, so a busy port fails early.
+	sockets := make(map[int]*net.UDPConn)
+	for i := range ingest.Tracks {
+		track := &ingest.Tracks[i]
+		if _, ok := sockets[track.Port]; ok {
+			continue
+		}
+
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: track.Port})
+		if err != nil {
+			ingest.closeSockets()
+			return nil, err
+		}
+		ingest.conns = append(ingest.conns, conn)
+		if track.Port != 0 {
+			sockets[track.Port] = conn
+		}
+		track.Port = conn.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	user, err := JoinSyntheticUser(room, RoleParticipant)
+	if err != nil {
+		ingest.closeSockets()
+		return nil, err
+	}
+	ingest.user = user
+	ingest.UserId = user.Id
+
+	stream := newIncomingStream(user)
+	for i := range ingest.Tracks {
+		track := &ingest.Tracks[i]
+		id := fmt.Sprintf("rtp-%d-%d", track.Port, track.PayloadType)
+		streamTrack, err := stream.addTrack(id, codecs[i], nil)
+		if err != nil {
+			ingest.stop("rtp ingest failed starting")
+			return nil, err
+		}
+		track.track = streamTrack
+	}
+	if err := room.AddInStream(stream); err != nil {
+		ingest.stop("rtp ingest failed starting")
+		return nil, err
+	}
+	ingest.stream = stream
+	ingest.StreamId = stream.Id
+
+	rtpIngestsMutex.Lock()
+	rtpIngests[ingest.Id] = ingest
+	rtpIngestsMutex.Unlock()
+
+	for _, conn := range ingest.conns {
+		go ingest.readPackets(conn)
+	}
+	go func() {
+		<-stream.Done()
+		ingest.stop("the stream has been unpublished")
+	}()
+
+	logger.Info(fmt.Sprintf("rtp ingest %s started in room %s on %s", ingest.Id, room.Id, host))
+
+	return ingest, nil
+}
+
+func GetRTPIngest(id string) *RTPIngest {
+	rtpIngestsMutex.Lock()
+	defer rtpIngestsMutex.Unlock()
+
+	return rtpIngests[id]
+}
+
+func GetRTPIngests() []*RTPIngest {
+	rtpIngestsMutex.Lock()
+	defer rtpIngestsMutex.Unlock()
+
+	return slices.Collect(maps.Values(rtpIngests))
+}
+
+func (ingest *RTPIngest) Stop() {
+	ingest.stop("rtp ingest stopped")
+}
+
+func (ingest *RTPIngest) stop(cause string) {
+	ingest.once.Do(func() {
+		rtpIngestsMutex.Lock()
+		delete(rtpIngests, ingest.Id)
+		rtpIngestsMutex.Unlock()
+
+		ingest.closeSockets()
+		LeaveSyntheticUser(ingest.room, ingest.user, cause)
+		logger.Info(fmt.Sprintf("rtp ingest %s stopped, %s", ingest.Id, cause))
+	})
+}
+
+func (ingest *RTPIngest) closeSockets() {
+	for _, conn := range ingest.conns {
+		conn.Close()
+	}
+}
+
+func (ingest *RTPIngest) readPackets(conn *net.UDPConn) {
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	buffer := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		// Reports multiplexed on the port have a payload type of 72 to 76
+		// once the marker bit is masked, see RFC 5761.
+		if n < 2 || (buffer[1]&0x7F >= 72 && buffer[1]&0x7F <= 76) {
+			continue
+		}
+
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(slices.Clone(buffer[:n])); err != nil {
+			logger.Trace(fmt.Sprintf("rtp ingest %s dropped an invalid packet, %s", ingest.Id, err.Error()))
+			continue
+		}
+
+		track := ingest.match(port, packet)
+		if track == nil {
+			continue
+		}
+		ingest.stream.forwardRTP(track, packet)
+	}
+}
+
+// match prefers the track mapping the ssrc of the packet over the one only
+// mapping its payload type.
+func (ingest *RTPIngest) match(port int, packet *rtp.Packet) *StreamTrack {
+	var match *StreamTrack
+	for _, track := range ingest.Tracks {
+		if track.Port != port || track.PayloadType != packet.PayloadType {
+			continue
+		}
+		if track.SSRC == packet.SSRC {
+			return track.track
+		}
+		if track.SSRC == 0 {
+			match = track.track
+		}
+	}
+	return match
+}
+
+func (track RTPIngestTrack) codecParameters() (webrtc.RTPCodecParameters, error) {
+	name := strings.ToLower(track.Codec)
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "video/"), "audio/")
+
+	capability, ok := rtpIngestCodecs[name]
+	if !ok {
+		return webrtc.RTPCodecParameters{}, fmt.Errorf("unsupported codec %q", track.Codec)
+	}
+	if track.PayloadType > 127 {
+		return webrtc.RTPCodecParameters{}, errors.New("payload type must not exceed 127")
+	}
+	if track.ClockRate != 0 && track.ClockRate != capability.ClockRate {
+		return webrtc.RTPCodecParameters{}, fmt.Errorf("%s requires a clock rate of %d", capability.MimeType, capability.ClockRate)
+	}
+	if track.Fmtp != "" {
+		capability.SDPFmtpLine = track.Fmtp
+	}
+
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: capability,
+		PayloadType:        webrtc.PayloadType(track.PayloadType),
+	}, nil
+}
+
+// parseRTPIngestSdp reads the tracks of a session description, like the ones
+// written by ffmpeg or gstreamer, every media uses its first payload type.
+func parseRTPIngestSdp(sdp string) (string, []RTPIngestTrack, error) {
+	host := ""
+	tracks := make([]RTPIngestTrack, 0)
+
+	var media *RTPIngestTrack
+	for _, line := range sdpLines(sdp) {
+		switch {
+		case strings.HasPrefix(line, "c="):
+			fields := strings.Fields(strings.TrimPrefix(line, "c="))
+			if len(fields) == 3 && host == "" {
+				host, _, _ = strings.Cut(fields[2], "/")
+			}
+		case strings.HasPrefix(line, "m="):
+			fields := strings.Fields(strings.TrimPrefix(line, "m="))
+			if len(fields) < 4 || (fields[0] != "audio" && fields[0] != "video") {
+				media = nil
+				continue
+			}
+			port, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid media port %q", fields[1])
+			}
+			payloadType, err := strconv.ParseUint(fields[3], 10, 7)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid payload type %q", fields[3])
+			}
+			tracks = append(tracks, RTPIngestTrack{Port: port, PayloadType: uint8(payloadType)})
+			media = &tracks[len(tracks)-1]
+		case media == nil:
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			payloadType, rtpmap, _ := strings.Cut(strings.TrimPrefix(line, "a=rtpmap:"), " ")
+			if payloadType != strconv.Itoa(int(media.PayloadType)) {
+				continue
+			}
+			name, rate, _ := strings.Cut(rtpmap, "/")
+			rate, _, _ = strings.Cut(rate, "/")
+			clockRate, err := strconv.ParseUint(rate, 10, 32)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid clock rate in %q", line)
+			}
+			media.Codec, media.ClockRate = name, uint32(clockRate)
+		case strings.HasPrefix(line, "a=fmtp:"):
+			payloadType, fmtp, _ := strings.Cut(strings.TrimPrefix(line, "a=fmtp:"), " ")
+			if payloadType == strconv.Itoa(int(media.PayloadType)) {
+				media.Fmtp = fmtp
+			}
+		case strings.HasPrefix(line, "a=ssrc:") && media.SSRC == 0:
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "a=ssrc:"), " ")
+			ssrc, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid ssrc in %q", line)
+			}
+			media.SSRC = uint32(ssrc)
+		}
+	}
+
+	for i := range tracks {
+		if tracks[i].Codec == "" {
+			return "", nil, fmt.Errorf("media %d has no rtpmap for payload type %d", i, tracks[i].PayloadType)
+		}
+	}
+	return host, tracks, nil
+}
+
+func httpHandleRTPIngestStart(w http.ResponseWriter, r *http.Request) {
+	room := GetRoom(r.PathValue("id"))
+	if room == nil {
+		writeJsonError(w, http.StatusNotFound, "rtp_ingest_failure", "the room does not exist")
+		return
+	}
+
+	opts := RTPIngestOptions{}
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "rtp_ingest_failure", err.Error())
+		return
+	}
+
+	ingest, err := StartRTPIngest(room, opts)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "rtp_ingest_failure", err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusCreated, ingest)
+}
+
+func httpHandleRTPIngestsList(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, GetRTPIngests())
+}
+
+func httpHandleRTPIngestStop(w http.ResponseWriter, r *http.Request) {
+	ingest := GetRTPIngest(r.PathValue("id"))
+	if ingest == nil {
+		writeJsonError(w, http.StatusNotFound, "rtp_ingest_failure", ErrRTPIngestNotFound.Error())
+		return
+	}
+
+	ingest.Stop()
+	w.WriteHeader(http.StatusNoContent)
+}
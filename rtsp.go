@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+type RTSPConfig struct {
+	// Listen is the address of the rtsp listener, it is disabled when empty.
+	Listen string `json:"listen" yaml:"listen" toml:"listen"`
+}
+
+type RTSPServer struct {
+	listener net.Listener
+}
+
+// rtspSession plays a stream to the client of an rtsp connection, it is a
+// sink of the stream and ends with the connection. Packets are queued so a
+// slow client can't hold back the other subscribers of the stream.
+type rtspSession struct {
+	id     string
+	conn   net.Conn
+	reader *bufio.Reader
+
+	stream     *IncomingStream
+	authorized bool
+	tracks     []*rtspTrack
+	playing    bool
+
+	queue      chan rtspPacket
+	dropped    int
+	done       chan struct{}
+	closed     bool
+	mutex      *sync.Mutex
+	writeMutex *sync.Mutex
+}
+
+type rtspTrack struct {
+	track *StreamTrack
+
+	// Interleaved tracks use channel for rtp and channel+1 for rtcp, udp
+	// tracks send from their own sockets to the client ports.
+	interleaved bool
+	channel     int
+	rtpConn     *net.UDPConn
+	rtcpConn    *net.UDPConn
+	rtpAddr     *net.UDPAddr
+}
+
+type rtspPacket struct {
+	track *rtspTrack
+	data  []byte
+}
+
+type rtspRequest struct {
+	method string
+	url    *url.URL
+	header textproto.MIMEHeader
+}
+
+const (
+	rtspSessionTimeout = 60 * time.Second
+	rtspQueueSize      = 512
+	rtspMaxHeaderSize  = 16384
+)
+
+var (
+	errRTSPClosed               = errors.New("rtsp session closed")
+	errRTSPUnsupportedTransport = errors.New("unsupported transport")
+)
+
+func NewRTSPServer(cfg RTSPConfig) (*RTSPServer, error) {
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed listening rtsp, %w", err)
+	}
+
+	server := &RTSPServer{listener: listener}
+	go server.accept()
+
+	logger.Info(fmt.Sprintf("rtsp server listening on %s", listener.Addr().String()))
+
+	return server, nil
+}
+
+func (server *RTSPServer) Close() error {
+	return server.listener.Close()
+}
+
+func (server *RTSPServer) accept() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Warn(fmt.Sprintf("failed accepting rtsp connection, %s", err.Error()))
+			continue
+		}
+		go serveRTSP(conn)
+	}
+}
+
+func serveRTSP(conn net.Conn) {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	session := &rtspSession{
+		id:         hex.EncodeToString(id),
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		tracks:     make([]*rtspTrack, 0),
+		queue:      make(chan rtspPacket, rtspQueueSize),
+		done:       make(chan struct{}),
+		mutex:      new(sync.Mutex),
+		writeMutex: new(sync.Mutex),
+	}
+	defer session.close()
+
+	go session.writePackets()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(rtspSessionTimeout))
+
+		request, err := session.readRequest()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, errRTSPClosed) {
+				logger.Debug(fmt.Sprintf("rtsp connection of %s closed, %s", conn.RemoteAddr().String(), err.Error()))
+			}
+			return
+		}
+		if request == nil {
+			continue
+		}
+
+		if err := session.handle(request); err != nil {
+			if errors.Is(err, errRTSPClosed) {
+				return
+			}
+			logger.Debug(fmt.Sprintf("rtsp session %s failed, %s", session.id, err.Error()))
+			return
+		}
+	}
+}
+
+// readRequest returns nil for the interleaved rtcp of the client, which is
+// read from the same connection as the requests.
+func (s *rtspSession) readRequest() (*rtspRequest, error) {
+	first, err := s.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] == '$' {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(s.reader, header); err != nil {
+			return nil, err
+		}
+		data := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(s.reader, data); err != nil {
+			return nil, err
+		}
+		if header[1]%2 == 1 {
+			s.handleRTCP(data)
+		}
+		return nil, nil
+	}
+
+	lines := make([]string, 0)
+	size := 0
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size += len(line)
+		if size > rtspMaxHeaderSize {
+			return nil, errors.New("request headers too large")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("empty request")
+	}
+
+	header := make(textproto.MIMEHeader)
+	for _, field := range lines[1:] {
+		key, value, _ := strings.Cut(field, ":")
+		header.Add(textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(key)), strings.TrimSpace(value))
+	}
+	if length, _ := strconv.Atoi(header.Get("Content-Length")); length > 0 {
+		if _, err := io.CopyN(io.Discard, s.reader, int64(length)); err != nil {
+			return nil, err
+		}
+	}
+
+	line := lines[0]
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("invalid request line %q", line)
+	}
+	target, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return &rtspRequest{method: parts[0], url: target, header: header}, nil
+}
+
+func (s *rtspSession) handle(request *rtspRequest) error {
+	headers := map[string]string{}
+	status := "200 OK"
+	body := ""
+
+	switch request.method {
+	case "OPTIONS":
+		headers["Public"] = "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"
+	case "GET_PARAMETER":
+	case "DESCRIBE":
+		stream, err := s.resolve(request)
+		if err != nil {
+			return s.reply(request, s.errorStatus(err), nil, "")
+		}
+		headers["Content-Type"] = "application/sdp"
+		headers["Content-Base"] = strings.TrimSuffix(request.url.String(), "/") + "/"
+		body = s.describe(stream)
+	case "SETUP":
+		track, err := s.setup(request)
+		if err != nil {
+			return s.reply(request, s.errorStatus(err), nil, "")
+		}
+		headers["Session"] = fmt.Sprintf("%s;timeout=%d", s.id, int(rtspSessionTimeout.Seconds()))
+		headers["Transport"] = track.transport()
+	case "PLAY":
+		if err := s.play(); err != nil {
+			return s.reply(request, s.errorStatus(err), nil, "")
+		}
+		headers["Session"] = s.id
+		headers["Range"] = "npt=0.000-"
+	case "TEARDOWN":
+		s.reply(request, status, map[string]string{"Session": s.id}, "")
+		return errRTSPClosed
+	default:
+		status = "501 Not Implemented"
+	}
+
+	return s.reply(request, status, headers, body)
+}
+
+func (s *rtspSession) reply(request *rtspRequest, status string, headers map[string]string, body string) error {
+	lines := []string{
+		"RTSP/1.0 " + status,
+		"CSeq: " + request.header.Get("CSeq"),
+		"Server: SplashRTC",
+	}
+	if status == "401 Unauthorized" {
+		lines = append(lines, `WWW-Authenticate: Basic realm="splashrtc"`)
+	}
+	for _, key := range slices.Sorted(maps.Keys(headers)) {
+		lines = append(lines, fmt.Sprintf("%s: %s", key, headers[key]))
+	}
+	if body != "" {
+		lines = append(lines, fmt.Sprintf("Content-Length: %d", len(body)))
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(rtspSessionTimeout))
+	_, err := io.WriteString(s.conn, strings.Join(lines, "\r\n")+"\r\n\r\n"+body)
+	return err
+}
+
+func (s *rtspSession) errorStatus(err error) string {
+	switch {
+	case errors.Is(err, ErrRoomAccessDenied):
+		return "401 Unauthorized"
+	case errors.Is(err, ErrStreamNotInRoom):
+		return "404 Not Found"
+	case errors.Is(err, errRTSPUnsupportedTransport):
+		return "461 Unsupported Transport"
+	default:
+		return "400 Bad Request"
+	}
+}
+
+// resolve finds the stream of rtsp://host/room/<room_id>/<stream_id>,
+// protected and lobby rooms require a token as the basic auth password.
+func (s *rtspSession) resolve(request *rtspRequest) (*IncomingStream, error) {
+	parts := strings.Split(strings.Trim(request.url.Path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "room" {
+		return nil, ErrStreamNotInRoom
+	}
+
+	room := GetRoom(parts[1])
+	if room == nil {
+		return nil, ErrStreamNotInRoom
+	}
+	stream := room.GetInStream(parts[2])
+	if stream == nil {
+		return nil, ErrStreamNotInRoom
+	}
+	if s.stream != nil && s.stream != stream {
+		return nil, errors.New("the session already plays another stream")
+	}
+
+	if !s.authorized && room.RequiresToken() {
+		token := ""
+		if credentials, ok := strings.CutPrefix(request.header.Get("Authorization"), "Basic "); ok {
+			if decoded, err := base64.StdEncoding.DecodeString(credentials); err == nil {
+				_, token, _ = strings.Cut(string(decoded), ":")
+			}
+		}
+		if err := room.CheckToken(token); err != nil {
+			return nil, err
+		}
+		s.authorized = true
+	}
+
+	s.stream = stream
+	return stream, nil
+}
+
+func (s *rtspSession) describe(stream *IncomingStream) string {
+	lines := []string{
+		"v=0",
+		"o=- 0 0 IN IP4 0.0.0.0",
+		fmt.Sprintf("s=SplashRTC stream %s", stream.Id),
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		"a=control:*",
+	}
+	for i, track := range stream.GetTracks() {
+		lines = append(lines, sdpMediaLines(track.Codec, 0)...)
+		lines = append(lines, fmt.Sprintf("a=control:trackID=%d", i))
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// setup adds the track of the request url with the transport asked by the
+// client, udp packets are only sent to the address of the connection.
+func (s *rtspSession) setup(request *rtspRequest) (*rtspTrack, error) {
+	trackUrl := *request.url
+	control := ""
+	if idx := strings.LastIndex(trackUrl.Path, "/trackID="); idx != -1 {
+		control = trackUrl.Path[idx+len("/trackID="):]
+		trackUrl.Path = trackUrl.Path[:idx]
+	}
+	stream, err := s.resolve(&rtspRequest{method: request.method, url: &trackUrl, header: request.header})
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := stream.GetTracks()
+	index, err := strconv.Atoi(control)
+	if err != nil || index < 0 || index >= len(tracks) {
+		return nil, ErrStreamNotInRoom
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, setup := range s.tracks {
+		if setup.track == tracks[index] {
+			return setup, nil
+		}
+	}
+
+	track := &rtspTrack{track: tracks[index]}
+	transport := request.header.Get("Transport")
+	for _, option := range strings.Split(strings.Split(transport, ",")[0], ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+		switch key {
+		case "RTP/AVP/TCP":
+			track.interleaved = true
+		case "interleaved":
+			channel, _, _ := strings.Cut(value, "-")
+			track.channel, _ = strconv.Atoi(channel)
+		case "client_port":
+			port, _, _ := strings.Cut(value, "-")
+			clientPort, _ := strconv.Atoi(port)
+			track.rtpAddr = &net.UDPAddr{IP: s.conn.RemoteAddr().(*net.TCPAddr).IP, Port: clientPort}
+		}
+	}
+
+	switch {
+	case track.interleaved:
+		if track.channel < 0 || track.channel > 254 {
+			return nil, errRTSPUnsupportedTransport
+		}
+	case track.rtpAddr != nil && track.rtpAddr.Port > 0:
+		if err := track.listen(s); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errRTSPUnsupportedTransport
+	}
+
+	s.tracks = append(s.tracks, track)
+	return track, nil
+}
+
+func (track *rtspTrack) listen(s *rtspSession) error {
+	local := &net.UDPAddr{IP: s.conn.LocalAddr().(*net.TCPAddr).IP}
+
+	rtpConn, err := net.ListenUDP("udp", local)
+	if err != nil {
+		return err
+	}
+	rtcpConn, err := net.ListenUDP("udp", local)
+	if err != nil {
+		rtpConn.Close()
+		return err
+	}
+	track.rtpConn, track.rtcpConn = rtpConn, rtcpConn
+
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, _, err := rtcpConn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			s.handleRTCP(buffer[:n])
+		}
+	}()
+	return nil
+}
+
+func (track *rtspTrack) transport() string {
+	if track.interleaved {
+		return fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", track.channel, track.channel+1)
+	}
+	return fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d",
+		track.rtpAddr.Port, track.rtpAddr.Port+1,
+		track.rtpConn.LocalAddr().(*net.UDPAddr).Port, track.rtcpConn.LocalAddr().(*net.UDPAddr).Port,
+	)
+}
+
+func (s *rtspSession) play() error {
+	s.mutex.Lock()
+	if len(s.tracks) == 0 {
+		s.mutex.Unlock()
+		return errors.New("no track has been setup")
+	}
+	if s.playing {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.playing = true
+	s.mutex.Unlock()
+
+	if !s.stream.AddSink(s) {
+		return ErrStreamNotInRoom
+	}
+	s.stream.RequestKeyframe()
+
+	logger.Info(fmt.Sprintf("rtsp session %s of %s playing stream %s", s.id, s.conn.RemoteAddr().String(), s.stream.Id))
+	return nil
+}
+
+func (s *rtspSession) handleRTCP(data []byte) {
+	packets, err := rtcp.Unmarshal(data)
+	if err != nil || s.stream == nil {
+		return
+	}
+	for _, packet := range packets {
+		switch packet.(type) {
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			s.stream.RequestKeyframe()
+		}
+	}
+}
+
+func (s *rtspSession) WriteRTP(track *StreamTrack, packet *rtp.Packet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	var setup *rtspTrack
+	for _, candidate := range s.tracks {
+		if candidate.track == track {
+			setup = candidate
+		}
+	}
+	if setup == nil {
+		return
+	}
+
+	data, err := packet.Marshal()
+	if err != nil {
+		return
+	}
+	select {
+	case s.queue <- rtspPacket{track: setup, data: data}:
+	default:
+		s.dropped++
+	}
+}
+
+// Close is called once the stream is torn down or the connection closed.
+func (s *rtspSession) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.conn.Close()
+	for _, track := range s.tracks {
+		if track.rtpConn != nil {
+			track.rtpConn.Close()
+			track.rtcpConn.Close()
+		}
+	}
+	if s.playing {
+		logger.Info(fmt.Sprintf("rtsp session %s stopped, %d packets dropped", s.id, s.dropped))
+	}
+}
+
+func (s *rtspSession) close() {
+	if s.stream != nil && s.playing {
+		s.stream.RemoveSink(s)
+	}
+	s.Close()
+}
+
+func (s *rtspSession) writePackets() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case packet := <-s.queue:
+			var err error
+			if packet.track.interleaved {
+				frame := []byte{'$', byte(packet.track.channel)}
+				frame = binary.BigEndian.AppendUint16(frame, uint16(len(packet.data)))
+
+				s.writeMutex.Lock()
+				s.conn.SetWriteDeadline(time.Now().Add(rtspSessionTimeout))
+				_, err = s.conn.Write(append(frame, packet.data...))
+				s.writeMutex.Unlock()
+			} else {
+				_, err = packet.track.rtpConn.WriteToUDP(packet.data, packet.track.rtpAddr)
+			}
+			if err != nil {
+				logger.Trace(fmt.Sprintf("rtsp session %s failed sending rtp, %s", s.id, err.Error()))
+			}
+		}
+	}
+}
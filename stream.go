@@ -3,8 +3,15 @@ package main
 import (
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 )
 
@@ -12,8 +19,47 @@ type IncomingStream struct {
 	Id             string                 `json:"id"`
 	Publisher      *User                  `json:"publisher"`
 	PeerConnection *webrtc.PeerConnection `json:"-"`
+	room           *Room
 
-	receiversChannel map[*webrtc.RTPReceiver]chan []byte
+	Tracks      []*StreamTrack `json:"tracks"`
+	tracksMutex *sync.Mutex
+
+	dataChannels      map[string]*webrtc.DataChannel
+	dataChannelsMutex *sync.Mutex
+
+	subscribers      map[string]*OutgoingStream
+	subscribersMutex *sync.Mutex
+
+	mutedTracks      map[string]bool
+	mutedTracksMutex *sync.Mutex
+
+	sinks      []RTPSink
+	tornDown   bool
+	sinksMutex *sync.Mutex
+
+	done         chan struct{}
+	teardownOnce *sync.Once
+}
+
+// RTPSink receives every packet forwarded by an IncomingStream, Close is
+// called once the stream is torn down or the sink removed.
+type RTPSink interface {
+	WriteRTP(track *StreamTrack, packet *rtp.Packet)
+	Close()
+}
+
+// StreamTrack pairs a published track with the local track every subscriber
+// peer connection is bound to, writing once to Local fans out to all of them.
+type StreamTrack struct {
+	Id       string `json:"id"`
+	Kind     string `json:"kind"`
+	MimeType string `json:"mime_type"`
+
+	Codec  webrtc.RTPCodecParameters   `json:"-"`
+	Remote *webrtc.TrackRemote         `json:"-"`
+	Local  *webrtc.TrackLocalStaticRTP `json:"-"`
+
+	stats *rtpReceiveStats
 }
 
 func NewIncomingStream(user *User) (*IncomingStream, error) {
@@ -21,26 +67,20 @@ func NewIncomingStream(user *User) (*IncomingStream, error) {
 		return nil, errors.New("you should join a room before publishing a stream")
 	}
 
-	stream := &IncomingStream{
-		Id:             uuid.NewString(),
-		Publisher:      user,
-		PeerConnection: nil,
-
-		receiversChannel: make(map[*webrtc.RTPReceiver]chan []byte),
+	if !user.Room.RoleOf(user).CanPublish() {
+		return nil, ErrViewerCantPublish
 	}
-	pc, err := user.Room.Api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun2.l.google.com:19302"},
-			},
-		},
-		BundlePolicy: webrtc.BundlePolicyMaxBundle,
+
+	stream := newIncomingStream(user)
+	pc, err := newCapturedPeerConnection(user.Room, PeerConnectionConfiguration(user.Id), func(capture *Capture) bool {
+		return capture.matchesStream(stream)
 	})
 	if err != nil {
 		logger.Warn("peer connection failed", err.Error())
 		return nil, err
 	}
 	stream.PeerConnection = pc
+	watchTransportFailures(pc, "publisher")
 
 	stream.PeerConnection.OnSignalingStateChange(func(rs webrtc.SignalingState) {
 		logger.Debug(fmt.Sprintf("signaling state of stream %s changed to %s", stream.Id, rs.String()))
@@ -53,7 +93,17 @@ func NewIncomingStream(user *User) (*IncomingStream, error) {
 	})
 	stream.PeerConnection.OnTrack(func(t *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
 		logger.Debug(fmt.Sprintf("new track on stream %s => %s", stream.Id, t.ID()))
-		go stream.handleRTP(r)
+		track, err := stream.addTrack(t.ID(), t.Codec(), t)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("failed adding track %s to stream %s, %s", t.ID(), stream.Id, err.Error()))
+			return
+		}
+		go stream.handleRTP(track)
+		go stream.handleRTCP(r)
+	})
+	stream.PeerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
+		logger.Debug(fmt.Sprintf("new data channel on stream %s => %s", stream.Id, dc.Label()))
+		stream.addDataChannel(dc)
 	})
 
 	if err := user.Room.AddInStream(stream); err != nil {
@@ -68,6 +118,35 @@ func NewIncomingStream(user *User) (*IncomingStream, error) {
 	return stream, nil
 }
 
+// newIncomingStream returns a stream without peer connection, its tracks are
+// fed through forwardRTP.
+func newIncomingStream(user *User) *IncomingStream {
+	return &IncomingStream{
+		Id:             uuid.NewString(),
+		Publisher:      user,
+		PeerConnection: nil,
+		room:           user.Room,
+
+		Tracks:      make([]*StreamTrack, 0),
+		tracksMutex: new(sync.Mutex),
+
+		dataChannels:      make(map[string]*webrtc.DataChannel),
+		dataChannelsMutex: new(sync.Mutex),
+
+		subscribers:      make(map[string]*OutgoingStream),
+		subscribersMutex: new(sync.Mutex),
+
+		mutedTracks:      make(map[string]bool),
+		mutedTracksMutex: new(sync.Mutex),
+
+		sinks:      make([]RTPSink, 0),
+		sinksMutex: new(sync.Mutex),
+
+		done:         make(chan struct{}),
+		teardownOnce: new(sync.Once),
+	}
+}
+
 func (s *IncomingStream) AddIceCandidate(candidate webrtc.ICECandidateInit) {
 	if err := s.PeerConnection.AddICECandidate(candidate); err != nil {
 		logger.Warn(fmt.Sprintf("failed add ice candidate to stream %s", s.Id))
@@ -76,25 +155,236 @@ func (s *IncomingStream) AddIceCandidate(candidate webrtc.ICECandidateInit) {
 }
 
 func (s *IncomingStream) Teardown() {
-	if err := s.PeerConnection.GracefulClose(); err != nil {
-		logger.Warn("failed closing peer connection", err.Error())
+	s.teardownOnce.Do(func() {
+		close(s.done)
+
+		for _, subscriber := range s.GetSubscribers() {
+			subscriber.Close("the stream has been unpublished")
+		}
+
+		s.sinksMutex.Lock()
+		sinks := s.sinks
+		s.sinks = nil
+		s.tornDown = true
+		s.sinksMutex.Unlock()
+
+		for _, sink := range sinks {
+			sink.Close()
+		}
+
+		if s.PeerConnection == nil {
+			return
+		}
+		if err := s.PeerConnection.GracefulClose(); err != nil {
+			logger.Warn("failed closing peer connection", err.Error())
+		}
+	})
+}
+
+// Done is closed once the stream has been torn down.
+func (s *IncomingStream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *IncomingStream) GetTracks() []*StreamTrack {
+	s.tracksMutex.Lock()
+	defer s.tracksMutex.Unlock()
+
+	return slices.Clone(s.Tracks)
+}
+
+func (s *IncomingStream) GetDataChannels() []*webrtc.DataChannel {
+	s.dataChannelsMutex.Lock()
+	defer s.dataChannelsMutex.Unlock()
+
+	return slices.Collect(maps.Values(s.dataChannels))
+}
+
+func (s *IncomingStream) GetSubscribers() []*OutgoingStream {
+	s.subscribersMutex.Lock()
+	defer s.subscribersMutex.Unlock()
+
+	return slices.Collect(maps.Values(s.subscribers))
+}
+
+// AddSink reports false when the stream has already been torn down.
+func (s *IncomingStream) AddSink(sink RTPSink) bool {
+	s.sinksMutex.Lock()
+	defer s.sinksMutex.Unlock()
+
+	if s.tornDown {
+		return false
 	}
+	s.sinks = append(s.sinks, sink)
+	return true
 }
 
-func (s *IncomingStream) handleRTP(r *webrtc.RTPReceiver) {
-	buffer := make([]byte, 1500)
-	s.receiversChannel[r] = make(chan []byte)
+func (s *IncomingStream) RemoveSink(sink RTPSink) {
+	s.sinksMutex.Lock()
+	idx := slices.Index(s.sinks, sink)
+	if idx != -1 {
+		s.sinks = slices.Delete(s.sinks, idx, idx+1)
+	}
+	s.sinksMutex.Unlock()
+
+	if idx != -1 {
+		sink.Close()
+	}
+}
+
+func (s *IncomingStream) getSinks() []RTPSink {
+	s.sinksMutex.Lock()
+	defer s.sinksMutex.Unlock()
+
+	return slices.Clone(s.sinks)
+}
+
+func (s *IncomingStream) SetTrackMuted(trackId string, muted bool) {
+	s.mutedTracksMutex.Lock()
+	defer s.mutedTracksMutex.Unlock()
+
+	if muted {
+		s.mutedTracks[trackId] = true
+	} else {
+		delete(s.mutedTracks, trackId)
+	}
+}
+
+func (s *IncomingStream) IsTrackMuted(trackId string) bool {
+	s.mutedTracksMutex.Lock()
+	defer s.mutedTracksMutex.Unlock()
+
+	return s.mutedTracks[trackId]
+}
+
+func (s *IncomingStream) RequestKeyframe() {
+	for _, track := range s.GetTracks() {
+		if track.Remote == nil || track.Remote.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		packets := []rtcp.Packet{
+			&rtcp.PictureLossIndication{MediaSSRC: uint32(track.Remote.SSRC())},
+		}
+		if err := s.PeerConnection.WriteRTCP(packets); err != nil {
+			logger.Debug(fmt.Sprintf("failed requesting keyframe on stream %s, %s", s.Id, err.Error()))
+			continue
+		}
+		metricKeyframeRequests.With("out", "pli").Inc()
+	}
+}
+
+// addSubscriber reports false when the stream has already been torn down,
+// Teardown closes done before collecting the subscribers under the lock.
+func (s *IncomingStream) addSubscriber(subscriber *OutgoingStream) bool {
+	s.subscribersMutex.Lock()
+	defer s.subscribersMutex.Unlock()
 
-	defer func() {
-		close(s.receiversChannel[r])
-		delete(s.receiversChannel, r)
-	}()
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.subscribers[subscriber.Id] = subscriber
+	return true
+}
+
+func (s *IncomingStream) removeSubscriber(subscriber *OutgoingStream) {
+	s.subscribersMutex.Lock()
+	delete(s.subscribers, subscriber.Id)
+	s.subscribersMutex.Unlock()
+}
 
+func (s *IncomingStream) addTrack(id string, codec webrtc.RTPCodecParameters, remote *webrtc.TrackRemote) (*StreamTrack, error) {
+	local, err := webrtc.NewTrackLocalStaticRTP(codec.RTPCodecCapability, id, s.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	kind := webrtc.RTPCodecTypeAudio
+	if strings.HasPrefix(strings.ToLower(codec.MimeType), "video/") {
+		kind = webrtc.RTPCodecTypeVideo
+	}
+
+	track := &StreamTrack{
+		Id:       id,
+		Kind:     kind.String(),
+		MimeType: codec.MimeType,
+		Codec:    codec,
+		Remote:   remote,
+		Local:    local,
+		stats:    newRTPReceiveStats(codec),
+	}
+
+	s.tracksMutex.Lock()
+	s.Tracks = append(s.Tracks, track)
+	s.tracksMutex.Unlock()
+
+	for _, subscriber := range s.GetSubscribers() {
+		subscriber.AddTrack(track)
+	}
+	if s.room != nil {
+		s.room.refreshViewers()
+	}
+
+	return track, nil
+}
+
+func (s *IncomingStream) addDataChannel(dc *webrtc.DataChannel) {
+	s.dataChannelsMutex.Lock()
+	s.dataChannels[dc.Label()] = dc
+	s.dataChannelsMutex.Unlock()
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		for _, subscriber := range s.GetSubscribers() {
+			subscriber.SendData(dc.Label(), msg)
+		}
+	})
+	dc.OnClose(func() {
+		s.dataChannelsMutex.Lock()
+		if s.dataChannels[dc.Label()] == dc {
+			delete(s.dataChannels, dc.Label())
+		}
+		s.dataChannelsMutex.Unlock()
+	})
+
+	for _, subscriber := range s.GetSubscribers() {
+		subscriber.AddDataChannel(dc)
+	}
+}
+
+func (s *IncomingStream) handleRTP(track *StreamTrack) {
+	for {
+		packet, _, err := track.Remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		s.forwardRTP(track, packet)
+	}
+}
+
+func (s *IncomingStream) forwardRTP(track *StreamTrack, packet *rtp.Packet) {
+	captureStreamRTP(s, packet)
+	track.stats.observe(packet, time.Now())
+	if s.IsTrackMuted(track.Id) {
+		return
+	}
+	for _, sink := range s.getSinks() {
+		sink.WriteRTP(track, packet)
+	}
+	if err := track.Local.WriteRTP(packet); err != nil {
+		logger.Trace(fmt.Sprintf("failed forwarding rtp of track %s, %s", track.Id, err.Error()))
+	}
+}
+
+// handleRTCP drains the reports of the publisher so the interceptors keep
+// processing them.
+func (s *IncomingStream) handleRTCP(receiver *webrtc.RTPReceiver) {
+	buffer := make([]byte, 1500)
 	for {
-		_, _, err := r.Read(buffer)
+		n, _, err := receiver.Read(buffer)
 		if err != nil {
 			return
 		}
-		s.receiversChannel[r] <- buffer
+		captureStreamPacket(s, buffer[:n], true)
 	}
 }
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+var ErrSubscriptionNotFound = errors.New("the subscription does not exist")
+
+// OutgoingStream is a server offered peer connection forwarding the tracks
+// and data channels of an IncomingStream to a subscriber.
+type OutgoingStream struct {
+	Id             string                 `json:"id"`
+	StreamId       string                 `json:"stream_id"`
+	Subscriber     *User                  `json:"subscriber"`
+	Stream         *IncomingStream        `json:"-"`
+	PeerConnection *webrtc.PeerConnection `json:"-"`
+
+	dataChannels map[string]*webrtc.DataChannel
+
+	// negotiating is set while an offer waits for its answer, renegotiate
+	// records that another offer is needed once it arrives.
+	negotiating bool
+	renegotiate bool
+	closed      bool
+	mutex       *sync.Mutex
+}
+
+func NewOutgoingStream(user *User, stream *IncomingStream) (*OutgoingStream, error) {
+	if user.Room == nil {
+		return nil, errors.New("you should join a room before subscribing to a stream")
+	}
+	if user.Room.GetInStream(stream.Id) != stream {
+		return nil, ErrStreamNotInRoom
+	}
+
+	subscription := &OutgoingStream{
+		Id:         uuid.NewString(),
+		StreamId:   stream.Id,
+		Subscriber: user,
+		Stream:     stream,
+
+		dataChannels: make(map[string]*webrtc.DataChannel),
+		mutex:        new(sync.Mutex),
+	}
+
+	pc, err := newCapturedPeerConnection(user.Room, PeerConnectionConfiguration(user.Id), func(capture *Capture) bool {
+		return capture.matchesSubscription(subscription)
+	})
+	if err != nil {
+		return nil, err
+	}
+	subscription.PeerConnection = pc
+	watchTransportFailures(pc, "subscriber")
+
+	pc.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		logger.Debug(fmt.Sprintf("peer state of subscription %s changed to %s", subscription.Id, pcs.String()))
+		if pcs == webrtc.PeerConnectionStateFailed {
+			subscription.Close("the peer connection failed")
+		}
+	})
+
+	for _, track := range stream.GetTracks() {
+		subscription.addTrack(track)
+	}
+	for _, dc := range stream.GetDataChannels() {
+		subscription.addDataChannel(dc)
+	}
+
+	if !stream.addSubscriber(subscription) {
+		if err := pc.Close(); err != nil {
+			logger.Warn(fmt.Sprintf("failed closing peer connection of subscription %s, %s", subscription.Id, err.Error()))
+		}
+		return nil, ErrStreamNotInRoom
+	}
+	user.addSubscription(subscription)
+
+	logger.Info(fmt.Sprintf("user %s subscribe to stream %s", user.Id, stream.Id))
+	subscription.Negotiate()
+
+	return subscription, nil
+}
+
+func (sub *OutgoingStream) AddTrack(track *StreamTrack) {
+	if sub.addTrack(track) {
+		sub.Negotiate()
+	}
+}
+
+func (sub *OutgoingStream) AddDataChannel(source *webrtc.DataChannel) {
+	if sub.addDataChannel(source) {
+		sub.Negotiate()
+	}
+}
+
+func (sub *OutgoingStream) addTrack(track *StreamTrack) bool {
+	sender, err := sub.PeerConnection.AddTrack(track.Local)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("failed adding track %s to subscription %s, %s", track.Id, sub.Id, err.Error()))
+		return false
+	}
+
+	go sub.handleRTCP(sender, track)
+	return true
+}
+
+// addDataChannel mirrors a publisher data channel, keeping its label and
+// its ordered and reliability settings.
+func (sub *OutgoingStream) addDataChannel(source *webrtc.DataChannel) bool {
+	ordered := source.Ordered()
+	protocol := source.Protocol()
+	init := &webrtc.DataChannelInit{
+		Ordered:           &ordered,
+		MaxPacketLifeTime: source.MaxPacketLifeTime(),
+		MaxRetransmits:    source.MaxRetransmits(),
+		Protocol:          &protocol,
+	}
+
+	dc, err := sub.PeerConnection.CreateDataChannel(source.Label(), init)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("failed relaying data channel %s to subscription %s, %s", source.Label(), sub.Id, err.Error()))
+		return false
+	}
+
+	sub.mutex.Lock()
+	sub.dataChannels[source.Label()] = dc
+	sub.mutex.Unlock()
+
+	return true
+}
+
+func (sub *OutgoingStream) SendData(label string, msg webrtc.DataChannelMessage) {
+	sub.mutex.Lock()
+	dc, ok := sub.dataChannels[label]
+	sub.mutex.Unlock()
+
+	if !ok || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+
+	var err error
+	if msg.IsString {
+		err = dc.SendText(string(msg.Data))
+	} else {
+		err = dc.Send(msg.Data)
+	}
+	if err != nil {
+		logger.Trace(fmt.Sprintf("failed relaying data on %s to subscription %s, %s", label, sub.Id, err.Error()))
+	}
+}
+
+// Negotiate sends a new offer to the subscriber, or postpones it when an
+// offer is already waiting for its answer.
+func (sub *OutgoingStream) Negotiate() {
+	sub.mutex.Lock()
+	if sub.closed {
+		sub.mutex.Unlock()
+		return
+	}
+	if sub.negotiating {
+		sub.renegotiate = true
+		sub.mutex.Unlock()
+		return
+	}
+	sub.negotiating = true
+	sub.mutex.Unlock()
+
+	go sub.sendOffer()
+}
+
+func (sub *OutgoingStream) sendOffer() {
+	offer, err := sub.PeerConnection.CreateOffer(nil)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("failed creating offer for subscription %s, %s", sub.Id, err.Error()))
+		sub.abortNegotiation()
+		return
+	}
+
+	gathered := webrtc.GatheringCompletePromise(sub.PeerConnection)
+	if err := sub.PeerConnection.SetLocalDescription(offer); err != nil {
+		logger.Warn(fmt.Sprintf("failed setting offer for subscription %s, %s", sub.Id, err.Error()))
+		sub.abortNegotiation()
+		return
+	}
+	<-gathered
+
+	sub.Subscriber.SendMessageJson(NewMessageSubscribeOffer(sub, *sub.PeerConnection.LocalDescription()))
+}
+
+func (sub *OutgoingStream) abortNegotiation() {
+	sub.mutex.Lock()
+	sub.negotiating = false
+	sub.renegotiate = false
+	sub.mutex.Unlock()
+}
+
+func (sub *OutgoingStream) SetAnswer(answer webrtc.SessionDescription) error {
+	if err := sub.PeerConnection.SetRemoteDescription(answer); err != nil {
+		return err
+	}
+
+	sub.mutex.Lock()
+	sub.negotiating = false
+	renegotiate := sub.renegotiate
+	sub.renegotiate = false
+	sub.mutex.Unlock()
+
+	if renegotiate {
+		sub.Negotiate()
+	}
+
+	return nil
+}
+
+func (sub *OutgoingStream) AddIceCandidate(candidate webrtc.ICECandidateInit) {
+	if err := sub.PeerConnection.AddICECandidate(candidate); err != nil {
+		logger.Warn(fmt.Sprintf("failed add ice candidate to subscription %s", sub.Id))
+	}
+}
+
+func (sub *OutgoingStream) Close(cause string) {
+	sub.mutex.Lock()
+	if sub.closed {
+		sub.mutex.Unlock()
+		return
+	}
+	sub.closed = true
+	sub.mutex.Unlock()
+
+	sub.Stream.removeSubscriber(sub)
+	sub.Subscriber.removeSubscription(sub)
+
+	if err := sub.PeerConnection.Close(); err != nil {
+		logger.Warn(fmt.Sprintf("failed closing subscription %s, %s", sub.Id, err.Error()))
+	}
+
+	sub.Subscriber.SendMessageJson(NewMessageUnsubscribed(sub, cause))
+	logger.Info(fmt.Sprintf("subscription %s of user %s closed, %s", sub.Id, sub.Subscriber.Id, cause))
+}
+
+// handleRTCP forwards keyframe requests of the subscriber to the publisher.
+func (sub *OutgoingStream) handleRTCP(sender *webrtc.RTPSender, track *StreamTrack) {
+	feedback := newReceiverFeedback(sender, track.Kind, track.Codec.ClockRate)
+	buffer := make([]byte, 1500)
+	for {
+		n, _, err := sender.Read(buffer)
+		if err != nil {
+			return
+		}
+		captureSubscriptionPacket(sub, buffer[:n], true)
+
+		packets, err := rtcp.Unmarshal(buffer[:n])
+		if err != nil {
+			continue
+		}
+		feedback.observe(packets)
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				sub.Stream.RequestKeyframe()
+			}
+		}
+	}
+}
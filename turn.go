@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/turn/v4"
+)
+
+type TurnConfig struct {
+	Enabled bool   `json:"enabled" yaml:"enabled" toml:"enabled"`
+	Realm   string `json:"realm" yaml:"realm" toml:"realm"`
+
+	UDPListen string `json:"udp_listen" yaml:"udp_listen" toml:"udp_listen"`
+	TCPListen string `json:"tcp_listen" yaml:"tcp_listen" toml:"tcp_listen"`
+
+	PublicIP     string `json:"public_ip" yaml:"public_ip" toml:"public_ip"`
+	RelayAddress string `json:"relay_address" yaml:"relay_address" toml:"relay_address"`
+	RelayPortMin uint16 `json:"relay_port_min" yaml:"relay_port_min" toml:"relay_port_min"`
+	RelayPortMax uint16 `json:"relay_port_max" yaml:"relay_port_max" toml:"relay_port_max"`
+
+	Secret        string   `json:"secret" yaml:"secret" toml:"secret"`
+	CredentialTTL Duration `json:"credential_ttl" yaml:"credential_ttl" toml:"credential_ttl"`
+
+	MaxAllocationsPerUser int `json:"max_allocations_per_user" yaml:"max_allocations_per_user" toml:"max_allocations_per_user"`
+
+	// AllowedPeerNetworks lets clients relay to these networks even when
+	// they are loopback, private or link-local ones, which are denied.
+	AllowedPeerNetworks []string `json:"allowed_peer_networks" yaml:"allowed_peer_networks" toml:"allowed_peer_networks"`
+}
+
+func DefaultTurnConfig() TurnConfig {
+	return TurnConfig{
+		Enabled:               false,
+		Realm:                 "splashrtc",
+		UDPListen:             "0.0.0.0:3478",
+		TCPListen:             "0.0.0.0:3478",
+		RelayAddress:          "0.0.0.0",
+		RelayPortMin:          49152,
+		RelayPortMax:          65535,
+		CredentialTTL:         Duration{12 * time.Hour},
+		MaxAllocationsPerUser: 10,
+	}
+}
+
+func (cfg TurnConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	if net.ParseIP(cfg.PublicIP) == nil {
+		return errors.New("public_ip must be a valid ip address")
+	}
+	if net.ParseIP(cfg.RelayAddress) == nil {
+		return errors.New("relay_address must be a valid ip address")
+	}
+	if cfg.UDPListen == "" && cfg.TCPListen == "" {
+		return errors.New("at least one of udp_listen or tcp_listen is required")
+	}
+	for _, listen := range []string{cfg.UDPListen, cfg.TCPListen} {
+		if listen == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return err
+		}
+	}
+	if cfg.RelayPortMin == 0 || cfg.RelayPortMax < cfg.RelayPortMin {
+		return errors.New("relay port range is invalid")
+	}
+	if cfg.Secret == "" {
+		return errors.New("secret is required")
+	}
+	if cfg.CredentialTTL.Duration <= 0 {
+		return errors.New("credential_ttl must be positive")
+	}
+	if cfg.MaxAllocationsPerUser < 0 {
+		return errors.New("max_allocations_per_user must not be negative")
+	}
+	for _, network := range cfg.AllowedPeerNetworks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return fmt.Errorf("allowed_peer_networks: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// AllowsPeer denies relaying to the networks of the server itself and of
+// its private network, unless they are listed in the allowed peer networks.
+func (cfg TurnConfig) AllowsPeer(ip net.IP) bool {
+	for _, network := range cfg.AllowedPeerNetworks {
+		if _, ipNet, err := net.ParseCIDR(network); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+func (cfg TurnConfig) ICEServer() ICEServerConfig {
+	urls := make([]string, 0, 2)
+	if cfg.UDPListen != "" {
+		urls = append(urls, fmt.Sprintf("turn:%s?transport=udp", net.JoinHostPort(cfg.PublicIP, listenPort(cfg.UDPListen))))
+	}
+	if cfg.TCPListen != "" {
+		urls = append(urls, fmt.Sprintf("turn:%s?transport=tcp", net.JoinHostPort(cfg.PublicIP, listenPort(cfg.TCPListen))))
+	}
+
+	return ICEServerConfig{
+		URLs:   urls,
+		Secret: cfg.Secret,
+		TTL:    cfg.CredentialTTL,
+	}
+}
+
+type TurnServer struct {
+	cfg    TurnConfig
+	server *turn.Server
+
+	// allocations counts the allocations of every user, including the ones
+	// reserved by the quota check and not created yet, which are pending by
+	// client address.
+	allocations      map[string]int
+	pending          map[string]string
+	allocationsMutex *sync.Mutex
+}
+
+func NewTurnServer(cfg TurnConfig) (*TurnServer, error) {
+	ts := &TurnServer{
+		cfg:              cfg,
+		allocations:      make(map[string]int),
+		pending:          make(map[string]string),
+		allocationsMutex: new(sync.Mutex),
+	}
+
+	serverConfig := turn.ServerConfig{
+		Realm:        cfg.Realm,
+		AuthHandler:  ts.authenticate,
+		QuotaHandler: ts.allowAllocation,
+		EventHandler: turn.EventHandler{
+			OnAllocationCreated: func(srcAddr, _ net.Addr, _, _, _ string, _ net.Addr, _ int) {
+				ts.settleAllocation(srcAddr, true)
+			},
+			OnAllocationError: func(srcAddr, _ net.Addr, _, _ string) {
+				ts.settleAllocation(srcAddr, false)
+			},
+			OnAllocationDeleted: func(_, _ net.Addr, _, username, _ string) {
+				ts.releaseAllocation(username)
+			},
+		},
+	}
+
+	if cfg.UDPListen != "" {
+		conn, err := net.ListenPacket("udp4", cfg.UDPListen)
+		if err != nil {
+			return nil, fmt.Errorf("failed listening turn udp, %w", err)
+		}
+		serverConfig.PacketConnConfigs = append(serverConfig.PacketConnConfigs, turn.PacketConnConfig{
+			PacketConn:            conn,
+			RelayAddressGenerator: ts.relayAddressGenerator(),
+			PermissionHandler:     ts.allowPeer,
+		})
+	}
+
+	if cfg.TCPListen != "" {
+		listener, err := net.Listen("tcp4", cfg.TCPListen)
+		if err != nil {
+			for _, packetConfig := range serverConfig.PacketConnConfigs {
+				packetConfig.PacketConn.Close()
+			}
+			return nil, fmt.Errorf("failed listening turn tcp, %w", err)
+		}
+		serverConfig.ListenerConfigs = append(serverConfig.ListenerConfigs, turn.ListenerConfig{
+			Listener:              listener,
+			RelayAddressGenerator: ts.relayAddressGenerator(),
+			PermissionHandler:     ts.allowPeer,
+		})
+	}
+
+	server, err := turn.NewServer(serverConfig)
+	if err != nil {
+		for _, packetConfig := range serverConfig.PacketConnConfigs {
+			packetConfig.PacketConn.Close()
+		}
+		for _, listenerConfig := range serverConfig.ListenerConfigs {
+			listenerConfig.Listener.Close()
+		}
+		return nil, err
+	}
+	ts.server = server
+
+	logger.Info(fmt.Sprintf("turn server listening on udp %s, tcp %s, relaying from %s", cfg.UDPListen, cfg.TCPListen, cfg.PublicIP))
+
+	return ts, nil
+}
+
+func (ts *TurnServer) Close() error {
+	return ts.server.Close()
+}
+
+func (ts *TurnServer) relayAddressGenerator() turn.RelayAddressGenerator {
+	return &turn.RelayAddressGeneratorPortRange{
+		RelayAddress: net.ParseIP(ts.cfg.PublicIP),
+		Address:      ts.cfg.RelayAddress,
+		MinPort:      ts.cfg.RelayPortMin,
+		MaxPort:      ts.cfg.RelayPortMax,
+	}
+}
+
+func (ts *TurnServer) authenticate(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+	expiry, _, err := parseTurnUsername(username)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("turn auth rejected for %s from %s, %s", username, srcAddr, err.Error()))
+		return nil, false
+	}
+
+	if time.Now().After(expiry) {
+		logger.Debug(fmt.Sprintf("turn auth rejected for %s from %s, credentials expired", username, srcAddr))
+		return nil, false
+	}
+
+	return turn.GenerateAuthKey(username, realm, TurnCredential(ts.cfg.Secret, username)), true
+}
+
+func (ts *TurnServer) allowPeer(clientAddr net.Addr, peerIP net.IP) bool {
+	if !ts.cfg.AllowsPeer(peerIP) {
+		logger.Debug(fmt.Sprintf("turn permission to %s denied for %s", peerIP, clientAddr))
+		return false
+	}
+	return true
+}
+
+// allowAllocation checks the quota of the user and reserves the allocation
+// at once, the reservation is settled when the allocation is created or
+// fails.
+func (ts *TurnServer) allowAllocation(username string, _ string, srcAddr net.Addr) bool {
+	_, userId, err := parseTurnUsername(username)
+	if err != nil {
+		return false
+	}
+
+	ts.allocationsMutex.Lock()
+	defer ts.allocationsMutex.Unlock()
+
+	if ts.cfg.MaxAllocationsPerUser != 0 && ts.allocations[userId] >= ts.cfg.MaxAllocationsPerUser {
+		logger.Warn(fmt.Sprintf("turn allocation quota reached for user %s from %s", userId, srcAddr))
+		return false
+	}
+
+	ts.allocations[userId]++
+	ts.pending[srcAddr.String()] = userId
+
+	return true
+}
+
+// settleAllocation keeps the allocation reserved for the client address once
+// created, or gives it back when the allocate request failed.
+func (ts *TurnServer) settleAllocation(srcAddr net.Addr, created bool) {
+	ts.allocationsMutex.Lock()
+	defer ts.allocationsMutex.Unlock()
+
+	userId, ok := ts.pending[srcAddr.String()]
+	if !ok {
+		return
+	}
+	delete(ts.pending, srcAddr.String())
+
+	if !created {
+		ts.decrementAllocations(userId)
+	}
+}
+
+func (ts *TurnServer) releaseAllocation(username string) {
+	_, userId, err := parseTurnUsername(username)
+	if err != nil {
+		return
+	}
+
+	ts.allocationsMutex.Lock()
+	defer ts.allocationsMutex.Unlock()
+
+	ts.decrementAllocations(userId)
+}
+
+func (ts *TurnServer) decrementAllocations(userId string) {
+	ts.allocations[userId]--
+	if ts.allocations[userId] <= 0 {
+		delete(ts.allocations, userId)
+	}
+}
+
+func parseTurnUsername(username string) (time.Time, string, error) {
+	timestamp, userId, ok := strings.Cut(username, ":")
+	if !ok {
+		return time.Time{}, "", errors.New("username is not in the <expiry>:<user id> format")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid expiry, %w", err)
+	}
+
+	return time.Unix(seconds, 0), userId, nil
+}
+
+func listenPort(address string) string {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return ""
+	}
+	return port
+}
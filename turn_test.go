@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v4"
+)
+
+func TestParseTurnUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		expiry   int64
+		userId   string
+		fails    bool
+	}{
+		{username: "1700000000:alice", expiry: 1700000000, userId: "alice"},
+		{username: "1700000000:a:b", expiry: 1700000000, userId: "a:b"},
+		{username: "-1:alice", expiry: -1, userId: "alice"},
+		{username: "0:", expiry: 0, userId: ""},
+		{username: "alice", fails: true},
+		{username: ":alice", fails: true},
+		{username: "soon:alice", fails: true},
+		{username: "99999999999999999999:alice", fails: true},
+		{username: "", fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.username, func(t *testing.T) {
+			expiry, userId, err := parseTurnUsername(test.username)
+			if test.fails {
+				if err == nil {
+					t.Errorf("parsed %s %s, want an error", expiry, userId)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expiry.Unix() != test.expiry || userId != test.userId {
+				t.Errorf("parsed %d %q, want %d %q", expiry.Unix(), userId, test.expiry, test.userId)
+			}
+		})
+	}
+}
+
+func newTestTurnServer(maxAllocations int) *TurnServer {
+	return &TurnServer{
+		cfg:              TurnConfig{Realm: "realm", Secret: "secret", MaxAllocationsPerUser: maxAllocations},
+		allocations:      make(map[string]int),
+		pending:          make(map[string]string),
+		allocationsMutex: new(sync.Mutex),
+	}
+}
+
+func TestTurnServerAuthenticate(t *testing.T) {
+	ts := newTestTurnServer(0)
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	valid, _ := NewTurnCredentials("secret", "alice", time.Now().Add(time.Hour))
+	expired, _ := NewTurnCredentials("secret", "alice", time.Now().Add(-time.Second))
+
+	tests := []struct {
+		name     string
+		username string
+		accepted bool
+	}{
+		{name: "valid", username: valid, accepted: true},
+		{name: "expired", username: expired},
+		{name: "malformed", username: "alice"},
+		{name: "invalid expiry", username: "later:alice"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, accepted := ts.authenticate(test.username, "realm", addr)
+			if accepted != test.accepted {
+				t.Fatalf("accepted %t, want %t", accepted, test.accepted)
+			}
+			if !accepted {
+				return
+			}
+			// The client derives the same key from the credential it was given.
+			_, credential := NewTurnCredentials("secret", "alice", time.Unix(mustParseExpiry(t, test.username), 0))
+			if !bytes.Equal(key, turn.GenerateAuthKey(test.username, "realm", credential)) {
+				t.Error("key doesn't match the credential")
+			}
+		})
+	}
+}
+
+func mustParseExpiry(t *testing.T, username string) int64 {
+	t.Helper()
+
+	expiry, _, err := parseTurnUsername(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expiry.Unix()
+}
+
+func TestTurnServerAllocationQuota(t *testing.T) {
+	ts := newTestTurnServer(2)
+	username := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + ":alice"
+	addrs := []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000},
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4001},
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4002},
+	}
+
+	if !ts.allowAllocation(username, "realm", addrs[0]) || !ts.allowAllocation(username, "realm", addrs[1]) {
+		t.Fatal("allocations within the quota denied")
+	}
+	if ts.allowAllocation(username, "realm", addrs[2]) {
+		t.Fatal("allocation over the quota allowed")
+	}
+	if ts.allowAllocation("alice", "realm", addrs[2]) {
+		t.Fatal("allocation with a malformed username allowed")
+	}
+
+	// A failed allocation gives its reservation back, a created one keeps it.
+	ts.settleAllocation(addrs[0], false)
+	ts.settleAllocation(addrs[1], true)
+	if ts.allocations["alice"] != 1 || len(ts.pending) != 0 {
+		t.Fatalf("%d allocations, %d pending", ts.allocations["alice"], len(ts.pending))
+	}
+	if !ts.allowAllocation(username, "realm", addrs[2]) {
+		t.Fatal("allocation after a failed one denied")
+	}
+	ts.settleAllocation(addrs[2], true)
+
+	// Settling an unknown address changes nothing.
+	ts.settleAllocation(addrs[0], false)
+	if ts.allocations["alice"] != 2 {
+		t.Fatalf("%d allocations", ts.allocations["alice"])
+	}
+
+	ts.releaseAllocation(username)
+	ts.releaseAllocation(username)
+	ts.releaseAllocation("alice")
+	if _, ok := ts.allocations["alice"]; ok {
+		t.Error("released allocations still counted")
+	}
+}
+
+func TestTurnServerUnlimitedAllocations(t *testing.T) {
+	ts := newTestTurnServer(0)
+	username := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + ":alice"
+	for port := range 50 {
+		if !ts.allowAllocation(username, "realm", &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port}) {
+			t.Fatalf("allocation %d denied", port)
+		}
+	}
+}
+
+func TestTurnAllowsPeer(t *testing.T) {
+	cfg := TurnConfig{AllowedPeerNetworks: []string{"10.1.0.0/16", "fd00:1::/32"}}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{ip: "198.51.100.7", allowed: true},
+		{ip: "2001:db8::1", allowed: true},
+		{ip: "10.1.2.3", allowed: true},
+		{ip: "fd00:1::5", allowed: true},
+		{ip: "10.2.0.1"},
+		{ip: "192.168.1.1"},
+		{ip: "172.16.0.1"},
+		{ip: "127.0.0.1"},
+		{ip: "::1"},
+		{ip: "0.0.0.0"},
+		{ip: "::"},
+		{ip: "169.254.169.254"},
+		{ip: "fe80::1"},
+		{ip: "fd00:2::1"},
+		{ip: "224.0.0.1"},
+		{ip: "ff02::1"},
+		{ip: "::ffff:127.0.0.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			if allowed := cfg.AllowsPeer(net.ParseIP(test.ip)); allowed != test.allowed {
+				t.Errorf("allowed %t, want %t", allowed, test.allowed)
+			}
+		})
+	}
+}
+
+func TestTurnConfigValidate(t *testing.T) {
+	valid := DefaultTurnConfig()
+	valid.Enabled = true
+	valid.PublicIP = "198.51.100.7"
+	valid.Secret = "secret"
+
+	tests := []struct {
+		name   string
+		modify func(cfg *TurnConfig)
+		valid  bool
+	}{
+		{name: "valid", modify: func(cfg *TurnConfig) {}, valid: true},
+		{name: "disabled", modify: func(cfg *TurnConfig) { *cfg = DefaultTurnConfig() }, valid: true},
+		{name: "tcp only", modify: func(cfg *TurnConfig) { cfg.UDPListen = "" }, valid: true},
+		{name: "allowed peer networks", modify: func(cfg *TurnConfig) { cfg.AllowedPeerNetworks = []string{"10.0.0.0/8"} }, valid: true},
+		{name: "missing public ip", modify: func(cfg *TurnConfig) { cfg.PublicIP = "" }},
+		{name: "invalid relay address", modify: func(cfg *TurnConfig) { cfg.RelayAddress = "relay" }},
+		{name: "no listener", modify: func(cfg *TurnConfig) { cfg.UDPListen, cfg.TCPListen = "", "" }},
+		{name: "invalid listener", modify: func(cfg *TurnConfig) { cfg.UDPListen = "3478" }},
+		{name: "empty port range", modify: func(cfg *TurnConfig) { cfg.RelayPortMin, cfg.RelayPortMax = 50000, 49999 }},
+		{name: "zero port", modify: func(cfg *TurnConfig) { cfg.RelayPortMin = 0 }},
+		{name: "missing secret", modify: func(cfg *TurnConfig) { cfg.Secret = "" }},
+		{name: "zero ttl", modify: func(cfg *TurnConfig) { cfg.CredentialTTL = Duration{} }},
+		{name: "negative quota", modify: func(cfg *TurnConfig) { cfg.MaxAllocationsPerUser = -1 }},
+		{name: "invalid peer network", modify: func(cfg *TurnConfig) { cfg.AllowedPeerNetworks = []string{"10.0.0.0"} }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := valid
+			test.modify(&cfg)
+			if err := cfg.Validate(); (err == nil) != test.valid {
+				t.Errorf("validated with %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"net"
 	"net/http"
 	"slices"
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -19,8 +22,30 @@ type User struct {
 	Conn *websocket.Conn `json:"-"`
 	Room *Room           `json:"-"`
 
+	LobbyRoom *Room `json:"-"`
+
+	// remoteIP is the address the user connected from, bans apply to it.
+	remoteIP string
+
+	// lobbyInvite is the invite used to wait in the lobby, refunded when
+	// the user leaves it without being admitted.
+	lobbyInvite *RoomInvite
+
+	// Synthetic users are driven by the server, like file publishers, and
+	// have no websocket connection.
+	Synthetic bool `json:"synthetic,omitempty"`
+
 	IceCandidates      []webrtc.ICECandidateInit `json:"-"`
 	iceCandidatesMutex *sync.Mutex
+
+	subscriptions      map[string]*OutgoingStream
+	subscriptionsMutex *sync.Mutex
+
+	connMutex *sync.Mutex
+
+	// pendingWrites counts the messages waiting on connMutex or being
+	// written, it is the depth of the websocket queue.
+	pendingWrites *atomic.Int32
 }
 
 var (
@@ -35,12 +60,24 @@ func NewUser(conn *websocket.Conn) *User {
 		Room:               nil,
 		IceCandidates:      make([]webrtc.ICECandidateInit, 0),
 		iceCandidatesMutex: new(sync.Mutex),
+		subscriptions:      make(map[string]*OutgoingStream),
+		subscriptionsMutex: new(sync.Mutex),
+		connMutex:          new(sync.Mutex),
+		pendingWrites:      new(atomic.Int32),
 	}
 
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		user.remoteIP = host
+	}
+
+	user.Conn.SetReadLimit(userReadLimit())
+	user.SendMessageJson(NewMessageServerHello(user))
+
 	go func() {
 		for {
 			_, data, err := user.Conn.ReadMessage()
 			if err != nil {
+				user.LeaveLobby()
 				if user.Room != nil {
 					if err := user.LeaveCurrentRoom("user disconnected"); err != nil {
 						logger.Warn(fmt.Sprintf("user %s failed leaving is current room during disconnection, %s", user.Id, err.Error()))
@@ -58,9 +95,65 @@ func NewUser(conn *websocket.Conn) *User {
 	return user
 }
 
+// userReadLimit bounds the frames read from the users to the largest message
+// they may send, a chat message of the configured max size or a session
+// description, doubled for the json escaping and envelope. Frames aren't
+// bounded when chat messages aren't.
+func userReadLimit() int64 {
+	maxSize := GetConfig().Room.MaxMessageSize
+	if maxSize == 0 {
+		return 0
+	}
+	return 2 * int64(max(maxSize, maxSdpSize))
+}
+
+// NewSyntheticUser returns a user without connection, messages sent to it are
+// dropped and it isn't listed in the users list.
+func NewSyntheticUser() *User {
+	return &User{
+		Id:                 uuid.NewString(),
+		Synthetic:          true,
+		IceCandidates:      make([]webrtc.ICECandidateInit, 0),
+		iceCandidatesMutex: new(sync.Mutex),
+		subscriptions:      make(map[string]*OutgoingStream),
+		subscriptionsMutex: new(sync.Mutex),
+		connMutex:          new(sync.Mutex),
+		pendingWrites:      new(atomic.Int32),
+	}
+}
+
+// JoinSyntheticUser adds a synthetic user to the room with the given role,
+// the role is dropped again by LeaveSyntheticUser.
+func JoinSyntheticUser(room *Room, role Role) (*User, error) {
+	user := NewSyntheticUser()
+
+	room.rolesMutex.Lock()
+	room.roles[user.Id] = role
+	room.rolesMutex.Unlock()
+
+	if err := user.JoinRoom(room); err != nil {
+		LeaveSyntheticUser(room, user, "")
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func LeaveSyntheticUser(room *Room, user *User, cause string) {
+	if user.Room != nil {
+		if err := user.LeaveCurrentRoom(cause); err != nil {
+			logger.Warn(fmt.Sprintf("synthetic user %s failed leaving room, %s", user.Id, err.Error()))
+		}
+	}
+
+	room.rolesMutex.Lock()
+	delete(room.roles, user.Id)
+	room.rolesMutex.Unlock()
+}
+
 func (user *User) SendMessage(msg string) {
 	buffer := bytes.NewBufferString(msg)
-	if err := user.Conn.WriteMessage(websocket.TextMessage, buffer.Bytes()); err != nil {
+	if err := user.writeMessage(buffer.Bytes()); err != nil {
 		logger.Warn(fmt.Sprintf("failed sending message to user %s, %s", user.Id, err.Error()))
 	}
 }
@@ -71,12 +164,30 @@ func (user *User) SendMessageJson(msg any) {
 		logger.Warn(fmt.Sprintf("failed sending json message, %s", err.Error()))
 		return
 	}
-	if err := user.Conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+	if err := user.writeMessage(payload); err != nil {
 		logger.Warn(fmt.Sprintf("failed sending json message to user %s, %s", user.Id, err.Error()))
 	}
 }
 
+// writeMessage serializes writes, the websocket connection supports only one
+// concurrent writer.
+func (user *User) writeMessage(payload []byte) error {
+	if user.Conn == nil {
+		return nil
+	}
+
+	user.pendingWrites.Add(1)
+	defer user.pendingWrites.Add(-1)
+
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+
+	return user.Conn.WriteMessage(websocket.TextMessage, payload)
+}
+
 func (user *User) JoinRoom(room *Room) error {
+	user.LeaveLobby()
+
 	if user.Room != nil {
 		if err := user.LeaveCurrentRoom("leave current room, because joining another one"); err != nil {
 			return err
@@ -87,11 +198,18 @@ func (user *User) JoinRoom(room *Room) error {
 		return fmt.Errorf("failed adding user to room, %w", err)
 	}
 
-	user.SendMessageJson(NewReplyRoomJoined(room))
+	user.SendMessageJson(NewReplyRoomJoined(room, room.RoleOf(user)))
 	logger.Info(fmt.Sprintf("user %s join the room %s", user.Id, room.Id))
 
 	user.Room = room
 
+	if room.RoleOf(user).CanModerate() {
+		room.sendLobbyRequests(user)
+	}
+	for _, recording := range room.GetRecordings() {
+		user.SendMessageJson(NewMessageRecordingState(recording, ""))
+	}
+
 	return nil
 }
 
@@ -104,6 +222,10 @@ func (user *User) LeaveCurrentRoom(cause string) error {
 		return fmt.Errorf("failed removing user from room, %w", err)
 	}
 
+	for _, subscription := range user.GetSubscriptions() {
+		subscription.Close("you left the room")
+	}
+
 	user.SendMessageJson(NewReplyRoomLeaved(user.Room, cause))
 	logger.Info(fmt.Sprintf("user %s leave the room %s, reason: %s", user.Id, user.Room.Id, cause))
 
@@ -135,6 +257,32 @@ func (user *User) GetIceCandidates() []webrtc.ICECandidateInit {
 	return user.IceCandidates
 }
 
+func (user *User) GetSubscription(id string) *OutgoingStream {
+	user.subscriptionsMutex.Lock()
+	defer user.subscriptionsMutex.Unlock()
+
+	return user.subscriptions[id]
+}
+
+func (user *User) GetSubscriptions() []*OutgoingStream {
+	user.subscriptionsMutex.Lock()
+	defer user.subscriptionsMutex.Unlock()
+
+	return slices.Collect(maps.Values(user.subscriptions))
+}
+
+func (user *User) addSubscription(subscription *OutgoingStream) {
+	user.subscriptionsMutex.Lock()
+	user.subscriptions[subscription.Id] = subscription
+	user.subscriptionsMutex.Unlock()
+}
+
+func (user *User) removeSubscription(subscription *OutgoingStream) {
+	user.subscriptionsMutex.Lock()
+	delete(user.subscriptions, subscription.Id)
+	user.subscriptionsMutex.Unlock()
+}
+
 func (user *User) String() string {
 	return fmt.Sprintf("Id: %s", user.Id)
 }
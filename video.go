@@ -9,7 +9,7 @@ func addVideoCodecAV1(mediaEngine *webrtc.MediaEngine) error {
 			ClockRate:    90000,
 			Channels:     0,
 			SDPFmtpLine:  "",
-			RTCPFeedback: []webrtc.RTCPFeedback{{"goog-remb", ""}, {"ccm", "fir"}, {"nack", ""}, {"nack", "pli"}},
+			RTCPFeedback: []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}},
 		},
 		PayloadType: 45,
 	}, webrtc.RTPCodecTypeVideo)
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Matroska element ids used by the webm writer.
+const (
+	ebmlIdHeader             = 0x1A45DFA3
+	ebmlIdVersion            = 0x4286
+	ebmlIdReadVersion        = 0x42F7
+	ebmlIdMaxIdLength        = 0x42F2
+	ebmlIdMaxSizeLength      = 0x42F3
+	ebmlIdDocType            = 0x4282
+	ebmlIdDocTypeVersion     = 0x4287
+	ebmlIdDocTypeReadVersion = 0x4285
+	ebmlIdSegment            = 0x18538067
+	ebmlIdInfo               = 0x1549A966
+	ebmlIdTimecodeScale      = 0x2AD7B1
+	ebmlIdMuxingApp          = 0x4D80
+	ebmlIdWritingApp         = 0x5741
+	ebmlIdTracks             = 0x1654AE6B
+	ebmlIdTrackEntry         = 0xAE
+	ebmlIdTrackNumber        = 0xD7
+	ebmlIdTrackUid           = 0x73C5
+	ebmlIdTrackType          = 0x83
+	ebmlIdCodecId            = 0x86
+	ebmlIdCodecPrivate       = 0x63A2
+	ebmlIdVideo              = 0xE0
+	ebmlIdPixelWidth         = 0xB0
+	ebmlIdPixelHeight        = 0xBA
+	ebmlIdAudio              = 0xE1
+	ebmlIdSamplingFrequency  = 0xB5
+	ebmlIdChannels           = 0x9F
+	ebmlIdCluster            = 0x1F43B675
+	ebmlIdTimecode           = 0xE7
+	ebmlIdSimpleBlock        = 0xA3
+)
+
+// ebmlUnknownSize lets the segment and clusters be written without seeking
+// back, like live webm produced by browsers.
+var ebmlUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+type webmTrack struct {
+	Number   uint64
+	Video    bool
+	CodecId  string
+	Channels uint16
+	Width    uint16
+	Height   uint16
+}
+
+type webmWriter struct {
+	out    io.WriteCloser
+	tracks []*webmTrack
+
+	headerWritten   bool
+	clusterOpen     bool
+	clusterTimecode int64
+	mutex           *sync.Mutex
+}
+
+func newWebmWriter(path string, tracks []*webmTrack) (*webmWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webmWriter{
+		out:    file,
+		tracks: tracks,
+		mutex:  new(sync.Mutex),
+	}, nil
+}
+
+func webmCodecId(mimeType string) (string, bool) {
+	switch strings.ToLower(mimeType) {
+	case "video/vp8":
+		return "V_VP8", true
+	case "video/vp9":
+		return "V_VP9", true
+	case "video/av1":
+		return "V_AV1", true
+	case "audio/opus":
+		return "A_OPUS", true
+	default:
+		return "", false
+	}
+}
+
+func (w *webmWriter) hasVideo() bool {
+	for _, track := range w.tracks {
+		if track.Video {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteFrame appends a frame at timecode milliseconds from the start of the
+// recording. Nothing is written until the first video keyframe, so the file
+// starts decodable.
+func (w *webmWriter) WriteFrame(track *webmTrack, timecode int64, keyframe bool, frame []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.headerWritten {
+		if w.hasVideo() && (!track.Video || !keyframe) {
+			return nil
+		}
+		if track.CodecId == "V_VP8" {
+			track.Width, track.Height = vp8FrameSize(frame)
+		}
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	relative := timecode - w.clusterTimecode
+	if !w.clusterOpen || relative > math.MaxInt16 || relative < math.MinInt16 || (track.Video && keyframe && relative > 1000) {
+		cluster := append(ebmlId(ebmlIdCluster), ebmlUnknownSize...)
+		cluster = append(cluster, ebmlUint(ebmlIdTimecode, uint64(max(timecode, 0)))...)
+		if _, err := w.out.Write(cluster); err != nil {
+			return err
+		}
+		w.clusterOpen = true
+		w.clusterTimecode = max(timecode, 0)
+		relative = timecode - w.clusterTimecode
+	}
+
+	block := make([]byte, 0, len(frame)+4)
+	block = append(block, ebmlVint(track.Number)...)
+	block = binary.BigEndian.AppendUint16(block, uint16(int16(relative)))
+	flags := byte(0)
+	if keyframe {
+		flags |= 0x80
+	}
+	block = append(block, flags)
+	block = append(block, frame...)
+
+	_, err := w.out.Write(ebmlElement(ebmlIdSimpleBlock, block))
+	return err
+}
+
+func (w *webmWriter) Close() error {
+	return w.out.Close()
+}
+
+func (w *webmWriter) writeHeader() error {
+	header := ebmlElement(ebmlIdHeader, concatBytes(
+		ebmlUint(ebmlIdVersion, 1),
+		ebmlUint(ebmlIdReadVersion, 1),
+		ebmlUint(ebmlIdMaxIdLength, 4),
+		ebmlUint(ebmlIdMaxSizeLength, 8),
+		ebmlString(ebmlIdDocType, "webm"),
+		ebmlUint(ebmlIdDocTypeVersion, 4),
+		ebmlUint(ebmlIdDocTypeReadVersion, 2),
+	))
+
+	segment := append(ebmlId(ebmlIdSegment), ebmlUnknownSize...)
+
+	info := ebmlElement(ebmlIdInfo, concatBytes(
+		ebmlUint(ebmlIdTimecodeScale, 1000000),
+		ebmlString(ebmlIdMuxingApp, "splashrtc"),
+		ebmlString(ebmlIdWritingApp, "splashrtc"),
+	))
+
+	entries := make([][]byte, 0, len(w.tracks))
+	for _, track := range w.tracks {
+		entries = append(entries, track.entry())
+	}
+	tracks := ebmlElement(ebmlIdTracks, concatBytes(entries...))
+
+	if _, err := w.out.Write(concatBytes(header, segment, info, tracks)); err != nil {
+		return err
+	}
+	w.headerWritten = true
+
+	return nil
+}
+
+func (track *webmTrack) entry() []byte {
+	fields := [][]byte{
+		ebmlUint(ebmlIdTrackNumber, track.Number),
+		ebmlUint(ebmlIdTrackUid, track.Number),
+		ebmlString(ebmlIdCodecId, track.CodecId),
+	}
+
+	if track.Video {
+		width, height := track.Width, track.Height
+		if width == 0 || height == 0 {
+			// Unknown until the bitstream is parsed, decoders rely on the
+			// frame headers anyway.
+			width, height = 640, 480
+		}
+		fields = append(fields,
+			ebmlUint(ebmlIdTrackType, 1),
+			ebmlElement(ebmlIdVideo, concatBytes(
+				ebmlUint(ebmlIdPixelWidth, uint64(width)),
+				ebmlUint(ebmlIdPixelHeight, uint64(height)),
+			)),
+		)
+	} else {
+		fields = append(fields,
+			ebmlUint(ebmlIdTrackType, 2),
+			ebmlElement(ebmlIdCodecPrivate, opusHead(track.Channels)),
+			ebmlElement(ebmlIdAudio, concatBytes(
+				ebmlFloat(ebmlIdSamplingFrequency, 48000),
+				ebmlUint(ebmlIdChannels, uint64(track.Channels)),
+			)),
+		)
+	}
+
+	return ebmlElement(ebmlIdTrackEntry, concatBytes(fields...))
+}
+
+func opusHead(channels uint16) []byte {
+	head := []byte("OpusHead")
+	head = append(head, 1, byte(channels))
+	head = binary.LittleEndian.AppendUint16(head, 0)
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	head = binary.LittleEndian.AppendUint16(head, 0)
+	return append(head, 0)
+}
+
+// vp8FrameSize reads the dimensions of a vp8 keyframe, see RFC 6386 9.1.
+func vp8FrameSize(frame []byte) (uint16, uint16) {
+	if len(frame) < 10 || frame[0]&0x01 != 0 || frame[3] != 0x9D || frame[4] != 0x01 || frame[5] != 0x2A {
+		return 0, 0
+	}
+	width := binary.LittleEndian.Uint16(frame[6:8]) & 0x3FFF
+	height := binary.LittleEndian.Uint16(frame[8:10]) & 0x3FFF
+	return width, height
+}
+
+func ebmlId(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return binary.BigEndian.AppendUint32(nil, id)
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+func ebmlVint(value uint64) []byte {
+	length := 1
+	for length < 8 && value >= (1<<(7*length))-1 {
+		length++
+	}
+
+	encoded := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		encoded[i] = byte(value)
+		value >>= 8
+	}
+	encoded[0] |= 0x80 >> (length - 1)
+	return encoded
+}
+
+func ebmlElement(id uint32, data []byte) []byte {
+	return concatBytes(ebmlId(id), ebmlVint(uint64(len(data))), data)
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	data := binary.BigEndian.AppendUint64(nil, value)
+	for len(data) > 1 && data[0] == 0 {
+		data = data[1:]
+	}
+	return ebmlElement(id, data)
+}
+
+func ebmlFloat(id uint32, value float64) []byte {
+	return ebmlElement(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(value)))
+}
+
+func ebmlString(id uint32, value string) []byte {
+	return ebmlElement(id, []byte(value))
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	size := 0
+	for _, part := range parts {
+		size += len(part)
+	}
+
+	buffer := make([]byte, 0, size)
+	for _, part := range parts {
+		buffer = append(buffer, part...)
+	}
+	return buffer
+}
+
+var errWebmUnsupportedCodec = errors.New("codec can't be stored in webm")
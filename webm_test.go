@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestEbmlVint(t *testing.T) {
+	tests := []struct {
+		value   uint64
+		encoded []byte
+	}{
+		{value: 0, encoded: []byte{0x80}},
+		{value: 126, encoded: []byte{0xfe}},
+		// All ones is reserved for unknown sizes.
+		{value: 127, encoded: []byte{0x40, 0x7f}},
+		{value: 16382, encoded: []byte{0x7f, 0xfe}},
+		{value: 16383, encoded: []byte{0x20, 0x3f, 0xff}},
+		{value: 1 << 40, encoded: []byte{0x05, 0, 0, 0, 0, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.value), func(t *testing.T) {
+			if encoded := ebmlVint(test.value); !bytes.Equal(encoded, test.encoded) {
+				t.Errorf("encoded %x, want %x", encoded, test.encoded)
+			}
+		})
+	}
+}
+
+func TestEbmlElements(t *testing.T) {
+	tests := []struct {
+		name    string
+		element []byte
+		encoded []byte
+	}{
+		{name: "one byte id", element: ebmlUint(ebmlIdTrackNumber, 1), encoded: []byte{0xd7, 0x81, 0x01}},
+		{name: "two byte id", element: ebmlString(ebmlIdDocType, "webm"), encoded: []byte{0x42, 0x82, 0x84, 'w', 'e', 'b', 'm'}},
+		{name: "three byte id", element: ebmlUint(ebmlIdTimecodeScale, 1000000), encoded: []byte{0x2a, 0xd7, 0xb1, 0x83, 0x0f, 0x42, 0x40}},
+		{name: "four byte id", element: ebmlElement(ebmlIdTracks, nil), encoded: []byte{0x16, 0x54, 0xae, 0x6b, 0x80}},
+		{name: "zero", element: ebmlUint(ebmlIdTimecode, 0), encoded: []byte{0xe7, 0x81, 0x00}},
+		{name: "float", element: ebmlFloat(ebmlIdSamplingFrequency, 48000), encoded: []byte{0xb5, 0x88, 0x40, 0xe7, 0x70, 0, 0, 0, 0, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if !bytes.Equal(test.element, test.encoded) {
+				t.Errorf("encoded %x, want %x", test.element, test.encoded)
+			}
+		})
+	}
+}
+
+func TestWebmCodecId(t *testing.T) {
+	tests := []struct {
+		mimeType  string
+		codecId   string
+		supported bool
+	}{
+		{mimeType: "video/VP8", codecId: "V_VP8", supported: true},
+		{mimeType: "video/vp9", codecId: "V_VP9", supported: true},
+		{mimeType: "video/AV1", codecId: "V_AV1", supported: true},
+		{mimeType: "audio/opus", codecId: "A_OPUS", supported: true},
+		{mimeType: "video/H264"},
+		{mimeType: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mimeType, func(t *testing.T) {
+			codecId, supported := webmCodecId(test.mimeType)
+			if codecId != test.codecId || supported != test.supported {
+				t.Errorf("codec %q %t, want %q %t", codecId, supported, test.codecId, test.supported)
+			}
+		})
+	}
+}
+
+func TestVp8FrameSize(t *testing.T) {
+	keyframe := []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01}
+	withScale := slices.Clone(keyframe)
+	withScale[7] |= 0x40
+
+	tests := []struct {
+		name   string
+		frame  []byte
+		width  uint16
+		height uint16
+	}{
+		{name: "keyframe", frame: keyframe, width: 640, height: 480},
+		{name: "scaling bits ignored", frame: withScale, width: 640, height: 480},
+		{name: "interframe", frame: append([]byte{0x11}, keyframe[1:]...)},
+		{name: "truncated", frame: keyframe[:9]},
+		{name: "invalid start code", frame: append(slices.Clone(keyframe[:3]), 0x9d, 0x01, 0x2b, 0x80, 0x02, 0xe0, 0x01)},
+		{name: "empty", frame: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height := vp8FrameSize(test.frame)
+			if width != test.width || height != test.height {
+				t.Errorf("read %dx%d, want %dx%d", width, height, test.width, test.height)
+			}
+		})
+	}
+}
+
+type webmTestOutput struct {
+	bytes.Buffer
+}
+
+func (o *webmTestOutput) Close() error {
+	return nil
+}
+
+// webmTestElement reads the id and size of the element at the start of data,
+// size is -1 when unknown.
+func webmTestElement(data []byte) (uint32, int, int, error) {
+	if len(data) == 0 {
+		return 0, 0, 0, fmt.Errorf("truncated element")
+	}
+	idLength := 1
+	for idLength <= 4 && data[0]&(0x80>>(idLength-1)) == 0 {
+		idLength++
+	}
+	if idLength > 4 || len(data) < idLength+1 {
+		return 0, 0, 0, fmt.Errorf("invalid element id")
+	}
+	id := uint32(0)
+	for _, b := range data[:idLength] {
+		id = id<<8 | uint32(b)
+	}
+
+	sizeLength := 1
+	for sizeLength <= 8 && data[idLength]&(0x80>>(sizeLength-1)) == 0 {
+		sizeLength++
+	}
+	if sizeLength > 8 || len(data) < idLength+sizeLength {
+		return 0, 0, 0, fmt.Errorf("invalid element size")
+	}
+	raw := data[idLength : idLength+sizeLength]
+	size := uint64(raw[0] & (0xff >> sizeLength))
+	unknown := size == uint64(0xff>>sizeLength)
+	for _, b := range raw[1:] {
+		size = size<<8 | uint64(b)
+		unknown = unknown && b == 0xff
+	}
+	if unknown {
+		return id, idLength + sizeLength, -1, nil
+	}
+	if uint64(len(data)-idLength-sizeLength) < size {
+		return 0, 0, 0, fmt.Errorf("element %x of %d bytes is truncated", id, size)
+	}
+	return id, idLength + sizeLength, int(size), nil
+}
+
+type webmTestBlock struct {
+	cluster  uint64
+	track    uint64
+	relative int16
+	keyframe bool
+}
+
+// webmTestBlocks walks the top level elements, entering the segment and the
+// clusters, whose sizes are unknown.
+func webmTestBlocks(data []byte) ([]uint32, []webmTestBlock, error) {
+	ids := make([]uint32, 0)
+	blocks := make([]webmTestBlock, 0)
+	cluster := uint64(0)
+	for len(data) > 0 {
+		id, header, size, err := webmTestElement(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		if size < 0 {
+			data = data[header:]
+			continue
+		}
+
+		payload := data[header : header+size]
+		switch id {
+		case ebmlIdTimecode:
+			cluster = 0
+			for _, b := range payload {
+				cluster = cluster<<8 | uint64(b)
+			}
+		case ebmlIdSimpleBlock:
+			if len(payload) < 4 || payload[0]&0x80 == 0 {
+				return nil, nil, fmt.Errorf("invalid block")
+			}
+			blocks = append(blocks, webmTestBlock{
+				cluster:  cluster,
+				track:    uint64(payload[0] & 0x7f),
+				relative: int16(binary.BigEndian.Uint16(payload[1:3])),
+				keyframe: payload[3]&0x80 != 0,
+			})
+		}
+		data = data[header+size:]
+	}
+	return ids, blocks, nil
+}
+
+func TestWebmWriter(t *testing.T) {
+	type frame struct {
+		track    int
+		timecode int64
+		keyframe bool
+	}
+
+	tests := []struct {
+		name   string
+		frames []frame
+		blocks []webmTestBlock
+	}{
+		{
+			name:   "waits for a video keyframe",
+			frames: []frame{{1, 0, true}, {0, 10, false}, {0, 20, true}, {1, 30, true}, {0, 40, false}},
+			blocks: []webmTestBlock{{20, 1, 0, true}, {20, 2, 10, true}, {20, 1, 20, false}},
+		},
+		{
+			name:   "new cluster on a keyframe after a second",
+			frames: []frame{{0, 0, true}, {0, 900, true}, {0, 1500, false}, {0, 2100, true}},
+			blocks: []webmTestBlock{{0, 1, 0, true}, {0, 1, 900, true}, {0, 1, 1500, false}, {2100, 1, 0, true}},
+		},
+		{
+			name:   "new cluster past the relative timecode range",
+			frames: []frame{{0, 0, true}, {1, 40000, true}},
+			blocks: []webmTestBlock{{0, 1, 0, true}, {40000, 2, 0, true}},
+		},
+		{
+			name:   "late frame before the cluster",
+			frames: []frame{{0, 100, true}, {1, 60, true}},
+			blocks: []webmTestBlock{{100, 1, 0, true}, {100, 2, -40, true}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracks := []*webmTrack{
+				{Number: 1, Video: true, CodecId: "V_VP8"},
+				{Number: 2, CodecId: "A_OPUS", Channels: 2},
+			}
+			output := new(webmTestOutput)
+			writer := &webmWriter{out: output, tracks: tracks, mutex: new(sync.Mutex)}
+			for _, f := range test.frames {
+				if err := writer.WriteFrame(tracks[f.track], f.timecode, f.keyframe, []byte{0x10, 0x02, 0x00}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ids, blocks, err := webmTestBlocks(output.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) < 4 || !slices.Equal(ids[:4], []uint32{ebmlIdHeader, ebmlIdSegment, ebmlIdInfo, ebmlIdTracks}) {
+				t.Fatalf("elements %x", ids)
+			}
+			if !slices.Equal(blocks, test.blocks) {
+				t.Errorf("blocks %v, want %v", blocks, test.blocks)
+			}
+		})
+	}
+}
+
+func TestWebmWriterAudioOnly(t *testing.T) {
+	track := &webmTrack{Number: 1, CodecId: "A_OPUS", Channels: 1}
+	output := new(webmTestOutput)
+	writer := &webmWriter{out: output, tracks: []*webmTrack{track}, mutex: new(sync.Mutex)}
+	if err := writer.WriteFrame(track, 0, true, []byte{0x48}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, blocks, err := webmTestBlocks(output.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 {
+		t.Errorf("%d blocks, want 1", len(blocks))
+	}
+	if !bytes.Contains(output.Bytes(), opusHead(1)) {
+		t.Error("missing the opus head of the track")
+	}
+}
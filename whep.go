@@ -0,0 +1,462 @@
+package main
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// WhepViewer plays the streams of a room, or a single stream, over WHEP. The
+// client offer fixes the number of audio and video slots, the tracks of the
+// room are swapped into free slots as streams come and go.
+type WhepViewer struct {
+	Id       string    `json:"id"`
+	RoomId   string    `json:"room_id"`
+	StreamId string    `json:"stream_id,omitempty"`
+	Started  time.Time `json:"started_at"`
+
+	PeerConnection *webrtc.PeerConnection `json:"-"`
+
+	room   *Room
+	token  string
+	slots  []*whepSlot
+	closed bool
+	mutex  *sync.Mutex
+	once   *sync.Once
+}
+
+// whepSlot is a sender of the viewer, it sends a placeholder track that is
+// never written to while no track of the room is assigned to it.
+type whepSlot struct {
+	sender      *webrtc.RTPSender
+	kind        webrtc.RTPCodecType
+	placeholder *webrtc.TrackLocalStaticRTP
+
+	stream *IncomingStream
+	track  *StreamTrack
+}
+
+var ErrWhepViewerNotFound = errors.New("the whep viewer does not exist")
+
+func RegisterWhepHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("POST /whep/rooms/{id}", httpHandleWhepPlay)
+	mux.HandleFunc("POST /whep/rooms/{id}/streams/{stream}", httpHandleWhepPlay)
+	mux.HandleFunc("PATCH /whep/sessions/{id}", httpHandleWhepPatch)
+	mux.HandleFunc("DELETE /whep/sessions/{id}", httpHandleWhepDelete)
+}
+
+func StartWhepViewer(room *Room, streamId string, token string, offer string) (*WhepViewer, *webrtc.SessionDescription, error) {
+	if streamId != "" && room.GetInStream(streamId) == nil {
+		return nil, nil, ErrStreamNotInRoom
+	}
+
+	viewer := &WhepViewer{
+		Id:       uuid.NewString(),
+		RoomId:   room.Id,
+		StreamId: streamId,
+		Started:  time.Now(),
+
+		room:  room,
+		token: token,
+		slots: make([]*whepSlot, 0),
+		mutex: new(sync.Mutex),
+		once:  new(sync.Once),
+	}
+
+	pc, err := newCapturedPeerConnection(room, PeerConnectionConfiguration(viewer.Id), func(capture *Capture) bool {
+		return capture.matchesViewer(viewer)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	viewer.PeerConnection = pc
+	watchTransportFailures(pc, "whep_viewer")
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		logger.Debug(fmt.Sprintf("peer state of whep viewer %s changed to %s", viewer.Id, state.String()))
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			viewer.refresh()
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			go viewer.Close(fmt.Sprintf("the peer connection is %s", state.String()))
+		}
+	})
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		pc.Close()
+		return nil, nil, err
+	}
+	if err := viewer.addSlots(); err != nil {
+		pc.Close()
+		return nil, nil, err
+	}
+
+	answer, err := createAnswer(pc)
+	if err != nil {
+		pc.Close()
+		return nil, nil, err
+	}
+
+	if !room.addViewer(viewer) {
+		pc.Close()
+		return nil, nil, errors.New("the room has been destroyed")
+	}
+
+	logger.Info(fmt.Sprintf("whep viewer %s started in room %s", viewer.Id, room.Id))
+
+	return viewer, answer, nil
+}
+
+// addSlots binds a placeholder track to every media of the offer, using the
+// first codec the client accepts for it.
+func (v *WhepViewer) addSlots() error {
+	for i, transceiver := range v.PeerConnection.GetTransceivers() {
+		if transceiver.Sender() != nil {
+			continue
+		}
+
+		codecs := transceiver.Receiver().GetParameters().Codecs
+		idx := slices.IndexFunc(codecs, func(codec webrtc.RTPCodecParameters) bool {
+			return !strings.EqualFold(codec.MimeType, webrtc.MimeTypeRTX)
+		})
+		if idx == -1 {
+			continue
+		}
+
+		placeholder, err := webrtc.NewTrackLocalStaticRTP(codecs[idx].RTPCodecCapability, fmt.Sprintf("slot-%d", i), v.Id)
+		if err != nil {
+			return err
+		}
+		sender, err := v.PeerConnection.AddTrack(placeholder)
+		if err != nil {
+			return err
+		}
+
+		slot := &whepSlot{
+			sender:      sender,
+			kind:        transceiver.Kind(),
+			placeholder: placeholder,
+		}
+		v.slots = append(v.slots, slot)
+		go v.handleRTCP(slot)
+	}
+
+	if len(v.slots) == 0 {
+		return errors.New("the offer has no media to receive")
+	}
+	return nil
+}
+
+// refresh releases the slots of unpublished streams and assigns free slots,
+// tracks of streams already played are preferred.
+func (v *WhepViewer) refresh() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.closed || v.PeerConnection.ConnectionState() != webrtc.PeerConnectionStateConnected {
+		return
+	}
+
+	if v.StreamId != "" && v.room.GetInStream(v.StreamId) == nil {
+		go v.Close("the stream has been unpublished")
+		return
+	}
+
+	assigned := make(map[*StreamTrack]bool)
+	playing := make(map[*IncomingStream]bool)
+	for _, slot := range v.slots {
+		if slot.track == nil {
+			continue
+		}
+		if v.room.GetInStream(slot.stream.Id) != slot.stream {
+			v.release(slot)
+			continue
+		}
+		assigned[slot.track] = true
+		playing[slot.stream] = true
+	}
+
+	streams := v.room.GetInStreams()
+	if v.StreamId != "" {
+		streams = slices.DeleteFunc(streams, func(stream *IncomingStream) bool {
+			return stream.Id != v.StreamId
+		})
+	}
+	slices.SortFunc(streams, func(a, b *IncomingStream) int {
+		if playing[a] != playing[b] {
+			if playing[a] {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.Id, b.Id)
+	})
+
+	for _, slot := range v.slots {
+		if slot.track != nil {
+			continue
+		}
+	search:
+		for _, stream := range streams {
+			for _, track := range stream.GetTracks() {
+				if assigned[track] || track.Kind != slot.kind.String() {
+					continue
+				}
+				if err := slot.sender.ReplaceTrack(track.Local); err != nil {
+					logger.Debug(fmt.Sprintf("whep viewer %s can't play track %s, %s", v.Id, track.Id, err.Error()))
+					continue
+				}
+				slot.stream, slot.track = stream, track
+				assigned[track] = true
+				if slot.kind == webrtc.RTPCodecTypeVideo {
+					stream.RequestKeyframe()
+				}
+				break search
+			}
+		}
+	}
+}
+
+func (v *WhepViewer) release(slot *whepSlot) {
+	if err := slot.sender.ReplaceTrack(slot.placeholder); err != nil {
+		logger.Debug(fmt.Sprintf("whep viewer %s failed releasing track %s, %s", v.Id, slot.track.Id, err.Error()))
+	}
+	slot.stream, slot.track = nil, nil
+}
+
+func (v *WhepViewer) Close(cause string) {
+	v.once.Do(func() {
+		v.mutex.Lock()
+		v.closed = true
+		v.mutex.Unlock()
+
+		v.room.removeViewer(v)
+		if err := v.PeerConnection.Close(); err != nil {
+			logger.Warn(fmt.Sprintf("failed closing whep viewer %s, %s", v.Id, err.Error()))
+		}
+
+		logger.Info(fmt.Sprintf("whep viewer %s closed, %s", v.Id, cause))
+	})
+}
+
+func (v *WhepViewer) Patch(fragment string) (string, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	return patchPeerConnection(v.PeerConnection, fragment)
+}
+
+func (v *WhepViewer) ETag() string {
+	return sessionETag(v.PeerConnection)
+}
+
+// checkToken matches the token the session was started with, sessions
+// started without token can't be patched or deleted.
+func (v *WhepViewer) checkToken(token string) bool {
+	return v.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(v.token)) == 1
+}
+
+// handleRTCP forwards the keyframe requests of the viewer to the stream
+// currently played in the slot.
+func (v *WhepViewer) handleRTCP(slot *whepSlot) {
+	feedback := newReceiverFeedback(slot.sender, slot.kind.String(), slot.placeholder.Codec().ClockRate)
+	buffer := make([]byte, 1500)
+	for {
+		n, _, err := slot.sender.Read(buffer)
+		if err != nil {
+			return
+		}
+
+		captureViewerPacket(v, buffer[:n], true)
+
+		packets, err := rtcp.Unmarshal(buffer[:n])
+		if err != nil {
+			continue
+		}
+		feedback.observe(packets)
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				v.mutex.Lock()
+				stream := slot.stream
+				v.mutex.Unlock()
+
+				if stream != nil {
+					stream.RequestKeyframe()
+				}
+			}
+		}
+	}
+}
+
+func (room *Room) addViewer(viewer *WhepViewer) bool {
+	room.expiryMutex.Lock()
+	destroyed := room.destroyed
+	room.expiryMutex.Unlock()
+	if destroyed {
+		return false
+	}
+
+	room.viewersMutex.Lock()
+	room.viewers[viewer.Id] = viewer
+	room.viewersMutex.Unlock()
+
+	return true
+}
+
+func (room *Room) removeViewer(viewer *WhepViewer) {
+	room.viewersMutex.Lock()
+	delete(room.viewers, viewer.Id)
+	room.viewersMutex.Unlock()
+}
+
+func (room *Room) GetViewers() []*WhepViewer {
+	room.viewersMutex.Lock()
+	defer room.viewersMutex.Unlock()
+
+	return slices.Collect(maps.Values(room.viewers))
+}
+
+// ViewersCount counts the whep viewers, they aren't room participants.
+func (room *Room) ViewersCount() int {
+	room.viewersMutex.Lock()
+	defer room.viewersMutex.Unlock()
+
+	return len(room.viewers)
+}
+
+func (room *Room) refreshViewers() {
+	for _, viewer := range room.GetViewers() {
+		viewer.refresh()
+	}
+}
+
+func (room *Room) closeViewers(cause string) {
+	for _, viewer := range room.GetViewers() {
+		viewer.Close(cause)
+	}
+}
+
+func GetWhepViewer(id string) *WhepViewer {
+	for _, room := range GetRooms() {
+		room.viewersMutex.Lock()
+		viewer, ok := room.viewers[id]
+		room.viewersMutex.Unlock()
+		if ok {
+			return viewer
+		}
+	}
+	return nil
+}
+
+func httpHandleWhepPlay(w http.ResponseWriter, r *http.Request) {
+	room := GetRoom(r.PathValue("id"))
+	if room == nil {
+		writeJsonError(w, http.StatusNotFound, "whep_failure", "the room does not exist")
+		return
+	}
+
+	// Open rooms can be watched without token, like they can be joined.
+	token, _ := bearerToken(r)
+	if room.RequiresToken() {
+		if err := room.CheckToken(token); err != nil {
+			writeUnauthorized(w, "whep_failure", err.Error())
+			return
+		}
+	}
+
+	offer, ok := readSdp(w, r, sdpContentType)
+	if !ok {
+		return
+	}
+
+	viewer, answer, err := StartWhepViewer(room, r.PathValue("stream"), token, offer)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrStreamNotInRoom) {
+			status = http.StatusNotFound
+		}
+		writeJsonError(w, status, "whep_failure", err.Error())
+		return
+	}
+
+	writeIceServerLinks(w, viewer.Id)
+	w.Header().Set("Location", "/whep/sessions/"+viewer.Id)
+	w.Header().Set("ETag", viewer.ETag())
+	w.Header().Set("Content-Type", sdpContentType)
+	w.WriteHeader(http.StatusCreated)
+	if _, err := io.WriteString(w, answer.SDP); err != nil {
+		logger.Debug(fmt.Sprintf("failed writing whep answer, %s", err.Error()))
+	}
+}
+
+func httpHandleWhepPatch(w http.ResponseWriter, r *http.Request) {
+	viewer := GetWhepViewer(r.PathValue("id"))
+	if viewer == nil {
+		writeJsonError(w, http.StatusNotFound, "whep_failure", ErrWhepViewerNotFound.Error())
+		return
+	}
+
+	token, _ := bearerToken(r)
+	if !viewer.checkToken(token) {
+		writeUnauthorized(w, "whep_failure", "the token doesn't match the session")
+		return
+	}
+
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != viewer.ETag() {
+		writeJsonError(w, http.StatusPreconditionFailed, "whep_failure", "the session has been restarted")
+		return
+	}
+
+	fragment, ok := readSdp(w, r, sdpFragmentContentType)
+	if !ok {
+		return
+	}
+
+	answer, err := viewer.Patch(fragment)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "whep_failure", err.Error())
+		return
+	}
+
+	if answer == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("ETag", viewer.ETag())
+	w.Header().Set("Content-Type", sdpFragmentContentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(w, answer); err != nil {
+		logger.Debug(fmt.Sprintf("failed writing whep ice restart, %s", err.Error()))
+	}
+}
+
+func httpHandleWhepDelete(w http.ResponseWriter, r *http.Request) {
+	viewer := GetWhepViewer(r.PathValue("id"))
+	if viewer == nil {
+		writeJsonError(w, http.StatusNotFound, "whep_failure", ErrWhepViewerNotFound.Error())
+		return
+	}
+
+	token, _ := bearerToken(r)
+	if !viewer.checkToken(token) {
+		writeUnauthorized(w, "whep_failure", "the token doesn't match the session")
+		return
+	}
+
+	viewer.Close("the whep session has been deleted")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	sdpContentType         = "application/sdp"
+	sdpFragmentContentType = "application/trickle-ice-sdpfrag"
+	maxSdpSize             = 64 << 10
+)
+
+// WhipSession is a stream published over WHIP (RFC 9725) by a synthetic user,
+// the session ends with the stream.
+type WhipSession struct {
+	Id       string    `json:"id"`
+	RoomId   string    `json:"room_id"`
+	UserId   string    `json:"user_id"`
+	StreamId string    `json:"stream_id"`
+	Started  time.Time `json:"started_at"`
+
+	room   *Room
+	user   *User
+	stream *IncomingStream
+	token  string
+	mutex  *sync.Mutex
+	once   *sync.Once
+}
+
+var (
+	whipSessions      map[string]*WhipSession = make(map[string]*WhipSession)
+	whipSessionsMutex *sync.Mutex             = new(sync.Mutex)
+
+	ErrWhipSessionNotFound = errors.New("the whip session does not exist")
+)
+
+func RegisterWhipHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("POST /whip/rooms/{id}", httpHandleWhipPublish)
+	mux.HandleFunc("PATCH /whip/sessions/{id}", httpHandleWhipPatch)
+	mux.HandleFunc("DELETE /whip/sessions/{id}", httpHandleWhipDelete)
+}
+
+func StartWhipSession(room *Room, token string, offer string) (*WhipSession, *webrtc.SessionDescription, error) {
+	user, err := JoinSyntheticUser(room, RoleParticipant)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session := &WhipSession{
+		Id:      uuid.NewString(),
+		RoomId:  room.Id,
+		UserId:  user.Id,
+		Started: time.Now(),
+
+		room:  room,
+		user:  user,
+		token: token,
+		mutex: new(sync.Mutex),
+		once:  new(sync.Once),
+	}
+
+	stream, err := NewIncomingStream(user)
+	if err != nil {
+		LeaveSyntheticUser(room, user, "whip session failed starting")
+		return nil, nil, err
+	}
+	session.stream = stream
+	session.StreamId = stream.Id
+
+	stream.PeerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		logger.Debug(fmt.Sprintf("peer state of whip session %s changed to %s", session.Id, state.String()))
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			go session.Close(fmt.Sprintf("the peer connection is %s", state.String()))
+		}
+	})
+
+	answer, err := negotiateAnswer(stream.PeerConnection, webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		session.Close("whip session failed starting")
+		return nil, nil, err
+	}
+
+	whipSessionsMutex.Lock()
+	whipSessions[session.Id] = session
+	whipSessionsMutex.Unlock()
+
+	go func() {
+		<-stream.Done()
+		session.Close("the stream has been unpublished")
+	}()
+
+	logger.Info(fmt.Sprintf("whip session %s started in room %s", session.Id, room.Id))
+
+	return session, answer, nil
+}
+
+func GetWhipSession(id string) *WhipSession {
+	whipSessionsMutex.Lock()
+	defer whipSessionsMutex.Unlock()
+
+	return whipSessions[id]
+}
+
+func GetWhipSessions() []*WhipSession {
+	whipSessionsMutex.Lock()
+	defer whipSessionsMutex.Unlock()
+
+	return slices.Collect(maps.Values(whipSessions))
+}
+
+func (s *WhipSession) Close(cause string) {
+	s.once.Do(func() {
+		whipSessionsMutex.Lock()
+		delete(whipSessions, s.Id)
+		whipSessionsMutex.Unlock()
+
+		LeaveSyntheticUser(s.room, s.user, cause)
+		logger.Info(fmt.Sprintf("whip session %s ended, %s", s.Id, cause))
+	})
+}
+
+// ETag changes with the ice credentials, so with every ice restart.
+func (s *WhipSession) ETag() string {
+	return sessionETag(s.stream.PeerConnection)
+}
+
+// Patch adds the trickled candidates of the fragment, or restarts ice when it
+// carries new credentials, the returned fragment is empty without restart.
+func (s *WhipSession) Patch(fragment string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return patchPeerConnection(s.stream.PeerConnection, fragment)
+}
+
+func (s *WhipSession) checkToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func negotiateAnswer(pc *webrtc.PeerConnection, offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return nil, err
+	}
+	return createAnswer(pc)
+}
+
+// createAnswer answers the remote offer once every local candidate is
+// gathered, the http apis don't trickle candidates to the client.
+func createAnswer(pc *webrtc.PeerConnection) (*webrtc.SessionDescription, error) {
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return nil, err
+	}
+	<-gathered
+
+	return pc.LocalDescription(), nil
+}
+
+func patchPeerConnection(pc *webrtc.PeerConnection, fragment string) (string, error) {
+	ufrag, pwd, candidates := parseSdpFragment(fragment)
+
+	remote := pc.RemoteDescription()
+	if remote == nil {
+		return "", errors.New("the session has no remote description")
+	}
+
+	restart := ufrag != "" && pwd != "" && ufrag != sdpAttribute(remote.SDP, "ice-ufrag")
+	if restart {
+		offer := webrtc.SessionDescription{
+			Type: webrtc.SDPTypeOffer,
+			SDP:  replaceIceCredentials(remote.SDP, ufrag, pwd),
+		}
+		if _, err := negotiateAnswer(pc, offer); err != nil {
+			return "", err
+		}
+	}
+
+	for _, candidate := range candidates {
+		if err := pc.AddICECandidate(candidate); err != nil {
+			return "", err
+		}
+	}
+
+	if !restart {
+		return "", nil
+	}
+	return localSdpFragment(pc.LocalDescription().SDP), nil
+}
+
+func sessionETag(pc *webrtc.PeerConnection) string {
+	local := pc.LocalDescription()
+	if local == nil {
+		return ""
+	}
+	return fmt.Sprintf("%q", sdpAttribute(local.SDP, "ice-ufrag"))
+}
+
+func sdpLines(sdp string) []string {
+	return strings.Split(strings.ReplaceAll(sdp, "\r\n", "\n"), "\n")
+}
+
+func sdpAttribute(sdp string, name string) string {
+	for _, line := range sdpLines(sdp) {
+		if value, ok := strings.CutPrefix(line, "a="+name+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// parseSdpFragment reads a trickle ice fragment, see RFC 8840.
+func parseSdpFragment(fragment string) (string, string, []webrtc.ICECandidateInit) {
+	var ufrag, pwd string
+	var mid *string
+	candidates := make([]webrtc.ICECandidateInit, 0)
+
+	for _, line := range sdpLines(fragment) {
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    mid,
+			})
+		}
+	}
+
+	return ufrag, pwd, candidates
+}
+
+// replaceIceCredentials turns the previous offer into an ice restart offer,
+// its candidates are dropped as they belong to the previous credentials.
+func replaceIceCredentials(sdp string, ufrag string, pwd string) string {
+	lines := make([]string, 0)
+	for _, line := range sdpLines(sdp) {
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			line = "a=ice-ufrag:" + ufrag
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			line = "a=ice-pwd:" + pwd
+		case strings.HasPrefix(line, "a=candidate:"), line == "a=end-of-candidates":
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// localSdpFragment returns the credentials and candidates of the local
+// description, all media are bundled on the first one.
+func localSdpFragment(sdp string) string {
+	lines := []string{
+		"a=ice-ufrag:" + sdpAttribute(sdp, "ice-ufrag"),
+		"a=ice-pwd:" + sdpAttribute(sdp, "ice-pwd"),
+	}
+
+	media := 0
+	seen := make(map[string]bool)
+	for _, line := range sdpLines(sdp) {
+		switch {
+		case strings.HasPrefix(line, "m="):
+			media++
+			if media == 1 {
+				lines = append(lines, line)
+			}
+		case strings.HasPrefix(line, "a=mid:") && media == 1:
+			lines = append(lines, line)
+		case strings.HasPrefix(line, "a=candidate:") && !seen[line]:
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, "a=end-of-candidates")
+
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// writeIceServerLinks advertises the ice servers as link headers, see RFC 9725
+// section 4.6.
+func writeIceServerLinks(w http.ResponseWriter, userId string) {
+	if GetConfig().ICE.Lite {
+		return
+	}
+
+	for _, server := range ICEServersFor(userId) {
+		for _, url := range server.URLs {
+			link := fmt.Sprintf("<%s>; rel=\"ice-server\"", url)
+			if credential, ok := server.Credential.(string); ok && server.Username != "" {
+				link += fmt.Sprintf("; username=%q; credential=%q; credential-type=\"password\"", server.Username, credential)
+			}
+			w.Header().Add("Link", link)
+		}
+	}
+}
+
+func contentType(r *http.Request) string {
+	mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+func readSdp(w http.ResponseWriter, r *http.Request, expected string) (string, bool) {
+	if contentType(r) != expected {
+		writeJsonError(w, http.StatusUnsupportedMediaType, "sdp_failure", fmt.Sprintf("the content type must be %s", expected))
+		return "", false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSdpSize))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "sdp_failure", err.Error())
+		return "", false
+	}
+
+	return string(body), true
+}
+
+func httpHandleWhipSessionsList(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, GetWhipSessions())
+}
+
+func httpHandleWhipPublish(w http.ResponseWriter, r *http.Request) {
+	room := GetRoom(r.PathValue("id"))
+	if room == nil {
+		writeJsonError(w, http.StatusNotFound, "whip_failure", "the room does not exist")
+		return
+	}
+
+	token, _ := bearerToken(r)
+	if err := room.CheckToken(token); err != nil {
+		writeUnauthorized(w, "whip_failure", err.Error())
+		return
+	}
+
+	offer, ok := readSdp(w, r, sdpContentType)
+	if !ok {
+		return
+	}
+
+	session, answer, err := StartWhipSession(room, token, offer)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrPublishLimitReached) || errors.Is(err, ErrRoomFull) {
+			status = http.StatusServiceUnavailable
+		}
+		writeJsonError(w, status, "whip_failure", err.Error())
+		return
+	}
+
+	writeIceServerLinks(w, session.UserId)
+	w.Header().Set("Location", "/whip/sessions/"+session.Id)
+	w.Header().Set("ETag", session.ETag())
+	w.Header().Set("Content-Type", sdpContentType)
+	w.WriteHeader(http.StatusCreated)
+	if _, err := io.WriteString(w, answer.SDP); err != nil {
+		logger.Debug(fmt.Sprintf("failed writing whip answer, %s", err.Error()))
+	}
+}
+
+func httpHandleWhipPatch(w http.ResponseWriter, r *http.Request) {
+	session := GetWhipSession(r.PathValue("id"))
+	if session == nil {
+		writeJsonError(w, http.StatusNotFound, "whip_failure", ErrWhipSessionNotFound.Error())
+		return
+	}
+
+	token, _ := bearerToken(r)
+	if !session.checkToken(token) {
+		writeUnauthorized(w, "whip_failure", "the token doesn't match the session")
+		return
+	}
+
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != session.ETag() {
+		writeJsonError(w, http.StatusPreconditionFailed, "whip_failure", "the session has been restarted")
+		return
+	}
+
+	fragment, ok := readSdp(w, r, sdpFragmentContentType)
+	if !ok {
+		return
+	}
+
+	answer, err := session.Patch(fragment)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "whip_failure", err.Error())
+		return
+	}
+
+	if answer == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("ETag", session.ETag())
+	w.Header().Set("Content-Type", sdpFragmentContentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(w, answer); err != nil {
+		logger.Debug(fmt.Sprintf("failed writing whip ice restart, %s", err.Error()))
+	}
+}
+
+func httpHandleWhipDelete(w http.ResponseWriter, r *http.Request) {
+	session := GetWhipSession(r.PathValue("id"))
+	if session == nil {
+		writeJsonError(w, http.StatusNotFound, "whip_failure", ErrWhipSessionNotFound.Error())
+		return
+	}
+
+	token, _ := bearerToken(r)
+	if !session.checkToken(token) {
+		writeUnauthorized(w, "whip_failure", "the token doesn't match the session")
+		return
+	}
+
+	session.Close("the whip session has been deleted")
+	w.WriteHeader(http.StatusOK)
+}
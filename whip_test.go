@@ -0,0 +1,151 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const whipTestCandidate = "candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host"
+
+func TestParseSdpFragment(t *testing.T) {
+	mid0, mid1 := "0", "1"
+
+	tests := []struct {
+		name       string
+		fragment   string
+		ufrag      string
+		pwd        string
+		candidates []webrtc.ICECandidateInit
+	}{
+		{
+			name:       "rfc 8840 fragment",
+			fragment:   "a=ice-ufrag:EsAw\r\na=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\nm=audio 9 RTP/AVP 0\r\na=mid:0\r\na=" + whipTestCandidate + "\r\na=end-of-candidates\r\n",
+			ufrag:      "EsAw",
+			pwd:        "P2uYro0UCOQ4zxjKXaWCBui1",
+			candidates: []webrtc.ICECandidateInit{{Candidate: whipTestCandidate, SDPMid: &mid0}},
+		},
+		{
+			name:       "candidates of several media",
+			fragment:   "a=mid:0\na=" + whipTestCandidate + "\na=mid:1\na=" + whipTestCandidate + "\n",
+			candidates: []webrtc.ICECandidateInit{{Candidate: whipTestCandidate, SDPMid: &mid0}, {Candidate: whipTestCandidate, SDPMid: &mid1}},
+		},
+		{
+			name:       "candidate without mid",
+			fragment:   "a=" + whipTestCandidate,
+			candidates: []webrtc.ICECandidateInit{{Candidate: whipTestCandidate}},
+		},
+		{
+			name:       "credentials only",
+			fragment:   "a=ice-ufrag:abcd\r\na=ice-pwd:efgh",
+			ufrag:      "abcd",
+			pwd:        "efgh",
+			candidates: []webrtc.ICECandidateInit{},
+		},
+		{
+			name:       "unrelated and malformed lines",
+			fragment:   "v=0\r\na=ice-ufrag\r\na=candidate\r\nice-pwd:efgh\r\n\r\n",
+			candidates: []webrtc.ICECandidateInit{},
+		},
+		{name: "empty", fragment: "", candidates: []webrtc.ICECandidateInit{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ufrag, pwd, candidates := parseSdpFragment(test.fragment)
+			if ufrag != test.ufrag || pwd != test.pwd {
+				t.Errorf("credentials %q %q, want %q %q", ufrag, pwd, test.ufrag, test.pwd)
+			}
+			if !reflect.DeepEqual(candidates, test.candidates) {
+				t.Errorf("candidates %+v, want %+v", candidates, test.candidates)
+			}
+		})
+	}
+}
+
+func TestReplaceIceCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		sdp      string
+		replaced string
+	}{
+		{
+			name:     "credentials replaced and candidates dropped",
+			sdp:      "v=0\r\na=ice-ufrag:old\r\na=ice-pwd:oldpwd\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=" + whipTestCandidate + "\r\na=end-of-candidates\r\n",
+			replaced: "v=0\r\na=ice-ufrag:new\r\na=ice-pwd:newpwd\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\n",
+		},
+		{
+			name:     "credentials of every media",
+			sdp:      "m=audio 9 RTP/AVP 0\na=ice-ufrag:old\na=ice-pwd:oldpwd\nm=video 9 RTP/AVP 96\na=ice-ufrag:old\na=ice-pwd:oldpwd",
+			replaced: "m=audio 9 RTP/AVP 0\r\na=ice-ufrag:new\r\na=ice-pwd:newpwd\r\nm=video 9 RTP/AVP 96\r\na=ice-ufrag:new\r\na=ice-pwd:newpwd",
+		},
+		{
+			name:     "without credentials",
+			sdp:      "v=0\r\nm=audio 9 RTP/AVP 0",
+			replaced: "v=0\r\nm=audio 9 RTP/AVP 0",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if replaced := replaceIceCredentials(test.sdp, "new", "newpwd"); replaced != test.replaced {
+				t.Errorf("replaced %q, want %q", replaced, test.replaced)
+			}
+		})
+	}
+}
+
+func TestLocalSdpFragment(t *testing.T) {
+	other := "candidate:2 1 udp 1694498815 198.51.100.7 6000 typ srflx raddr 0.0.0.0 rport 0"
+
+	tests := []struct {
+		name     string
+		sdp      string
+		fragment string
+	}{
+		{
+			name: "bundled media",
+			sdp: "v=0\r\na=group:BUNDLE 0 1\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=ice-ufrag:abcd\r\na=ice-pwd:efgh\r\na=mid:0\r\na=" + whipTestCandidate +
+				"\r\na=" + other + "\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\na=" + whipTestCandidate + "\r\n",
+			fragment: "a=ice-ufrag:abcd\r\na=ice-pwd:efgh\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=" + whipTestCandidate + "\r\na=" + other + "\r\na=end-of-candidates\r\n",
+		},
+		{
+			name:     "no candidates",
+			sdp:      "m=audio 9 UDP/TLS/RTP/SAVPF 111\na=mid:0\na=ice-ufrag:abcd\na=ice-pwd:efgh\n",
+			fragment: "a=ice-ufrag:abcd\r\na=ice-pwd:efgh\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=end-of-candidates\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fragment := localSdpFragment(test.sdp)
+			if fragment != test.fragment {
+				t.Errorf("fragment %q, want %q", fragment, test.fragment)
+			}
+
+			// The fragment reads back into the same credentials and candidates.
+			ufrag, pwd, candidates := parseSdpFragment(fragment)
+			if ufrag != "abcd" || pwd != "efgh" {
+				t.Errorf("credentials %q %q", ufrag, pwd)
+			}
+			for _, candidate := range candidates {
+				if candidate.SDPMid == nil || *candidate.SDPMid != "0" {
+					t.Errorf("candidate %s isn't on the first media", candidate.Candidate)
+				}
+			}
+		})
+	}
+}
+
+func TestPatchPeerConnectionWithoutRemoteDescription(t *testing.T) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	if _, err := patchPeerConnection(pc, "a=ice-ufrag:abcd\r\na=ice-pwd:efgh\r\n"); err == nil {
+		t.Error("patched the session, want an error")
+	}
+}